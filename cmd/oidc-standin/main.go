@@ -0,0 +1,269 @@
+// oidc-standin is a minimal OpenID Connect provider for trying the single sign-on of the server
+// locally. It accepts any username without a password, so never expose it.
+//
+//	go run ./cmd/oidc-standin -addr 127.0.0.1:9999
+//	OIDC_CLIENT_SECRET=secret go run ./src -oidc-issuer http://127.0.0.1:9999 -oidc-client-id r2wars
+//
+// It implements discovery, the authorization code flow with PKCE and signs the id tokens with a
+// fresh RSA key on every start.
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// grant is an issued authorization code waiting to be redeemed
+type grant struct {
+	clientID    string
+	redirectURI string
+	nonce       string
+	challenge   string
+	username    string
+	email       string
+	issued      time.Time
+}
+
+var (
+	issuer       string
+	clientID     string
+	clientSecret string
+
+	key   *rsa.PrivateKey
+	keyID string
+
+	grantsMu sync.Mutex
+	grants   = map[string]grant{}
+)
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<title>oidc-standin</title>
+<h1>oidc-standin</h1>
+<p>Sign in to {{ .client_id }} as anyone:</p>
+<form method="POST">
+  {{ range $k, $v := . }}<input type="hidden" name="{{ $k }}" value="{{ $v }}">
+  {{ end }}
+  <label>Username <input name="username" autofocus></label>
+  <label>Email <input name="email"></label>
+  <input type="submit" value="Sign in">
+</form>
+`))
+
+func main() {
+	var addr string
+	flag.StringVar(&addr, "addr", "127.0.0.1:9999", "The address to listen on")
+	flag.StringVar(&issuer, "issuer", "", "The issuer url (default http://<addr>)")
+	flag.StringVar(&clientID, "client-id", "r2wars", "The client id accepted")
+	flag.StringVar(&clientSecret, "client-secret", "secret", "The client secret accepted")
+	flag.Parse()
+	if issuer == "" {
+		issuer = "http://" + addr
+	}
+
+	var err error
+	key, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyID = random()[:8]
+
+	http.HandleFunc("/.well-known/openid-configuration", discoveryHandler)
+	http.HandleFunc("/jwks", jwksHandler)
+	http.HandleFunc("/authorize", authorizeHandler)
+	http.HandleFunc("/token", tokenHandler)
+
+	log.Printf("oidc-standin for client %q running on %s", clientID, issuer)
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
+
+func random() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func tokenError(w http.ResponseWriter, status int, code string, description string) {
+	writeJSON(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+func discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"jwks_uri":                              issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": keyID,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+}
+
+// authorizeHandler shows a form asking for a username and issues a code for it
+func authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if r.Form.Get("client_id") != clientID || r.Form.Get("response_type") != "code" {
+		http.Error(w, "unknown client or unsupported response type", http.StatusBadRequest)
+		return
+	}
+	if r.Form.Get("code_challenge_method") != "S256" || r.Form.Get("redirect_uri") == "" {
+		http.Error(w, "S256 code challenge and redirect uri required", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method != "POST" || r.Form.Get("username") == "" {
+		params := map[string]string{}
+		for _, k := range []string{"client_id", "response_type", "redirect_uri", "scope", "state", "nonce", "code_challenge", "code_challenge_method"} {
+			params[k] = r.Form.Get(k)
+		}
+		loginPage.Execute(w, params)
+		return
+	}
+
+	code := random()
+	grantsMu.Lock()
+	grants[code] = grant{
+		clientID:    r.Form.Get("client_id"),
+		redirectURI: r.Form.Get("redirect_uri"),
+		nonce:       r.Form.Get("nonce"),
+		challenge:   r.Form.Get("code_challenge"),
+		username:    r.Form.Get("username"),
+		email:       r.Form.Get("email"),
+		issued:      time.Now(),
+	}
+	grantsMu.Unlock()
+
+	target, err := url.Parse(r.Form.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect uri", http.StatusBadRequest)
+		return
+	}
+	query := target.Query()
+	query.Set("code", code)
+	query.Set("state", r.Form.Get("state"))
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.String(), http.StatusSeeOther)
+}
+
+// tokenHandler redeems a code for a signed id token
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		tokenError(w, http.StatusMethodNotAllowed, "invalid_request", "POST only")
+		return
+	}
+	r.ParseForm()
+
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if id != clientID || secret != clientSecret {
+		tokenError(w, http.StatusUnauthorized, "invalid_client", "wrong client id or secret")
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	grantsMu.Lock()
+	g, ok := grants[code]
+	delete(grants, code)
+	grantsMu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case r.PostForm.Get("grant_type") != "authorization_code":
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type", "authorization_code only")
+		return
+	case !ok || time.Since(g.issued) > time.Minute || g.clientID != id:
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "unknown or expired code")
+		return
+	case g.redirectURI != r.PostForm.Get("redirect_uri"):
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "redirect uri mismatch")
+		return
+	case base64.RawURLEncoding.EncodeToString(challenge[:]) != g.challenge:
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "code verifier mismatch")
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":                issuer,
+		"sub":                "standin-" + g.username,
+		"aud":                clientID,
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              g.nonce,
+		"preferred_username": g.username,
+	}
+	if g.email != "" {
+		claims["email"] = g.email
+	}
+
+	idToken, err := sign(claims)
+	if err != nil {
+		tokenError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": random(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+// sign returns the claims as a RS256 signed JWT
+func sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s.%s", signed, base64.RawURLEncoding.EncodeToString(signature)), nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The types below mirror the ones returned by the json api of the server, only the fields used by
+// the cli are included.
+
+type apiErrorBody struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type User struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Bots []Bot  `json:"bots,omitempty"`
+}
+
+type Bot struct {
+	ID     int    `json:"id,omitempty"`
+	Name   string `json:"name"`
+	Source string `json:"source,omitempty"`
+	Arch   string `json:"arch,omitempty"`
+	Bits   string `json:"bits,omitempty"`
+	Owners []User `json:"owners,omitempty"`
+}
+
+type Battle struct {
+	ID         int      `json:"id"`
+	Name       string   `json:"name"`
+	Visibility string   `json:"visibility"`
+	Archs      []string `json:"archs,omitempty"`
+	Bits       []string `json:"bits,omitempty"`
+	ArenaSize  int      `json:"arena_size,omitempty"`
+	MaxRounds  int      `json:"max_rounds,omitempty"`
+	MaxBotSize int      `json:"max_bot_size"`
+	MixedArch  bool     `json:"mixed_arch"`
+	Owners     []User   `json:"owners,omitempty"`
+	Bots       []Bot    `json:"bots,omitempty"`
+}
+
+type RunResult struct {
+	Winner *Bot `json:"winner"`
+	Rounds int  `json:"rounds"`
+}
+
+type Run struct {
+	ID        int       `json:"id"`
+	BattleID  int       `json:"battle_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Status    string    `json:"status"`
+	Fights    int       `json:"fights"`
+	Seed      int64     `json:"seed"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type SeriesStat struct {
+	BotID   int     `json:"bot_id"`
+	BotName string  `json:"bot_name"`
+	Fights  int     `json:"fights"`
+	Wins    int     `json:"wins"`
+	Draws   int     `json:"draws"`
+	WinRate float64 `json:"win_rate"`
+	Low     float64 `json:"ci_low"`
+	High    float64 `json:"ci_high"`
+}
+
+type RunStats struct {
+	Run  Run          `json:"run"`
+	Bots []SeriesStat `json:"bots"`
+}
+
+// Client talks to the json api of an r2wars server using an api token
+type Client struct {
+	Server string // e.g. https://r2wa.rs
+	Token  string
+	HTTP   *http.Client
+}
+
+func NewClient(server, token string) *Client {
+	return &Client{
+		Server: strings.TrimSuffix(server, "/"),
+		Token:  token,
+		HTTP:   &http.Client{Timeout: 5 * time.Minute}, // running a battle waits for the fight
+	}
+}
+
+// Do sends the request body (if not nil) as json to the api path given and decodes the response
+// into res (if not nil). Errors returned by the api are turned into go errors.
+func (c *Client) Do(method, path string, body interface{}, res interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, c.Server+"/api/v1"+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var apierr apiError
+		if err := json.NewDecoder(resp.Body).Decode(&apierr); err != nil || apierr.Error.Message == "" {
+			return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return fmt.Errorf("%s %s: %d - %s", method, path, apierr.Error.Status, apierr.Error.Message)
+	}
+
+	if res == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return fmt.Errorf("%s %s: invalid response: %s", method, path, err)
+	}
+	return nil
+}
+
+func (c *Client) Me() (User, error) {
+	var user User
+	err := c.Do("GET", "/me", nil, &user)
+	return user, err
+}
+
+func (c *Client) Bot(id int) (Bot, error) {
+	var bot Bot
+	err := c.Do("GET", fmt.Sprintf("/bots/%d", id), nil, &bot)
+	return bot, err
+}
+
+func (c *Client) CreateBot(bot Bot) (Bot, error) {
+	var res Bot
+	err := c.Do("POST", "/bots", bot, &res)
+	return res, err
+}
+
+func (c *Client) UpdateBot(id int, bot Bot) (Bot, error) {
+	var res Bot
+	err := c.Do("PUT", fmt.Sprintf("/bots/%d", id), bot, &res)
+	return res, err
+}
+
+func (c *Client) Battles() ([]Battle, error) {
+	var battles []Battle
+	err := c.Do("GET", "/battles", nil, &battles)
+	return battles, err
+}
+
+func (c *Client) Battle(id int) (Battle, error) {
+	var battle Battle
+	err := c.Do("GET", fmt.Sprintf("/battles/%d", id), nil, &battle)
+	return battle, err
+}
+
+func (c *Client) Submit(battleid int, botids []int) (Battle, error) {
+	var battle Battle
+	err := c.Do("POST", fmt.Sprintf("/battles/%d/bots", battleid), map[string][]int{"bots": botids}, &battle)
+	return battle, err
+}
+
+func (c *Client) RunOnce(battleid int) (RunResult, error) {
+	var res RunResult
+	err := c.Do("POST", fmt.Sprintf("/battles/%d/run", battleid), nil, &res)
+	return res, err
+}
+
+// RunSeries enqueues a series, the server picks a random seed if seed is nil
+func (c *Client) RunSeries(battleid int, fights int, seed *int64) (Run, error) {
+	var run Run
+	body := map[string]interface{}{"fights": fights}
+	if seed != nil {
+		body["seed"] = *seed
+	}
+	err := c.Do("POST", fmt.Sprintf("/battles/%d/series", battleid), body, &run)
+	return run, err
+}
+
+func (c *Client) Run(runid int) (RunStats, error) {
+	var stats RunStats
+	err := c.Do("GET", fmt.Sprintf("/runs/%d", runid), nil, &stats)
+	return stats, err
+}
+
+func (c *Client) Output(battleid int) (string, error) {
+	var res struct {
+		Output string `json:"output"`
+	}
+	err := c.Do("GET", fmt.Sprintf("/battles/%d/output", battleid), nil, &res)
+	return res.Output, err
+}
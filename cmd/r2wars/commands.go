@@ -0,0 +1,442 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// parseFlags parses the flags of a subcommand, flags and positional arguments may be mixed
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func loginCmd(args []string) error {
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("login", flag.ContinueOnError)
+	fs.StringVar(&config.Server, "server", config.Server, "The url of the r2wars server")
+	fs.StringVar(&config.Token, "token", "", "The api token, read from stdin if not given")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if config.Server == "" {
+		if config.Server, err = readLine("Server: "); err != nil {
+			return err
+		}
+	}
+	if config.Token == "" {
+		if config.Token, err = readLine("Token: "); err != nil {
+			return err
+		}
+	}
+
+	// make sure the token works before storing it
+	user, err := NewClient(config.Server, config.Token).Me()
+	if err != nil {
+		return err
+	}
+
+	path, err := saveConfig(config)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Logged in as %s, the token is stored in %s\n", user.Name, path)
+	return nil
+}
+
+func whoamiCmd(args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	user, err := c.Me()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s (id %d) on %s\n", user.Name, user.ID, c.Server)
+	return nil
+}
+
+func botsCmd(args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	user, err := c.Me()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tARCH\tBITS")
+	for _, bot := range user.Bots {
+		bot, err := c.Bot(bot.ID)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", bot.ID, bot.Name, bot.Arch, bot.Bits)
+	}
+	return w.Flush()
+}
+
+// botFromFilename splits a filename such as "warrior.x86-32.asm" into the name, the arch and the
+// bits of the bot. The arch and bits are empty if the filename doesn't contain them.
+func botFromFilename(path string) (string, string, string) {
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	name, rest, found := strings.Cut(base, ".")
+	if !found {
+		return base, "", ""
+	}
+
+	i := strings.LastIndex(rest, "-")
+	if i < 0 {
+		return base, "", ""
+	}
+	if _, err := strconv.Atoi(rest[i+1:]); err != nil {
+		return base, "", ""
+	}
+	return name, rest[:i], rest[i+1:]
+}
+
+// pushCmd creates the bot, or updates it if the user already has a bot with the same name
+func pushCmd(args []string) error {
+	var name, arch, bits string
+	fs := flag.NewFlagSet("push", flag.ContinueOnError)
+	fs.StringVar(&name, "name", "", "The name of the bot (default: taken from the filename)")
+	fs.StringVar(&arch, "arch", "", "The arch of the bot (default: taken from the filename)")
+	fs.StringVar(&bits, "bits", "", "The bits of the bot (default: taken from the filename)")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("expected exactly one .asm file")
+	}
+	path := positional[0]
+
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	fileName, fileArch, fileBits := botFromFilename(path)
+	if name == "" {
+		name = fileName
+	}
+	if arch == "" {
+		arch = fileArch
+	}
+	if bits == "" {
+		bits = fileBits
+	}
+	if arch == "" || bits == "" {
+		return fmt.Errorf("can't tell the arch and bits of %s, name it like %s.x86-32.asm or use -arch and -bits", path, fileName)
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	user, err := c.Me()
+	if err != nil {
+		return err
+	}
+
+	bot := Bot{Name: name, Source: string(source), Arch: arch, Bits: bits}
+	for _, existing := range user.Bots {
+		if existing.Name == name {
+			updated, err := c.UpdateBot(existing.ID, bot)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Updated bot %d (%s, %s %s bits)\n", updated.ID, updated.Name, updated.Arch, updated.Bits)
+			return nil
+		}
+	}
+
+	created, err := c.CreateBot(bot)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created bot %d (%s, %s %s bits)\n", created.ID, created.Name, created.Arch, created.Bits)
+	return nil
+}
+
+func battlesCmd(args []string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	battles, err := c.Battles()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tARCHS\tBITS\tBOTS")
+	for _, battle := range battles {
+		battle, err := c.Battle(battle.ID)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\n", battle.ID, battle.Name,
+			strings.Join(battle.Archs, ","), strings.Join(battle.Bits, ","), len(battle.Bots))
+	}
+	return w.Flush()
+}
+
+// findBattle returns the id of the battle given by id or by name
+func findBattle(c *Client, arg string) (int, error) {
+	if id, err := strconv.Atoi(arg); err == nil {
+		return id, nil
+	}
+	battles, err := c.Battles()
+	if err != nil {
+		return 0, err
+	}
+	for _, battle := range battles {
+		if battle.Name == arg {
+			return battle.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("no battle named %q", arg)
+}
+
+// findBot returns the id of the bot given by id or by the name of one of the users bots
+func findBot(user User, arg string) (int, error) {
+	if id, err := strconv.Atoi(arg); err == nil {
+		return id, nil
+	}
+	for _, bot := range user.Bots {
+		if bot.Name == arg {
+			return bot.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("you have no bot named %q", arg)
+}
+
+func printBattle(battle Battle) {
+	fmt.Printf("Battle %d: %s\n", battle.ID, battle.Name)
+	fmt.Printf("  visibility: %s\n", battle.Visibility)
+	fmt.Printf("  archs:      %s\n", strings.Join(battle.Archs, ", "))
+	fmt.Printf("  bits:       %s\n", strings.Join(battle.Bits, ", "))
+	fmt.Printf("  arena size: %d\n", battle.ArenaSize)
+	fmt.Printf("  max rounds: %d\n", battle.MaxRounds)
+	if battle.MaxBotSize > 0 {
+		fmt.Printf("  max size:   %d\n", battle.MaxBotSize)
+	}
+	fmt.Printf("  bots:\n")
+	for _, bot := range battle.Bots {
+		fmt.Printf("    %d %s\n", bot.ID, bot.Name)
+	}
+}
+
+func battleCmd(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a battle")
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	id, err := findBattle(c, args[0])
+	if err != nil {
+		return err
+	}
+	battle, err := c.Battle(id)
+	if err != nil {
+		return err
+	}
+	printBattle(battle)
+	return nil
+}
+
+func submitCmd(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("expected a battle and at least one bot")
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	battleid, err := findBattle(c, args[0])
+	if err != nil {
+		return err
+	}
+	user, err := c.Me()
+	if err != nil {
+		return err
+	}
+
+	var botids []int
+	for _, arg := range args[1:] {
+		id, err := findBot(user, arg)
+		if err != nil {
+			return err
+		}
+		botids = append(botids, id)
+	}
+
+	battle, err := c.Submit(battleid, botids)
+	if err != nil {
+		return err
+	}
+	printBattle(battle)
+	return nil
+}
+
+func runCmd(args []string) error {
+	var series int
+	var seed int64
+	var follow bool
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.IntVar(&series, "series", 0, "Enqueue a series with this many fights per pairing instead of a single fight")
+	fs.Int64Var(&seed, "seed", 0, "The seed of the series (default: a random one)")
+	fs.BoolVar(&follow, "follow", false, "Wait for the series to finish")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("expected a battle")
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	battleid, err := findBattle(c, positional[0])
+	if err != nil {
+		return err
+	}
+
+	if series == 0 {
+		res, err := c.RunOnce(battleid)
+		if err != nil {
+			return err
+		}
+		if res.Winner == nil {
+			fmt.Printf("No winner after %d rounds\n", res.Rounds)
+		} else {
+			fmt.Printf("%s (%d) won after %d rounds\n", res.Winner.Name, res.Winner.ID, res.Rounds)
+		}
+		return nil
+	}
+
+	// only a seed given explicitly is sent, the server picks a random one otherwise
+	var seedp *int64
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "seed" {
+			seedp = &seed
+		}
+	})
+
+	run, err := c.RunSeries(battleid, series, seedp)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Enqueued run %d\n", run.ID)
+	if follow {
+		return tail(c, run.ID)
+	}
+	return nil
+}
+
+func tailCmd(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a run id")
+	}
+	runid, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid run id %q", args[0])
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	return tail(c, runid)
+}
+
+// tail polls the run, printing its status whenever it changes, until it is done
+func tail(c *Client, runid int) error {
+	status := ""
+	for {
+		stats, err := c.Run(runid)
+		if err != nil {
+			return err
+		}
+		if stats.Run.Status != status {
+			status = stats.Run.Status
+			fmt.Printf("%s run %d: %s\n", time.Now().Format("15:04:05"), runid, status)
+		}
+
+		switch status {
+		case "finished":
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "BOT\tFIGHTS\tWINS\tDRAWS\tWIN RATE\t95% CI")
+			for _, bot := range stats.Bots {
+				fmt.Fprintf(w, "%s (%d)\t%d\t%d\t%d\t%.1f%%\t%.1f%% - %.1f%%\n", bot.BotName, bot.BotID,
+					bot.Fights, bot.Wins, bot.Draws, bot.WinRate*100, bot.Low*100, bot.High*100)
+			}
+			return w.Flush()
+		case "failed":
+			return fmt.Errorf("run %d failed: %s", runid, stats.Run.Error)
+		}
+
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func outputCmd(args []string) error {
+	var out string
+	fs := flag.NewFlagSet("output", flag.ContinueOnError)
+	fs.StringVar(&out, "o", "", "Write the output to this file instead of stdout")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return fmt.Errorf("expected a battle")
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	battleid, err := findBattle(c, positional[0])
+	if err != nil {
+		return err
+	}
+	output, err := c.Output(battleid)
+	if err != nil {
+		return err
+	}
+
+	if out == "" {
+		fmt.Print(output)
+		return nil
+	}
+	return os.WriteFile(out, []byte(output), 0644)
+}
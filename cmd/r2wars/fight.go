@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"git.emile.space/r2wars-web/engine"
+)
+
+// fightCmd runs a fight locally using the same engine as the server, without any database or
+// server involved. The arch and bits of the bots are taken from their filenames.
+func fightCmd(args []string) error {
+	var arenaSize, maxRounds, maxSize int
+	var seed int64
+	var transcript, events string
+	var verbose bool
+	fs := flag.NewFlagSet("fight", flag.ContinueOnError)
+	fs.IntVar(&arenaSize, "arena", 1024, "The size of the arena in bytes")
+	fs.IntVar(&maxRounds, "rounds", 100, "The max amount of rounds")
+	fs.IntVar(&maxSize, "max-size", 0, "The max size of a single bot in bytes, 0 for no limit")
+	fs.Int64Var(&seed, "seed", 0, "The seed used to place the bots, 0 places them at fixed offsets")
+	fs.StringVar(&transcript, "transcript", "", "Write the transcript of the fight to this file")
+	fs.StringVar(&events, "json", "", "Write the result and the event log of the fight as json to this file")
+	fs.BoolVar(&verbose, "v", false, "Log every r2 command")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) < 2 {
+		return fmt.Errorf("expected at least two .asm files")
+	}
+
+	fight := engine.Fight{
+		ArenaSize:  arenaSize,
+		MaxRounds:  maxRounds,
+		MaxBotSize: maxSize,
+		Seed:       seed,
+	}
+	for _, path := range positional {
+		source, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name, arch, bits := botFromFilename(path)
+		if arch == "" || bits == "" {
+			return fmt.Errorf("can't tell the arch and bits of %s, name it like %s.x86-32.asm", path, name)
+		}
+		fight.Fighters = append(fight.Fighters, engine.Fighter{Name: name, Source: string(source), ArchName: arch, BitsName: bits})
+	}
+
+	if !verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	result, err := engine.FightRun(fight)
+	if err != nil {
+		return err
+	}
+
+	if transcript != "" {
+		if err := os.WriteFile(transcript, []byte(result.RawOutput), 0644); err != nil {
+			return err
+		}
+	}
+
+	if events != "" {
+		res := struct {
+			Bots      []string       `json:"bots"`
+			Winner    int            `json:"winner"`
+			Rounds    int            `json:"rounds"`
+			BaseAddrs []int          `json:"base_addrs"`
+			Events    []engine.Event `json:"events"`
+		}{nil, result.Winner, result.Rounds, result.BaseAddrs, result.Events}
+		for _, path := range positional {
+			res.Bots = append(res.Bots, path)
+		}
+
+		content, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(events, content, 0644); err != nil {
+			return err
+		}
+	}
+
+	for i, addr := range result.BaseAddrs {
+		fmt.Printf("bot %d %s placed at 0x%x\n", i, positional[i], addr)
+	}
+	if result.Winner < 0 {
+		fmt.Printf("Draw after %d rounds\n", result.Rounds)
+	} else {
+		fmt.Printf("%s wins after %d rounds\n", positional[result.Winner], result.Rounds)
+	}
+	return nil
+}
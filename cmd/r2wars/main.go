@@ -0,0 +1,160 @@
+// r2wars is the command line client for bot authors. It talks to the json api of an r2wars server
+// using a personal api token, which can be created on the profile page.
+//
+//	r2wars login -server https://r2wa.rs
+//	r2wars push bots/warrior.x86-32.asm
+//	r2wars battles
+//	r2wars submit 3 warrior
+//	r2wars run -series 10 -follow 3
+//	r2wars output 3
+//
+// Bots can also be tested offline, using the same engine as the server:
+//
+//	r2wars fight -arena 1024 -rounds 5000 -seed 42 a.x86-32.asm b.x86-32.asm
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Config is stored in the users config dir after logging in. R2WARS_SERVER and R2WARS_TOKEN
+// override the stored values.
+type Config struct {
+	Server string `json:"server"`
+	Token  string `json:"token"`
+}
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"login", "login [-server url] [-token token]     store the server and api token", loginCmd},
+		{"whoami", "whoami                                 show the user the token belongs to", whoamiCmd},
+		{"bots", "bots                                   list your bots", botsCmd},
+		{"push", "push [-name n] [-arch a] [-bits b] f   create or update a bot from an .asm file", pushCmd},
+		{"battles", "battles                                list the battles", battlesCmd},
+		{"battle", "battle <battle>                        show a battle", battleCmd},
+		{"submit", "submit <battle> <bot>...               set your bots registered in a battle", submitCmd},
+		{"run", "run [-series n] [-seed s] [-follow] b  run a battle once or enqueue a series", runCmd},
+		{"tail", "tail <run>                             follow a series until it is done", tailCmd},
+		{"output", "output [-o file] <battle>              print or save the output of the last fight", outputCmd},
+		{"fight", "fight [-arena n] [-rounds n] [-seed s] [-transcript f] [-json f] a.asm b.asm...\n" +
+			"                                         run a fight locally, without a server", fightCmd},
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: r2wars <command> [arguments]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s\n", cmd.usage)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Battles and bots can be given by id or by name.")
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "-h" || os.Args[1] == "--help" || os.Args[1] == "help" {
+		usage()
+		os.Exit(2)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "r2wars %s: %s\n", cmd.name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "r2wars: unknown command %q\n\n", os.Args[1])
+	usage()
+	os.Exit(2)
+}
+
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "r2wars", "config.json"), nil
+}
+
+func loadConfig() (Config, error) {
+	var config Config
+
+	path, err := configPath()
+	if err != nil {
+		return config, err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return config, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, &config); err != nil {
+			return config, fmt.Errorf("invalid config %s: %s", path, err)
+		}
+	}
+
+	if server := os.Getenv("R2WARS_SERVER"); server != "" {
+		config.Server = server
+	}
+	if token := os.Getenv("R2WARS_TOKEN"); token != "" {
+		config.Token = token
+	}
+	return config, nil
+}
+
+// saveConfig writes the config readable by the user only, as it contains the token
+func saveConfig(config Config) (string, error) {
+	path, err := configPath()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	content, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return path, os.WriteFile(path, content, 0600)
+}
+
+// newClient returns a client using the stored config
+func newClient() (*Client, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config.Server == "" || config.Token == "" {
+		return nil, fmt.Errorf("not logged in, run `r2wars login` or set R2WARS_SERVER and R2WARS_TOKEN")
+	}
+	return NewClient(config.Server, config.Token), nil
+}
+
+// readLine prompts for a single line on stdin
+func readLine(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
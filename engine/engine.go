@@ -0,0 +1,707 @@
+// Package engine runs r2wars fights. It is used by the web server as well as by `r2wars fight`, so
+// that bots behave the same offline as they do in the battles on the server.
+package engine
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/radareorg/r2pipe-go"
+)
+
+// Fighter is a bot as seen by the engine: the source to assemble and the arch and bits the
+// emulator has to be switched to when it's the bots turn
+type Fighter struct {
+	Name     string
+	Source   string
+	ArchName string
+	BitsName string
+}
+
+// The ways the arena can be filled before the bots are placed
+const (
+	ArenaZeros   = "zeros"
+	ArenaByte    = "byte"
+	ArenaPattern = "pattern"
+	ArenaRandom  = "random"
+)
+
+// ArenaInit defines what the arena contains before the bots are written to it
+type ArenaInit struct {
+	Mode string
+
+	// The hex encoded byte (ArenaByte), the hex encoded pattern (ArenaPattern) or the decimal
+	// seed (ArenaRandom). Random noise without a seed uses the seed of the fight.
+	Value string
+}
+
+// The ways a register can be initialized when placing a bot
+const (
+	RegKeep   = "keep"   // whatever aeim produced (the stack pointer is shifted by the base address)
+	RegBase   = "base"   // the base address of the bot plus Value
+	RegFixed  = "fixed"  // Value
+	RegRandom = "random" // a random (word aligned) address within the arena
+	RegZero   = "zero"
+)
+
+// RegInit defines how a single register (or group of registers) is initialized
+type RegInit struct {
+	Mode  string
+	Value int
+}
+
+// RegisterInit defines the register state of every bot before the first step. The registers are
+// set using r2's register aliases (SP, BP) so that this works the same across archs. GPR applies
+// to all general purpose registers except for the program counter, stack and base pointer and the
+// flags.
+type RegisterInit struct {
+	SP  RegInit
+	BP  RegInit
+	GPR RegInit
+}
+
+// Fight describes a single execution of a set of bots within one shared arena
+type Fight struct {
+	ArenaSize int
+	MaxRounds int
+	Arena     ArenaInit
+	Registers RegisterInit
+
+	// The maximum amount of bytes a single bot may assemble to, 0 for no limit
+	MaxBotSize int
+
+	// Seed is used to randomize the placement of the bots within the arena. A Seed of 0 places
+	// the bots at the fixed offsets 0x50, 0xa0, ...
+	Seed int64
+
+	// The bots are stepped in the order given here
+	Fighters []Fighter
+}
+
+// FightResult is the outcome of a single fight
+type FightResult struct {
+	Winner    int // index into Fight.Fighters, -1 if no single bot survived
+	Rounds    int
+	BaseAddrs []int
+	RawOutput string
+	Events    []Event
+}
+
+// The kinds of events logged during a fight
+const (
+	EventPlace = "place" // a bot has been written to the arena at Addr
+	EventStep  = "step"  // a bot executed the instruction at PC
+	EventDeath = "death" // a bot hit an invalid instruction, trap or io error
+	EventWin   = "win"   // a bot is the only one left
+	EventDraw  = "draw"  // the max amount of rounds was reached with more than one bot alive
+)
+
+// Event is a single entry of the machine readable log of a fight, the RawOutput being the human
+// readable one
+type Event struct {
+	Type  string `json:"type"`
+	Round int    `json:"round"`
+	Bot   int    `json:"bot"` // index into Fight.Fighters, -1 for draws
+	Name  string `json:"name,omitempty"`
+	PC    string `json:"pc,omitempty"`
+	Addr  int    `json:"addr,omitempty"`
+}
+
+// the state of a single bot while the fight is running
+type runtimeBot struct {
+	Fighter
+	Bytecode string
+	Regs     string
+	BaseAddr int
+	Alive    bool
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// GENERAL PURPOSE
+
+// FightRun assembles the bots, places them in a fresh arena and steps them one instruction at a
+// time until only one of them is left or the max amount of rounds is reached
+func FightRun(fight Fight) (FightResult, error) {
+	result := FightResult{Winner: -1}
+
+	if len(fight.Fighters) < 2 {
+		return result, fmt.Errorf("a fight needs at least two bots, got %d", len(fight.Fighters))
+	}
+
+	// open radare with the arena as input
+	cmd := fmt.Sprintf("malloc://%d", fight.ArenaSize)
+	r2p, err := r2pipe.NewPipe(cmd)
+	if err != nil {
+		return result, err
+	}
+	defer r2p.Close()
+
+	var rawOutput string
+
+	// fill the arena
+	arena, err := fight.Arena.Bytes(fight.ArenaSize, fight.Seed)
+	if err != nil {
+		return result, err
+	}
+	if arena != nil {
+		rawOutput += fmt.Sprintf("[0x00000000]> # Filling the arena (%s %s)\n", fight.Arena.Mode, fight.Arena.Value)
+
+		// write in chunks in order to not send megabytes in a single command
+		for off := 0; off < len(arena); off += 4096 {
+			end := min(off+4096, len(arena))
+			_, _ = r2cmd(r2p, fmt.Sprintf("wx %s @ 0x%x", hex.EncodeToString(arena[off:end]), off))
+		}
+	}
+
+	cmd = fmt.Sprintf("pxc %d @ 0x0", fight.ArenaSize)
+	output, _ := r2cmd(r2p, cmd)
+	rawOutput += fmt.Sprintf("[0x00000000]> %s\n%s\n", cmd, output)
+
+	rawOutput += "[0x00000000]> # Assembling the bots\n"
+
+	var bots []runtimeBot
+	for _, f := range fight.Fighters {
+		rawOutput += fmt.Sprintf("; %s\n", f.assembleCommand())
+
+		bytecode, err := f.assemble(r2p)
+		if err != nil {
+			return result, err
+		}
+
+		if fight.MaxBotSize > 0 && len(bytecode)/2 > fight.MaxBotSize {
+			return result, fmt.Errorf("bot %s is %d bytes large, only %d bytes are allowed", f.Name, len(bytecode)/2, fight.MaxBotSize)
+		}
+
+		bots = append(bots, runtimeBot{
+			Fighter:  f,
+			Bytecode: bytecode,
+			Alive:    true,
+		})
+	}
+
+	// figure out where to put the bots
+	var sizes []int
+	for _, b := range bots {
+		sizes = append(sizes, len(b.Bytecode)/2)
+	}
+	addrs, err := fightPlacement(fight.ArenaSize, sizes, fight.Seed)
+	if err != nil {
+		return result, err
+	}
+	result.BaseAddrs = addrs
+
+	// the vm and the stack are initialized using the arch of the first bot
+	for _, cmd := range bots[0].archCommands() {
+		_, _ = r2cmd(r2p, cmd)
+		rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
+	}
+
+	rawOutput += "[0x00000000]> # initializing the vm and the stack\n"
+	cmd = "aei"
+	output, _ = r2cmd(r2p, cmd)
+	rawOutput += fmt.Sprintf("[0x00000000]> %s\n%s", cmd, output)
+
+	cmd = "aeim"
+	output, _ = r2cmd(r2p, cmd)
+	rawOutput += fmt.Sprintf("[0x00000000]> %s\n%s", cmd, output)
+
+	// Switching the arch loads another register profile with all registers reset, so the stack
+	// set up by aeim is remembered and handed to every bot after its arch has been set
+	stackPointer, _ := r2cmd(r2p, "aer SP")
+	stackPointer = strings.TrimSpace(stackPointer)
+	basePointer, _ := r2cmd(r2p, "aer BP")
+	basePointer = strings.TrimSpace(basePointer)
+
+	// the random register values are derived from the seed of the fight
+	rng := rand.New(rand.NewSource(fight.Seed))
+
+	// place bots
+	for i := range bots {
+		addr := addrs[i]
+		bots[i].BaseAddr = addr
+
+		msg := fmt.Sprintf("# writing bot %d to 0x%x", i, addr)
+		rawOutput += fmt.Sprintf("[0x00000000]> %s\n", msg)
+		cmd := fmt.Sprintf("wx %s @ 0x%x", bots[i].Bytecode, addr)
+		_, _ = r2cmd(r2p, cmd)
+		rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
+
+		// the register aliases depend on the arch, so set it before touching any register
+		for _, cmd := range bots[i].archCommands() {
+			_, _ = r2cmd(r2p, cmd)
+			rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
+		}
+		for _, cmd := range []string{
+			fmt.Sprintf("aer SP=%s", stackPointer),
+			fmt.Sprintf("aer BP=%s", basePointer),
+		} {
+			_, _ = r2cmd(r2p, cmd)
+			rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
+		}
+
+		// define the instruction point and the stack pointer
+		rawOutput += "[0x00000000]> # Setting the program counter and the stack pointer\n"
+		cmd = fmt.Sprintf("aer PC=0x%x", addr)
+		_, _ = r2cmd(r2p, cmd)
+		rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
+
+		var gprs []string
+		if fight.Registers.GPR.Mode != "" && fight.Registers.GPR.Mode != RegKeep {
+			gprs = fightGPRNames(r2p)
+		}
+
+		for _, cmd := range fight.Registers.commands(addr, fight.ArenaSize, gprs, rng) {
+			_, _ = r2cmd(r2p, cmd)
+			rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
+		}
+
+		// dump the registers of the bot for being able to switch inbetween them
+		// This is done in order to be able to play one step of each bot at a time,
+		// but sort of in parallel
+		rawOutput += "[0x00000000]> # Storing registers\n"
+		cmd = "aerR"
+		regs, _ := r2cmd(r2p, cmd)
+		rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
+
+		bots[i].Regs = strings.Replace(regs, "\n", ";", -1)
+
+		result.Events = append(result.Events, Event{Type: EventPlace, Bot: i, Name: bots[i].Name, Addr: addr})
+	}
+
+	for i := range bots {
+		// print the memory for some pleasing visuals
+		cmd = fmt.Sprintf("pxc 100 @ 0x%x", bots[i].BaseAddr)
+		output, _ = r2cmd(r2p, cmd)
+		rawOutput += fmt.Sprintf("[0x00000000]> %s\n%s\n", cmd, output)
+	}
+
+	// define end conditions
+	rawOutput += "[0x00000000]> # Defining the end conditions\n"
+	for _, cmd := range []string{
+		"e cmd.esil.todo=t theend=1",
+		"e cmd.esil.trap=t theend=1",
+		"e cmd.esil.intr=t theend=1",
+		"e cmd.esil.ioer=t theend=1",
+	} {
+		_, _ = r2cmd(r2p, cmd)
+		rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
+	}
+
+	// set the end condition to 0 initially
+	rawOutput += "[0x00000000]> # Initializing the end condition variable\n"
+	cmd = "f theend=0"
+	_, _ = r2cmd(r2p, cmd)
+	rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
+
+	alive := len(bots)
+	current := -1
+
+	round := 0
+	for ; round < fight.MaxRounds && alive > 1; round++ {
+
+		// the next bot that's still alive is up
+		for {
+			current = (current + 1) % len(bots)
+			if bots[current].Alive {
+				break
+			}
+		}
+
+		rawOutput += "[0x00000000]> ########################################################################\n"
+
+		// The arch has to be set before loading the registers, as the register profile (and thus
+		// the registers the aerR output of the bot refers to) depends on it
+		rawOutput += "[0x00000000]> # setting the architecture accordingly\n"
+		for _, cmd := range bots[current].archCommands() {
+			output, _ = r2cmd(r2p, cmd)
+			rawOutput += fmt.Sprintf("[0x00000000]> %s\n%s", cmd, output)
+		}
+
+		rawOutput += "[0x00000000]> # Loading the registers\n"
+		r2cmd(r2p, bots[current].Regs)
+
+		// this is architecture agnostic and just gets the program counter
+		pc, _ := r2cmd(r2p, "aer~$(arn PC)~[1]")
+
+		arch, _ := r2cmd(r2p, "e asm.arch")
+		bits, _ := r2cmd(r2p, "e asm.bits")
+		rawOutput += fmt.Sprintf("[0x00000000]> # ROUND %d, BOT %d (%s), PC=%s, arch=%s, bits=%s\n", round, current, bots[current].Name, pc, arch, bits)
+
+		result.Events = append(result.Events, Event{Type: EventStep, Round: round, Bot: current, Name: bots[current].Name, PC: strings.TrimSpace(pc)})
+
+		rawOutput += "[0x00000000]> # Stepping\n"
+		cmd = "aes"
+		_, _ = r2cmd(r2p, cmd)
+		rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
+
+		// store the regisers
+		rawOutput += "[0x00000000]> # Storing the registers\n"
+		registers, _ := r2cmd(r2p, "aerR")
+		bots[current].Regs = strings.Replace(registers, "\n", ";", -1)
+
+		// print the arena
+		rawOutput += "[0x00000000]> # Printing the arena\n"
+		cmd := fmt.Sprintf("pxc 100 @ 0x%x", bots[current].BaseAddr)
+		output, _ := r2cmd(r2p, cmd)
+		rawOutput += fmt.Sprintf("[0x00000000]> %s\n%s\n", cmd, output)
+
+		// predicate - the end?
+		rawOutput += "[0x00000000]> # Checking if we've won\n"
+		pend, _ := r2cmd(r2p, "?v theend")
+		status := strings.TrimSpace(pend)
+		// fixme: on Windows, we sometimes get output *from other calls to r2*
+
+		switch status {
+		case "0x0":
+		case "0x1":
+			log.Printf("[!] Bot %d has died", current)
+			rawOutput += fmt.Sprintf("[0x00000000]> # BOT %d (%s) has died\n", current, bots[current].Name)
+			bots[current].Alive = false
+			alive--
+			result.Events = append(result.Events, Event{Type: EventDeath, Round: round, Bot: current, Name: bots[current].Name})
+
+			// reset the end condition for the bots still alive
+			_, _ = r2cmd(r2p, "f theend=0")
+		default:
+			log.Printf("[!] Got invalid status '%s' for bot %d", status, current)
+		}
+	}
+
+	result.Rounds = round
+
+	if alive == 1 {
+		for i, b := range bots {
+			if b.Alive {
+				result.Winner = i
+				result.Events = append(result.Events, Event{Type: EventWin, Round: round, Bot: i, Name: b.Name})
+				rawOutput += fmt.Sprintf("[0x00000000]> # BOT %d (%s) wins after %d rounds\n", i, b.Name, round)
+			}
+		}
+	} else {
+		result.Events = append(result.Events, Event{Type: EventDraw, Round: round, Bot: -1})
+		rawOutput += fmt.Sprintf("[0x00000000]> # Draw after %d rounds, %d bots are still alive\n", round, alive)
+	}
+
+	result.RawOutput = rawOutput
+	return result, nil
+}
+
+// FighterSize assembles the bot in a throwaway r2 instance and returns its size in bytes
+func FighterSize(f Fighter) (int, error) {
+	r2p, err := r2pipe.NewPipe("--")
+	if err != nil {
+		return 0, err
+	}
+	defer r2p.Close()
+
+	bytecode, err := f.assemble(r2p)
+	if err != nil {
+		return 0, err
+	}
+	return len(bytecode) / 2, nil
+}
+
+// Assembly is the bytecode of a bot and its disassembly, along with the rasm2 commands used to
+// produce them
+type Assembly struct {
+	BytecodeCommand string
+	Bytecode        string
+	DisasmCommand   string
+	Disasm          string
+}
+
+// FighterAssemble assembles the bot and disassembles the result again in a throwaway r2 instance
+func FighterAssemble(f Fighter) (Assembly, error) {
+	r2p, err := r2pipe.NewPipe("--")
+	if err != nil {
+		return Assembly{}, err
+	}
+	defer r2p.Close()
+
+	bytecode, err := f.assemble(r2p)
+	if err != nil {
+		return Assembly{}, err
+	}
+
+	asm := Assembly{
+		BytecodeCommand: f.assembleCommand(),
+		Bytecode:        bytecode,
+		DisasmCommand:   fmt.Sprintf("rasm2 -a %s -b %s -D %+v", f.ArchName, f.BitsName, bytecode),
+	}
+	asm.Disasm, err = r2cmd(r2p, asm.DisasmCommand)
+	if err != nil {
+		return asm, fmt.Errorf("could not disassemble bot %s: %w", f.Name, err)
+	}
+	return asm, nil
+}
+
+// the commands switching the emulator over to the arch and bits of the bot
+func (f Fighter) archCommands() []string {
+	return []string{
+		fmt.Sprintf("e asm.arch=%s", f.ArchName),
+		fmt.Sprintf("e asm.bits=%s", f.BitsName),
+	}
+}
+
+// the rasm2 command used to assemble the bot
+func (f Fighter) assembleCommand() string {
+	src := strings.ReplaceAll(f.Source, "\r\n", "; ")
+	return fmt.Sprintf("rasm2 -a %s -b %s \"%+v\"", f.ArchName, f.BitsName, src)
+}
+
+// assemble returns the hex encoded bytecode of the bot
+func (f Fighter) assemble(r2p *r2pipe.Pipe) (string, error) {
+	if f.ArchName == "" || f.BitsName == "" {
+		return "", fmt.Errorf("bot %s has no arch or bits defined", f.Name)
+	}
+
+	bytecode, err := r2cmd(r2p, f.assembleCommand())
+	if err != nil {
+		return "", fmt.Errorf("could not assemble bot %s: %w", f.Name, err)
+	}
+
+	// rasm2 prints nothing (but an error on stderr) if the source is invalid
+	bytecode = strings.TrimSpace(bytecode)
+	if bytecode == "" {
+		return "", fmt.Errorf("bot %s assembled to nothing", f.Name)
+	}
+	return bytecode, nil
+}
+
+// ArenaInitParse validates the given mode and value, normalizing the hex values
+func ArenaInitParse(mode string, value string) (ArenaInit, error) {
+	value = strings.TrimSpace(value)
+
+	switch mode {
+	case "", ArenaZeros:
+		return ArenaInit{Mode: ArenaZeros}, nil
+
+	case ArenaByte, ArenaPattern:
+		value = strings.ToLower(strings.TrimPrefix(strings.ReplaceAll(value, " ", ""), "0x"))
+		b, err := hex.DecodeString(value)
+		if err != nil || len(b) == 0 {
+			return ArenaInit{}, fmt.Errorf("%q is not a valid hex value", value)
+		}
+		if mode == ArenaByte && len(b) != 1 {
+			return ArenaInit{}, fmt.Errorf("%q is not a single byte", value)
+		}
+		return ArenaInit{Mode: mode, Value: value}, nil
+
+	case ArenaRandom:
+		if value != "" {
+			if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+				return ArenaInit{}, fmt.Errorf("%q is not a valid seed", value)
+			}
+		}
+		return ArenaInit{Mode: mode, Value: value}, nil
+
+	default:
+		return ArenaInit{}, fmt.Errorf("unknown arena fill %q", mode)
+	}
+}
+
+// Bytes returns the initial contents of an arena of the given size. For zeroed arenas, nil is
+// returned, as a fresh malloc:// is zeroed already.
+func (a ArenaInit) Bytes(size int, fightSeed int64) ([]byte, error) {
+	a, err := ArenaInitParse(a.Mode, a.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	switch a.Mode {
+	case ArenaByte, ArenaPattern:
+		pattern, _ := hex.DecodeString(a.Value)
+		arena := make([]byte, size)
+		for i := range arena {
+			arena[i] = pattern[i%len(pattern)]
+		}
+		return arena, nil
+
+	case ArenaRandom:
+		seed := fightSeed
+		if a.Value != "" {
+			seed, _ = strconv.ParseInt(a.Value, 10, 64)
+		}
+		arena := make([]byte, size)
+		rand.New(rand.NewSource(seed)).Read(arena)
+		return arena, nil
+	}
+
+	return nil, nil
+}
+
+// RegInitParse validates the given mode and parses the value (decimal or 0x prefixed hex)
+func RegInitParse(mode string, value string) (RegInit, error) {
+	switch mode {
+	case "", RegKeep:
+		return RegInit{Mode: RegKeep}, nil
+	case RegRandom, RegZero:
+		return RegInit{Mode: mode}, nil
+	case RegBase, RegFixed:
+		v, err := strconv.ParseInt(strings.TrimSpace(value), 0, 64)
+		if err != nil {
+			return RegInit{}, fmt.Errorf("%q is not a valid register value", value)
+		}
+		if mode == RegFixed && v < 0 {
+			return RegInit{}, fmt.Errorf("a fixed register value can't be negative")
+		}
+		return RegInit{Mode: mode, Value: int(v)}, nil
+	default:
+		return RegInit{}, fmt.Errorf("unknown register init %q", mode)
+	}
+}
+
+// command returns the r2 command initializing the given register for a bot placed at base, or
+// an empty string if the register shall be kept as is
+func (ri RegInit) command(reg string, base int, arenaSize int, rng *rand.Rand) string {
+	switch ri.Mode {
+	case RegBase:
+		// negative offsets wrap around, r2 truncates the value to the size of the register
+		return fmt.Sprintf("aer %s=0x%x", reg, uint64(base+ri.Value))
+	case RegFixed:
+		return fmt.Sprintf("aer %s=0x%x", reg, ri.Value)
+	case RegRandom:
+		return fmt.Sprintf("aer %s=0x%x", reg, rng.Intn(arenaSize)&^3)
+	case RegZero:
+		return fmt.Sprintf("aer %s=0x0", reg)
+	}
+	return ""
+}
+
+// commands returns the r2 commands setting up the registers of a bot placed at base
+func (ri RegisterInit) commands(base int, arenaSize int, gprs []string, rng *rand.Rand) []string {
+	var cmds []string
+
+	if ri.SP.Mode == "" || ri.SP.Mode == RegKeep {
+		// the stack set up by aeim is shifted by the base address of the bot
+		cmds = append(cmds, fmt.Sprintf("aer SP=SP+0x%x", base))
+	} else {
+		cmds = append(cmds, ri.SP.command("SP", base, arenaSize, rng))
+	}
+
+	if cmd := ri.BP.command("BP", base, arenaSize, rng); cmd != "" {
+		cmds = append(cmds, cmd)
+	}
+
+	for _, reg := range gprs {
+		if cmd := ri.GPR.command(reg, base, arenaSize, rng); cmd != "" {
+			cmds = append(cmds, cmd)
+		}
+	}
+
+	return cmds
+}
+
+// fightGPRNames returns the names of the general purpose registers of the current arch, see
+// gprNames
+func fightGPRNames(r2p *r2pipe.Pipe) []string {
+	profile, _ := r2cmd(r2p, "drp")
+	return gprNames(profile)
+}
+
+// gprNotGeneral are the registers some register profiles list as general purpose ones that aren't:
+// the status registers and orax (rax before a syscall on x86-64)
+var gprNotGeneral = map[string]bool{
+	"eflags": true, "rflags": true, "flags": true, "cpsr": true, "apsr": true, "spsr": true,
+	"psr": true, "sr": true, "nzcv": true, "fpsr": true, "fpcr": true, "orax": true,
+}
+
+// gprNames returns the general purpose registers of the register profile (the output of drp):
+// the ones of type gpr, without the ones aliased as the program counter, stack and base pointer
+// or status register, the single bit flags and the gprNotGeneral
+func gprNames(profile string) []string {
+	var registers [][]string
+	skip := map[string]bool{}
+	for _, line := range strings.Split(profile, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "=PC", "=SP", "=BP", "=SR":
+			skip[fields[1]] = true
+		case "gpr":
+			registers = append(registers, fields)
+		}
+	}
+
+	var names []string
+	for _, fields := range registers {
+		name := fields[1]
+		// the size is the third field, .1 for the flags
+		if skip[name] || gprNotGeneral[name] || (len(fields) > 2 && fields[2] == ".1") {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// fixedPlacementStep is the distance between the bots placed at fixed offsets (a seed of 0)
+const fixedPlacementStep = 0x50
+
+// FightSlotSize returns the number of bytes each of the given number of bots may assemble to
+// in order to be placed with the seed: the distance between the fixed offsets for a seed of 0
+// (the last bot has to end within the arena as well), an equal share of the arena otherwise.
+// It is 0 if the arena is too small to hold the bots at all.
+func FightSlotSize(arenaSize int, bots int, seed int64) int {
+	if bots <= 0 {
+		return max(0, arenaSize)
+	}
+	if seed == 0 {
+		return max(0, min(fixedPlacementStep, arenaSize-fixedPlacementStep*bots))
+	}
+	return max(0, arenaSize/bots)
+}
+
+// ArenaMinSize returns the size of the smallest arena the given number of bots can be placed in
+// with any seed, each of them getting at least one byte
+func ArenaMinSize(bots int) int {
+	return fixedPlacementStep*bots + 1
+}
+
+// fightPlacement returns the base addresses of bots with the given sizes. Without a seed, the bots
+// are placed at fixed offsets. With a seed, the arena is split into one slot per bot, every bot
+// gets a random slot and a random offset within that slot, so that bots never overlap.
+func fightPlacement(arenaSize int, sizes []int, seed int64) ([]int, error) {
+	addrs := make([]int, len(sizes))
+
+	if seed == 0 {
+		for i := range sizes {
+			addrs[i] = fixedPlacementStep * (i + 1)
+		}
+		return addrs, fightCheckPlacement(arenaSize, sizes, addrs)
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	slotSize := FightSlotSize(arenaSize, len(sizes), seed)
+	slots := rng.Perm(len(sizes))
+
+	for i, size := range sizes {
+		if size > slotSize {
+			return nil, fmt.Errorf("bot %d (%d bytes) doesn't fit into a %d byte slot of the arena", i, size, slotSize)
+		}
+		addrs[i] = slots[i]*slotSize + rng.Intn(slotSize-size+1)
+	}
+	return addrs, fightCheckPlacement(arenaSize, sizes, addrs)
+}
+
+// fightCheckPlacement makes sure that every bot is placed fully within the arena and that no two
+// bots overlap
+func fightCheckPlacement(arenaSize int, sizes []int, addrs []int) error {
+	for i := range sizes {
+		if addrs[i] < 0 || addrs[i]+sizes[i] > arenaSize {
+			return fmt.Errorf("bot %d (%d bytes at 0x%x) doesn't fit into the arena of %d bytes", i, sizes[i], addrs[i], arenaSize)
+		}
+		for j := i + 1; j < len(sizes); j++ {
+			if addrs[i] < addrs[j]+sizes[j] && addrs[j] < addrs[i]+sizes[i] {
+				return fmt.Errorf("bot %d (0x%x-0x%x) overlaps with bot %d (0x%x-0x%x)", i, addrs[i], addrs[i]+sizes[i], j, addrs[j], addrs[j]+sizes[j])
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package engine
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFightSlotSize(t *testing.T) {
+	tests := []struct {
+		arenaSize int
+		bots      int
+		seed      int64
+		want      int
+	}{
+		{4096, 2, 1, 2048},
+		{4096, 3, 1, 1365},
+		{4096, 0, 1, 4096},
+		{4096, 2, 0, 0x50},
+		{0x100, 2, 0, 0x50},
+		{0xc0, 2, 0, 0xc0 - 0xa0},
+		{0x100, 4, 0, 0},
+		{0x100, 3, 0, 0x10},
+		{0, 2, 1, 0},
+		{-1, 0, 1, 0},
+	}
+	for _, tt := range tests {
+		if got := FightSlotSize(tt.arenaSize, tt.bots, tt.seed); got != tt.want {
+			t.Errorf("FightSlotSize(%d, %d, %d) = %d, want %d", tt.arenaSize, tt.bots, tt.seed, got, tt.want)
+		}
+	}
+}
+
+func TestArenaMinSize(t *testing.T) {
+	for bots := 1; bots <= 8; bots++ {
+		size := ArenaMinSize(bots)
+		for _, seed := range []int64{0, 1} {
+			if got := FightSlotSize(size, bots, seed); got < 1 {
+				t.Errorf("%d bots, seed %d: %d byte slots in an arena of %d bytes", bots, seed, got, size)
+			}
+		}
+		if got := FightSlotSize(size-1, bots, 0); got != 0 {
+			t.Errorf("%d bots: %d byte slots in an arena of %d bytes", bots, got, size-1)
+		}
+		// one byte bots placed at the fixed offsets, the last one ending with the arena
+		sizes := make([]int, bots)
+		for i := range sizes {
+			sizes[i] = 1
+		}
+		if _, err := fightPlacement(size, sizes, 0); err != nil {
+			t.Errorf("%d bots: %v", bots, err)
+		}
+	}
+}
+
+func TestFightCheckPlacement(t *testing.T) {
+	tests := []struct {
+		name      string
+		arenaSize int
+		sizes     []int
+		addrs     []int
+		err       string
+	}{
+		{"adjacent", 0x100, []int{0x10, 0x10}, []int{0x0, 0x10}, ""},
+		{"overlap", 0x100, []int{0x11, 0x10}, []int{0x0, 0x10}, "overlaps"},
+		{"contained", 0x100, []int{0x40, 0x10}, []int{0x0, 0x10}, "overlaps"},
+		{"past the end", 0x100, []int{0x10}, []int{0xf8}, "doesn't fit"},
+		{"negative", 0x100, []int{0x10}, []int{-1}, "doesn't fit"},
+		{"exactly the end", 0x100, []int{0x10}, []int{0xf0}, ""},
+	}
+	for _, tt := range tests {
+		err := fightCheckPlacement(tt.arenaSize, tt.sizes, tt.addrs)
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestFightPlacementFixed(t *testing.T) {
+	addrs, err := fightPlacement(4096, []int{0x50, 0x20, 0x50}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, addr := range addrs {
+		if want := 0x50 * (i + 1); addr != want {
+			t.Errorf("bot %d placed at 0x%x, want 0x%x", i, addr, want)
+		}
+	}
+
+	// anything larger than the distance between the offsets runs into the next bot
+	if _, err := fightPlacement(4096, []int{0x51, 0x20}, 0); err == nil {
+		t.Error("overlapping bots placed without an error")
+	}
+	// the size of the last bot is only limited by the end of the arena
+	if _, err := fightPlacement(0xc0, []int{0x20, 0x20}, 0); err != nil {
+		t.Errorf("bots fitting the arena rejected: %v", err)
+	}
+	if _, err := fightPlacement(0xc0, []int{0x20, 0x21}, 0); err == nil {
+		t.Error("bot past the end of the arena placed without an error")
+	}
+}
+
+func TestFightPlacementSeeded(t *testing.T) {
+	sizes := []int{0x200, 0x10, 0x555}
+	slotSize := FightSlotSize(4096, len(sizes), 1)
+
+	for seed := int64(1); seed < 200; seed++ {
+		addrs, err := fightPlacement(4096, sizes, seed)
+		if err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		for i, addr := range addrs {
+			slot := addr / slotSize
+			if (addr+sizes[i]-1)/slotSize != slot {
+				t.Errorf("seed %d: bot %d at 0x%x crosses the end of its slot", seed, i, addr)
+			}
+		}
+	}
+
+	// placed the same way for the same seed
+	a, _ := fightPlacement(4096, sizes, 42)
+	b, _ := fightPlacement(4096, sizes, 42)
+	for i := range a {
+		if a[i] != b[i] {
+			t.Errorf("seed 42 placed bot %d at 0x%x and 0x%x", i, a[i], b[i])
+		}
+	}
+
+	if _, err := fightPlacement(4096, []int{0x556, 0x10, 0x10}, 1); err == nil {
+		t.Error("bot larger than its slot placed without an error")
+	}
+}
+
+func TestGPRNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		want    []string
+	}{
+		{"x86-32", `=PC	eip
+=SP	esp
+=BP	ebp
+=A0	eax
+gpr	eax	.32	24	0
+gpr	ebx	.32	0	0
+gpr	ecx	.32	4	0
+gpr	esp	.32	60	0
+gpr	ebp	.32	20	0
+gpr	eip	.32	48	0
+gpr	eflags	.32	56	0	c1p.a.zstido.n.rv
+gpr	cf	.1	.448	0	carry
+seg	cs	.16	52	0
+drx	dr0	.32	0	0`, []string{"eax", "ebx", "ecx"}},
+		{"x86-64", `=PC	rip
+=SP	rsp
+=BP	rbp
+gpr	rax	.64	80	0
+gpr	r8	.64	72	0
+gpr	orax	.64	120	0
+gpr	rip	.64	128	0
+gpr	rsp	.64	152	0
+gpr	rbp	.64	32	0
+gpr	rflags	.64	144	0	c1p.a.zstido.n.rv
+gpr	eflags	.32	144	0	c1p.a.zstido.n.rv
+fpu	xmm0	.128	160	0`, []string{"rax", "r8"}},
+		{"arm-32", `=PC	r15
+=SP	r13
+=BP	fp
+=SR	cpsr
+gpr	r0	.32	0	0
+gpr	r1	.32	4	0
+gpr	r13	.32	52	0
+gpr	r15	.32	60	0
+gpr	cpsr	.32	64	0	_____tfiae_____________j__qvczn
+flg	tf	.1	.517	0	thumb`, []string{"r0", "r1"}},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		got := gprNames(tt.profile)
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestArenaInitParse(t *testing.T) {
+	tests := []struct {
+		mode, value string
+		want        ArenaInit
+		err         bool
+	}{
+		{"", "", ArenaInit{Mode: ArenaZeros}, false},
+		{ArenaZeros, "ff", ArenaInit{Mode: ArenaZeros}, false},
+		{ArenaByte, "0xCC", ArenaInit{Mode: ArenaByte, Value: "cc"}, false},
+		{ArenaByte, " 90 ", ArenaInit{Mode: ArenaByte, Value: "90"}, false},
+		{ArenaByte, "9090", ArenaInit{}, true},
+		{ArenaByte, "", ArenaInit{}, true},
+		{ArenaPattern, "de ad BE ef", ArenaInit{Mode: ArenaPattern, Value: "deadbeef"}, false},
+		{ArenaPattern, "abc", ArenaInit{}, true},
+		{ArenaPattern, "zz", ArenaInit{}, true},
+		{ArenaRandom, "", ArenaInit{Mode: ArenaRandom}, false},
+		{ArenaRandom, "-42", ArenaInit{Mode: ArenaRandom, Value: "-42"}, false},
+		{ArenaRandom, "0x10", ArenaInit{}, true},
+		{"noise", "", ArenaInit{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ArenaInitParse(tt.mode, tt.value)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ArenaInitParse(%q, %q) = %+v, %v", tt.mode, tt.value, got, err)
+		}
+	}
+}
+
+func TestArenaInitBytes(t *testing.T) {
+	if arena, err := (ArenaInit{Mode: ArenaZeros}).Bytes(16, 1); err != nil || arena != nil {
+		t.Errorf("zeros: %x, %v", arena, err)
+	}
+	if arena, _ := (ArenaInit{Mode: ArenaByte, Value: "cc"}).Bytes(4, 1); !bytes.Equal(arena, []byte{0xcc, 0xcc, 0xcc, 0xcc}) {
+		t.Errorf("byte: %x", arena)
+	}
+	// the pattern is cut off at the end of the arena
+	if arena, _ := (ArenaInit{Mode: ArenaPattern, Value: "010203"}).Bytes(7, 1); !bytes.Equal(arena, []byte{1, 2, 3, 1, 2, 3, 1}) {
+		t.Errorf("pattern: %x", arena)
+	}
+	if _, err := (ArenaInit{Mode: ArenaPattern, Value: "xyz"}).Bytes(4, 1); err == nil {
+		t.Error("an invalid pattern was accepted")
+	}
+
+	// random noise with a seed of its own is the same in every fight, without one it follows the
+	// seed of the fight
+	random := func(value string, fightSeed int64) []byte {
+		t.Helper()
+		arena, err := (ArenaInit{Mode: ArenaRandom, Value: value}).Bytes(64, fightSeed)
+		if err != nil || len(arena) != 64 {
+			t.Fatalf("random %q: %x, %v", value, arena, err)
+		}
+		return arena
+	}
+	if !bytes.Equal(random("7", 1), random("7", 2)) {
+		t.Error("seeded noise differs between fights")
+	}
+	if !bytes.Equal(random("", 1), random("", 1)) {
+		t.Error("noise differs for the same fight seed")
+	}
+	if bytes.Equal(random("", 1), random("", 2)) {
+		t.Error("noise is the same for different fight seeds")
+	}
+}
@@ -0,0 +1,670 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// AccountExport is everything stored about a user, downloadable from the profile page. Secrets
+// (password hashes, token hashes, webhook secrets, TOTP secrets) are left out. Bots only store
+// their current source, so there is a single version of each: the export says so in BotHistory
+// instead of leaving the reader wondering about the missing versions.
+type AccountExport struct {
+	ExportedAt time.Time `json:"exported_at"`
+	BotHistory string    `json:"bot_history"`
+
+	User       accountExportUser       `json:"user"`
+	Bots       []accountExportBot      `json:"bots"`
+	Teams      []accountExportTeam     `json:"teams"`
+	Battles    []accountExportBattle   `json:"battles"`
+	Fights     []accountExportFight    `json:"fights"`
+	Tokens     []accountExportToken    `json:"tokens"`
+	Webhooks   []accountExportWebhook  `json:"webhooks"`
+	Identities []accountExportIdentity `json:"identities"`
+	Sessions   []accountExportSession  `json:"sessions"`
+	Logins     []accountExportLogin    `json:"logins"`
+}
+
+type accountExportUser struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Role      string    `json:"role"`
+	Disabled  bool      `json:"disabled"`
+	TOTP      bool      `json:"totp_enabled"`
+}
+
+type accountExportBot struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name"`
+	Source string   `json:"source"`
+	Archs  []string `json:"archs"`
+	Bits   []string `json:"bits"`
+	Owners []string `json:"owners"`
+	Hidden bool     `json:"hidden"`
+}
+
+type accountExportTeam struct {
+	ID       int       `json:"id"`
+	Name     string    `json:"name"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+type accountExportBattle struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Owner bool   `json:"owner"`
+
+	// the bots of the user registered in the battle
+	Bots []string `json:"bots"`
+
+	Runs []accountExportRun `json:"runs"`
+}
+
+type accountExportRun struct {
+	Run
+	Stats []SeriesStat `json:"stats"`
+}
+
+// accountExportFight is a single fight one of the bots of the user took part in
+type accountExportFight struct {
+	RunID     int    `json:"run_id"`
+	BattleID  int    `json:"battle_id"`
+	Seed      int64  `json:"seed"`
+	FirstBot  string `json:"first_bot"`
+	SecondBot string `json:"second_bot"`
+	Winner    string `json:"winner,omitempty"` // empty for draws
+	Rounds    int    `json:"rounds"`
+}
+
+type accountExportToken struct {
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+type accountExportWebhook struct {
+	BattleID  int       `json:"battle_id,omitempty"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type accountExportIdentity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type accountExportSession struct {
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	CreatedOn time.Time `json:"created_on"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type accountExportLogin struct {
+	CreatedAt time.Time `json:"created_at"`
+	IP        string    `json:"ip"`
+	Success   bool      `json:"success"`
+	Reason    string    `json:"reason"`
+}
+
+// What happens to the bots of a deleted account. Bots shared with other users are only unlinked
+// in both cases.
+const (
+	AccountBotsTransfer = "transfer" // hand the bots over to another user
+	AccountBotsDelete   = "delete"
+)
+
+// accountBotHistory is the BotHistory of every export
+const accountBotHistory = "Only the current source of each bot is stored, editing a bot overwrites " +
+	"the previous source, so earlier versions are not kept and can't be exported. The runs and " +
+	"fights the bots took part in are listed under battles and fights."
+
+var errAccountLastAdmin = errors.New("the last admin can't be deleted")
+var errAccountTeamOwner = errors.New("the last owner of a team can't be deleted")
+
+//////////////////////////////////////////////////////////////////////////////
+// GENERAL PURPOSE
+
+// AccountGetExport collects everything stored about the user
+func AccountGetExport(user User) (AccountExport, error) {
+	export := AccountExport{ExportedAt: time.Now(), BotHistory: accountBotHistory}
+
+	var err error
+	if export.User, err = globalState.GetAccountExportUser(user.ID); err != nil {
+		return export, err
+	}
+	if export.User.TOTP, err = TOTPEnabled(user.ID); err != nil {
+		return export, err
+	}
+
+	bots, err := UserGetBotsUsingUserID(user.ID)
+	if err != nil {
+		return export, err
+	}
+	for _, b := range bots {
+		bot, err := BotGetById(b.ID)
+		if err != nil {
+			return export, err
+		}
+		// the joins in BotGetById repeat the archs and bits for every owner
+		e := accountExportBot{ID: bot.ID, Name: bot.Name, Source: bot.Source, Hidden: bot.Hidden}
+		for _, arch := range bot.Archs {
+			e.Archs = accountAppendUnique(e.Archs, arch.Name)
+		}
+		for _, bit := range bot.Bits {
+			e.Bits = accountAppendUnique(e.Bits, bit.Name)
+		}
+		for _, owner := range bot.Users {
+			e.Owners = accountAppendUnique(e.Owners, owner.Name)
+		}
+		export.Bots = append(export.Bots, e)
+	}
+
+	teams, err := TeamGetAllForUser(user.ID)
+	if err != nil {
+		return export, err
+	}
+	for _, team := range teams {
+		members, err := TeamGetMembers(team.ID)
+		if err != nil {
+			return export, err
+		}
+		for _, m := range members {
+			if m.UserID == user.ID {
+				export.Teams = append(export.Teams, accountExportTeam{team.ID, team.Name, m.Role, m.JoinedAt})
+			}
+		}
+	}
+
+	if export.Battles, err = globalState.GetAccountExportBattles(user.ID); err != nil {
+		return export, err
+	}
+	for i, battle := range export.Battles {
+		runs, err := globalState.GetRunsForBattle(battle.ID)
+		if err != nil {
+			return export, err
+		}
+		for _, run := range runs {
+			stats, err := RunGetSeriesStats(run.ID)
+			if err != nil {
+				return export, err
+			}
+			export.Battles[i].Runs = append(export.Battles[i].Runs, accountExportRun{run, stats})
+		}
+	}
+
+	if export.Fights, err = globalState.GetAccountExportFights(user.ID); err != nil {
+		return export, err
+	}
+
+	tokens, err := TokenGetAllForUser(user.ID)
+	if err != nil {
+		return export, err
+	}
+	for _, token := range tokens {
+		export.Tokens = append(export.Tokens, accountExportToken{token.Name, token.Scopes, token.CreatedAt, token.LastUsedAt})
+	}
+
+	webhooks, err := globalState.GetWebhooks("user_id=?", user.ID)
+	if err != nil {
+		return export, err
+	}
+	for _, hook := range webhooks {
+		export.Webhooks = append(export.Webhooks, accountExportWebhook{hook.BattleID, hook.URL, hook.Events, hook.CreatedAt})
+	}
+
+	identities, err := OIDCGetAllForUser(user.ID)
+	if err != nil {
+		return export, err
+	}
+	for _, identity := range identities {
+		export.Identities = append(export.Identities, accountExportIdentity{identity.Issuer, identity.Subject, identity.Email, identity.CreatedAt})
+	}
+
+	sessions, err := SessionGetAllForUser(user.Name)
+	if err != nil {
+		return export, err
+	}
+	for _, session := range sessions {
+		export.Sessions = append(export.Sessions, accountExportSession{session.UserAgent, session.IP, session.CreatedOn, session.ModifiedOn})
+	}
+
+	if export.Logins, err = globalState.GetAccountExportLogins(user.Name); err != nil {
+		return export, err
+	}
+
+	return export, nil
+}
+
+func accountAppendUnique(list []string, s string) []string {
+	for _, e := range list {
+		if e == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+// accountWriteZip writes the export as account.json along with the source of every bot, named
+// like the cli expects them (name.arch-bits.asm)
+func accountWriteZip(w http.ResponseWriter, export AccountExport) error {
+	content, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(w)
+	f, err := archive.Create("account.json")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		return err
+	}
+
+	for _, bot := range export.Bots {
+		// bot names are free text, they must not escape the bots directory
+		botname := strings.NewReplacer("/", "_", "\\", "_").Replace(bot.Name)
+		name := fmt.Sprintf("bots/%d-%s.asm", bot.ID, botname)
+		if len(bot.Archs) > 0 && len(bot.Bits) > 0 {
+			name = fmt.Sprintf("bots/%d-%s.%s-%s.asm", bot.ID, botname, bot.Archs[0], bot.Bits[0])
+		}
+		f, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write([]byte(bot.Source)); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// AccountDelete deletes the user along with everything linked to them. Their bots are either
+// transferred to transferTo or deleted, depending on bots. The bots of their teams stay with the
+// teams. The battles they own are only handed over to battlesTo if one is given (battlesTo.ID != 0).
+func AccountDelete(user User, bots string, transferTo User, battlesTo User) error {
+	if user.IsAdmin() {
+		users, err := UserGetAll()
+		if err != nil {
+			return err
+		}
+		admins := 0
+		for _, u := range users {
+			if u.IsAdmin() {
+				admins++
+			}
+		}
+		if admins <= 1 {
+			return errAccountLastAdmin
+		}
+	}
+
+	// teams can't be left without an owner
+	teams, err := TeamGetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+	for _, team := range teams {
+		if err := teamCheckOwnerLeft(team.ID, user.ID); err != nil {
+			return errAccountTeamOwner
+		}
+	}
+
+	if err := globalState.DeleteAccount(user.ID, user.Name, bots, transferTo.ID, battlesTo.ID); err != nil {
+		return err
+	}
+
+	// the sessions live in their own database, so they can't be part of the transaction
+	if err := SessionRevokeAll(user.Name); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// DATABASE
+
+func (s *State) GetAccountExportUser(userid int) (accountExportUser, error) {
+	var user accountExportUser
+	err := s.db.QueryRow(`
+		SELECT id, name, created_at, role, disabled
+		FROM users
+		WHERE id=?`, userid).Scan(&user.ID, &user.Name, &user.CreatedAt, &user.Role, &user.Disabled)
+	return user, err
+}
+
+// Returns the battles the user owns or has bots in
+func (s *State) GetAccountExportBattles(userid int) ([]accountExportBattle, error) {
+	rows, err := s.db.Query(`
+		SELECT
+			ba.id, ba.name,
+			EXISTS (SELECT 1 FROM owner_battle_rel ob WHERE ob.battle_id = ba.id AND ob.user_id = ?),
+			COALESCE((
+				SELECT group_concat(bo.name)
+				FROM bot_battle_rel bb
+				JOIN bots bo ON bo.id = bb.bot_id
+				JOIN user_bot_rel ub ON ub.bot_id = bb.bot_id
+				WHERE bb.battle_id = ba.id AND ub.user_id = ?
+			), "")
+		FROM battles ba
+		WHERE ba.id IN (
+			SELECT battle_id FROM owner_battle_rel WHERE user_id = ?
+			UNION
+			SELECT bb.battle_id FROM bot_battle_rel bb JOIN user_bot_rel ub ON ub.bot_id = bb.bot_id WHERE ub.user_id = ?
+		)
+		ORDER BY ba.id`, userid, userid, userid, userid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var battles []accountExportBattle
+	for rows.Next() {
+		var battle accountExportBattle
+		var bots string
+		if err := rows.Scan(&battle.ID, &battle.Name, &battle.Owner, &bots); err != nil {
+			return battles, err
+		}
+		if bots != "" {
+			battle.Bots = strings.Split(bots, ",")
+		}
+		battles = append(battles, battle)
+	}
+	return battles, rows.Err()
+}
+
+func (s *State) GetRunsForBattle(battleid int) ([]Run, error) {
+	rows, err := s.db.Query(`
+		SELECT id, battle_id, created_at, status, fights, seed, COALESCE(error, "")
+		FROM runs
+		WHERE battle_id=?
+		ORDER BY id`, battleid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []Run
+	for rows.Next() {
+		var run Run
+		if err := rows.Scan(&run.ID, &run.BattleID, &run.CreatedAt, &run.Status, &run.Fights, &run.Seed, &run.Error); err != nil {
+			return runs, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// Returns the fights any of the bots of the user took part in
+func (s *State) GetAccountExportFights(userid int) ([]accountExportFight, error) {
+	rows, err := s.db.Query(`
+		SELECT f.run_id, r.battle_id, f.seed, COALESCE(b1.name, ""), COALESCE(b2.name, ""), COALESCE(bw.name, ""), f.rounds
+		FROM fights f
+		JOIN runs r ON r.id = f.run_id
+		LEFT JOIN bots b1 ON b1.id = f.first_bot_id
+		LEFT JOIN bots b2 ON b2.id = f.second_bot_id
+		LEFT JOIN bots bw ON bw.id = f.winner_bot_id
+		WHERE f.first_bot_id IN (SELECT bot_id FROM user_bot_rel WHERE user_id = ?)
+		   OR f.second_bot_id IN (SELECT bot_id FROM user_bot_rel WHERE user_id = ?)
+		ORDER BY f.id`, userid, userid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fights []accountExportFight
+	for rows.Next() {
+		var f accountExportFight
+		if err := rows.Scan(&f.RunID, &f.BattleID, &f.Seed, &f.FirstBot, &f.SecondBot, &f.Winner, &f.Rounds); err != nil {
+			return fights, err
+		}
+		fights = append(fights, f)
+	}
+	return fights, rows.Err()
+}
+
+func (s *State) GetAccountExportLogins(username string) ([]accountExportLogin, error) {
+	rows, err := s.db.Query(`
+		SELECT created_at, ip, success, reason
+		FROM login_attempts
+		WHERE username=?
+		ORDER BY id`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logins []accountExportLogin
+	for rows.Next() {
+		var l accountExportLogin
+		if err := rows.Scan(&l.CreatedAt, &l.IP, &l.Success, &l.Reason); err != nil {
+			return logins, err
+		}
+		logins = append(logins, l)
+	}
+	return logins, rows.Err()
+}
+
+// DeleteAccount deletes the user and everything linked to them in a single transaction. Bots
+// only owned by the user are transferred to transferTo or deleted, bots shared with others are
+// unlinked. The battles owned by the user are handed over to battlesTo if it isn't 0, otherwise
+// they stay around (managed by the admins) as they contain the bots and results of others.
+//
+// Every statement of a multi statement Exec binds its parameters starting at the first argument,
+// hence the numbered parameters.
+func (s *State) DeleteAccount(userid int, username string, bots string, transferTo int, battlesTo int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// both only touch the bots nobody else owns
+	switch bots {
+	case AccountBotsTransfer:
+		_, err = tx.Exec(`
+			INSERT OR IGNORE INTO user_bot_rel (user_id, bot_id)
+				SELECT ?1, bot_id FROM user_bot_rel
+				WHERE user_id = ?2 AND bot_id NOT IN (SELECT bot_id FROM user_bot_rel WHERE user_id != ?2)
+				AND bot_id NOT IN (SELECT bot_id FROM team_bot_rel);
+			`, transferTo, userid)
+	case AccountBotsDelete:
+		_, err = tx.Exec(`
+			CREATE TEMP TABLE deleted_bots AS
+				SELECT bot_id FROM user_bot_rel
+				WHERE user_id = ?1 AND bot_id NOT IN (SELECT bot_id FROM user_bot_rel WHERE user_id != ?1)
+				AND bot_id NOT IN (SELECT bot_id FROM team_bot_rel);
+			DELETE FROM bots WHERE id IN (SELECT bot_id FROM deleted_bots);
+			DROP TABLE deleted_bots;
+			`, userid)
+	default:
+		err = fmt.Errorf("invalid choice for the bots: %q", bots)
+	}
+	if err != nil {
+		return err
+	}
+
+	if battlesTo != 0 {
+		_, err = tx.Exec(`
+			INSERT OR IGNORE INTO owner_battle_rel (user_id, battle_id)
+				SELECT ?, battle_id FROM owner_battle_rel WHERE user_id = ?;
+			`, battlesTo, userid)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the links, team memberships, tokens, webhooks, second factors and identities of the user
+	// are deleted along with it by the foreign keys, the login attempts only know the name
+	_, err = tx.Exec(`
+		DELETE FROM login_attempts WHERE username = ?2;
+		DELETE FROM users WHERE id = ?1;
+		`, userid, username)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// HTTP
+
+// accountExportHandler downloads the export of the user as json, or as a zip with the bot sources
+// as separate files if ?format=zip is given
+func accountExportHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Error reading the profile id"))
+		return
+	}
+
+	redir_target := fmt.Sprintf("/user/%d/profile?res=%%s#account", id)
+
+	switch r.Method {
+	case "GET":
+		session, _ := globalState.sessions.Get(r, "session")
+		user, err := UserGetUserFromUsername(session.Values["username"].(string))
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the id for your username")
+			return
+		}
+		if user.ID != id {
+			log_and_redir_with_msg(w, r, nil, redir_target, "You can only export your own account")
+			return
+		}
+
+		export, err := AccountGetExport(user)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not export your account")
+			return
+		}
+
+		filename := fmt.Sprintf("r2wars-%s-%s", user.Name, export.ExportedAt.Format("2006-01-02"))
+		if r.URL.Query().Get("format") == "zip" {
+			w.Header().Set("Content-Type", "application/zip")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".zip"))
+			if err := accountWriteZip(w, export); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".json"))
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(export); err != nil {
+			log.Println(err)
+		}
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
+
+// accountDeleteHandler deletes the account of the user. They have to confirm it by entering their
+// username, and their password if they have one.
+func accountDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Error reading the profile id"))
+		return
+	}
+
+	redir_target := fmt.Sprintf("/user/%d/profile?res=%%s#account", id)
+
+	switch r.Method {
+	case "POST":
+		session, _ := globalState.sessions.Get(r, "session")
+		user, err := UserGetUserFromUsername(session.Values["username"].(string))
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the id for your username")
+			return
+		}
+		if user.ID != id {
+			log_and_redir_with_msg(w, r, nil, redir_target, "You can only delete your own account")
+			return
+		}
+
+		r.ParseForm()
+		if r.Form.Get("confirm") != user.Name {
+			log_and_redir_with_msg(w, r, nil, redir_target, "Please enter your username to confirm deleting your account")
+			return
+		}
+
+		passwordHash, err := globalState.GetUserPasswordHash(user.Name)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not check your password")
+			return
+		}
+		if len(passwordHash) > 0 && !UserCheckPassword(user.Name, r.Form.Get("password")) {
+			log_and_redir_with_msg(w, r, nil, redir_target, "Invalid password")
+			return
+		}
+
+		bots := r.Form.Get("bots")
+		var transferTo User
+		if bots == AccountBotsTransfer {
+			transferTo, err = UserGetUserFromUsername(r.Form.Get("transfer_to"))
+			if err != nil || transferTo.Name == "" {
+				log_and_redir_with_msg(w, r, err, redir_target, "There is no user to transfer your bots to with that name")
+				return
+			}
+			if transferTo.ID == user.ID {
+				log_and_redir_with_msg(w, r, nil, redir_target, "Please choose another user to transfer your bots to")
+				return
+			}
+		}
+
+		// handing over the battles is a choice of its own, independent of the bots
+		var battlesTo User
+		if r.Form.Get("transfer_battles") == "on" {
+			battlesTo, err = UserGetUserFromUsername(r.Form.Get("battles_to"))
+			if err != nil || battlesTo.Name == "" {
+				log_and_redir_with_msg(w, r, err, redir_target, "There is no user to transfer your battles to with that name")
+				return
+			}
+			if battlesTo.ID == user.ID {
+				log_and_redir_with_msg(w, r, nil, redir_target, "Please choose another user to transfer your battles to")
+				return
+			}
+		}
+
+		if err := AccountDelete(user, bots, transferTo, battlesTo); err != nil {
+			msg := "Could not delete your account"
+			if errors.Is(err, errAccountLastAdmin) {
+				msg = "You are the last admin, promote someone else before deleting your account"
+			}
+			if errors.Is(err, errAccountTeamOwner) {
+				msg = "You are the last owner of a team, promote someone else or delete the team first"
+			}
+			log_and_redir_with_msg(w, r, err, redir_target, msg)
+			return
+		}
+		log.Printf("[i] Deleted the account of %s (%s bots, battles to %q)", user.Name, bots, battlesTo.Name)
+
+		http.Redirect(w, r, "/login?res=Your account has been deleted", http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+)
+
+// accountTestSetup registers alice, bob and carol and gives alice a bot and a battle
+func accountTestSetup(t *testing.T) (*State, []User, int, int) {
+	s := testState(t)
+
+	var users []User
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if _, err := UserRegister(name, []byte("hash")); err != nil {
+			t.Fatal(err)
+		}
+		user, err := UserGetUserFromUsername(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+
+	botid, err := BotCreate("bot", "nop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := UserLinkBot("alice", botid); err != nil {
+		t.Fatal(err)
+	}
+	battleid, err := BattleCreate(Battle{Name: "battle", Visibility: BattlePublic}, users[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, users, botid, battleid
+}
+
+func accountTestOwners(t *testing.T, s *State, query string, id int) []int {
+	t.Helper()
+	rows, err := s.db.Query(query, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestAccountDeleteTransfer(t *testing.T) {
+	tests := []struct {
+		name         string
+		battlesTo    int // index into the users, -1 to keep the battles without an owner
+		battleOwners []int
+	}{
+		{"bots only", -1, nil},
+		{"bots and battles to someone else", 2, []int{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, users, botid, battleid := accountTestSetup(t)
+
+			var battlesTo User
+			if tt.battlesTo >= 0 {
+				battlesTo = users[tt.battlesTo]
+			}
+			if err := AccountDelete(users[0], AccountBotsTransfer, users[1], battlesTo); err != nil {
+				t.Fatal(err)
+			}
+
+			botOwners := accountTestOwners(t, s, "SELECT user_id FROM user_bot_rel WHERE bot_id=?", botid)
+			if len(botOwners) != 1 || botOwners[0] != users[1].ID {
+				t.Errorf("bot owners %v, want [%d]", botOwners, users[1].ID)
+			}
+
+			battleOwners := accountTestOwners(t, s, "SELECT user_id FROM owner_battle_rel WHERE battle_id=?", battleid)
+			var want []int
+			for _, i := range tt.battleOwners {
+				want = append(want, users[i].ID)
+			}
+			if len(battleOwners) != len(want) || (len(want) > 0 && battleOwners[0] != want[0]) {
+				t.Errorf("battle owners %v, want %v", battleOwners, want)
+			}
+		})
+	}
+}
+
+func TestAccountExportBotHistory(t *testing.T) {
+	_, users, _, _ := accountTestSetup(t)
+
+	export, err := AccountGetExport(users[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if export.BotHistory == "" {
+		t.Error("the export doesn't say that the history of the bots isn't kept")
+	}
+	if len(export.Bots) != 1 || export.Bots[0].Source != "nop" {
+		t.Errorf("exported bots %+v", export.Bots)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+//////////////////////////////////////////////////////////////////////////////
+// GENERAL PURPOSE
+
+// AdminGetAllBots returns all bots including the hidden ones
+func AdminGetAllBots() ([]Bot, error) {
+	return globalState.GetAllBotsIncludingHidden()
+}
+
+// AdminGetAllBattles returns all battles including the hidden ones
+func AdminGetAllBattles() ([]Battle, error) {
+	return globalState.GetAllBattlesIncludingHidden()
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// DATABASE
+
+func (s *State) GetAllBotsIncludingHidden() ([]Bot, error) {
+	rows, err := s.db.Query("SELECT id, name, hidden FROM bots;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bots []Bot
+	for rows.Next() {
+		var bot Bot
+		if err := rows.Scan(&bot.ID, &bot.Name, &bot.Hidden); err != nil {
+			return bots, err
+		}
+		bots = append(bots, bot)
+	}
+	return bots, rows.Err()
+}
+
+func (s *State) GetAllBattlesIncludingHidden() ([]Battle, error) {
+	rows, err := s.db.Query("SELECT id, name, hidden FROM battles;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var battles []Battle
+	for rows.Next() {
+		var battle Battle
+		if err := rows.Scan(&battle.ID, &battle.Name, &battle.Hidden); err != nil {
+			return battles, err
+		}
+		battles = append(battles, battle)
+	}
+	return battles, rows.Err()
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// HTTP
+
+func adminHandler(w http.ResponseWriter, r *http.Request) {
+	redir_target := "/admin?res=%s"
+
+	switch r.Method {
+	case "GET":
+		// define data
+		data := map[string]interface{}{}
+		data["version"] = os.Getenv("VERSION")
+		data["csrfToken"] = csrfToken(r)
+		data["pagelink1"] = Link{Name: "admin", Target: "/admin"}
+		data["pagelink1options"] = []Link{
+			{Name: "user", Target: "/user"},
+			{Name: "bot", Target: "/bot"},
+			{Name: "battle", Target: "/battle"},
+		}
+
+		// display errors passed via query parameters
+		queryres := r.URL.Query().Get("res")
+		if queryres != "" {
+			data["res"] = queryres
+		}
+
+		session, _ := globalState.sessions.Get(r, "session")
+		username := session.Values["username"].(string)
+
+		viewer, err := UserGetUserFromUsername(username)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the id for your username")
+			return
+		}
+		data["user"] = viewer
+
+		users, err := UserGetAll()
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the users")
+			return
+		}
+		data["users"] = users
+
+		bots, err := AdminGetAllBots()
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the bots")
+			return
+		}
+		data["bots"] = bots
+
+		battles, err := AdminGetAllBattles()
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the battles")
+			return
+		}
+		data["battles"] = battles
+
+		archs, err := ArchGetAll()
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the archs")
+			return
+		}
+		data["archs"] = archs
+
+		bits, err := BitGetAll()
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the bits")
+			return
+		}
+		data["bits"] = bits
+
+		runs, err := RunGetPending()
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the pending runs")
+			return
+		}
+		data["runs"] = runs
+
+		logins, err := LoginGetFailed()
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the failed logins")
+			return
+		}
+		data["failedLogins"] = logins
+
+		// get the template
+		t, err := template.ParseGlob(fmt.Sprintf("%s/*.html", templatesPath))
+		if err != nil {
+			log.Printf("Error reading the template Path: %s/*.html", templatesPath)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("500 - Error reading template file"))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// exec!
+		t.ExecuteTemplate(w, "admin", data)
+
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminActionRequest parses the id from the url and the action from the form of the admin POST
+// endpoints below
+func adminActionRequest(r *http.Request) (int, string, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, "", err
+	}
+	r.ParseForm()
+	return id, r.Form.Get("action"), nil
+}
+
+func adminUserHandler(w http.ResponseWriter, r *http.Request) {
+	redir_target := "/admin?res=%s#users"
+
+	switch r.Method {
+	case "POST":
+		userid, action, err := adminActionRequest(r)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Invalid user id")
+			return
+		}
+
+		// admins can't lock themselves out
+		session, _ := globalState.sessions.Get(r, "session")
+		viewer, err := UserGetUserFromUsername(session.Values["username"].(string))
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the id for your username")
+			return
+		}
+		if viewer.ID == userid {
+			log_and_redir_with_msg(w, r, nil, redir_target, "You can't change your own account here")
+			return
+		}
+
+		switch action {
+		case "disable":
+			err = UserSetDisabled(userid, true)
+		case "enable":
+			err = UserSetDisabled(userid, false)
+		case "promote":
+			err = UserSetRole(userid, RoleAdmin)
+		case "demote":
+			err = UserSetRole(userid, RoleUser)
+		case "unlock":
+			var user User
+			user, err = UserGetUserFromID(userid)
+			if err == nil {
+				err = LoginUnlock(user.Name, viewer.Name)
+			}
+		case "reset 2fa":
+			// for users that lost both their authenticator and their recovery codes
+			err = TOTPDisable(userid)
+		default:
+			log_and_redir_with_msg(w, r, nil, redir_target, "Invalid action")
+			return
+		}
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not update the user")
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf(redir_target, "Updated the user"), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
+
+func adminBotHandler(w http.ResponseWriter, r *http.Request) {
+	redir_target := "/admin?res=%s#bots"
+
+	switch r.Method {
+	case "POST":
+		botid, action, err := adminActionRequest(r)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Invalid bot id")
+			return
+		}
+
+		switch action {
+		case "hide":
+			err = BotSetHidden(botid, true)
+		case "unhide":
+			err = BotSetHidden(botid, false)
+		case "delete":
+			err = BotDeleteID(botid)
+		default:
+			log_and_redir_with_msg(w, r, nil, redir_target, "Invalid action")
+			return
+		}
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not update the bot")
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf(redir_target, "Updated the bot"), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
+
+func adminBattleHandler(w http.ResponseWriter, r *http.Request) {
+	redir_target := "/admin?res=%s#battles"
+
+	switch r.Method {
+	case "POST":
+		battleid, action, err := adminActionRequest(r)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Invalid battle id")
+			return
+		}
+
+		switch action {
+		case "hide":
+			err = BattleSetHidden(battleid, true)
+		case "unhide":
+			err = BattleSetHidden(battleid, false)
+		case "delete":
+			err = BattleDeleteID(battleid)
+		default:
+			log_and_redir_with_msg(w, r, nil, redir_target, "Invalid action")
+			return
+		}
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not update the battle")
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf(redir_target, "Updated the battle"), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
+
+func adminArchHandler(w http.ResponseWriter, r *http.Request) {
+	redir_target := "/admin?res=%s#archs"
+
+	switch r.Method {
+	case "POST":
+		archid, action, err := adminActionRequest(r)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Invalid arch id")
+			return
+		}
+
+		switch action {
+		case "enable":
+			err = ArchSetEnabled(archid, true)
+		case "disable":
+			err = ArchSetEnabled(archid, false)
+		default:
+			log_and_redir_with_msg(w, r, nil, redir_target, "Invalid action")
+			return
+		}
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not update the arch")
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf(redir_target, "Updated the arch"), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
+
+func adminBitHandler(w http.ResponseWriter, r *http.Request) {
+	redir_target := "/admin?res=%s#bits"
+
+	switch r.Method {
+	case "POST":
+		bitid, action, err := adminActionRequest(r)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Invalid bit id")
+			return
+		}
+
+		switch action {
+		case "enable":
+			err = BitSetEnabled(bitid, true)
+		case "disable":
+			err = BitSetEnabled(bitid, false)
+		default:
+			log_and_redir_with_msg(w, r, nil, redir_target, "Invalid action")
+			return
+		}
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not update the bits")
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf(redir_target, "Updated the bits"), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,1019 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.emile.space/r2wars-web/engine"
+	"github.com/gorilla/mux"
+)
+
+// The JSON API (/api/v1) exposes the same operations as the html handlers. Requests are
+// authenticated either using the session cookie or using an API token, errors are returned as
+//
+//	{"error": {"status": 404, "message": "..."}}
+//
+// with the corresponding http status code.
+
+type apiErrorBody struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiUser struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type apiBot struct {
+	ID     int       `json:"id"`
+	Name   string    `json:"name"`
+	Source string    `json:"source,omitempty"`
+	Arch   string    `json:"arch,omitempty"`
+	Bits   string    `json:"bits,omitempty"`
+	Owners []apiUser `json:"owners,omitempty"`
+}
+
+// apiSetting is the mode and value pair used by the arena fill and register settings
+type apiSetting struct {
+	Mode  string `json:"mode"`
+	Value string `json:"value,omitempty"`
+}
+
+type apiRegisters struct {
+	SP  apiSetting `json:"sp"`
+	BP  apiSetting `json:"bp"`
+	GPR apiSetting `json:"gpr"`
+}
+
+type apiBattle struct {
+	ID         int          `json:"id"`
+	Name       string       `json:"name"`
+	Visibility string       `json:"visibility,omitempty"`
+	Archs      []string     `json:"archs,omitempty"`
+	Bits       []string     `json:"bits,omitempty"`
+	ArenaSize  int          `json:"arena_size,omitempty"`
+	MaxRounds  int          `json:"max_rounds,omitempty"`
+	MaxBotSize int          `json:"max_bot_size"`
+	MixedArch  bool         `json:"mixed_arch"`
+	ArenaFill  apiSetting   `json:"arena_fill"`
+	Registers  apiRegisters `json:"registers"`
+	Owners     []apiUser    `json:"owners,omitempty"`
+	Bots       []apiBot     `json:"bots,omitempty"`
+}
+
+// apiUserBots is a user together with the bots they own
+type apiUserBots struct {
+	apiUser
+	Bots []apiBot `json:"bots"`
+}
+
+// apiRunResult is the result of a single fight
+type apiRunResult struct {
+	Winner *apiBot `json:"winner"`
+	Rounds int     `json:"rounds"`
+}
+
+type apiOutput struct {
+	Output string `json:"output"`
+}
+
+// apiRunStats is a run of a series together with the per bot results
+type apiRunStats struct {
+	Run  Run          `json:"run"`
+	Bots []SeriesStat `json:"bots"`
+}
+
+type apiSubmission struct {
+	Bots []int `json:"bots"`
+}
+
+// apiSeries is the series to enqueue, a random seed is used unless one is given
+type apiSeries struct {
+	Fights int    `json:"fights"`
+	Seed   *int64 `json:"seed,omitempty"`
+}
+
+type apiUserContextKeyType struct{}
+
+// apiUserContextKey is used to store the User an api request has been authenticated as
+var apiUserContextKey = apiUserContextKeyType{}
+
+//////////////////////////////////////////////////////////////////////////////
+// GENERAL PURPOSE
+
+func apiUserFromUser(user User) apiUser {
+	return apiUser{ID: user.ID, Name: user.Name}
+}
+
+func apiUsersFromUsers(users []User) []apiUser {
+	var res []apiUser
+	for _, user := range users {
+		res = append(res, apiUserFromUser(user))
+	}
+	return res
+}
+
+// apiBotFromBot converts the (deep) bot
+func apiBotFromBot(bot Bot) apiBot {
+	fighter := BotFighter(bot)
+	return apiBot{
+		ID:     bot.ID,
+		Name:   bot.Name,
+		Source: bot.Source,
+		Arch:   fighter.ArchName,
+		Bits:   fighter.BitsName,
+		Owners: apiUsersFromUsers(bot.Users),
+	}
+}
+
+func apiSettingFromRegInit(ri engine.RegInit) apiSetting {
+	switch ri.Mode {
+	case engine.RegBase, engine.RegFixed:
+		return apiSetting{Mode: ri.Mode, Value: strconv.Itoa(ri.Value)}
+	case "":
+		return apiSetting{Mode: engine.RegKeep}
+	}
+	return apiSetting{Mode: ri.Mode}
+}
+
+// apiBattleFromBattle converts the (deep) battle
+func apiBattleFromBattle(battle Battle) apiBattle {
+	res := apiBattle{
+		ID:         battle.ID,
+		Name:       battle.Name,
+		Visibility: battle.Visibility,
+		ArenaSize:  battle.ArenaSize,
+		MaxRounds:  battle.MaxRounds,
+		MaxBotSize: battle.MaxBotSize,
+		MixedArch:  battle.MixedArch,
+		ArenaFill:  apiSetting{Mode: battle.ArenaInit.Mode, Value: battle.ArenaInit.Value},
+		Registers: apiRegisters{
+			SP:  apiSettingFromRegInit(battle.Registers.SP),
+			BP:  apiSettingFromRegInit(battle.Registers.BP),
+			GPR: apiSettingFromRegInit(battle.Registers.GPR),
+		},
+		Owners: apiUsersFromUsers(battle.Owners),
+	}
+	if res.ArenaFill.Mode == "" {
+		res.ArenaFill.Mode = engine.ArenaZeros
+	}
+	for _, arch := range battle.Archs {
+		res.Archs = append(res.Archs, arch.Name)
+	}
+	for _, bit := range battle.Bits {
+		res.Bits = append(res.Bits, bit.Name)
+	}
+	for _, bot := range battle.Bots {
+		res.Bots = append(res.Bots, apiBot{ID: bot.ID, Name: bot.Name})
+	}
+	return res
+}
+
+// apiArchIDs maps the arch names to the ids of the enabled archs
+func apiArchIDs(names []string) ([]int, error) {
+	archs, err := ArchGetAllEnabled()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for _, name := range names {
+		found := false
+		for _, arch := range archs {
+			if arch.Name == name {
+				ids = append(ids, arch.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown or disabled arch %q", name)
+		}
+	}
+	return ids, nil
+}
+
+// apiBitIDs maps the bit names to the ids of the enabled bits
+func apiBitIDs(names []string) ([]int, error) {
+	bits, err := BitGetAllEnabled()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for _, name := range names {
+		found := false
+		for _, bit := range bits {
+			if bit.Name == name {
+				ids = append(ids, bit.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown or disabled bits %q", name)
+		}
+	}
+	return ids, nil
+}
+
+// apiBattleSettings validates the settings of the battle given and converts them into a Battle
+// (without id, owners and bots) and the arch and bit ids to link
+func apiBattleSettings(req apiBattle) (Battle, []int, []int, error) {
+	if req.Name == "" {
+		return Battle{}, nil, nil, fmt.Errorf("please provide a name")
+	}
+	if err := battleCheckArena(req.ArenaSize, 0); err != nil {
+		return Battle{}, nil, nil, err
+	}
+	if req.MaxRounds <= 0 {
+		return Battle{}, nil, nil, fmt.Errorf("the max rounds have to be positive")
+	}
+	if req.MaxBotSize < 0 {
+		return Battle{}, nil, nil, fmt.Errorf("the max bot size can't be negative")
+	}
+	if len(req.Archs) == 0 || len(req.Bits) == 0 {
+		return Battle{}, nil, nil, fmt.Errorf("please select at least one arch and bits")
+	}
+	if !battleVisibilityValid(req.Visibility) {
+		return Battle{}, nil, nil, fmt.Errorf("the visibility has to be one of %v", battleVisibilities)
+	}
+
+	archIDs, err := apiArchIDs(req.Archs)
+	if err != nil {
+		return Battle{}, nil, nil, err
+	}
+	bitIDs, err := apiBitIDs(req.Bits)
+	if err != nil {
+		return Battle{}, nil, nil, err
+	}
+
+	arenainit, err := engine.ArenaInitParse(req.ArenaFill.Mode, req.ArenaFill.Value)
+	if err != nil {
+		return Battle{}, nil, nil, err
+	}
+
+	var registers engine.RegisterInit
+	registers.SP, err = engine.RegInitParse(req.Registers.SP.Mode, req.Registers.SP.Value)
+	if err != nil {
+		return Battle{}, nil, nil, err
+	}
+	registers.BP, err = engine.RegInitParse(req.Registers.BP.Mode, req.Registers.BP.Value)
+	if err != nil {
+		return Battle{}, nil, nil, err
+	}
+	registers.GPR, err = engine.RegInitParse(req.Registers.GPR.Mode, req.Registers.GPR.Value)
+	if err != nil {
+		return Battle{}, nil, nil, err
+	}
+
+	battle := Battle{
+		Name:       req.Name,
+		Visibility: req.Visibility,
+		MaxRounds:  req.MaxRounds,
+		ArenaSize:  req.ArenaSize,
+		ArenaInit:  arenainit,
+		Registers:  registers,
+		MaxBotSize: req.MaxBotSize,
+		MixedArch:  req.MixedArch,
+	}
+	return battle, archIDs, bitIDs, nil
+}
+
+// apiBotSettings validates the bot given and returns the arch and bit ids to link
+func apiBotSettings(req apiBot) ([]int, []int, error) {
+	if req.Name == "" {
+		return nil, nil, fmt.Errorf("please provide a name")
+	}
+	if req.Source == "" {
+		return nil, nil, fmt.Errorf("please provide some source")
+	}
+	if req.Arch == "" || req.Bits == "" {
+		return nil, nil, fmt.Errorf("please provide the arch and bits")
+	}
+
+	archIDs, err := apiArchIDs([]string{req.Arch})
+	if err != nil {
+		return nil, nil, err
+	}
+	bitIDs, err := apiBitIDs([]string{req.Bits})
+	if err != nil {
+		return nil, nil, err
+	}
+	return archIDs, bitIDs, nil
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// HTTP
+
+func apiWriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+func apiWriteError(w http.ResponseWriter, status int, msg string) {
+	apiWriteJSON(w, status, apiError{apiErrorBody{Status: status, Message: msg}})
+}
+
+// apiDecode decodes the json body of the request into v, unknown fields are rejected
+func apiDecode(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid json body: %s", err)
+	}
+	return nil
+}
+
+// apiRequestUser returns the user the request has been authenticated as by the apiMiddleware
+func apiRequestUser(r *http.Request) User {
+	return r.Context().Value(apiUserContextKey).(User)
+}
+
+// apiID parses the id path variable
+func apiID(r *http.Request, name string) (int, error) {
+	return strconv.Atoi(mux.Vars(r)[name])
+}
+
+// apiMiddleware authenticates api requests using an api token or, if there is none, the session
+// cookie. In contrast to the authMiddleware, it responds with json errors instead of redirecting
+// to the login page.
+func apiMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// requests with an api token have already been authenticated by the csrfMiddleware
+		var user User
+		if _, ok := RequestToken(r); ok {
+			user = apiRequestUser(r)
+		} else if r.Header.Get("Authorization") != "" {
+			var status int
+			var msg string
+			if r, status, msg = tokenAuthenticateRequest(r); status != 0 {
+				apiWriteError(w, status, msg)
+				return
+			}
+			user = apiRequestUser(r)
+		} else {
+			session, _ := globalState.sessions.Get(r, "session")
+			username := session.Values["username"]
+			if username == nil {
+				apiWriteError(w, http.StatusUnauthorized, "Log in or provide an api token")
+				return
+			}
+
+			var err error
+			user, err = UserGetUserFromUsername(username.(string))
+			if err != nil {
+				apiWriteError(w, http.StatusUnauthorized, "Unknown user")
+				return
+			}
+		}
+
+		if user.Disabled {
+			apiWriteError(w, http.StatusForbidden, "Account disabled")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiUserContextKey, user)))
+	})
+}
+
+func apiNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	apiWriteError(w, http.StatusNotFound, "Not found")
+}
+
+// apiRoutes registers the api handlers with the methods they serve, they have to match the
+// apiOperations documented in the openapi description (see openapi_test.go)
+func apiRoutes(api *mux.Router) {
+	api.NotFoundHandler = http.HandlerFunc(apiNotFoundHandler)
+
+	routes := []struct {
+		path    string
+		handler http.HandlerFunc
+		methods []string
+	}{
+		{"/archs", apiArchsHandler, []string{"GET"}},
+		{"/bits", apiBitsHandler, []string{"GET"}},
+		{"/users", apiUsersHandler, []string{"GET"}},
+		{"/users/{id}", apiUserHandler, []string{"GET"}},
+		{"/me", apiMeHandler, []string{"GET"}},
+		{"/bots", apiBotsHandler, []string{"GET", "POST"}},
+		{"/bots/{id}", apiBotHandler, []string{"GET", "PUT"}},
+		{"/battles", apiBattlesHandler, []string{"GET", "POST"}},
+		{"/battles/{id}", apiBattleHandler, []string{"GET", "PUT"}},
+		{"/battles/{id}/bots", apiBattleSubmitHandler, []string{"POST"}},
+		{"/battles/{id}/run", apiBattleRunHandler, []string{"POST"}},
+		{"/battles/{id}/series", apiBattleSeriesHandler, []string{"POST"}},
+		{"/battles/{id}/output", apiBattleOutputHandler, []string{"GET"}},
+		{"/runs/{id}", apiRunHandler, []string{"GET"}},
+	}
+	for _, route := range routes {
+		api.HandleFunc(route.path, route.handler).Methods(route.methods...)
+	}
+
+	// mux forgets about a method mismatch as soon as a later route doesn't match the path,
+	// so the MethodNotAllowedHandler of the router isn't reliable: answer every other method
+	// on the known paths explicitly
+	for _, route := range routes {
+		api.HandleFunc(route.path, apiMethodNotAllowedHandler)
+	}
+}
+
+func apiMethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	apiWriteError(w, http.StatusMethodNotAllowed, "Method not allowed")
+}
+
+func apiArchsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiMethodNotAllowedHandler(w, r)
+		return
+	}
+
+	archs, err := ArchGetAllEnabled()
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "Could not get the archs")
+		return
+	}
+
+	names := []string{}
+	for _, arch := range archs {
+		names = append(names, arch.Name)
+	}
+	apiWriteJSON(w, http.StatusOK, names)
+}
+
+func apiBitsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiMethodNotAllowedHandler(w, r)
+		return
+	}
+
+	bits, err := BitGetAllEnabled()
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "Could not get the bits")
+		return
+	}
+
+	names := []string{}
+	for _, bit := range bits {
+		names = append(names, bit.Name)
+	}
+	apiWriteJSON(w, http.StatusOK, names)
+}
+
+func apiUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiMethodNotAllowedHandler(w, r)
+		return
+	}
+
+	users, err := UserGetAll()
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "Could not get the users")
+		return
+	}
+	res := apiUsersFromUsers(users)
+	if res == nil {
+		res = []apiUser{}
+	}
+	apiWriteJSON(w, http.StatusOK, res)
+}
+
+func apiUserHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiMethodNotAllowedHandler(w, r)
+		return
+	}
+
+	userid, err := apiID(r, "id")
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, "Invalid user id")
+		return
+	}
+
+	user, err := UserGetUserFromID(userid)
+	if err != nil {
+		apiWriteError(w, http.StatusNotFound, "No user with that id")
+		return
+	}
+
+	apiWriteUserBots(w, user)
+}
+
+// apiMeHandler returns the user the request has been authenticated as, so that clients only
+// holding a token can find out who they are
+func apiMeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiMethodNotAllowedHandler(w, r)
+		return
+	}
+
+	apiWriteUserBots(w, apiRequestUser(r))
+}
+
+func apiWriteUserBots(w http.ResponseWriter, user User) {
+	bots, err := UserGetBotsUsingUserID(user.ID)
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "Could not get the bots of the user")
+		return
+	}
+
+	res := apiUserBots{apiUserFromUser(user), []apiBot{}}
+	for _, bot := range bots {
+		res.Bots = append(res.Bots, apiBot{ID: bot.ID, Name: bot.Name})
+	}
+	apiWriteJSON(w, http.StatusOK, res)
+}
+
+func apiBotsHandler(w http.ResponseWriter, r *http.Request) {
+	user := apiRequestUser(r)
+
+	switch r.Method {
+	case "GET":
+		bots, err := globalState.GetAllBotsWithUsers()
+		if err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not get the bots")
+			return
+		}
+
+		res := []apiBot{}
+		for _, bot := range bots {
+			res = append(res, apiBot{ID: bot.ID, Name: bot.Name, Owners: apiUsersFromUsers(bot.Users)})
+		}
+		apiWriteJSON(w, http.StatusOK, res)
+
+	case "POST":
+		var req apiBot
+		if err := apiDecode(r, &req); err != nil {
+			apiWriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		archIDs, bitIDs, err := apiBotSettings(req)
+		if err != nil {
+			apiWriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		botid, err := BotCreate(req.Name, req.Source)
+		if err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not create the bot")
+			return
+		}
+		if err := UserLinkBot(user.Name, botid); err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not add the bot to the user")
+			return
+		}
+		if err := BotLinkArchIDs(botid, archIDs); err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not link the arch to the bot")
+			return
+		}
+		if err := BotLinkBitIDs(botid, bitIDs); err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not link the bits to the bot")
+			return
+		}
+
+		bot, err := BotGetById(botid)
+		if err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not get the created bot")
+			return
+		}
+		apiWriteJSON(w, http.StatusCreated, apiBotFromBot(bot))
+
+	default:
+		apiMethodNotAllowedHandler(w, r)
+	}
+}
+
+func apiBotHandler(w http.ResponseWriter, r *http.Request) {
+	user := apiRequestUser(r)
+
+	botid, err := apiID(r, "id")
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, "Invalid bot id")
+		return
+	}
+
+	bot, err := BotGetById(botid)
+	if err != nil || (bot.Hidden && !user.IsAdmin()) {
+		apiWriteError(w, http.StatusNotFound, "No bot with that id")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		apiWriteJSON(w, http.StatusOK, apiBotFromBot(bot))
+
+	case "PUT":
+		if !bot.HasOwner(user.ID) {
+			apiWriteError(w, http.StatusForbidden, "You aren't an owner of that bot")
+			return
+		}
+
+		// fields that aren't given are kept as they are
+		req := apiBotFromBot(bot)
+		req.Owners = nil
+		if err := apiDecode(r, &req); err != nil {
+			apiWriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.Owners != nil {
+			apiWriteError(w, http.StatusBadRequest, "The owners of a bot can't be changed")
+			return
+		}
+
+		archIDs, bitIDs, err := apiBotSettings(req)
+		if err != nil {
+			apiWriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err := BotLinkArchIDs(botid, archIDs); err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not link the arch to the bot")
+			return
+		}
+		if err := BotLinkBitIDs(botid, bitIDs); err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not link the bits to the bot")
+			return
+		}
+		if err := BotUpdate(botid, req.Name, req.Source); err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not update the bot")
+			return
+		}
+
+		bot, err := BotGetById(botid)
+		if err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not get the updated bot")
+			return
+		}
+		apiWriteJSON(w, http.StatusOK, apiBotFromBot(bot))
+
+	default:
+		apiMethodNotAllowedHandler(w, r)
+	}
+}
+
+func apiBattlesHandler(w http.ResponseWriter, r *http.Request) {
+	user := apiRequestUser(r)
+
+	switch r.Method {
+	case "GET":
+		battles, err := BattleGetAllVisible(user)
+		if err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not get the battles")
+			return
+		}
+
+		res := []apiBattle{}
+		for _, battle := range battles {
+			res = append(res, apiBattle{ID: battle.ID, Name: battle.Name})
+		}
+		apiWriteJSON(w, http.StatusOK, res)
+
+	case "POST":
+		// the same defaults as in the battle creation form
+		req := apiBattle{
+			Visibility: BattlePublic,
+			ArenaSize:  1024,
+			MaxRounds:  100,
+			ArenaFill:  apiSetting{Mode: engine.ArenaZeros},
+			Registers: apiRegisters{
+				SP:  apiSetting{Mode: engine.RegKeep},
+				BP:  apiSetting{Mode: engine.RegKeep},
+				GPR: apiSetting{Mode: engine.RegKeep},
+			},
+		}
+		if err := apiDecode(r, &req); err != nil {
+			apiWriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		battle, archIDs, bitIDs, err := apiBattleSettings(req)
+		if err != nil {
+			apiWriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		battleid, err := BattleCreate(battle, user)
+		if err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not create the battle")
+			return
+		}
+		if err := BattleLinkArchIDs(battleid, archIDs); err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not link the archs to the battle")
+			return
+		}
+		if err := BattleLinkBitIDs(battleid, bitIDs); err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not link the bits to the battle")
+			return
+		}
+		if err := BattleLinkOwnerIDs(battleid, []int{user.ID}); err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not link the owner to the battle")
+			return
+		}
+
+		created, err := BattleGetByIdDeep(battleid)
+		if err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not get the created battle")
+			return
+		}
+		apiWriteJSON(w, http.StatusCreated, apiBattleFromBattle(created))
+
+	default:
+		apiMethodNotAllowedHandler(w, r)
+	}
+}
+
+// apiGetBattle fetches the battle with the id given in the url, writing an error if it can't be
+// accessed
+func apiGetBattle(w http.ResponseWriter, r *http.Request) (Battle, bool) {
+	user := apiRequestUser(r)
+
+	battleid, err := apiID(r, "id")
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, "Invalid battle id")
+		return Battle{}, false
+	}
+
+	battle, err := BattleGetByIdDeep(battleid)
+	if err != nil || !BattleCan(battle, user, BattleView) {
+		apiWriteError(w, http.StatusNotFound, "No battle with that id")
+		return Battle{}, false
+	}
+	return battle, true
+}
+
+func apiBattleHandler(w http.ResponseWriter, r *http.Request) {
+	user := apiRequestUser(r)
+
+	battle, ok := apiGetBattle(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		apiWriteJSON(w, http.StatusOK, apiBattleFromBattle(battle))
+
+	case "PUT":
+		if !BattleCan(battle, user, BattleEdit) {
+			apiWriteError(w, http.StatusForbidden, "You aren't an owner of that battle")
+			return
+		}
+
+		// fields that aren't given are kept as they are, owners and bots are managed elsewhere
+		req := apiBattleFromBattle(battle)
+		req.Owners = nil
+		req.Bots = nil
+		if err := apiDecode(r, &req); err != nil {
+			apiWriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.Owners != nil || req.Bots != nil {
+			apiWriteError(w, http.StatusBadRequest, "The owners and bots can't be changed here")
+			return
+		}
+
+		updated, archIDs, bitIDs, err := apiBattleSettings(req)
+		if err != nil {
+			apiWriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := battleCheckArena(updated.ArenaSize, len(battle.Bots)); err != nil {
+			apiWriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		updated.ID = battle.ID
+		updated.Hidden = battle.Hidden
+
+		if err := BattleUpdate(updated); err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not update the battle")
+			return
+		}
+		if err := BattleLinkArchIDs(battle.ID, archIDs); err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not link the archs to the battle")
+			return
+		}
+		if err := BattleLinkBitIDs(battle.ID, bitIDs); err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not link the bits to the battle")
+			return
+		}
+
+		battle, err := BattleGetByIdDeep(battle.ID)
+		if err != nil {
+			log.Println(err)
+			apiWriteError(w, http.StatusInternalServerError, "Could not get the updated battle")
+			return
+		}
+		apiWriteJSON(w, http.StatusOK, apiBattleFromBattle(battle))
+
+	default:
+		apiMethodNotAllowedHandler(w, r)
+	}
+}
+
+// apiBattleSubmitHandler replaces the bots of the requesting user registered in the battle
+func apiBattleSubmitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiMethodNotAllowedHandler(w, r)
+		return
+	}
+
+	user := apiRequestUser(r)
+
+	battle, ok := apiGetBattle(w, r)
+	if !ok {
+		return
+	}
+
+	var req apiSubmission
+	if err := apiDecode(r, &req); err != nil {
+		apiWriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := BattleSubmitBots(battle, user, req.Bots); err != nil {
+		apiWriteError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	battle, err := BattleGetByIdDeep(battle.ID)
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "Could not get the battle")
+		return
+	}
+	apiWriteJSON(w, http.StatusOK, apiBattleFromBattle(battle))
+}
+
+// apiBattleRunHandler runs a single fight between the registered bots and waits for it to finish
+func apiBattleRunHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiMethodNotAllowedHandler(w, r)
+		return
+	}
+
+	battle, ok := apiGetBattle(w, r)
+	if !ok {
+		return
+	}
+	if !BattleCan(battle, apiRequestUser(r), BattleReferee) {
+		apiWriteError(w, http.StatusForbidden, "You aren't a referee of that battle")
+		return
+	}
+
+	bots, result, err := BattleRunOnce(battle.ID)
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "Could not run the battle")
+		return
+	}
+
+	// the winner is an index into the bots that fought, which might differ from the ones fetched
+	// above
+	res := apiRunResult{Rounds: result.Rounds}
+	if result.Winner >= 0 && result.Winner < len(bots) {
+		res.Winner = &apiBot{ID: bots[result.Winner].ID, Name: bots[result.Winner].Name}
+	}
+	apiWriteJSON(w, http.StatusOK, res)
+}
+
+// apiBattleSeriesHandler enqueues a series, its results can be fetched using the run id
+func apiBattleSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiMethodNotAllowedHandler(w, r)
+		return
+	}
+
+	battle, ok := apiGetBattle(w, r)
+	if !ok {
+		return
+	}
+	if !BattleCan(battle, apiRequestUser(r), BattleReferee) {
+		apiWriteError(w, http.StatusForbidden, "You aren't a referee of that battle")
+		return
+	}
+
+	req := apiSeries{Fights: 10}
+	if err := apiDecode(r, &req); err != nil {
+		apiWriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Fights < 1 || req.Fights > maxSeriesFights {
+		apiWriteError(w, http.StatusBadRequest, fmt.Sprintf("The amount of fights has to be between 1 and %d", maxSeriesFights))
+		return
+	}
+	if len(battle.Bots) < 2 {
+		apiWriteError(w, http.StatusUnprocessableEntity, "A series needs at least two bots")
+		return
+	}
+
+	seed := time.Now().UnixNano()
+	if req.Seed != nil {
+		seed = *req.Seed
+	}
+
+	runid, err := RunEnqueue(battle.ID, req.Fights, seed)
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "Could not enqueue the series")
+		return
+	}
+
+	run, err := RunGetById(runid)
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "Could not get the run")
+		return
+	}
+	apiWriteJSON(w, http.StatusAccepted, run)
+}
+
+func apiBattleOutputHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiMethodNotAllowedHandler(w, r)
+		return
+	}
+
+	battle, ok := apiGetBattle(w, r)
+	if !ok {
+		return
+	}
+
+	apiWriteJSON(w, http.StatusOK, apiOutput{battle.RawOutput})
+}
+
+func apiRunHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiMethodNotAllowedHandler(w, r)
+		return
+	}
+
+	user := apiRequestUser(r)
+
+	runid, err := apiID(r, "id")
+	if err != nil {
+		apiWriteError(w, http.StatusBadRequest, "Invalid run id")
+		return
+	}
+
+	run, err := RunGetById(runid)
+	if err != nil {
+		apiWriteError(w, http.StatusNotFound, "No run with that id")
+		return
+	}
+
+	// runs of battles the user can't see are hidden as well
+	battle, err := BattleGetByIdDeep(run.BattleID)
+	if err != nil || !BattleCan(battle, user, BattleView) {
+		apiWriteError(w, http.StatusNotFound, "No run with that id")
+		return
+	}
+
+	stats, err := RunGetSeriesStats(run.ID)
+	if err != nil {
+		log.Println(err)
+		apiWriteError(w, http.StatusInternalServerError, "Could not get the results of the run")
+		return
+	}
+	if stats == nil {
+		stats = []SeriesStat{}
+	}
+
+	apiWriteJSON(w, http.StatusOK, apiRunStats{run, stats})
+}
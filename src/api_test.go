@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAPIBattleSeriesSeed(t *testing.T) {
+	testState(t)
+
+	if _, err := UserRegister("alice", []byte("hash")); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := UserGetUserFromUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	battleid, err := BattleCreate(Battle{Name: "battle", Visibility: BattlePublic}, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"one", "two"} {
+		botid, err := BotCreate(name, "nop")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := BattleLinkBot(botid, battleid); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	series := func(body string) Run {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/api/v1/battles/"+strconv.Itoa(battleid)+"/series", strings.NewReader(body))
+		r = mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(battleid)})
+		r = r.WithContext(context.WithValue(r.Context(), apiUserContextKey, alice))
+		w := httptest.NewRecorder()
+		apiBattleSeriesHandler(w, r)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("%s: %d %s", body, w.Code, w.Body)
+		}
+		var run Run
+		if err := json.Unmarshal(w.Body.Bytes(), &run); err != nil {
+			t.Fatal(err)
+		}
+		return run
+	}
+
+	// the seed given is kept, even if it's 0
+	for _, seed := range []int64{0, 42} {
+		if run := series(`{"fights": 1, "seed": ` + strconv.FormatInt(seed, 10) + `}`); run.Seed != seed {
+			t.Errorf("seed %d: the run has the seed %d", seed, run.Seed)
+		}
+	}
+
+	// without one, every series gets its own
+	first, second := series(`{"fights": 1}`), series(`{"fights": 1}`)
+	if first.Seed == second.Seed {
+		t.Errorf("two series without a seed both got the seed %d", first.Seed)
+	}
+}
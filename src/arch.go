@@ -13,11 +13,35 @@ func ArchGetAll() ([]Arch, error) {
 	return globalState.GetAllArchs()
 }
 
+// ArchGetAllEnabled returns the archs that may be selected for bots and battles
+func ArchGetAllEnabled() ([]Arch, error) {
+	all, err := ArchGetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var enabled []Arch
+	for _, arch := range all {
+		if arch.Enabled {
+			enabled = append(enabled, arch)
+		}
+	}
+	return enabled, nil
+}
+
+func ArchIsEnabled(id int) (bool, error) {
+	return globalState.IsArchEnabled(id)
+}
+
+func ArchSetEnabled(id int, enabled bool) error {
+	return globalState.UpdateArchEnabled(id, enabled)
+}
+
 //////////////////////////////////////////////////////////////////////////////
 // DATABASE
 
 func (s *State) GetAllArchs() ([]Arch, error) {
-	rows, err := s.db.Query("SELECT id, name FROM archs")
+	rows, err := s.db.Query("SELECT id, name, enabled FROM archs")
 	defer rows.Close()
 	if err != nil {
 		return nil, err
@@ -26,7 +50,7 @@ func (s *State) GetAllArchs() ([]Arch, error) {
 	var archs []Arch
 	for rows.Next() {
 		var arch Arch
-		if err := rows.Scan(&arch.ID, &arch.Name); err != nil {
+		if err := rows.Scan(&arch.ID, &arch.Name, &arch.Enabled); err != nil {
 			return archs, err
 		}
 		archs = append(archs, arch)
@@ -37,5 +61,23 @@ func (s *State) GetAllArchs() ([]Arch, error) {
 	return archs, nil
 }
 
+// returns false if the arch has been disabled and an error if it doesn't exist
+func (s *State) IsArchEnabled(id int) (bool, error) {
+	var enabled bool
+	err := s.db.QueryRow("SELECT enabled FROM archs WHERE id=?", id).Scan(&enabled)
+	if err != nil {
+		return false, err
+	}
+	return enabled, nil
+}
+
+func (s *State) UpdateArchEnabled(id int, enabled bool) error {
+	_, err := s.db.Exec("UPDATE archs SET enabled=? WHERE id=?", enabled, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 //////////////////////////////////////////////////////////////////////////////
 // HTTP
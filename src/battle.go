@@ -11,28 +11,81 @@ import (
 	"strings"
 	"time"
 
+	"git.emile.space/r2wars-web/engine"
 	"github.com/gorilla/mux"
-	"github.com/radareorg/r2pipe-go"
 )
 
 type Battle struct {
-	ID        int
-	Name      string
-	Bots      []Bot
-	Owners    []User
-	Public    bool
-	Archs     []Arch
-	Bits      []Bit
-	RawOutput string
-	MaxRounds int
-	ArenaSize int
+	ID         int
+	Name       string
+	Bots       []Bot
+	Owners     []User
+	Visibility string
+	Archs      []Arch
+	Bits       []Bit
+	RawOutput  string
+	MaxRounds  int
+	ArenaSize  int
+	ArenaInit  engine.ArenaInit
+	Registers  engine.RegisterInit
+
+	// The maximum amount of bytes a bot may assemble to, 0 for no limit
+	MaxBotSize int
+
+	// In mixed arch battles, bots of different archs and bits share the arena
+	MixedArch bool
+
+	// Hidden battles are only visible to admins and their owners
+	Hidden bool
+
+	// The referees and participants of the battle, the owners are kept in Owners
+	Members []BattleMember
 }
 
+// BattleMember is a user invited to a battle as a referee or participant
+type BattleMember struct {
+	UserID int
+	Name   string
+	Role   string
+}
+
+// The roles of the users in a battle. Owners change the settings, manage the access and delete
+// the battle, referees run it and disqualify bots and participants enter their bots.
+const (
+	BattleRoleOwner       = "owner"
+	BattleRoleReferee     = "referee"
+	BattleRoleParticipant = "participant"
+)
+
+// BattlePermission is something a user might be allowed to do with a battle, see BattleCan
+type BattlePermission int
+
+const (
+	BattleView BattlePermission = iota
+	BattleSubmit
+	BattleReferee
+	BattleEdit
+)
+
+// The visibility modes of a battle. Public battles are listed and can be viewed without logging
+// in, unlisted ones are only reachable by their owners, members and through share links, and
+// private ones only by their owners and members.
+const (
+	BattlePublic   = "public"
+	BattleUnlisted = "unlisted"
+	BattlePrivate  = "private"
+)
+
+var battleVisibilities = []string{BattlePublic, BattleUnlisted, BattlePrivate}
+
 //////////////////////////////////////////////////////////////////////////////
 // GENERAL PURPOSE
 
-func BattleGetAll() ([]Battle, error) {
-	return globalState.GetAllBattles()
+// BattleGetAllVisible returns the battles listed for the given user: the public ones and the ones
+// they own or are a member of, hidden ones only if they own them. Anonymous visitors are passed as
+// the empty user.
+func BattleGetAllVisible(user User) ([]Battle, error) {
+	return globalState.GetAllBattlesVisibleTo(user.ID)
 }
 
 func BattleCreate(battle Battle, owner User) (int, error) {
@@ -47,6 +100,12 @@ func BattleUnlinkAllBotsForUser(userid int, battleid int) error {
 	return globalState.UnlinkAllBotsForUserFromBattle(userid, battleid)
 }
 
+// BattleReplaceBotsForUser swaps the bots of the user (and their teams) in the battle for the
+// given ones in a single transaction
+func BattleReplaceBotsForUser(userid int, battleid int, botIDs []int) error {
+	return globalState.ReplaceBotsForUserInBattle(userid, battleid, botIDs)
+}
+
 func BattleGetByIdDeep(id int) (Battle, error) {
 	return globalState.GetBattleByIdDeep(id)
 }
@@ -75,20 +134,379 @@ func BattleDeleteID(battleid int) error {
 	return globalState.DeleteBattleByID(battleid)
 }
 
+func BattleSetHidden(battleid int, hidden bool) error {
+	return globalState.UpdateBattleHidden(battleid, hidden)
+}
+
+// HasOwner returns true if the user with the given id is one of the owners of the battle
+func (b Battle) HasOwner(userid int) bool {
+	for _, owner := range b.Owners {
+		if owner.ID == userid {
+			return true
+		}
+	}
+	return false
+}
+
+// Role returns the role of the user with the given id in the battle, or "" if they have none
+func (b Battle) Role(userid int) string {
+	if b.HasOwner(userid) {
+		return BattleRoleOwner
+	}
+	for _, member := range b.Members {
+		if member.UserID == userid {
+			return member.Role
+		}
+	}
+	return ""
+}
+
+// BattleCan returns true if the user is allowed to do the given thing with the (deep) battle.
+// Anonymous visitors are passed as the empty user, share links are checked by the caller.
+//
+// Everybody may view public battles and every logged in user may enter bots into them, the other
+// battles are only open to the users with a role in them. The owners may do anything, even with
+// hidden battles, which are only visible to them and the admins otherwise. Admins can view every
+// battle but have no role in them otherwise.
+func BattleCan(battle Battle, user User, perm BattlePermission) bool {
+	role := ""
+	if user.ID != 0 {
+		role = battle.Role(user.ID)
+	}
+	if role == BattleRoleOwner {
+		return true
+	}
+
+	view := user.IsAdmin() || (!battle.Hidden && (role != "" || battle.Visibility == BattlePublic))
+	if !view {
+		return false
+	}
+
+	switch perm {
+	case BattleView:
+		return true
+	case BattleSubmit:
+		if role == "" {
+			return user.ID != 0 && battle.Visibility == BattlePublic
+		}
+		return role == BattleRoleParticipant
+	case BattleReferee:
+		return role == BattleRoleReferee
+	}
+	return false
+}
+
+// BattleSubmitBots replaces the bots the user has registered in the (deep) battle with the given
+// ones, checking that each of them is allowed to take part. Nothing changes unless all of them
+// are. The errors returned are meant to be displayed to the user.
+func BattleSubmitBots(battle Battle, user User, botIDs []int) error {
+	battleid := battle.ID
+
+	if !BattleCan(battle, user, BattleSubmit) {
+		return fmt.Errorf("You have to be a participant to enter bots into this battle")
+	}
+
+	// the bots entered by others stay, the ones of the user (and their teams) are replaced
+	var entered []Bot
+	for _, b := range battle.Bots {
+		other, err := BotGetById(b.ID)
+		if err != nil {
+			log.Println(err)
+			return fmt.Errorf("ERROR: Couldn't get bot with id %d", b.ID)
+		}
+		if !other.HasOwner(user.ID) {
+			entered = append(entered, other)
+		}
+	}
+
+	// In battles that aren't mixed arch battles, all bots have to share the same arch and
+	// bits. The bots already registered by others define which ones.
+	var reference *engine.Fighter
+	if !battle.MixedArch && len(entered) > 0 {
+		fighter := BotFighter(entered[0])
+		reference = &fighter
+	}
+
+	// for all bots, get their bits and arch and compare them to the one of the battle
+	for _, id := range botIDs {
+		bot, err := BotGetById(id)
+		if err != nil {
+			log.Println(err)
+			return fmt.Errorf("ERROR: Couldn't get bot with id %d", id)
+		}
+
+		if !bot.HasOwner(user.ID) {
+			return fmt.Errorf("You can only submit your own bots and the ones of your teams!")
+		}
+
+		disqualified, err := BattleBotIsDisqualified(battleid, id)
+		if err != nil {
+			log.Println(err)
+			return fmt.Errorf("ERROR: Couldn't check whether bot %d was disqualified", id)
+		}
+		if disqualified {
+			return fmt.Errorf("%s has been disqualified from this battle!", bot.Name)
+		}
+
+		var archValid bool = false
+		for _, battle_arch := range battle.Archs {
+			for _, bot_arch := range bot.Archs {
+				if battle_arch.ID == bot_arch.ID {
+					archValid = true
+				}
+			}
+		}
+
+		var bitValid bool = false
+		for _, battle_bit := range battle.Bits {
+			for _, bot_bit := range bot.Bits {
+				if battle_bit.ID == bot_bit.ID {
+					bitValid = true
+				}
+			}
+		}
+
+		if archValid == false {
+			return fmt.Errorf("Bot has an invalid architecture!")
+		}
+		if bitValid == false {
+			return fmt.Errorf("Bot has an invalid 'bit-ness'!")
+		}
+
+		if !battle.MixedArch {
+			fighter := BotFighter(bot)
+			if reference == nil {
+				reference = &fighter
+			}
+			if fighter.ArchName != reference.ArchName || fighter.BitsName != reference.BitsName {
+				return fmt.Errorf("This isn't a mixed arch battle, all bots have to be %s %s!", reference.ArchName, reference.BitsName)
+			}
+		}
+
+		entered = append(entered, bot)
+	}
+
+	if err := battleCheckFit(battle, entered); err != nil {
+		return err
+	}
+
+	log.Printf("entering bots %v of user %d into battle %d\n", botIDs, user.ID, battleid)
+	if err := BattleReplaceBotsForUser(user.ID, battleid, botIDs); err != nil {
+		log.Println(err)
+		return fmt.Errorf("ERROR: Couldn't enter the bots into the battle")
+	}
+	return nil
+}
+
+// battleMinBots is the number of bots the arena of every battle has room for, a fight needs two
+const battleMinBots = 2
+
+// battleCheckArena makes sure an arena of the given size can hold the given number of bots (at
+// least battleMinBots) no matter the seed they're placed with
+func battleCheckArena(arenaSize int, bots int) error {
+	bots = max(bots, battleMinBots)
+	if need := engine.ArenaMinSize(bots); arenaSize < need {
+		return fmt.Errorf("the arena of %d bytes is too small for %d bots, it has to be at least %d bytes large", arenaSize, bots, need)
+	}
+	return nil
+}
+
+// battleCheckFit assembles the bots and checks them against the size limit of the battle and the
+// slots they get when all of them are placed in the arena for a run
+func battleCheckFit(battle Battle, bots []Bot) error {
+	if err := battleCheckArena(battle.ArenaSize, len(bots)); err != nil {
+		return err
+	}
+
+	slotSize := engine.FightSlotSize(battle.ArenaSize, len(bots), battleSeed())
+
+	for _, bot := range bots {
+		size, err := engine.FighterSize(BotFighter(bot))
+		if err != nil {
+			log.Println(err)
+			return fmt.Errorf("Could not assemble bot %s", bot.Name)
+		}
+		if battle.MaxBotSize > 0 && size > battle.MaxBotSize {
+			return fmt.Errorf("Bot %s is %d bytes large, only %d bytes are allowed!", bot.Name, size, battle.MaxBotSize)
+		}
+		if size > slotSize {
+			return fmt.Errorf("Bot %s (%d bytes) doesn't fit into the arena, with %d bots each gets %d bytes!", bot.Name, size, len(bots), slotSize)
+		}
+	}
+	return nil
+}
+
+// battleSeed returns a random seed placing the bots of a fight, never 0 as that would place them
+// at fixed offsets
+func battleSeed() int64 {
+	return rand.Int63() | 1
+}
+
+// BattleRunOnce runs a single fight between all bots registered in the battle and stores its
+// output. It returns the bots that fought, the winner of the result is an index into them. The
+// fight isn't stored as a run, but fires the same webhook events as one.
+func BattleRunOnce(battleid int) ([]Bot, engine.FightResult, error) {
+	run := Run{BattleID: battleid, CreatedAt: time.Now(), Status: RunRunning, Fights: 1, Seed: battleSeed()}
+	WebhookFire(EventRunStarted, run)
+
+	bots, result, err := battleRunOnce(battleid, run.Seed)
+	if err != nil {
+		run.Status, run.Error = RunFailed, err.Error()
+		WebhookFire(EventRunFailed, run)
+		return nil, engine.FightResult{}, err
+	}
+
+	// the results of a single fight, in the same form as the ones of a series
+	var results []SeriesStat
+	for i, bot := range bots {
+		stat := SeriesStat{BotID: bot.ID, BotName: bot.Name, Fights: 1}
+		if result.Winner == i {
+			stat.Wins = 1
+		} else if result.Winner == -1 {
+			stat.Draws = 1
+		}
+		stat.WinRate, stat.Low, stat.High = wilson(stat.Wins, stat.Fights)
+		results = append(results, stat)
+	}
+
+	run.Status = RunFinished
+	webhookFire(EventRunFinished, run, results)
+	return bots, result, nil
+}
+
+func battleRunOnce(battleid int, seed int64) ([]Bot, engine.FightResult, error) {
+	// Fetch the battle information
+	// This includes all bots linked to the battle
+	fullDeepBattle, err := BattleGetByIdDeep(battleid)
+	if err != nil {
+		return nil, engine.FightResult{}, err
+	}
+
+	// for each bot involved within the battle, we need to fetch it again, as the deep battle
+	// fech doesn't fetch that deep (it fetches the batle and the corresponding bots, but only
+	// their ids and names and not the archs and bits associated)
+	var bots []Bot
+	var fighters []engine.Fighter
+	for _, b := range fullDeepBattle.Bots {
+		bot, err := BotGetById(b.ID)
+		if err != nil {
+			return nil, engine.FightResult{}, err
+		}
+		bots = append(bots, bot)
+		fighters = append(fighters, BotFighter(bot))
+	}
+
+	result, err := engine.FightRun(engine.Fight{
+		ArenaSize:  fullDeepBattle.ArenaSize,
+		MaxRounds:  fullDeepBattle.MaxRounds,
+		Arena:      fullDeepBattle.ArenaInit,
+		Registers:  fullDeepBattle.Registers,
+		MaxBotSize: fullDeepBattle.MaxBotSize,
+		Seed:       seed,
+		Fighters:   fighters,
+	})
+	if err != nil {
+		return nil, engine.FightResult{}, err
+	}
+
+	if err := BattleSaveRawOutput(battleid, result.RawOutput); err != nil {
+		return nil, engine.FightResult{}, err
+	}
+	return bots, result, nil
+}
+
+// battleRegisterInitFromForm parses the sp-init, bp-init and gpr-init form values (and their
+// corresponding -value fields)
+func battleRegisterInitFromForm(r *http.Request) (engine.RegisterInit, error) {
+	var registers engine.RegisterInit
+	var err error
+
+	registers.SP, err = engine.RegInitParse(r.Form.Get("sp-init"), r.Form.Get("sp-init-value"))
+	if err != nil {
+		return engine.RegisterInit{}, err
+	}
+	registers.BP, err = engine.RegInitParse(r.Form.Get("bp-init"), r.Form.Get("bp-init-value"))
+	if err != nil {
+		return engine.RegisterInit{}, err
+	}
+	registers.GPR, err = engine.RegInitParse(r.Form.Get("gpr-init"), r.Form.Get("gpr-init-value"))
+	if err != nil {
+		return engine.RegisterInit{}, err
+	}
+	return registers, nil
+}
+
+// battleVisibilityFromForm parses the visibility form value, an empty value keeps the given default
+func battleVisibilityFromForm(r *http.Request, def string) (string, error) {
+	visibility := r.Form.Get("visibility")
+	if visibility == "" {
+		return def, nil
+	}
+	if !battleVisibilityValid(visibility) {
+		return "", fmt.Errorf("unknown visibility %q", visibility)
+	}
+	return visibility, nil
+}
+
+func battleVisibilityValid(visibility string) bool {
+	for _, v := range battleVisibilities {
+		if v == visibility {
+			return true
+		}
+	}
+	return false
+}
+
+// battleMaxBotSizeFromForm parses the max-bot-size form value, an empty value means no limit
+func battleMaxBotSizeFromForm(r *http.Request) (int, error) {
+	if r.Form.Get("max-bot-size") == "" {
+		return 0, nil
+	}
+	maxbotsize, err := strconv.Atoi(r.Form.Get("max-bot-size"))
+	if err != nil {
+		return 0, err
+	}
+	if maxbotsize < 0 {
+		return 0, fmt.Errorf("the max bot size can't be negative")
+	}
+	return maxbotsize, nil
+}
+
 //////////////////////////////////////////////////////////////////////////////
 // DATABASE
 
 func (s *State) InsertBattle(battle Battle, owner User) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
 	// create the battle
-	res, err := s.db.Exec(`
-		INSERT INTO battles
-		VALUES(NULL,?,?,?,?,?,?)
+	res, err := tx.Exec(`
+		INSERT INTO battles (
+			created_at, name, public, raw_output, max_rounds, arena_size, arena_fill,
+			arena_fill_value, sp_init, sp_init_value, bp_init, bp_init_value, gpr_init,
+			gpr_init_value, max_bot_size, mixed_arch, hidden, visibility)
+		VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)
 		`, time.Now(),
 		battle.Name,
-		battle.Public,
+		battle.Visibility == BattlePublic,
 		battle.RawOutput,
 		battle.MaxRounds,
-		battle.ArenaSize)
+		battle.ArenaSize,
+		battle.ArenaInit.Mode,
+		battle.ArenaInit.Value,
+		battle.Registers.SP.Mode,
+		battle.Registers.SP.Value,
+		battle.Registers.BP.Mode,
+		battle.Registers.BP.Value,
+		battle.Registers.GPR.Mode,
+		battle.Registers.GPR.Value,
+		battle.MaxBotSize,
+		battle.MixedArch,
+		battle.Hidden,
+		battle.Visibility)
 
 	if err != nil {
 		log.Println(err)
@@ -102,12 +520,16 @@ func (s *State) InsertBattle(battle Battle, owner User) (int, error) {
 	}
 
 	// insert the owner into the battle_owner rel
-	_, err = s.db.Exec("INSERT INTO owner_battle_rel VALUES (?, ?)", owner.ID, battle.ID)
+	_, err = tx.Exec("INSERT INTO owner_battle_rel (user_id, battle_id) VALUES (?, ?)", owner.ID, id)
 	if err != nil {
 		log.Println(err)
 		return -1, err
 	}
 
+	if err := tx.Commit(); err != nil {
+		log.Println(err)
+		return -1, err
+	}
 	return int(id), nil
 }
 
@@ -116,12 +538,25 @@ func (s *State) UpdateBattle(battle Battle) error {
 	log.Println(battle.ArenaSize)
 	_, err := s.db.Exec(`
 		UPDATE battles
-		SET name=?, public=?, arena_size=?, max_rounds=?
+		SET name=?, public=?, arena_size=?, max_rounds=?, arena_fill=?, arena_fill_value=?,
+			sp_init=?, sp_init_value=?, bp_init=?, bp_init_value=?, gpr_init=?, gpr_init_value=?,
+			max_bot_size=?, mixed_arch=?, visibility=?
 		WHERE id=?`,
 		battle.Name,
-		battle.Public,
+		battle.Visibility == BattlePublic,
 		battle.ArenaSize,
 		battle.MaxRounds,
+		battle.ArenaInit.Mode,
+		battle.ArenaInit.Value,
+		battle.Registers.SP.Mode,
+		battle.Registers.SP.Value,
+		battle.Registers.BP.Mode,
+		battle.Registers.BP.Value,
+		battle.Registers.GPR.Mode,
+		battle.Registers.GPR.Value,
+		battle.MaxBotSize,
+		battle.MixedArch,
+		battle.Visibility,
 		battle.ID)
 	if err != nil {
 		log.Println(err)
@@ -132,7 +567,7 @@ func (s *State) UpdateBattle(battle Battle) error {
 }
 
 func (s *State) LinkBotBattle(botid int, battleid int) error {
-	_, err := s.db.Exec("INSERT INTO bot_battle_rel VALUES (?, ?)", botid, battleid)
+	_, err := s.db.Exec("INSERT INTO bot_battle_rel (bot_id, battle_id) VALUES (?, ?)", botid, battleid)
 	if err != nil {
 		log.Println(err)
 		return err
@@ -142,7 +577,7 @@ func (s *State) LinkBotBattle(botid int, battleid int) error {
 }
 
 func (s *State) LinkOwnerBattle(battleid int, ownerid int) error {
-	_, err := s.db.Exec("INSERT INTO owner_battle_rel VALUES (?, ?)", ownerid, battleid)
+	_, err := s.db.Exec("INSERT INTO owner_battle_rel (user_id, battle_id) VALUES (?, ?)", ownerid, battleid)
 	if err != nil {
 		log.Println(err)
 		return err
@@ -153,27 +588,21 @@ func (s *State) LinkOwnerBattle(battleid int, ownerid int) error {
 
 func (s *State) UnlinkAllBotsForUserFromBattle(userid int, battleid int) error {
 	// get a user with the given id
-	// for all of their bots
-	// delete the bots from the bot_battle relation
+	// for all of their bots and the bots of their teams
+	// delete the bots from the bot_battle relation of the battle
 
 	// there are some joins to get through the following links:
 	// bot_battle_rel.bot_id
-	//   -> bot.id
 	//   -> user_bot_rel.bot_id
 	//   -> user_bot_rel.user_id
-	//   -> user.id
+	// or
+	// bot_battle_rel.bot_id
+	//   -> team_bot_rel.bot_id
+	//   -> team_members.team_id
+	//   -> team_members.user_id
 
 	// delete preexisting links
-	_, err := s.db.Exec(`
-	DELETE FROM bot_battle_rel
-	WHERE bot_id IN
-		(SELECT b.id
-		 FROM bot_battle_rel bb_rel
-		 JOIN bots b ON b.id = bb_rel.bot_id
-		 JOIN user_bot_rel ub_rel ON ub_rel.bot_id = b.id
-		 JOIN users u ON u.id = ub_rel.user_id
-		 WHERE u.id=?)`, userid)
-
+	_, err := s.db.Exec(unlinkUserBotsFromBattle, battleid, userid, userid)
 	if err != nil {
 		log.Println(err)
 		return err
@@ -182,6 +611,34 @@ func (s *State) UnlinkAllBotsForUserFromBattle(userid int, battleid int) error {
 	return nil
 }
 
+const unlinkUserBotsFromBattle = `
+	DELETE FROM bot_battle_rel
+	WHERE battle_id=? AND bot_id IN
+		(SELECT bot_id FROM user_bot_rel WHERE user_id=?
+		 UNION
+		 SELECT tb.bot_id
+		 FROM team_bot_rel tb
+		 JOIN team_members tm ON tm.team_id = tb.team_id
+		 WHERE tm.user_id=?)`
+
+func (s *State) ReplaceBotsForUserInBattle(userid int, battleid int, botids []int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(unlinkUserBotsFromBattle, battleid, userid, userid); err != nil {
+		return err
+	}
+	for _, botid := range botids {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO bot_battle_rel (bot_id, battle_id) VALUES (?, ?)", botid, battleid); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func (s *State) LinkArchIDsToBattle(battleid int, archIDs []int) error {
 	// delete preexisting links
 	_, err := s.db.Exec("DELETE FROM arch_battle_rel WHERE battle_id=?", battleid)
@@ -269,13 +726,20 @@ func (s *State) LinkOwnerIDsToBattle(battleid int, ownerIDs []int) error {
 	}
 }
 
-func (s *State) GetAllBattles() ([]Battle, error) {
-	rows, err := s.db.Query("SELECT id, name FROM battles;")
-	defer rows.Close()
+func (s *State) GetAllBattlesVisibleTo(userid int) ([]Battle, error) {
+	// the single quotes matter, "public" would refer to the column of the same name
+	rows, err := s.db.Query(`
+	SELECT id, name
+	FROM battles
+	WHERE id IN (SELECT battle_id FROM owner_battle_rel WHERE user_id=?1)
+	OR (NOT hidden
+		AND (visibility = 'public'
+			OR id IN (SELECT battle_id FROM user_battle_rel WHERE user_id=?1)))`, userid)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
+	defer rows.Close()
 
 	var battles []Battle
 	for rows.Next() {
@@ -296,17 +760,20 @@ func (s *State) GetAllBattles() ([]Battle, error) {
 func (s *State) GetBattleByIdDeep(id int) (Battle, error) {
 	var battleid int
 	var battlename string
-	var battlepublic bool
+	var battlevisibility string
 	var battlerawoutput string
 	var battlemaxrounds int
 	var battlearenasize int
+	var battlearenafill string
+	var battlearenafillvalue string
+	var battleregisters engine.RegisterInit
+	var battlemaxbotsize int
+	var battlemixedarch bool
+	var battlehidden bool
 
 	var botids string
 	var botnames string
 
-	var userids string
-	var usernames string
-
 	var archids string
 	var archnames string
 
@@ -323,23 +790,25 @@ func (s *State) GetBattleByIdDeep(id int) (Battle, error) {
 	// TODO(emile): go deeper! we could fetch battle -> bot -> arch (so fetching the linked arch
 	//              for the given bot)
 
-	// COALESCE is used to set default values
-	// TODO(emile): do fancy migrations instead of the COALESCE stuff for setting defaults if
-	// no value is set beforehand
-
 	err := s.db.QueryRow(`
 	SELECT DISTINCT
-		ba.id, ba.name, ba.public, 
-		COALESCE(ba.raw_output, ""),
-		COALESCE(ba.max_rounds, 100),
-		COALESCE(ba.arena_size, 4096),
+		ba.id, ba.name,
+		ba.visibility,
+		ba.raw_output,
+		ba.max_rounds,
+		ba.arena_size,
+		ba.arena_fill,
+		ba.arena_fill_value,
+		ba.sp_init, ba.sp_init_value,
+		ba.bp_init, ba.bp_init_value,
+		ba.gpr_init, ba.gpr_init_value,
+		ba.max_bot_size,
+		ba.mixed_arch,
+		ba.hidden,
 
 		COALESCE(group_concat(DISTINCT bb.bot_id), ""),
 		COALESCE(group_concat(DISTINCT bo.name), ""),
 
-		COALESCE(group_concat(DISTINCT ub.user_id), ""),
-		COALESCE(group_concat(DISTINCT us.name), ""),
-
 		COALESCE(group_concat(DISTINCT ab.arch_id), ""),
 		COALESCE(group_concat(DISTINCT ar.name), ""),
 
@@ -353,9 +822,6 @@ func (s *State) GetBattleByIdDeep(id int) (Battle, error) {
 	LEFT JOIN bot_battle_rel bb ON bb.battle_id = ba.id
 	LEFT JOIN bots bo ON bo.id = bb.bot_id
 
-	LEFT JOIN user_battle_rel ub ON ub.battle_id = ba.id
-	LEFT JOIN users us ON us.id = ub.user_id
-
 	LEFT JOIN arch_battle_rel ab ON ab.battle_id = ba.id
 	LEFT JOIN archs ar ON ar.id = ab.arch_id
 
@@ -367,7 +833,7 @@ func (s *State) GetBattleByIdDeep(id int) (Battle, error) {
 
 	WHERE ba.id=?
 	GROUP BY ba.id;
-	`, id).Scan(&battleid, &battlename, &battlepublic, &battlerawoutput, &battlemaxrounds, &battlearenasize, &botids, &botnames, &userids, &usernames, &archids, &archnames, &bitids, &bitnames, &ownerids, &ownernames)
+	`, id).Scan(&battleid, &battlename, &battlevisibility, &battlerawoutput, &battlemaxrounds, &battlearenasize, &battlearenafill, &battlearenafillvalue, &battleregisters.SP.Mode, &battleregisters.SP.Value, &battleregisters.BP.Mode, &battleregisters.BP.Value, &battleregisters.GPR.Mode, &battleregisters.GPR.Value, &battlemaxbotsize, &battlemixedarch, &battlehidden, &botids, &botnames, &archids, &archnames, &bitids, &bitnames, &ownerids, &ownernames)
 	if err != nil {
 		log.Println(err)
 		return Battle{}, err
@@ -392,30 +858,12 @@ func (s *State) GetBattleByIdDeep(id int) (Battle, error) {
 				log.Println(err)
 				return Battle{}, err
 			}
-			bots = append(bots, Bot{id, botNameList[i], "", []User{}, []Arch{}, []Bit{}})
+			bots = append(bots, Bot{id, botNameList[i], "", []User{}, []Arch{}, []Bit{}, false})
 		}
 	} else {
 		bots = []Bot{}
 	}
 
-	// assemble the users
-	userIDList := strings.Split(userids, ",")
-	userNameList := strings.Split(usernames, ",")
-
-	var users []User
-	if userIDList[0] != "" {
-		for i := range userIDList {
-			id, err := strconv.Atoi(userIDList[i])
-			if err != nil {
-				log.Println(err)
-				return Battle{}, err
-			}
-			users = append(users, User{id, userNameList[i], []byte{}})
-		}
-	} else {
-		users = []User{}
-	}
-
 	// assemble the archs
 	archIDList := strings.Split(archids, ",")
 	archNameList := strings.Split(archnames, ",")
@@ -452,6 +900,14 @@ func (s *State) GetBattleByIdDeep(id int) (Battle, error) {
 		bits = []Bit{}
 	}
 
+	// the roles of the members are fetched separately, as the group_concat above would lose which
+	// role belongs to which user
+	members, err := s.GetBattleMembers(battleid)
+	if err != nil {
+		log.Println(err)
+		return Battle{}, err
+	}
+
 	// assemble the owners
 	ownerIDList := strings.Split(ownerids, ",")
 	ownerNameList := strings.Split(ownernames, ",")
@@ -464,23 +920,30 @@ func (s *State) GetBattleByIdDeep(id int) (Battle, error) {
 				log.Println(err)
 				return Battle{}, err
 			}
-			owners = append(owners, User{id, ownerNameList[i], nil})
+			owners = append(owners, User{ID: id, Name: ownerNameList[i], PasswordHash: nil})
 		}
 	} else {
 		owners = []User{}
 	}
 
 	return Battle{
-		ID:        battleid,
-		Name:      battlename,
-		Bots:      bots,
-		Owners:    owners,
-		Public:    battlepublic,
-		Archs:     archs,
-		Bits:      bits,
-		RawOutput: battlerawoutput,
-		MaxRounds: battlemaxrounds,
-		ArenaSize: battlearenasize,
+		ID:         battleid,
+		Name:       battlename,
+		Bots:       bots,
+		Owners:     owners,
+		Visibility: battlevisibility,
+		Archs:      archs,
+		Bits:       bits,
+		RawOutput:  battlerawoutput,
+		MaxRounds:  battlemaxrounds,
+		ArenaSize:  battlearenasize,
+		ArenaInit:  engine.ArenaInit{Mode: battlearenafill, Value: battlearenafillvalue},
+		Registers:  battleregisters,
+
+		MaxBotSize: battlemaxbotsize,
+		MixedArch:  battlemixedarch,
+		Hidden:     battlehidden,
+		Members:    members,
 	}, nil
 }
 
@@ -493,32 +956,27 @@ func (s *State) UpdateBattleRawOutput(battleid int, rawOutput string) error {
 	return nil
 }
 
-// This deletes a battle and all links to users, bots, architectures and bits
-func (s *State) DeleteBattleByID(battleid int) error {
-	_, err := s.db.Exec(`
-	DELETE FROM battles WHERE battleid = ?;
-
-	DELETE FROM user_battle_rel WHERE battleid = ?;
-	DELETE FROM bot_battle_rel WHERE battleid = ?;
-	DELETE FROM arch_battle_rel WHERE battleid = ?;
-	DELETE FROM bit_battle_rel WHERE battleid = ?;
-	`, battleid, battleid, battleid, battleid, battleid)
-
+func (s *State) UpdateBattleHidden(battleid int, hidden bool) error {
+	_, err := s.db.Exec("UPDATE battles SET hidden=? WHERE id=?", hidden, battleid)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
+	return nil
+}
 
-	_, err = s.db.Exec(`
-	DELETE FROM battles
-	WHERE battleid = ?
-	`, battleid)
-
+// This deletes a battle along with its links to users, bots, architectures and bits, its share
+// links, disqualifications, webhooks and runs. The foreign keys cascade the delete within the single
+// statement, so either all of it is gone or nothing is.
+func (s *State) DeleteBattleByID(battleid int) error {
+	res, err := s.db.Exec("DELETE FROM battles WHERE id = ?", battleid)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
-
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("no battle with the id %d", battleid)
+	}
 	return nil
 }
 
@@ -531,37 +989,41 @@ func battlesHandler(w http.ResponseWriter, r *http.Request) {
 		// define data
 		data := map[string]interface{}{}
 		data["version"] = os.Getenv("VERSION")
+		data["csrfToken"] = csrfToken(r)
 		data["pagelink1"] = Link{Name: "battle", Target: "/battle"}
 		data["pagelink1options"] = []Link{
 			{Name: "bot", Target: "/bot"},
 			{Name: "user", Target: "/user"},
+			{Name: "team", Target: "/team"},
 		}
 		data["pagelinknext"] = []Link{
 			{Name: "new", Target: "/new"},
 			{Name: "quick", Target: "/quick"},
 		}
 
-		// sessions
-		session, _ := globalState.sessions.Get(r, "session")
-		username := session.Values["username"]
-
-		if username == nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
+		// the public battles can be viewed without logging in
+		viewer := sessionUser(r)
+		if viewer.ID != 0 {
+			data["user"] = viewer
 		} else {
-			// get the user
-			user, err := UserGetUserFromUsername(username.(string))
-			if err != nil {
-				log.Println(err)
-				http.Redirect(w, r, "/login", http.StatusSeeOther)
-				return
+			data["pagelinkauth"] = []Link{
+				{Name: "login", Target: "/login"},
+				{Name: "register", Target: "/register"},
 			}
+		}
 
-			data["user"] = user
+		// display messages passed via query parameters
+		queryres := r.URL.Query().Get("res")
+		if queryres != "" {
+			data["res"] = queryres
 		}
 
-		// get all battles
-		battles, err := BattleGetAll()
+		// get all battles the viewer may see
+		battles, err := BattleGetAllVisible(viewer)
+		if err != nil {
+			log.Println(err)
+			data["res"] = "Could not fetch the battles"
+		}
 		data["battles"] = battles
 
 		// get the template
@@ -587,6 +1049,7 @@ func battleNewHandler(w http.ResponseWriter, r *http.Request) {
 		// define data
 		data := map[string]interface{}{}
 		data["version"] = os.Getenv("VERSION")
+		data["csrfToken"] = csrfToken(r)
 
 		// breadcrumb foo
 		session, _ := globalState.sessions.Get(r, "session")
@@ -617,7 +1080,7 @@ func battleNewHandler(w http.ResponseWriter, r *http.Request) {
 			data["user"] = user
 		}
 
-		archs, err := ArchGetAll()
+		archs, err := ArchGetAllEnabled()
 		if err != nil {
 			log.Println(err)
 			data["err"] = "Could not fetch the archs"
@@ -625,7 +1088,7 @@ func battleNewHandler(w http.ResponseWriter, r *http.Request) {
 			data["archs"] = archs
 		}
 
-		bits, err := BitGetAll()
+		bits, err := BitGetAllEnabled()
 		if err != nil {
 			log.Println(err)
 			data["err"] = "Could not fetch the bits"
@@ -684,6 +1147,10 @@ func battleNewHandler(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, fmt.Sprintf("/battle/new?res=%s", msg), http.StatusSeeOther)
 			return
 		}
+		if err := battleCheckArena(arenasize, 0); err != nil {
+			log_and_redir_with_msg(w, r, err, "/battle/new?res=%s", "ERROR: "+err.Error())
+			return
+		}
 		maxrounds, err := strconv.Atoi(r.Form.Get("max-rounds"))
 		if err != nil {
 			// TODO(emile): use the log_and_redir function in here (and the surrounding code)
@@ -694,10 +1161,41 @@ func battleNewHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		var public bool
-		query_public := r.Form.Get("public")
-		if query_public == "on" {
-			public = true
+		arenainit, err := engine.ArenaInitParse(r.Form.Get("arena-fill"), r.Form.Get("arena-fill-value"))
+		if err != nil {
+			log.Println(err)
+			msg := "ERROR: Invalid arena fill"
+			http.Redirect(w, r, fmt.Sprintf("/battle/new?res=%s", msg), http.StatusSeeOther)
+			return
+		}
+
+		registers, err := battleRegisterInitFromForm(r)
+		if err != nil {
+			log.Println(err)
+			msg := "ERROR: Invalid register init"
+			http.Redirect(w, r, fmt.Sprintf("/battle/new?res=%s", msg), http.StatusSeeOther)
+			return
+		}
+
+		maxbotsize, err := battleMaxBotSizeFromForm(r)
+		if err != nil {
+			log.Println(err)
+			msg := "ERROR: Invalid max bot size"
+			http.Redirect(w, r, fmt.Sprintf("/battle/new?res=%s", msg), http.StatusSeeOther)
+			return
+		}
+
+		visibility, err := battleVisibilityFromForm(r, BattlePublic)
+		if err != nil {
+			log.Println(err)
+			msg := "ERROR: Invalid visibility"
+			http.Redirect(w, r, fmt.Sprintf("/battle/new?res=%s", msg), http.StatusSeeOther)
+			return
+		}
+
+		var mixedarch bool
+		if r.Form.Get("mixed-arch") == "on" {
+			mixedarch = true
 		}
 
 		// gather the information from the arch and bit selection
@@ -735,12 +1233,18 @@ func battleNewHandler(w http.ResponseWriter, r *http.Request) {
 				name,
 				nil,
 				nil,
-				public,
+				visibility,
 				nil,
 				nil,
 				"",
 				maxrounds,
 				arenasize,
+				arenainit,
+				registers,
+				maxbotsize,
+				mixedarch,
+				false,
+				nil,
 			}
 			battleid, err := BattleCreate(newbattle, user)
 			if err != nil {
@@ -795,6 +1299,7 @@ func battleQuickHandler(w http.ResponseWriter, r *http.Request) {
 		// define data
 		data := map[string]interface{}{}
 		data["version"] = os.Getenv("VERSION")
+		data["csrfToken"] = csrfToken(r)
 
 		// breadcrumb foo
 		session, _ := globalState.sessions.Get(r, "session")
@@ -861,10 +1366,13 @@ func battleQuickHandler(w http.ResponseWriter, r *http.Request) {
 		// parse the post parameters
 		r.ParseForm()
 
-		var public bool
-		query_public := r.Form.Get("public")
-		if query_public == "on" {
-			public = true
+		// quick battles aren't listed, they're shared by sending the link around
+		visibility, err := battleVisibilityFromForm(r, BattleUnlisted)
+		if err != nil {
+			log.Println(err)
+			msg := "ERROR: Invalid visibility"
+			http.Redirect(w, r, fmt.Sprintf("/battle/quick?res=%s", msg), http.StatusSeeOther)
+			return
 		}
 
 		arenasize, err := strconv.Atoi(r.Form.Get("arena-size"))
@@ -876,6 +1384,10 @@ func battleQuickHandler(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, fmt.Sprintf("/battle/new?res=%s", msg), http.StatusSeeOther)
 			return
 		}
+		if err := battleCheckArena(arenasize, 0); err != nil {
+			log_and_redir_with_msg(w, r, err, "/battle/quick?res=%s", "ERROR: "+err.Error())
+			return
+		}
 		maxrounds, err := strconv.Atoi(r.Form.Get("max-rounds"))
 		if err != nil {
 			// TODO(emile): use the log_and_redir function in here (and the surrounding code)
@@ -909,12 +1421,18 @@ func battleQuickHandler(w http.ResponseWriter, r *http.Request) {
 			fmt.Sprintf("quick-%d", rand.Intn(10000)),
 			nil,
 			nil,
-			public,
+			visibility,
 			nil,
 			nil,
 			"",
 			maxrounds,
 			arenasize,
+			engine.ArenaInit{Mode: engine.ArenaZeros},
+			engine.RegisterInit{},
+			0,
+			false,
+			false,
+			nil,
 		}
 		battleid, err := BattleCreate(newbattle, user)
 		if err != nil {
@@ -973,6 +1491,7 @@ func battleSingleHandler(w http.ResponseWriter, r *http.Request) {
 		// define data
 		data := map[string]interface{}{}
 		data["version"] = os.Getenv("VERSION")
+		data["csrfToken"] = csrfToken(r)
 		data["pagelink1"] = Link{"battle", "/battle"}
 		data["pagelink1options"] = []Link{
 			{Name: "user", Target: "/user"},
@@ -985,42 +1504,70 @@ func battleSingleHandler(w http.ResponseWriter, r *http.Request) {
 			data["res"] = queryres
 		}
 
-		session, _ := globalState.sessions.Get(r, "session")
-		username := session.Values["username"]
-
-		if username == nil {
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
-			return
+		// public battles can be viewed without logging in, so the viewer might be anonymous
+		viewer := sessionUser(r)
+		if viewer.ID != 0 {
+			data["user"] = viewer
+		} else {
+			data["pagelinkauth"] = []Link{
+				{Name: "login", Target: "/login"},
+				{Name: "register", Target: "/register"},
+			}
 		}
 
-		viewer, err := UserGetUserFromUsername(username.(string))
+		// get the battle including it's users, bots, archs, bits
+		battle, err := BattleGetByIdDeep(int(battleid))
 		if err != nil {
-			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the id for your username")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 - Battle not found"))
 			return
 		}
-		data["user"] = viewer
+		data["battle"] = battle
+		data["botAmount"] = len(battle.Bots)
 
-		users, err := UserGetAll()
-		if err != nil {
-			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the users")
-			return
+		allowed := BattleCan(battle, viewer, BattleView)
+
+		// share links let everyone view the battle, logged in users may join it as participants
+		// using the form posting to /battle/{id}/join
+		if share := r.URL.Query().Get("share"); share != "" && !allowed {
+			if _, err := BattleShareLinkVerify(battle, share); err != nil {
+				log.Println(err)
+			} else {
+				allowed = true
+				data["shareToken"] = share
+			}
 		}
-		data["users"] = users
 
-		// get the battle including it's users, bots, archs, bits
-		battle, err := BattleGetByIdDeep(int(battleid))
-		if err != nil {
-			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the battle given the id provided")
+		// the battles the viewer isn't allowed to see don't exist as far as they know, anonymous
+		// visitors might be allowed to see them after logging in though
+		if !allowed {
+			if viewer.ID == 0 {
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 - Battle not found"))
 			return
 		}
-		data["battle"] = battle
-		data["botAmount"] = len(battle.Bots)
+
+		// the registered bots including their archs and bits, as they might differ in mixed arch
+		// battles
+		var registeredBots []Bot
+		for _, b := range battle.Bots {
+			bot, err := BotGetById(b.ID)
+			if err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Could not get the registered bots")
+				return
+			}
+			registeredBots = append(registeredBots, bot)
+		}
+		data["registeredBots"] = registeredBots
 		data["battleCount"] = (len(battle.Bots) * len(battle.Bots)) * 2
 
 		// define the breadcrumbs
 		data["pagelink2"] = Link{battle.Name, fmt.Sprintf("/%d", battle.ID)}
 
-		allbattleNames, err := BattleGetAll()
+		allbattleNames, err := BattleGetAllVisible(viewer)
 		var opts []Link
 		for _, battle := range allbattleNames {
 			opts = append(opts, Link{Name: battle.Name, Target: fmt.Sprintf("/%d", battle.ID)})
@@ -1028,15 +1575,33 @@ func battleSingleHandler(w http.ResponseWriter, r *http.Request) {
 		data["pagelink2options"] = opts
 
 		// get the bots of the user viewing the page, as they might want to submit them
-		myBots, err := UserGetBotsUsingUsername(username.(string))
+		myBots, err := UserGetBotsUsingUsername(viewer.Name)
 		if err != nil {
 			log_and_redir_with_msg(w, r, err, redir_target, "Could not get your bots")
 			return
 		}
+
+		// members of a team enter the bots of the team together
+		teamBots, err := TeamGetBotsForUser(viewer.ID)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the bots of your teams")
+			return
+		}
+		for _, bot := range teamBots {
+			mine := false
+			for _, b := range myBots {
+				if b.ID == bot.ID {
+					mine = true
+				}
+			}
+			if !mine {
+				myBots = append(myBots, bot)
+			}
+		}
 		data["myBots"] = myBots
 
-		// get all architectures and set the enable flag on the ones that are enabled in the battle
-		archs, err := ArchGetAll()
+		// get the architectures enabled by the admins, the ones of the battle are checked
+		archs, err := ArchGetAllEnabled()
 		if err != nil {
 			log_and_redir_with_msg(w, r, err, redir_target, "Could not get your bots")
 			return
@@ -1044,16 +1609,14 @@ func battleSingleHandler(w http.ResponseWriter, r *http.Request) {
 			data["archs"] = archs
 		}
 
-		for i, a := range archs {
-			for _, b := range battle.Archs {
-				if a.ID == b.ID {
-					archs[i].Enabled = true
-				}
-			}
+		selectedArchs := map[int]bool{}
+		for _, a := range battle.Archs {
+			selectedArchs[a.ID] = true
 		}
+		data["selectedArchs"] = selectedArchs
 
-		// get all bits and set the enable flag on the ones that are enabled in the battle
-		bits, err := BitGetAll()
+		// get the bits enabled by the admins, the ones of the battle are checked
+		bits, err := BitGetAllEnabled()
 		if err != nil {
 			log_and_redir_with_msg(w, r, err, redir_target, "Could not fetch the bits")
 			return
@@ -1061,23 +1624,83 @@ func battleSingleHandler(w http.ResponseWriter, r *http.Request) {
 			data["bits"] = bits
 		}
 
-		for i, a := range bits {
-			for _, b := range battle.Bits {
-				if a.ID == b.ID {
-					bits[i].Enabled = true
-				}
-			}
+		selectedBits := map[int]bool{}
+		for _, a := range battle.Bits {
+			selectedBits[a.ID] = true
 		}
+		data["selectedBits"] = selectedBits
+
+		// get the latest series run for the battle and how the bots did in there
+		run, err := RunGetLatestForBattle(battleid)
+		if err == nil {
+			data["seriesRun"] = run
 
-		// check if we're allowed to edit
-		editable := false
-		for _, owner := range battle.Owners {
-			if owner.ID == viewer.ID {
-				editable = true
+			stats, err := RunGetSeriesStats(run.ID)
+			if err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Could not fetch the series results")
+				return
 			}
+			data["seriesStats"] = stats
+		}
+
+		// the teams that entered bots and how they did in the latest series
+		standings, err := TeamGetStandings(battleid)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not fetch the team standings")
+			return
 		}
-		if editable == true {
+		data["teamStandings"] = standings
+
+		// the parts of the page shown depend on the role of the viewer in the battle
+		data["role"] = battle.Role(viewer.ID)
+		data["canSubmit"] = BattleCan(battle, viewer, BattleSubmit)
+
+		if BattleCan(battle, viewer, BattleReferee) {
+			data["referee"] = true
+		}
+
+		disqualifications, err := BattleGetDisqualifications(battleid)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not fetch the disqualified bots")
+			return
+		}
+		data["disqualifications"] = disqualifications
+
+		if BattleCan(battle, viewer, BattleEdit) {
 			data["editable"] = true
+
+			users, err := UserGetAll()
+			if err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Could not get the users")
+				return
+			}
+			data["users"] = users
+
+			shareLinks, err := BattleShareLinkGetAll(battleid)
+			if err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Could not fetch the share links")
+				return
+			}
+			data["shareLinks"] = shareLinks
+			data["shareLinkMaxDays"] = shareLinkMaxDays
+
+			// the webhooks and their deliveries are only shown to the owners, as they contain
+			// the secrets used to sign the payloads
+			webhooks, err := WebhookGetAllForBattle(battleid)
+			if err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Could not fetch the webhooks")
+				return
+			}
+			data["webhooks"] = webhooks
+
+			deliveries, err := WebhookGetDeliveriesForBattle(battleid)
+			if err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Could not fetch the webhook deliveries")
+				return
+			}
+			data["webhookDeliveries"] = deliveries
+			data["webhookEvents"] = webhookEvents
+			data["webhookBase"] = fmt.Sprintf("/battle/%d/webhook", battleid)
 		}
 
 		// get the template
@@ -1161,9 +1784,27 @@ func battleSingleHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		var public bool
-		if r.Form.Get("public") == "on" {
-			public = true
+		arenainit, err := engine.ArenaInitParse(r.Form.Get("arena-fill"), r.Form.Get("arena-fill-value"))
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target+"#settings", "Invalid arena fill")
+			return
+		}
+
+		registers, err := battleRegisterInitFromForm(r)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target+"#settings", "Invalid register init")
+			return
+		}
+
+		maxbotsize, err := battleMaxBotSizeFromForm(r)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target+"#settings", "Invalid max bot size")
+			return
+		}
+
+		var mixedarch bool
+		if r.Form.Get("mixed-arch") == "on" {
+			mixedarch = true
 		}
 
 		// gather the information from the arch and bit selection
@@ -1200,15 +1841,30 @@ func battleSingleHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		// CHECK THAT THE USER REQUESTING CHANGES IS ALREADY PART OF THE OWNERS
-		allowedToEdit := false
-		for _, ownerID := range ownerIDs {
-			if user.ID == ownerID {
-				allowedToEdit = true
-			}
+		// only the current owners may change the settings, including who the owners are
+		orig_battle, err := BattleGetByIdDeep(battleid)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target+"#settings", "Could not get the battle given the id provided")
+			return
 		}
-		if allowedToEdit == false {
-			log_and_redir_with_msg(w, r, err, redir_target+"#settings", "You aren't an owner and aren't allowed to edit the settings")
+		if !BattleCan(orig_battle, user, BattleEdit) {
+			log_and_redir_with_msg(w, r, nil, redir_target+"#settings", "You aren't an owner and aren't allowed to edit the settings")
+			return
+		}
+		if len(ownerIDs) == 0 {
+			log_and_redir_with_msg(w, r, nil, redir_target+"#settings", "A battle needs at least one owner")
+			return
+		}
+
+		if err := battleCheckArena(arenasize, len(orig_battle.Bots)); err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target+"#settings", err.Error())
+			return
+		}
+
+		// a form without a visibility keeps the one the battle has
+		visibility, err := battleVisibilityFromForm(r, orig_battle.Visibility)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target+"#settings", "Invalid visibility")
 			return
 		}
 
@@ -1235,7 +1891,7 @@ func battleSingleHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		new_battle := Battle{int(battleid), form_name, []Bot{}, []User{user}, public, []Arch{}, []Bit{}, "", 100, arenasize}
+		new_battle := Battle{int(battleid), form_name, []Bot{}, []User{user}, visibility, []Arch{}, []Bit{}, "", 100, arenasize, arenainit, registers, maxbotsize, mixedarch, false, nil}
 
 		log.Println("Updating battle...")
 		err = BattleUpdate(new_battle)
@@ -1305,54 +1961,11 @@ func battleSubmitHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// clear all bots from that user for that battle before readding them here
-		BattleUnlinkAllBotsForUser(user.ID, battleid)
-
-		// for all bots, get their bits and arch and compare them to the one of the battle
-		for _, id := range botIDs {
-			bot, err := BotGetById(id)
-			if err != nil {
-				msg := fmt.Sprintf("ERROR: Couldn't get bot with id %d", id)
-				http.Redirect(w, r, fmt.Sprintf("/battle/%d?res=%s", battleid, msg), http.StatusSeeOther)
-				return
-			}
-
-			var archValid bool = false
-			for _, battle_arch := range battle.Archs {
-				for _, bot_arch := range bot.Archs {
-					if battle_arch.ID == bot_arch.ID {
-						archValid = true
-					}
-				}
-			}
-
-			var bitValid bool = false
-			for _, battle_bit := range battle.Bits {
-				for _, bot_bit := range bot.Bits {
-					if battle_bit.ID == bot_bit.ID {
-						bitValid = true
-					}
-				}
-			}
-
-			if archValid && bitValid {
-				log.Printf("arch and bit valid, adding bot with id %d to battle with id %d\n", id, battleid)
-				BattleLinkBot(id, battleid)
-			} else {
-				if archValid == false {
-					msg := "Bot has an invalid architecture!"
-					http.Redirect(w, r, fmt.Sprintf("/battle/%d?res=%s", battleid, msg), http.StatusSeeOther)
-					return
-				}
-				if bitValid == false {
-					msg := "Bot has an invalid 'bit-ness'!"
-					http.Redirect(w, r, fmt.Sprintf("/battle/%d?res=%s", battleid, msg), http.StatusSeeOther)
-					return
-				}
-			}
-
-			log.Println(bot)
+		if err := BattleSubmitBots(battle, user, botIDs); err != nil {
+			http.Redirect(w, r, fmt.Sprintf("/battle/%d?res=%s", battleid, err.Error()), http.StatusSeeOther)
+			return
 		}
+
 		msg := "Success!"
 		http.Redirect(w, r, fmt.Sprintf("/battle/%d?res=%s", battleid, msg), http.StatusSeeOther)
 	default:
@@ -1394,223 +2007,23 @@ func battleRunHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Fetch the battle information
-		// This includes all bots linked to the battle
-		log.Printf("user %+v wants to run the battle", user)
-		fullDeepBattle, err := BattleGetByIdDeep(battleid)
-
-		// open radare without input for building the bot
-		// TODO(emile): configure a variable memsize for the arena
-		cmd := fmt.Sprintf("malloc://%d", fullDeepBattle.ArenaSize)
-		r2p1, err := r2pipe.NewPipe(cmd)
-		if err != nil {
-			panic(err)
-		}
-		defer r2p1.Close()
-
-		var botSources []string
-		var rawOutput string
-
-		cmd = fmt.Sprintf("pxc %d @ 0x0", fullDeepBattle.ArenaSize)
-		output, _ := r2cmd(r2p1, cmd)
-		rawOutput += fmt.Sprintf("[0x00000000]> %s\n%s\n", cmd, output)
-
-		// TODO(emile): currently hardcoded to two bots, extract this anonymous struct into a named struct and make this work with > 2 bots
-		runtimeBots := []struct {
-			Name     string
-			Regs     string
-			BaseAddr int
-			ArchName string
-			BitsName string
-		}{
-			{Name: "", Regs: "", BaseAddr: 0, ArchName: "", BitsName: ""},
-			{Name: "", Regs: "", BaseAddr: 0, ArchName: "", BitsName: ""},
+		battle, err := BattleGetByIdDeep(battleid)
+		if err != nil || !BattleCan(battle, user, BattleView) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 - Battle not found"))
+			return
 		}
-
-		rawOutput += "[0x00000000]> # Assembling the bots\n"
-
-		// for each bot involved within the battle, we need to fetch it again, as the deep battle
-		// fech doesn't fetch that deep (it fetches the batle and the corresponding bots, but only
-		// their ids and names and not the archs and bits associated)
-		for i, b := range fullDeepBattle.Bots {
-			bot, err := BotGetById(b.ID)
-			if err != nil {
-				log.Println(err)
-			}
-
-			runtimeBots[i].Name = bot.Name
-
-			// TODO(emile): a bot can have multiple archs/bits, figure out what to do then
-			// I've just gone and used the first one, as a bot alwas has at least one...
-			// ...it has right?
-			runtimeBots[i].ArchName = bot.Archs[0].Name
-			runtimeBots[i].BitsName = bot.Bits[0].Name
-
-			// define the command used to assemble the bot
-			src := strings.ReplaceAll(bot.Source, "\r\n", "; ")
-			radareCommand := fmt.Sprintf("rasm2 -a %s -b %s \"%+v\"", bot.Archs[0].Name, bot.Bits[0].Name, src)
-			rawOutput += fmt.Sprintf("; %s\n", radareCommand)
-
-			// assemble the bot
-			bytecode, err := r2cmd(r2p1, radareCommand)
-			if err != nil {
-				http.Redirect(w, r, fmt.Sprintf("/battle/%d?res=%s", battleid, "err building bot"), http.StatusSeeOther)
-				return
-			}
-
-			botSources = append(botSources, bytecode)
+		if !BattleCan(battle, user, BattleReferee) {
+			log_and_redir_with_msg(w, r, nil, redir_target, "Only the referees of the battle can run it")
+			return
 		}
 
-		// TODO(emile): [L] implement some kind of queue
-
-		rawOutput += "[0x00000000]> # initializing the vm and the stack\n"
-		cmd = "aei"
-		output, _ = r2cmd(r2p1, cmd)
-		rawOutput += fmt.Sprintf("[0x00000000]> %s\n%s", cmd, output)
-
-		cmd = "aeim"
-		output, _ = r2cmd(r2p1, cmd)
-		rawOutput += fmt.Sprintf("[0x00000000]> %s\n%s", cmd, output)
-
-		// TODO(emile): random offsets
-		// place bots
-		for i, s := range botSources {
-
-			// the address to write the bot to
-			addr := 50 * (i + 1)
-
-			// store it
-			runtimeBots[i].BaseAddr = addr
-
-			msg := fmt.Sprintf("# writing bot %d to 0x%d", i, addr)
-			rawOutput += fmt.Sprintf("[0x00000000]> %s\n", msg)
-			cmd := fmt.Sprintf("wx %s @ 0x%d", s, addr)
-			_, _ = r2cmd(r2p1, cmd)
-			rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
-
-			// define the instruction point and the stack pointer
-			rawOutput += "[0x00000000]> # Setting the program counter and the stack pointer\n"
-			cmd = fmt.Sprintf("aer PC=0x%d", addr)
-			_, _ = r2cmd(r2p1, cmd)
-			rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
-
-			cmd = fmt.Sprintf("aer SP=SP+0x%d", addr)
-			_, _ = r2cmd(r2p1, cmd)
-			rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
-
-			// dump the registers of the bot for being able to switch inbetween them
-			// This is done in order to be able to play one step of each bot at a time,
-			// but sort of in parallel
-			rawOutput += "[0x00000000]> # Storing registers\n"
-			cmd = "aerR"
-			regs, _ := r2cmd(r2p1, cmd)
-			rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
-
-			initialRegisers := strings.Replace(regs, "\n", ";", -1)
-			runtimeBots[i].Regs = initialRegisers
-		}
-
-		for i := range botSources {
-			// print the memory for some pleasing visuals
-			cmd = fmt.Sprintf("pxc 100 @ 0x%d", runtimeBots[i].BaseAddr)
-			output, _ = r2cmd(r2p1, cmd) // print
-			rawOutput += fmt.Sprintf("[0x00000000]> %s\n%s\n", cmd, output)
-		}
-
-		output, _ = r2cmd(r2p1, "pxc 100 @ 0x50") // print
-		fmt.Println(output)
-
-		// define end conditions
-		rawOutput += "[0x00000000]> # Defining the end conditions\n"
-		cmd = "e cmd.esil.todo=t theend=1"
-		_, _ = r2cmd(r2p1, cmd)
-		rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
-		cmd = "e cmd.esil.trap=t theend=1"
-		_, _ = r2cmd(r2p1, cmd)
-		rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
-		cmd = "e cmd.esil.intr=t theend=1"
-		_, _ = r2cmd(r2p1, cmd)
-		rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
-		cmd = "e cmd.esil.ioer=t theend=1"
-		_, _ = r2cmd(r2p1, cmd)
-		rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
-
-		// set the end condition to 0 initially
-		rawOutput += "[0x00000000]> # Initializing the end condition variable\n"
-		cmd = "f theend=0"
-		_, _ = r2cmd(r2p1, cmd)
-		rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
-
-		currentBotId := 0
-
-		// TODO(emile): find a sensible default for the max amount of rounds
-		for i := 0; i < fullDeepBattle.MaxRounds; i++ {
-
-			currentBotId = i % 2
-
-			rawOutput += fmt.Sprintf("[0x00000000]> ########################################################################\n")
-
-			rawOutput += "[0x00000000]> # Loading the registers\n"
-			r2cmd(r2p1, runtimeBots[currentBotId].Regs)
-
-			// this is architecture agnostic and just gets the program counter
-			pc, _ := r2cmd(r2p1, "aer~$(arn PC)~[1]")
-
-			arch, _ := r2cmd(r2p1, "e asm.arch")
-			bits, _ := r2cmd(r2p1, "e asm.bits")
-			rawOutput += fmt.Sprintf("[0x00000000]> # ROUND %d, BOT %d (%s), PC=%s, arch=%s, bits=%s\n", i, currentBotId, runtimeBots[currentBotId].Name, pc, arch, bits)
-
-			rawOutput += "[0x00000000]> # setting the architecture accordingly\n"
-			cmd = fmt.Sprintf("e asm.arch=%s", runtimeBots[currentBotId].ArchName)
-			output, _ = r2cmd(r2p1, cmd)
-			rawOutput += fmt.Sprintf("[0x00000000]> %s\n%s", cmd, output)
-
-			cmd = fmt.Sprintf("e asm.bits=%s", runtimeBots[currentBotId].BitsName)
-			output, _ = r2cmd(r2p1, cmd)
-			rawOutput += fmt.Sprintf("[0x00000000]> %s\n%s", cmd, output)
-
-			// load registers
-			//  rawOutput += fmt.Sprintf("%+v\n", runtimeBots[currentBotId].Regs)
-
-			//  cmd = "dr"
-			//  output, _ = r2cmd(r2p1, cmd)
-			//  rawOutput += fmt.Sprintf("[0x00000000]> %s\n%s\n", cmd, output)
-
-			//  _, _ = r2cmd(r2p1, "aes") // step
-			rawOutput += "[0x00000000]> # Stepping\n"
-			cmd = "aes"
-			_, _ = r2cmd(r2p1, cmd)
-			rawOutput += fmt.Sprintf("[0x00000000]> %s\n", cmd)
-
-			// store the regisers
-			rawOutput += "[0x00000000]> # Storing the registers\n"
-			registers, _ := r2cmd(r2p1, "aerR")
-			registersStripped := strings.Replace(registers, "\n", ";", -1)
-			runtimeBots[currentBotId].Regs = registersStripped
-
-			// print the arena
-			rawOutput += "[0x00000000]> # Printing the arena\n"
-			cmd := fmt.Sprintf("pxc 100 @ 0x%d", runtimeBots[currentBotId].BaseAddr)
-			output, _ := r2cmd(r2p1, cmd) // print
-			rawOutput += fmt.Sprintf("[0x00000000]> %s\n%s\n", cmd, output)
-			//  fmt.Println(output)
-
-			// predicate - the end?
-			rawOutput += "[0x00000000]> # Checking if we've won\n"
-			pend, _ := r2cmd(r2p1, "?v theend")
-			status := strings.TrimSpace(pend)
-			// fixme: on Windows, we sometimes get output *from other calls to r2*
-
-			if status == "0x1" {
-				log.Printf("[!] Bot %d has died", currentBotId)
-			}
-			if status != "0x0" {
-				log.Printf("[!] Got invalid status '%s' for bot %d", status, currentBotId)
-			}
+		log.Printf("user %+v wants to run the battle", user)
+		if _, _, err := BattleRunOnce(battleid); err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "err running the battle")
+			return
 		}
 
-		BattleSaveRawOutput(battleid, rawOutput)
-
 		msg := "Success!"
 		http.Redirect(w, r, fmt.Sprintf("/battle/%d?res=%s#output", battleid, msg), http.StatusSeeOther)
 	default:
@@ -1618,8 +2031,8 @@ func battleRunHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// delete a battle
-// TODO(emile): finish implementing the deletion of battles
+// delete a battle, the bots stay around, everything else belonging to the battle (links, runs,
+// share links, webhooks) is deleted along with it by the foreign keys
 func battleDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	battleid, err := strconv.Atoi(vars["id"])
@@ -1655,28 +2068,19 @@ func battleDeleteHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		battle_owned_by_requesting_user := false
-		for _, owner := range battle.Owners {
-
-			// if the requesting users id is equal to an owners id, we're allowed to delete
-			// the battle
-			if viewer.ID == owner.ID {
-				battle_owned_by_requesting_user = true
-				break
-			}
-		}
-
-		// check that the user that created the battle is the current user, if not, return
-		if battle_owned_by_requesting_user == false {
+		// only the owners are allowed to delete the battle
+		if !BattleCan(battle, viewer, BattleEdit) {
 			msg := "You aren't in the owners list of the battle, so you can't delete this battle"
 			log_and_redir_with_msg(w, r, err, redir_target, msg)
 			return
 		}
 
-		BattleDeleteID(battleid)
+		if err := BattleDeleteID(battleid); err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not delete the battle")
+			return
+		}
 
-		msg := "Successfully deleted the battle"
-		http.Redirect(w, r, fmt.Sprintf("/battle/%d?res=%s", battleid, msg), http.StatusSeeOther)
+		http.Redirect(w, r, "/battle?res=Successfully deleted the battle", http.StatusSeeOther)
 	default:
 		log.Println("expected POST, got ", r.Method)
 		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
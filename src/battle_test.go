@@ -0,0 +1,233 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"git.emile.space/r2wars-web/engine"
+	"github.com/gorilla/mux"
+)
+
+func TestBattleCan(t *testing.T) {
+	users := map[string]User{
+		"owner":       {ID: 1, Name: "owner"},
+		"referee":     {ID: 2, Name: "referee"},
+		"participant": {ID: 3, Name: "participant"},
+		"stranger":    {ID: 4, Name: "stranger"},
+		"admin":       {ID: 5, Name: "admin", Role: RoleAdmin},
+		"anonymous":   {},
+	}
+	perms := []BattlePermission{BattleView, BattleSubmit, BattleReferee, BattleEdit}
+
+	// want lists the permissions granted, one letter each: view, submit, referee and edit
+	tests := []struct {
+		visibility string
+		hidden     bool
+		user       string
+		want       string
+	}{
+		{BattlePublic, false, "owner", "vsre"},
+		{BattlePublic, false, "referee", "v-r-"},
+		{BattlePublic, false, "participant", "vs--"},
+		{BattlePublic, false, "stranger", "vs--"},
+		{BattlePublic, false, "admin", "vs--"},
+		{BattlePublic, false, "anonymous", "v---"},
+
+		{BattleUnlisted, false, "owner", "vsre"},
+		{BattleUnlisted, false, "referee", "v-r-"},
+		{BattleUnlisted, false, "participant", "vs--"},
+		{BattleUnlisted, false, "stranger", "----"},
+		{BattleUnlisted, false, "admin", "v---"},
+		{BattleUnlisted, false, "anonymous", "----"},
+
+		{BattlePrivate, false, "owner", "vsre"},
+		{BattlePrivate, false, "referee", "v-r-"},
+		{BattlePrivate, false, "participant", "vs--"},
+		{BattlePrivate, false, "stranger", "----"},
+		{BattlePrivate, false, "admin", "v---"},
+		{BattlePrivate, false, "anonymous", "----"},
+
+		// hidden battles are only visible to the admins and the owners, who keep every permission
+		{BattlePublic, true, "owner", "vsre"},
+		{BattlePublic, true, "referee", "----"},
+		{BattlePublic, true, "participant", "----"},
+		{BattlePublic, true, "stranger", "----"},
+		{BattlePublic, true, "admin", "vs--"},
+		{BattlePublic, true, "anonymous", "----"},
+
+		{BattlePrivate, true, "owner", "vsre"},
+		{BattlePrivate, true, "referee", "----"},
+		{BattlePrivate, true, "admin", "v---"},
+	}
+
+	for _, tt := range tests {
+		battle := Battle{
+			ID:         1,
+			Owners:     []User{users["owner"]},
+			Visibility: tt.visibility,
+			Hidden:     tt.hidden,
+			Members: []BattleMember{
+				{UserID: users["referee"].ID, Name: "referee", Role: BattleRoleReferee},
+				{UserID: users["participant"].ID, Name: "participant", Role: BattleRoleParticipant},
+			},
+		}
+
+		got := ""
+		for i, perm := range perms {
+			if BattleCan(battle, users[tt.user], perm) {
+				got += string("vsre"[i])
+			} else {
+				got += "-"
+			}
+		}
+		if got != tt.want {
+			t.Errorf("%s (hidden %t) %s: got %s, want %s", tt.visibility, tt.hidden, tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestBattleSettingsKeepVisibility(t *testing.T) {
+	testState(t)
+
+	if _, err := UserRegister("alice", []byte("hash")); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := UserGetUserFromUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	battleid, err := BattleCreate(Battle{Name: "battle", Visibility: BattlePrivate}, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// log alice in
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	session, _ := globalState.sessions.Get(r, "session")
+	session.Values["username"] = "alice"
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+
+	// the settings form, without a visibility
+	form := url.Values{
+		"name":                            {"renamed"},
+		"arena-size":                      {"1024"},
+		"arena-fill":                      {"zeros"},
+		"arch-2":                          {"on"},
+		"bit-2":                           {"on"},
+		"owner-" + strconv.Itoa(alice.ID): {"on"},
+	}
+	r = httptest.NewRequest("POST", "/battle/"+strconv.Itoa(battleid), strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	r = mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(battleid)})
+	w = httptest.NewRecorder()
+	battleSingleHandler(w, r)
+	if loc := w.Header().Get("Location"); !strings.Contains(loc, "Success") {
+		t.Fatalf("updating the battle: %d %s", w.Code, loc)
+	}
+
+	battle, err := BattleGetByIdDeep(battleid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if battle.Name != "renamed" || battle.Visibility != BattlePrivate {
+		t.Errorf("after updating: %q is %s, want it to stay %s", battle.Name, battle.Visibility, BattlePrivate)
+	}
+}
+
+func TestBattleCheckArena(t *testing.T) {
+	tests := []struct {
+		arenaSize int
+		bots      int
+		ok        bool
+	}{
+		{4096, 0, true},
+		{0xa1, 0, true},
+		{0xa0, 0, false},
+		{0xa1, 2, true},
+		{0xa1, 3, false},
+		{0xf1, 3, true},
+		{0, 0, false},
+		{-1, 0, false},
+	}
+	for _, tt := range tests {
+		if err := battleCheckArena(tt.arenaSize, tt.bots); (err == nil) != tt.ok {
+			t.Errorf("battleCheckArena(%d, %d): %v", tt.arenaSize, tt.bots, err)
+		}
+	}
+}
+
+func TestBattleGetAllVisibleHidden(t *testing.T) {
+	testState(t)
+
+	var users []User
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := UserRegister(name, []byte("hash")); err != nil {
+			t.Fatal(err)
+		}
+		user, err := UserGetUserFromUsername(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+	alice, bob := users[0], users[1]
+
+	battleid, err := BattleCreate(Battle{Name: "battle", Visibility: BattlePublic}, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := BattleAddMember(battleid, bob.ID, BattleRoleParticipant); err != nil {
+		t.Fatal(err)
+	}
+	if err := BattleSetHidden(battleid, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// the owner still sees the hidden battle, the members and everybody else don't
+	for _, tt := range []struct {
+		user User
+		want int
+	}{{alice, 1}, {bob, 0}, {User{}, 0}} {
+		battles, err := BattleGetAllVisible(tt.user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(battles) != tt.want {
+			t.Errorf("%q sees %d battles, want %d", tt.user.Name, len(battles), tt.want)
+		}
+	}
+}
+
+func TestBattleArenaInitStored(t *testing.T) {
+	testState(t)
+	alice := testUser(t, "alice")
+
+	for _, arena := range []engine.ArenaInit{
+		{Mode: engine.ArenaZeros},
+		{Mode: engine.ArenaByte, Value: "cc"},
+		{Mode: engine.ArenaPattern, Value: "deadbeef"},
+		{Mode: engine.ArenaRandom},
+		{Mode: engine.ArenaRandom, Value: "42"},
+	} {
+		battleid, err := BattleCreate(Battle{Name: "battle", Visibility: BattlePublic, ArenaSize: 1024, ArenaInit: arena}, alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		battle, err := BattleGetByIdDeep(battleid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if battle.ArenaInit != arena {
+			t.Errorf("stored %+v, got %+v back", arena, battle.ArenaInit)
+		}
+	}
+}
@@ -14,11 +14,35 @@ func BitGetAll() ([]Bit, error) {
 	return globalState.GetAllBits()
 }
 
+// BitGetAllEnabled returns the bits that may be selected for bots and battles
+func BitGetAllEnabled() ([]Bit, error) {
+	all, err := BitGetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var enabled []Bit
+	for _, bit := range all {
+		if bit.Enabled {
+			enabled = append(enabled, bit)
+		}
+	}
+	return enabled, nil
+}
+
+func BitIsEnabled(id int) (bool, error) {
+	return globalState.IsBitEnabled(id)
+}
+
+func BitSetEnabled(id int, enabled bool) error {
+	return globalState.UpdateBitEnabled(id, enabled)
+}
+
 //////////////////////////////////////////////////////////////////////////////
 // DATABASE
 
 func (s *State) GetAllBits() ([]Bit, error) {
-	rows, err := s.db.Query("SELECT id, name FROM bits")
+	rows, err := s.db.Query("SELECT id, name, enabled FROM bits")
 	defer rows.Close()
 	if err != nil {
 		return nil, err
@@ -27,7 +51,7 @@ func (s *State) GetAllBits() ([]Bit, error) {
 	var bit []Bit
 	for rows.Next() {
 		var arch Bit
-		if err := rows.Scan(&arch.ID, &arch.Name); err != nil {
+		if err := rows.Scan(&arch.ID, &arch.Name, &arch.Enabled); err != nil {
 			return bit, err
 		}
 		bit = append(bit, arch)
@@ -38,5 +62,23 @@ func (s *State) GetAllBits() ([]Bit, error) {
 	return bit, nil
 }
 
+// returns false if the bit has been disabled and an error if it doesn't exist
+func (s *State) IsBitEnabled(id int) (bool, error) {
+	var enabled bool
+	err := s.db.QueryRow("SELECT enabled FROM bits WHERE id=?", id).Scan(&enabled)
+	if err != nil {
+		return false, err
+	}
+	return enabled, nil
+}
+
+func (s *State) UpdateBitEnabled(id int, enabled bool) error {
+	_, err := s.db.Exec("UPDATE bits SET enabled=? WHERE id=?", enabled, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 //////////////////////////////////////////////////////////////////////////////
 // HTTP
@@ -10,8 +10,8 @@ import (
 	"strings"
 	"time"
 
+	"git.emile.space/r2wars-web/engine"
 	"github.com/gorilla/mux"
-	"github.com/radareorg/r2pipe-go"
 )
 
 type Bot struct {
@@ -22,6 +22,9 @@ type Bot struct {
 
 	Archs []Arch
 	Bits  []Bit
+
+	// Hidden bots are only visible to admins
+	Hidden bool
 }
 
 //////////////////////////////////////////////////////////////////////////////
@@ -43,6 +46,14 @@ func BotGetAll() ([]Bot, error) {
 	return globalState.GetAllBot()
 }
 
+func BotSetHidden(botid int, hidden bool) error {
+	return globalState.UpdateBotHidden(botid, hidden)
+}
+
+func BotDeleteID(botid int) error {
+	return globalState.DeleteBotByID(botid)
+}
+
 func BotLinkArchIDs(botid int, archIDs []int) error {
 	return globalState.LinkArchIDsToBot(botid, archIDs)
 }
@@ -51,11 +62,41 @@ func BotLinkBitIDs(botid int, bitIDs []int) error {
 	return globalState.LinkBitIDsToBot(botid, bitIDs)
 }
 
+// BotFighter converts the (deep) bot into what the engine needs to run it
+// TODO(emile): a bot can have multiple archs/bits, figure out what to do then
+// I've just gone and used the first one, as a bot alwas has at least one...
+// ...it has right?
+func BotFighter(bot Bot) engine.Fighter {
+	fighter := engine.Fighter{Name: bot.Name, Source: bot.Source}
+	if len(bot.Archs) > 0 {
+		fighter.ArchName = bot.Archs[0].Name
+	}
+	if len(bot.Bits) > 0 {
+		fighter.BitsName = bot.Bits[0].Name
+	}
+	return fighter
+}
+
+// HasOwner returns true if the user with the given id is one of the owners of the bot, either
+// directly or as a member of a team owning the bot
+func (b Bot) HasOwner(userid int) bool {
+	for _, user := range b.Users {
+		if user.ID == userid {
+			return true
+		}
+	}
+	member, err := TeamIsBotMember(b.ID, userid)
+	if err != nil {
+		log.Println(err)
+	}
+	return member
+}
+
 //////////////////////////////////////////////////////////////////////////////
 // DATABASE
 
 func (s *State) InsertBot(bot Bot) (int, error) {
-	res, err := s.db.Exec("INSERT INTO bots VALUES(NULL,?,?,?);", time.Now(), bot.Name, bot.Source)
+	res, err := s.db.Exec("INSERT INTO bots (created_at, name, source, hidden) VALUES(?,?,?,?);", time.Now(), bot.Name, bot.Source, false)
 	if err != nil {
 		return 0, err
 	}
@@ -75,10 +116,33 @@ func (s *State) UpdateBot(bot Bot) error {
 	return nil
 }
 
+func (s *State) UpdateBotHidden(botid int, hidden bool) error {
+	_, err := s.db.Exec("UPDATE bots SET hidden=? WHERE id=?", hidden, botid)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// This deletes a bot along with its links to users, teams, battles, architectures and bits (the
+// foreign keys cascade the delete within the single statement)
+func (s *State) DeleteBotByID(botid int) error {
+	res, err := s.db.Exec("DELETE FROM bots WHERE id = ?", botid)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("no bot with the id %d", botid)
+	}
+	return nil
+}
+
 func (s *State) GetBotById(id int) (Bot, error) {
 	var botid int
 	var botname string
 	var botsource string
+	var bothidden bool
 
 	var ownerids string
 	var ownernames string
@@ -91,7 +155,7 @@ func (s *State) GetBotById(id int) (Bot, error) {
 
 	err := s.db.QueryRow(`
 	SELECT
-		bo.id, bo.name, bo.source,
+		bo.id, bo.name, bo.source, bo.hidden,
 		COALESCE(group_concat(ub.user_id), ""),
 		COALESCE(group_concat(us.name), ""),
 		COALESCE(group_concat(ab.arch_id), ""),
@@ -111,7 +175,7 @@ func (s *State) GetBotById(id int) (Bot, error) {
 
 	WHERE bo.id=?
 	GROUP BY bo.id;
-	`, id).Scan(&botid, &botname, &botsource,
+	`, id).Scan(&botid, &botname, &botsource, &bothidden,
 		&ownerids, &ownernames,
 		&archids, &archnames,
 		&bitids, &bitnames)
@@ -123,14 +187,17 @@ func (s *State) GetBotById(id int) (Bot, error) {
 	ownerIDList := strings.Split(ownerids, ",")
 	ownerNameList := strings.Split(ownernames, ",")
 
+	// bots owned by a team only have no users
 	var users []User
-	for i, _ := range ownerIDList {
-		id, err := strconv.Atoi(ownerIDList[i])
-		if err != nil {
-			log.Println("ERR1: ", err)
-			return Bot{}, err
+	if ownerIDList[0] != "" {
+		for i, _ := range ownerIDList {
+			id, err := strconv.Atoi(ownerIDList[i])
+			if err != nil {
+				log.Println("ERR1: ", err)
+				return Bot{}, err
+			}
+			users = append(users, User{ID: id, Name: ownerNameList[i], PasswordHash: nil})
 		}
-		users = append(users, User{ID: id, Name: ownerNameList[i], PasswordHash: nil})
 	}
 
 	// assemble the archs
@@ -175,7 +242,7 @@ func (s *State) GetBotById(id int) (Bot, error) {
 		return Bot{}, err
 	default:
 		//  log.Printf("returning bot with archs %+v and bits %+v", archs, bits)
-		return Bot{botid, botname, botsource, users, archs, bits}, nil
+		return Bot{botid, botname, botsource, users, archs, bits, bothidden}, nil
 	}
 }
 
@@ -221,7 +288,7 @@ func (s *State) GetBotUsers(botid int) ([]User, error) {
 
 // Returns the users belonging to the given bot
 func (s *State) GetAllBot() ([]Bot, error) {
-	rows, err := s.db.Query("SELECT id, name FROM bots;")
+	rows, err := s.db.Query("SELECT id, name FROM bots WHERE NOT hidden;")
 	defer rows.Close()
 	if err != nil {
 		return nil, err
@@ -244,10 +311,11 @@ func (s *State) GetAllBot() ([]Bot, error) {
 // Returns the users belonging to the given bot
 func (s *State) GetAllBotsWithUsers() ([]Bot, error) {
 	rows, err := s.db.Query(`SELECT
-		b.id, b.name, b.source, group_concat(ub.user_id), group_concat(u.name)
+		b.id, b.name, b.source, COALESCE(group_concat(ub.user_id), ""), COALESCE(group_concat(u.name), "")
 	FROM bots b
 	LEFT JOIN user_bot_rel ub ON ub.bot_id = b.id
 	LEFT JOIN users u ON ub.user_id = u.id
+	WHERE NOT b.hidden
 	GROUP BY b.id;`)
 	defer rows.Close()
 	if err != nil {
@@ -268,13 +336,16 @@ func (s *State) GetAllBotsWithUsers() ([]Bot, error) {
 		userIDList := strings.Split(userIDListString, ",")
 		usernameList := strings.Split(usernameListString, ",")
 
+		// bots owned by a team only have no users
 		var users []User
-		for i, _ := range userIDList {
-			id, err := strconv.Atoi(userIDList[i])
-			if err != nil {
-				return nil, err
+		if userIDList[0] != "" {
+			for i, _ := range userIDList {
+				id, err := strconv.Atoi(userIDList[i])
+				if err != nil {
+					return nil, err
+				}
+				users = append(users, User{ID: id, Name: usernameList[i], PasswordHash: nil})
 			}
-			users = append(users, User{ID: id, Name: usernameList[i], PasswordHash: nil})
 		}
 		bot.Users = users
 
@@ -353,6 +424,7 @@ func botsHandler(w http.ResponseWriter, r *http.Request) {
 		// define data
 		data := map[string]interface{}{}
 		data["version"] = os.Getenv("VERSION")
+		data["csrfToken"] = csrfToken(r)
 
 		session, _ := globalState.sessions.Get(r, "session")
 		username := session.Values["username"]
@@ -360,6 +432,7 @@ func botsHandler(w http.ResponseWriter, r *http.Request) {
 		data["pagelink1options"] = []Link{
 			{Name: "user", Target: "/user"},
 			{Name: "battle", Target: "/battle"},
+			{Name: "team", Target: "/team"},
 		}
 		data["pagelinknext"] = []Link{
 			{Name: "new", Target: "/new"},
@@ -411,6 +484,7 @@ func botSingleHandler(w http.ResponseWriter, r *http.Request) {
 		// define data
 		data := map[string]interface{}{}
 		data["version"] = os.Getenv("VERSION")
+		data["csrfToken"] = csrfToken(r)
 		data["pagelink1"] = Link{"bot", "/bot"}
 		data["pagelink1options"] = []Link{
 			{Name: "user", Target: "/user"},
@@ -438,38 +512,25 @@ func botSingleHandler(w http.ResponseWriter, r *http.Request) {
 		data["bot"] = bot
 		data["user"] = viewer
 
-		// open radare without input for building the bot
-		r2p1, err := r2pipe.NewPipe("--")
-		if err != nil {
-			panic(err)
+		// hidden bots are only visible to admins
+		if bot.Hidden && !viewer.IsAdmin() {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("404 - Bot not found"))
+			return
 		}
-		defer r2p1.Close()
 
 		// TODO(emile): improve the archs and bit handling here. I'll use the first one for now,
 		// but it would be nice to loop over all of them (would be a matrix with archs and bits
 		// on the axes)
-		src := strings.ReplaceAll(bot.Source, "\r\n", "; ")
-		radareCommand := fmt.Sprintf("rasm2 -a %s -b %s \"%+v\"", bot.Archs[0].Name, bot.Bits[0].Name, src)
-		bytecode, err := r2cmd(r2p1, radareCommand)
+		asm, err := engine.FighterAssemble(BotFighter(bot))
 		if err != nil {
+			log.Println(err)
 			data["err"] = "Error assembling the bot"
-			http.Redirect(w, r, fmt.Sprintf("/bot/%d", botid), http.StatusSeeOther)
-			return
-		}
-		data["bytecode_r2cmd"] = radareCommand
-		data["bytecode"] = bytecode
-
-		radareCommand = fmt.Sprintf("rasm2 -a %s -b %s -D %+v", bot.Archs[0].Name, bot.Bits[0].Name, bytecode)
-		disasm, err := r2cmd(r2p1, radareCommand)
-		if err != nil {
-			data["err"] = "Error disassembling the bot"
-			http.Redirect(w, r, fmt.Sprintf("/bot/%d", botid), http.StatusSeeOther)
-			return
 		}
-		data["err"] = "Could not get the id four your username... Please contact an admin"
-
-		data["disasm_r2cmd"] = radareCommand
-		data["disasm"] = disasm
+		data["bytecode_r2cmd"] = asm.BytecodeCommand
+		data["bytecode"] = asm.Bytecode
+		data["disasm_r2cmd"] = asm.DisasmCommand
+		data["disasm"] = asm.Disasm
 
 		// define the breadcrumbs
 		data["pagelink2"] = Link{bot.Name, fmt.Sprintf("/%d", bot.ID)}
@@ -485,47 +546,44 @@ func botSingleHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		data["pagelink2options"] = opts
 
-		editable := false
-		for _, user := range bot.Users {
-			if user.ID == viewer.ID {
-				editable = true
-			}
-		}
-		if editable == true {
+		if bot.HasOwner(viewer.ID) {
 			data["editable"] = true
 		}
 
-		// get all architectures and set the enable flag on the ones that are enabled in the battle
-		archs, err := ArchGetAll()
+		teams, err := TeamGetAllForBot(bot.ID)
+		if err != nil {
+			data["err"] = "Could not fetch the teams of the bot"
+		} else {
+			data["teams"] = teams
+		}
+
+		// get the architectures enabled by the admins, the ones of the bot are checked
+		archs, err := ArchGetAllEnabled()
 		if err != nil {
 			data["err"] = "Could not fetch the archs"
 		} else {
 			data["archs"] = archs
 		}
 
-		for i, a := range archs {
-			for _, b := range bot.Archs {
-				if a.ID == b.ID {
-					archs[i].Enabled = true
-				}
-			}
+		selectedArchs := map[int]bool{}
+		for _, a := range bot.Archs {
+			selectedArchs[a.ID] = true
 		}
+		data["selectedArchs"] = selectedArchs
 
-		// get all bits and set the enable flag on the ones that are enabled in the battle
-		bits, err := BitGetAll()
+		// get the bits enabled by the admins, the ones of the bot are checked
+		bits, err := BitGetAllEnabled()
 		if err != nil {
 			data["err"] = "Could not fetch the bits"
 		} else {
 			data["bits"] = bits
 		}
 
-		for i, a := range bits {
-			for _, b := range bot.Bits {
-				if a.ID == b.ID {
-					bits[i].Enabled = true
-				}
-			}
+		selectedBits := map[int]bool{}
+		for _, a := range bot.Bits {
+			selectedBits[a.ID] = true
 		}
+		data["selectedBits"] = selectedBits
 
 		// get the template
 		t, err := template.ParseGlob(fmt.Sprintf("%s/*.html", templatesPath))
@@ -565,14 +623,7 @@ func botSingleHandler(w http.ResponseWriter, r *http.Request) {
 
 		// check if the user submitting the change request is within the users the bot belongs to
 		log.Println("Checking if edit is allowed...")
-		allowed_to_edit := false
-		for _, user := range orig_bot.Users {
-			if user.ID == requesting_user.ID {
-				allowed_to_edit = true
-			}
-		}
-
-		if allowed_to_edit == false {
+		if !orig_bot.HasOwner(requesting_user.ID) {
 			http.Redirect(w, r, fmt.Sprintf("/bot/%d", botid), http.StatusSeeOther)
 			return
 		}
@@ -593,6 +644,11 @@ func botSingleHandler(w http.ResponseWriter, r *http.Request) {
 					http.Redirect(w, r, fmt.Sprintf("/bot/%d?res=%s", botid, msg), http.StatusSeeOther)
 					return
 				}
+				if enabled, err := ArchIsEnabled(id); err != nil || !enabled {
+					msg := "ERROR: That arch isn't available"
+					http.Redirect(w, r, fmt.Sprintf("/bot/%d?res=%s", botid, msg), http.StatusSeeOther)
+					return
+				}
 				archIDs = append(archIDs, id)
 			}
 			if strings.HasPrefix(k, "bit-") {
@@ -602,6 +658,11 @@ func botSingleHandler(w http.ResponseWriter, r *http.Request) {
 					http.Redirect(w, r, fmt.Sprintf("/bot/%d?res=%s", botid, msg), http.StatusSeeOther)
 					return
 				}
+				if enabled, err := BitIsEnabled(id); err != nil || !enabled {
+					msg := "ERROR: That bit isn't available"
+					http.Redirect(w, r, fmt.Sprintf("/bot/%d?res=%s", botid, msg), http.StatusSeeOther)
+					return
+				}
 				bitIDs = append(bitIDs, id)
 			}
 		}
@@ -673,6 +734,7 @@ func botNewHandler(w http.ResponseWriter, r *http.Request) {
 		// define data
 		data := map[string]interface{}{}
 		data["version"] = os.Getenv("VERSION")
+		data["csrfToken"] = csrfToken(r)
 
 		session, _ := globalState.sessions.Get(r, "session")
 		username := session.Values["username"].(string)
@@ -700,14 +762,22 @@ func botNewHandler(w http.ResponseWriter, r *http.Request) {
 			data["user"] = user
 		}
 
-		archs, err := ArchGetAll()
+		// the bot can be created for one of the teams of the user instead
+		teams, err := TeamGetAllForUser(user.ID)
+		if err != nil {
+			data["err"] = "Could not fetch your teams"
+		} else {
+			data["teams"] = teams
+		}
+
+		archs, err := ArchGetAllEnabled()
 		if err != nil {
 			data["err"] = "Could not fetch the archs"
 		} else {
 			data["archs"] = archs
 		}
 
-		bits, err := BitGetAll()
+		bits, err := BitGetAllEnabled()
 		if err != nil {
 			data["err"] = "Could not fetch the bits"
 		} else {
@@ -763,6 +833,11 @@ func botNewHandler(w http.ResponseWriter, r *http.Request) {
 					http.Redirect(w, r, fmt.Sprintf("/bot/new?res=%s", msg), http.StatusSeeOther)
 					return
 				}
+				if enabled, err := ArchIsEnabled(id); err != nil || !enabled {
+					msg := "ERROR: That arch isn't available"
+					http.Redirect(w, r, fmt.Sprintf("/bot/new?res=%s", msg), http.StatusSeeOther)
+					return
+				}
 				archIDs = append(archIDs, id)
 			}
 			if strings.HasPrefix(k, "bit-") {
@@ -772,6 +847,11 @@ func botNewHandler(w http.ResponseWriter, r *http.Request) {
 					http.Redirect(w, r, fmt.Sprintf("/bot/new?res=%s", msg), http.StatusSeeOther)
 					return
 				}
+				if enabled, err := BitIsEnabled(id); err != nil || !enabled {
+					msg := "ERROR: That bit isn't available"
+					http.Redirect(w, r, fmt.Sprintf("/bot/new?res=%s", msg), http.StatusSeeOther)
+					return
+				}
 				bitIDs = append(bitIDs, id)
 			}
 		}
@@ -798,6 +878,30 @@ func botNewHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// bots created for a team belong to the team instead of the user creating them
+		teamid := 0
+		var user User
+		if r.Form.Get("team") != "" {
+			var err error
+			user, err = UserGetUserFromUsername(username)
+			if err != nil {
+				msg := "ERROR: Could not get the id for your username"
+				http.Redirect(w, r, fmt.Sprintf("/bot/new?res=%s", msg), http.StatusSeeOther)
+				return
+			}
+			teamid, err = strconv.Atoi(r.Form.Get("team"))
+			if err != nil {
+				msg := "ERROR: Invalid team id"
+				http.Redirect(w, r, fmt.Sprintf("/bot/new?res=%s", msg), http.StatusSeeOther)
+				return
+			}
+			if role, err := TeamGetRole(teamid, user.ID); err != nil || role == "" {
+				msg := "ERROR: You can only create bots for your own teams"
+				http.Redirect(w, r, fmt.Sprintf("/bot/new?res=%s", msg), http.StatusSeeOther)
+				return
+			}
+		}
+
 		botid, err := BotCreate(name, source)
 		if err != nil {
 			log.Println("Error creating the bot: ", err)
@@ -806,7 +910,11 @@ func botNewHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		err = UserLinkBot(username, botid)
+		if teamid != 0 {
+			err = TeamLinkBot(teamid, botid, user)
+		} else {
+			err = UserLinkBot(username, botid)
+		}
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("500 - Error adding the bot to the user"))
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Every session gets a random CSRF token. State changing requests have to send it back, either in
+// the csrf_token form field (added to every form using the "csrf" template) or in the X-CSRF-Token
+// header (for json api requests authenticated using the session cookie). Requests authenticated
+// using an api token are exempt, as browsers never attach those on their own.
+const (
+	csrfSessionKey = "csrf"
+	csrfFormField  = "csrf_token"
+	csrfHeader     = "X-CSRF-Token"
+)
+
+//////////////////////////////////////////////////////////////////////////////
+// GENERAL PURPOSE
+
+// csrfToken returns the CSRF token of the session of the request. It is created by the
+// csrfMiddleware, so it exists for every request passing through it.
+func csrfToken(r *http.Request) string {
+	session, _ := globalState.sessions.Get(r, "session")
+	token, _ := session.Values[csrfSessionKey].(string)
+	return token
+}
+
+// csrfSafeMethod returns true for the methods that must not change any state
+func csrfSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// HTTP
+
+// csrfMiddleware makes sure every session has a CSRF token and rejects state changing requests
+// not carrying it
+func csrfMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// requests using api tokens don't rely on cookies, so they can't be forged cross-site. They
+		// are exempt only once the token has been verified and ignore the session entirely.
+		if r.Header.Get("Authorization") != "" {
+			r, status, msg := tokenAuthenticateRequest(r)
+			if status != 0 {
+				if strings.HasPrefix(r.URL.Path, "/api/") {
+					apiWriteError(w, status, msg)
+					return
+				}
+				w.WriteHeader(status)
+				w.Write([]byte(fmt.Sprintf("%d - %s", status, msg)))
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		session, _ := globalState.sessions.Get(r, "session")
+		token, _ := session.Values[csrfSessionKey].(string)
+
+		if token == "" {
+			secret := make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("500 - Could not create a CSRF token"))
+				return
+			}
+			token = hex.EncodeToString(secret)
+			session.Values[csrfSessionKey] = token
+			if err := session.Save(r, w); err != nil {
+				log.Println(err)
+			}
+		}
+
+		if !csrfSafeMethod(r.Method) {
+			sent := r.Header.Get(csrfHeader)
+			if sent == "" {
+				sent = r.PostFormValue(csrfFormField)
+			}
+
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				log.Printf("[!] Rejecting %s %s: invalid CSRF token", r.Method, r.URL.Path)
+				if strings.HasPrefix(r.URL.Path, "/api/") {
+					apiWriteError(w, http.StatusForbidden, "Invalid CSRF token, send it in the X-CSRF-Token header")
+					return
+				}
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("403 - Invalid CSRF token, please reload the page and try again"))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCSRFMiddlewareTokens(t *testing.T) {
+	testState(t)
+
+	userid, err := UserRegister("alice", []byte("hash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := TokenCreate(userid, "test", []string{ScopeRead, ScopeBots})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reached *http.Request
+	handler := csrfMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = r
+	}))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		header string
+		status int // 0 if the request should reach the handler
+	}{
+		{"no csrf token", "POST", "/bot/new", "", http.StatusForbidden},
+		{"any bearer token", "POST", "/api/v1/bots", "Bearer r2w_forged", http.StatusUnauthorized},
+		{"not a bearer token", "POST", "/api/v1/bots", "Basic YWxpY2U6cHc=", http.StatusUnauthorized},
+		{"valid token", "POST", "/api/v1/bots", "Bearer " + token, 0},
+		{"valid token, missing scope", "POST", "/api/v1/battles", "Bearer " + token, http.StatusForbidden},
+		{"valid token, web route", "POST", "/user/1/delete", "Bearer " + token, http.StatusForbidden},
+		{"safe method", "GET", "/", "", 0},
+	}
+	for _, tt := range tests {
+		reached = nil
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(""))
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if tt.status == 0 {
+			if reached == nil {
+				t.Errorf("%s: rejected with %d", tt.name, w.Code)
+			}
+			continue
+		}
+		if reached != nil || w.Code != tt.status {
+			t.Errorf("%s: status %d (handler reached: %v), want %d", tt.name, w.Code, reached != nil, tt.status)
+		}
+	}
+
+	// token requests ignore the session: no cookie gets issued and the user is in the context
+	r := httptest.NewRequest("POST", "/api/v1/bots", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("token request got a cookie: %v", cookies)
+	}
+	if user := apiRequestUser(reached); user.ID != userid {
+		t.Errorf("token request authenticated as %d, want %d", user.ID, userid)
+	}
+}
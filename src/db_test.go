@@ -0,0 +1,47 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// testState points the globalState to a freshly migrated database and session store in a
+// temporary directory for the duration of the test
+func testState(t *testing.T) *State {
+	t.Helper()
+	dir := t.TempDir()
+
+	oldState, oldPath := globalState, databasePath
+	databasePath = filepath.Join(dir, "main.db")
+
+	s, err := NewState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewSqliteStore(filepath.Join(dir, "sessions.db"), "sessions", "/", 3600, []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.sessions = store
+	globalState = s
+
+	t.Cleanup(func() {
+		store.Close()
+		s.db.Close()
+		globalState, databasePath = oldState, oldPath
+	})
+	return s
+}
+
+// testUser registers a user with the given name in the testState and returns it
+func testUser(t *testing.T, name string) User {
+	t.Helper()
+	if _, err := UserRegister(name, []byte("hash")); err != nil {
+		t.Fatal(err)
+	}
+	user, err := UserGetUserFromUsername(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
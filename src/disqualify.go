@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Disqualification is a bot removed from a battle by a referee. Disqualified bots can't be entered
+// into the battle again until a referee reinstates them.
+type Disqualification struct {
+	BotID     int
+	BotName   string
+	Referee   string
+	Reason    string
+	CreatedAt time.Time
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// GENERAL PURPOSE
+
+// BattleDisqualifyBot removes the bot from the (deep) battle and keeps it from being entered again
+func BattleDisqualifyBot(battle Battle, botid int, referee User, reason string) error {
+	registered := false
+	for _, bot := range battle.Bots {
+		if bot.ID == botid {
+			registered = true
+		}
+	}
+	if !registered {
+		return fmt.Errorf("that bot isn't registered in the battle")
+	}
+	return globalState.InsertDisqualification(battle.ID, botid, referee.ID, strings.TrimSpace(reason))
+}
+
+// BattleReinstateBot lifts the disqualification, the bot has to be entered again by its owners
+func BattleReinstateBot(battleid int, botid int) error {
+	return globalState.DeleteDisqualification(battleid, botid)
+}
+
+func BattleGetDisqualifications(battleid int) ([]Disqualification, error) {
+	return globalState.GetDisqualifications(battleid)
+}
+
+func BattleBotIsDisqualified(battleid int, botid int) (bool, error) {
+	return globalState.GetBotDisqualified(battleid, botid)
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// DATABASE
+
+func (s *State) InsertDisqualification(battleid int, botid int, userid int, reason string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM bot_battle_rel WHERE battle_id=? AND bot_id=?", battleid, botid)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT OR REPLACE INTO battle_disqualifications (battle_id, bot_id, user_id, created_at, reason)
+		VALUES (?, ?, ?, ?, ?)`, battleid, botid, userid, time.Now(), reason)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *State) DeleteDisqualification(battleid int, botid int) error {
+	_, err := s.db.Exec("DELETE FROM battle_disqualifications WHERE battle_id=? AND bot_id=?", battleid, botid)
+	return err
+}
+
+func (s *State) GetDisqualifications(battleid int) ([]Disqualification, error) {
+	rows, err := s.db.Query(`
+		SELECT d.bot_id, COALESCE(b.name, ""), COALESCE(u.name, ""), COALESCE(d.reason, ""), d.created_at
+		FROM battle_disqualifications d
+		LEFT JOIN bots b ON b.id = d.bot_id
+		LEFT JOIN users u ON u.id = d.user_id
+		WHERE d.battle_id=?
+		ORDER BY d.created_at`, battleid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var disqualifications []Disqualification
+	for rows.Next() {
+		var d Disqualification
+		if err := rows.Scan(&d.BotID, &d.BotName, &d.Referee, &d.Reason, &d.CreatedAt); err != nil {
+			return disqualifications, err
+		}
+		disqualifications = append(disqualifications, d)
+	}
+	return disqualifications, rows.Err()
+}
+
+func (s *State) GetBotDisqualified(battleid int, botid int) (bool, error) {
+	var id int
+	err := s.db.QueryRow("SELECT bot_id FROM battle_disqualifications WHERE battle_id=? AND bot_id=?", battleid, botid).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// HTTP
+
+// battleDisqualifyHandler disqualifies a bot registered in the battle (/battle/{id}/disqualify) or
+// reinstates a disqualified one (/battle/{id}/disqualify/{botid}/reinstate)
+func battleDisqualifyHandler(w http.ResponseWriter, r *http.Request) {
+	redir_target := fmt.Sprintf("/battle/%s?res=%%s#registered-bots", mux.Vars(r)["id"])
+
+	switch r.Method {
+	case "POST":
+		r.ParseForm()
+
+		user, battle, err := battleRequest(r, BattleReferee, "Only the referees of the battle can disqualify bots")
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, err.Error())
+			return
+		}
+
+		if mux.Vars(r)["botid"] != "" {
+			botid, err := strconv.Atoi(mux.Vars(r)["botid"])
+			if err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Invalid bot id")
+				return
+			}
+			if err := BattleReinstateBot(battle.ID, botid); err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Could not reinstate the bot")
+				return
+			}
+			http.Redirect(w, r, fmt.Sprintf(redir_target, "Reinstated the bot, it can be entered again"), http.StatusSeeOther)
+			return
+		}
+
+		botid, err := strconv.Atoi(r.Form.Get("bot"))
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Invalid bot id")
+			return
+		}
+
+		if err := BattleDisqualifyBot(battle, botid, user, r.Form.Get("reason")); err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not disqualify the bot")
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf(redir_target, "Disqualified the bot"), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
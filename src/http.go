@@ -19,6 +19,7 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 		// define data
 		data := map[string]interface{}{}
 		data["version"] = os.Getenv("VERSION")
+		data["csrfToken"] = csrfToken(r)
 		data["pagelink1"] = ""
 		data["pagelinknext"] = []Link{
 			{Name: "user/", Target: "/user"},
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ShareLink gives the people holding it access to an unlisted battle until it expires or gets
+// revoked. The token is signed, so it can't be guessed from the id of the link.
+type ShareLink struct {
+	ID        int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	CreatedBy string
+	Token     string
+}
+
+// The amount of days a share link can be valid for
+const shareLinkMaxDays = 90
+
+var errShareLinkInvalid = errors.New("invalid or expired share link")
+
+//////////////////////////////////////////////////////////////////////////////
+// GENERAL PURPOSE
+
+// BattleAddMember invites the user to the battle with the given role, or changes their role if
+// they're already a member. Referees don't enter bots, so the bots they entered are removed.
+func BattleAddMember(battleid int, userid int, role string) error {
+	if role != BattleRoleReferee && role != BattleRoleParticipant {
+		return fmt.Errorf("invalid role %q", role)
+	}
+	if err := globalState.LinkUserBattle(userid, battleid, role); err != nil {
+		return err
+	}
+	if role == BattleRoleReferee {
+		return BattleUnlinkAllBotsForUser(userid, battleid)
+	}
+	return nil
+}
+
+// BattleRemoveMember removes the user from the members of the battle along with the bots they
+// entered into it
+func BattleRemoveMember(battleid int, userid int) error {
+	if err := globalState.UnlinkUserBattle(userid, battleid); err != nil {
+		return err
+	}
+	return BattleUnlinkAllBotsForUser(userid, battleid)
+}
+
+// BattleJoin makes the user a participant of the battle using the token of a share link. The
+// membership belongs to the link, revoking the link removes the user along with their bots. Members
+// keep their role.
+func BattleJoin(battle Battle, user User, token string) error {
+	linkid, err := BattleShareLinkVerify(battle, token)
+	if err != nil {
+		return err
+	}
+	if battle.Role(user.ID) != "" {
+		return nil
+	}
+	return globalState.LinkUserBattleShareLink(user.ID, battle.ID, linkid)
+}
+
+// BattleShareLinkCreate creates a new share link for the battle valid for the given amount of days
+func BattleShareLinkCreate(battle Battle, user User, days int) (ShareLink, error) {
+	if battle.Visibility == BattlePrivate {
+		return ShareLink{}, fmt.Errorf("private battles can't be shared using links, invite the users instead")
+	}
+	if days < 1 || days > shareLinkMaxDays {
+		return ShareLink{}, fmt.Errorf("share links can be valid for 1 to %d days", shareLinkMaxDays)
+	}
+
+	// the expiry time is part of the signed token, so it's stored with a precision of seconds
+	link := ShareLink{
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Duration(days) * 24 * time.Hour).Truncate(time.Second),
+		CreatedBy: user.Name,
+	}
+
+	id, err := globalState.InsertShareLink(battle.ID, user.ID, link.ExpiresAt)
+	if err != nil {
+		return ShareLink{}, err
+	}
+	link.ID = id
+	link.Token = shareLinkToken(battle.ID, link.ID, link.ExpiresAt)
+	return link, nil
+}
+
+// BattleShareLinkGetAll returns the share links of the battle that haven't expired yet
+func BattleShareLinkGetAll(battleid int) ([]ShareLink, error) {
+	links, err := globalState.GetShareLinks(battleid)
+	if err != nil {
+		return nil, err
+	}
+	for i := range links {
+		links[i].Token = shareLinkToken(battleid, links[i].ID, links[i].ExpiresAt)
+	}
+	return links, nil
+}
+
+func BattleShareLinkRevoke(battleid int, linkid int) error {
+	return globalState.DeleteShareLink(battleid, linkid)
+}
+
+// BattleShareLinkVerify checks that the token belongs to a share link of the (deep) battle that is
+// still valid and returns the id of the link. Private battles ignore share links.
+func BattleShareLinkVerify(battle Battle, token string) (int, error) {
+	if battle.Visibility == BattlePrivate {
+		return -1, errShareLinkInvalid
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return -1, errShareLinkInvalid
+	}
+	linkid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return -1, errShareLinkInvalid
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return -1, errShareLinkInvalid
+	}
+
+	expected := shareLinkToken(battle.ID, linkid, time.Unix(expires, 0))
+	if !hmac.Equal([]byte(expected), []byte(token)) {
+		return -1, errShareLinkInvalid
+	}
+	if time.Now().Unix() > expires {
+		return -1, errShareLinkInvalid
+	}
+
+	// revoked links are deleted, so the link has to exist as well
+	links, err := globalState.GetShareLinks(battle.ID)
+	if err != nil {
+		return -1, err
+	}
+	for _, link := range links {
+		if link.ID == linkid && link.ExpiresAt.Unix() == expires {
+			return linkid, nil
+		}
+	}
+	return -1, errShareLinkInvalid
+}
+
+// shareLinkToken signs the battle, link id and expiry time using a key derived from the session
+// key, so that the tokens can't be forged without knowing it
+func shareLinkToken(battleid int, linkid int, expires time.Time) string {
+	key := hmac.New(sha256.New, []byte(os.Getenv("SESSION_KEY")))
+	key.Write([]byte("r2wars battle share links"))
+
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	fmt.Fprintf(mac, "%d:%d:%d", battleid, linkid, expires.Unix())
+	sig := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	return fmt.Sprintf("%d.%d.%s", linkid, expires.Unix(), sig)
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// DATABASE
+
+// LinkUserBattle adds the user as a member with the role, invited members don't depend on the share
+// link they might have joined with anymore
+func (s *State) LinkUserBattle(userid int, battleid int, role string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO user_battle_rel (user_id, battle_id, role) VALUES (?, ?, ?)
+		ON CONFLICT(user_id, battle_id) DO UPDATE SET role=excluded.role, share_link_id=NULL`, userid, battleid, role)
+	return err
+}
+
+func (s *State) LinkUserBattleShareLink(userid int, battleid int, linkid int) error {
+	_, err := s.db.Exec(`
+		INSERT OR IGNORE INTO user_battle_rel (user_id, battle_id, role, share_link_id)
+		VALUES (?, ?, ?, ?)`, userid, battleid, BattleRoleParticipant, linkid)
+	return err
+}
+
+func (s *State) UnlinkUserBattle(userid int, battleid int) error {
+	_, err := s.db.Exec("DELETE FROM user_battle_rel WHERE user_id=? AND battle_id=?", userid, battleid)
+	return err
+}
+
+func (s *State) GetBattleMembers(battleid int) ([]BattleMember, error) {
+	rows, err := s.db.Query(`
+		SELECT u.id, u.name, ub.role
+		FROM user_battle_rel ub
+		JOIN users u ON u.id = ub.user_id
+		WHERE ub.battle_id=?
+		ORDER BY ub.role DESC, u.name`, battleid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []BattleMember{}
+	for rows.Next() {
+		var m BattleMember
+		if err := rows.Scan(&m.UserID, &m.Name, &m.Role); err != nil {
+			return members, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (s *State) InsertShareLink(battleid int, userid int, expires time.Time) (int, error) {
+	res, err := s.db.Exec(`
+		INSERT INTO battle_share_links (created_at, battle_id, user_id, expires_at)
+		VALUES (?, ?, ?, ?)`, time.Now(), battleid, userid, expires)
+	if err != nil {
+		return -1, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return -1, err
+	}
+	return int(id), nil
+}
+
+func (s *State) GetShareLinks(battleid int) ([]ShareLink, error) {
+	rows, err := s.db.Query(`
+		SELECT sl.id, sl.created_at, sl.expires_at, COALESCE(u.name, "")
+		FROM battle_share_links sl
+		LEFT JOIN users u ON u.id = sl.user_id
+		WHERE sl.battle_id=? AND sl.expires_at > ?
+		ORDER BY sl.created_at`, battleid, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []ShareLink
+	for rows.Next() {
+		var link ShareLink
+		if err := rows.Scan(&link.ID, &link.CreatedAt, &link.ExpiresAt, &link.CreatedBy); err != nil {
+			return links, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// DeleteShareLink deletes the link along with the bots entered by the users who joined using it,
+// their membership goes with the link
+func (s *State) DeleteShareLink(battleid int, linkid int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT user_id FROM user_battle_rel WHERE battle_id=? AND share_link_id=?", battleid, linkid)
+	if err != nil {
+		return err
+	}
+	var userids []int
+	for rows.Next() {
+		var userid int
+		if err := rows.Scan(&userid); err != nil {
+			rows.Close()
+			return err
+		}
+		userids = append(userids, userid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, userid := range userids {
+		if _, err := tx.Exec(unlinkUserBotsFromBattle, battleid, userid, userid); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM battle_share_links WHERE battle_id=? AND id=?", battleid, linkid); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// HTTP
+
+// battleRequest returns the user making the request and the (deep) battle from the url, failing
+// with the denied message if the user lacks the given permission
+func battleRequest(r *http.Request, perm BattlePermission, denied string) (User, Battle, error) {
+	session, _ := globalState.sessions.Get(r, "session")
+	user, err := UserGetUserFromUsername(session.Values["username"].(string))
+	if err != nil {
+		return User{}, Battle{}, fmt.Errorf("Could not get the id for your username")
+	}
+
+	battleid, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return user, Battle{}, fmt.Errorf("Invalid battle id")
+	}
+	battle, err := BattleGetByIdDeep(battleid)
+	if err != nil {
+		return user, Battle{}, fmt.Errorf("Could not get the battle")
+	}
+
+	if !BattleCan(battle, user, perm) {
+		return user, battle, errors.New(denied)
+	}
+	return user, battle, nil
+}
+
+// battleMemberHandler invites a user by name with a role (/battle/{id}/member) or changes the role
+// of a member (/battle/{id}/member/{userid}/{action}, the action being the new role or remove).
+// Members may remove themselves.
+func battleMemberHandler(w http.ResponseWriter, r *http.Request) {
+	redir_target := fmt.Sprintf("/battle/%s?res=%%s#access", mux.Vars(r)["id"])
+
+	switch r.Method {
+	case "POST":
+		r.ParseForm()
+
+		user, battle, ownerErr := battleRequest(r, BattleEdit, "Only the owners of the battle can manage who has access to it")
+		action := mux.Vars(r)["action"]
+
+		var member User
+		if action == "" {
+			var err error
+			member, err = UserGetUserFromUsername(strings.TrimSpace(r.Form.Get("username")))
+			if err != nil || member.Name == "" {
+				log_and_redir_with_msg(w, r, err, redir_target, "There is no user with that name")
+				return
+			}
+			action = r.Form.Get("role")
+		} else {
+			memberid, err := strconv.Atoi(mux.Vars(r)["userid"])
+			if err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Invalid user id")
+				return
+			}
+			member.ID = memberid
+		}
+
+		leaving := action == "remove" && member.ID == user.ID && battle.Role(user.ID) != ""
+		if ownerErr != nil && !leaving {
+			log_and_redir_with_msg(w, r, ownerErr, redir_target, ownerErr.Error())
+			return
+		}
+		if battle.HasOwner(member.ID) {
+			log_and_redir_with_msg(w, r, nil, redir_target, "Owners are managed in the settings of the battle")
+			return
+		}
+
+		var err error
+		var msg string
+		switch action {
+		case BattleRoleReferee, BattleRoleParticipant:
+			err = BattleAddMember(battle.ID, member.ID, action)
+			msg = fmt.Sprintf("Made the user a %s", action)
+		case "remove":
+			err = BattleRemoveMember(battle.ID, member.ID)
+			msg = "Removed the member"
+		default:
+			err = fmt.Errorf("invalid action %q", action)
+		}
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not update the members")
+			return
+		}
+
+		if leaving {
+			http.Redirect(w, r, "/battle?res=You left the battle", http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf(redir_target, msg), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
+
+// battleShareHandler creates a share link (/battle/{id}/share) or revokes one
+// (/battle/{id}/share/{linkid}/revoke)
+func battleShareHandler(w http.ResponseWriter, r *http.Request) {
+	redir_target := fmt.Sprintf("/battle/%s?res=%%s#access", mux.Vars(r)["id"])
+
+	switch r.Method {
+	case "POST":
+		r.ParseForm()
+
+		user, battle, err := battleRequest(r, BattleEdit, "Only the owners of the battle can manage who has access to it")
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, err.Error())
+			return
+		}
+
+		if mux.Vars(r)["linkid"] != "" {
+			linkid, err := strconv.Atoi(mux.Vars(r)["linkid"])
+			if err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Invalid share link id")
+				return
+			}
+			if err := BattleShareLinkRevoke(battle.ID, linkid); err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Could not revoke the share link")
+				return
+			}
+			http.Redirect(w, r, fmt.Sprintf(redir_target, "Revoked the share link and removed the members who joined using it"), http.StatusSeeOther)
+			return
+		}
+
+		days, err := strconv.Atoi(r.Form.Get("days"))
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Invalid amount of days")
+			return
+		}
+
+		if _, err := BattleShareLinkCreate(battle, user, days); err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, err.Error())
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf(redir_target, "Created a new share link"), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
+
+// battleJoinHandler makes the user a participant of the battle using the share link in the form
+// (/battle/{id}/join). Opening a share link only shows the battle, joining takes this extra step.
+func battleJoinHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		r.ParseForm()
+
+		session, _ := globalState.sessions.Get(r, "session")
+		user, err := UserGetUserFromUsername(session.Values["username"].(string))
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, "/battle?res=%s", "Could not get the id for your username")
+			return
+		}
+
+		battleid, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, "/battle?res=%s", "Invalid battle id")
+			return
+		}
+		battle, err := BattleGetByIdDeep(battleid)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, "/battle?res=%s", "Could not get the battle")
+			return
+		}
+
+		if err := BattleJoin(battle, user, r.Form.Get("share")); err != nil {
+			log_and_redir_with_msg(w, r, err, "/battle?res=%s", "Could not join the battle, the share link is invalid or has expired")
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("/battle/%d?res=You joined the battle as a participant", battle.ID), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
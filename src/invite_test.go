@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// inviteTestSetup registers alice, bob and carol, gives each a bot and creates an unlisted battle
+// owned by alice along with a share link for it
+func inviteTestSetup(t *testing.T) ([]User, []int, int, ShareLink) {
+	testState(t)
+
+	var users []User
+	var bots []int
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if _, err := UserRegister(name, []byte("hash")); err != nil {
+			t.Fatal(err)
+		}
+		user, err := UserGetUserFromUsername(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+
+		botid, err := BotCreate(name+"s bot", "nop")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := UserLinkBot(name, botid); err != nil {
+			t.Fatal(err)
+		}
+		bots = append(bots, botid)
+	}
+
+	battleid, err := BattleCreate(Battle{Name: "battle", Visibility: BattleUnlisted}, users[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := BattleShareLinkCreate(inviteTestBattle(t, battleid), users[0], 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return users, bots, battleid, link
+}
+
+func inviteTestBattle(t *testing.T, battleid int) Battle {
+	t.Helper()
+	battle, err := BattleGetByIdDeep(battleid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return battle
+}
+
+func inviteTestHasBot(battle Battle, botid int) bool {
+	for _, bot := range battle.Bots {
+		if bot.ID == botid {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBattleShareLinkVerify(t *testing.T) {
+	users, _, battleid, link := inviteTestSetup(t)
+	battle := inviteTestBattle(t, battleid)
+
+	if linkid, err := BattleShareLinkVerify(battle, link.Token); err != nil || linkid != link.ID {
+		t.Errorf("verifying the link: %d, %v", linkid, err)
+	}
+
+	tampered := link.Token[:len(link.Token)-1] + "x"
+	if link.Token[len(link.Token)-1] == 'x' {
+		tampered = link.Token[:len(link.Token)-1] + "y"
+	}
+	for _, token := range []string{"", "1.2", tampered} {
+		if _, err := BattleShareLinkVerify(battle, token); !errors.Is(err, errShareLinkInvalid) {
+			t.Errorf("verifying %q: %v", token, err)
+		}
+	}
+
+	// the token of another battle isn't valid for this one
+	other, err := BattleCreate(Battle{Name: "other", Visibility: BattleUnlisted}, users[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := BattleShareLinkVerify(inviteTestBattle(t, other), link.Token); !errors.Is(err, errShareLinkInvalid) {
+		t.Errorf("verifying the link for another battle: %v", err)
+	}
+
+	if err := BattleShareLinkRevoke(battleid, link.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := BattleShareLinkVerify(battle, link.Token); !errors.Is(err, errShareLinkInvalid) {
+		t.Errorf("verifying a revoked link: %v", err)
+	}
+}
+
+func TestBattleJoinRevoke(t *testing.T) {
+	users, bots, battleid, link := inviteTestSetup(t)
+	alice, bob, carol := users[0], users[1], users[2]
+
+	// carol was invited before, joining using the link doesn't tie her membership to it
+	if err := BattleAddMember(battleid, carol.ID, BattleRoleReferee); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range []User{alice, bob, carol} {
+		if err := BattleJoin(inviteTestBattle(t, battleid), user, link.Token); err != nil {
+			t.Fatalf("%s joining: %v", user.Name, err)
+		}
+	}
+	if err := BattleJoin(inviteTestBattle(t, battleid), bob, "1.2.3"); !errors.Is(err, errShareLinkInvalid) {
+		t.Errorf("joining using an invalid link: %v", err)
+	}
+
+	battle := inviteTestBattle(t, battleid)
+	if role := battle.Role(alice.ID); role != BattleRoleOwner {
+		t.Errorf("the owner is a %q after joining", role)
+	}
+	if role := battle.Role(bob.ID); role != BattleRoleParticipant {
+		t.Errorf("bob joined as %q", role)
+	}
+	if role := battle.Role(carol.ID); role != BattleRoleReferee {
+		t.Errorf("carol is a %q after joining", role)
+	}
+
+	for _, botid := range bots {
+		if err := BattleLinkBot(botid, battleid); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// revoking the link removes bob and his bot, the others stay
+	if err := BattleShareLinkRevoke(battleid, link.ID); err != nil {
+		t.Fatal(err)
+	}
+	battle = inviteTestBattle(t, battleid)
+	if role := battle.Role(bob.ID); role != "" {
+		t.Errorf("bob is still a %s", role)
+	}
+	if inviteTestHasBot(battle, bots[1]) {
+		t.Error("the bot of bob is still in the battle")
+	}
+	if role := battle.Role(carol.ID); role != BattleRoleReferee {
+		t.Errorf("carol is a %q after revoking", role)
+	}
+	for _, botid := range []int{bots[0], bots[2]} {
+		if !inviteTestHasBot(battle, botid) {
+			t.Errorf("bot %d was removed", botid)
+		}
+	}
+}
+
+func TestBattleJoinInvited(t *testing.T) {
+	users, _, battleid, link := inviteTestSetup(t)
+	bob := users[1]
+
+	// inviting a user who joined using a link makes the membership permanent
+	if err := BattleJoin(inviteTestBattle(t, battleid), bob, link.Token); err != nil {
+		t.Fatal(err)
+	}
+	if err := BattleAddMember(battleid, bob.ID, BattleRoleParticipant); err != nil {
+		t.Fatal(err)
+	}
+	if err := BattleShareLinkRevoke(battleid, link.ID); err != nil {
+		t.Fatal(err)
+	}
+	if role := inviteTestBattle(t, battleid).Role(bob.ID); role != BattleRoleParticipant {
+		t.Errorf("bob is a %q after revoking", role)
+	}
+}
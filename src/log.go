@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"net/http"
 	"os"
 
@@ -27,8 +28,63 @@ func authMiddleware(next http.Handler) http.Handler {
 
 		if username == nil {
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
-		} else {
-			next.ServeHTTP(w, r)
+			return
 		}
+
+		// disabled users get logged out
+		user, err := UserGetUserFromUsername(username.(string))
+		if err == nil && user.Disabled {
+			delete(session.Values, "username")
+			session.Save(r, w)
+			http.Redirect(w, r, "/login?err=Account+disabled", http.StatusSeeOther)
+			return
+		}
+
+		// keep the last seen time of the session listed on the profile page up to date
+		if err := globalState.sessions.Touch(r, session); err != nil {
+			log.Println(err)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sessionUser returns the user logged in using the session of the request. Anonymous visitors
+// and disabled users get the empty user, it's meant for the pages that can be viewed without
+// logging in.
+func sessionUser(r *http.Request) User {
+	session, _ := globalState.sessions.Get(r, "session")
+	username := session.Values["username"]
+	if username == nil {
+		return User{}
+	}
+
+	user, err := UserGetUserFromUsername(username.(string))
+	if err != nil || user.Disabled {
+		return User{}
+	}
+	return user
+}
+
+// adminMiddleware only lets users with the admin role through, it's meant to be used behind the
+// authMiddleware
+func adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, _ := globalState.sessions.Get(r, "session")
+		username := session.Values["username"]
+
+		if username == nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		user, err := UserGetUserFromUsername(username.(string))
+		if err != nil || !user.IsAdmin() {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Admins only"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoginAttempt is a single try to log in, stored for throttling the logins and as an audit log
+type LoginAttempt struct {
+	ID        int
+	CreatedAt time.Time
+	Username  string
+	IP        string
+	Success   bool
+	Reason    string
+}
+
+// The reasons stored for the login attempts
+const (
+	LoginOK              = "ok"
+	LoginOIDC            = "ok via single sign-on"
+	LoginInvalidPassword = "invalid password"
+	LoginDisabled        = "account disabled"
+	LoginThrottled       = "throttled" // rejected without checking the password
+	LoginUnlocked        = "unlocked by an admin"
+)
+
+// loginLimit defines how failed logins are throttled. The first Free failures are let through
+// right away, after that every attempt has to wait Base * 2^(failures - Free) (capped at
+// MaxDelay) after the last failure. After Lockout failures, no attempts are accepted at all for
+// LockoutDuration. Only failures within Window are counted.
+type loginLimit struct {
+	Free            int
+	Base            time.Duration
+	MaxDelay        time.Duration
+	Lockout         int
+	LockoutDuration time.Duration
+	Window          time.Duration
+}
+
+var (
+	// failures for a single account, counted since the last successful login
+	loginUsernameLimit = loginLimit{
+		Free:            3,
+		Base:            time.Second,
+		MaxDelay:        5 * time.Minute,
+		Lockout:         10,
+		LockoutDuration: 15 * time.Minute,
+		Window:          time.Hour,
+	}
+
+	// failures from a single ip across all accounts, more lenient as people share ips
+	loginIPLimit = loginLimit{
+		Free:            10,
+		Base:            time.Second,
+		MaxDelay:        5 * time.Minute,
+		Lockout:         50,
+		LockoutDuration: 15 * time.Minute,
+		Window:          15 * time.Minute,
+	}
+)
+
+// the amount of failed logins displayed on the admin page
+const loginAuditSize = 100
+
+// loginLocks serializes the attempts to log in per username and per ip, see LoginLock
+var loginLocks = struct {
+	sync.Mutex
+	keys map[string]*loginLockKey
+}{keys: map[string]*loginLockKey{}}
+
+// loginLockKey is the lock of a single username or ip, removed once nobody holds or waits for it
+type loginLockKey struct {
+	sync.Mutex
+	refs int
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// GENERAL PURPOSE
+
+// wait returns how long to wait after the last failure, given the amount of failures
+func (l loginLimit) wait(failures int) time.Duration {
+	if failures >= l.Lockout {
+		return l.LockoutDuration
+	}
+	if failures < l.Free {
+		return 0
+	}
+	delay := l.Base << (failures - l.Free)
+	if delay > l.MaxDelay || delay <= 0 {
+		delay = l.MaxDelay
+	}
+	return delay
+}
+
+// LoginLock locks the username and the ip until the returned function is called. Checking the
+// throttle and recording the attempt happen while holding it, parallel attempts would all pass
+// the throttle before the first failure is recorded otherwise.
+func LoginLock(username string, ip string) func() {
+	// always the ip first, so two attempts can't wait for each other
+	keys := []string{"ip " + ip, "user " + username}
+
+	var locks []*loginLockKey
+	for _, key := range keys {
+		loginLocks.Lock()
+		lock, ok := loginLocks.keys[key]
+		if !ok {
+			lock = &loginLockKey{}
+			loginLocks.keys[key] = lock
+		}
+		lock.refs++
+		loginLocks.Unlock()
+
+		lock.Lock()
+		locks = append(locks, lock)
+	}
+
+	return func() {
+		loginLocks.Lock()
+		defer loginLocks.Unlock()
+		for i, lock := range locks {
+			lock.Unlock()
+			lock.refs--
+			if lock.refs == 0 {
+				delete(loginLocks.keys, keys[i])
+			}
+		}
+	}
+}
+
+// LoginThrottle returns how long the client has to wait before trying to log in as the user
+// again, 0 if it may try right away
+func LoginThrottle(username string, ip string) (time.Duration, error) {
+	now := time.Now()
+	var wait time.Duration
+
+	failures, last, err := globalState.GetLoginFailuresForUsername(username, now.Add(-loginUsernameLimit.Window))
+	if err != nil {
+		return 0, err
+	}
+	if d := last.Add(loginUsernameLimit.wait(failures)).Sub(now); failures > 0 && d > wait {
+		wait = d
+	}
+
+	failures, last, err = globalState.GetLoginFailuresForIP(ip, now.Add(-loginIPLimit.Window))
+	if err != nil {
+		return 0, err
+	}
+	if d := last.Add(loginIPLimit.wait(failures)).Sub(now); failures > 0 && d > wait {
+		wait = d
+	}
+
+	return wait, nil
+}
+
+// LoginRecord stores the attempt to log in
+func LoginRecord(username string, ip string, success bool, reason string) error {
+	return globalState.InsertLoginAttempt(LoginAttempt{Username: username, IP: ip, Success: success, Reason: reason})
+}
+
+// LoginUnlock resets the failures of the user, so that they can log in right away again
+func LoginUnlock(username string, admin string) error {
+	return LoginRecord(username, "", true, fmt.Sprintf("%s (%s)", LoginUnlocked, admin))
+}
+
+func LoginGetFailed() ([]LoginAttempt, error) {
+	return globalState.GetFailedLoginAttempts(loginAuditSize)
+}
+
+// loginClientIP returns the ip of the client. The X-Forwarded-For header is only used with
+// -trustproxy, as anyone can set it otherwise.
+func loginClientIP(r *http.Request) string {
+	if trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			// the left most address is the client, the others are proxies
+			ip, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(ip)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginWaitMessage formats the wait duration for the user
+func loginWaitMessage(wait time.Duration) string {
+	return fmt.Sprintf("Too many failed logins, please try again in %s", wait.Round(time.Second))
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// DATABASE
+
+// InsertLoginAttempt stores the attempt, created_ns is the time used for throttling as the text
+// of created_at doesn't compare correctly across timezone offsets
+func (s *State) InsertLoginAttempt(attempt LoginAttempt) error {
+	now := time.Now()
+	_, err := s.db.Exec(`
+		INSERT INTO login_attempts (created_at, created_ns, username, ip, success, reason)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		now, now.UnixNano(), attempt.Username, attempt.IP, attempt.Success, attempt.Reason)
+	return err
+}
+
+// GetLoginFailuresForUsername returns the amount of failed logins since the last successful one
+// (or since the given time) and the time of the last failure
+func (s *State) GetLoginFailuresForUsername(username string, since time.Time) (int, time.Time, error) {
+	return s.getLoginFailures(`
+		username=?1 AND created_ns>=MAX(?2, COALESCE(
+			(SELECT MAX(created_ns) FROM login_attempts WHERE username=?1 AND success=true),
+			?2))`, username, since.UnixNano())
+}
+
+// GetLoginFailuresForIP returns the amount of failed logins from the ip since the given time and
+// the time of the last failure
+func (s *State) GetLoginFailuresForIP(ip string, since time.Time) (int, time.Time, error) {
+	return s.getLoginFailures("ip=?1 AND created_ns>=?2", ip, since.UnixNano())
+}
+
+// getLoginFailures counts the failures matching the where clause, which binds its arguments
+// using ?1 and ?2. Throttled attempts aren't counted, as the lockout would otherwise never end
+// while someone keeps trying.
+func (s *State) getLoginFailures(where string, args ...interface{}) (int, time.Time, error) {
+	var count int
+	var last int64
+	err := s.db.QueryRow(`
+		SELECT COUNT(*), COALESCE(MAX(created_ns), 0)
+		FROM login_attempts
+		WHERE success=false AND reason!=?3 AND `+where, append(args, LoginThrottled)...).Scan(&count, &last)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return count, time.Unix(0, last), nil
+}
+
+func (s *State) GetFailedLoginAttempts(limit int) ([]LoginAttempt, error) {
+	rows, err := s.db.Query(`
+		SELECT id, created_at, username, ip, success, reason
+		FROM login_attempts
+		WHERE success=false
+		ORDER BY id DESC
+		LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []LoginAttempt
+	for rows.Next() {
+		var a LoginAttempt
+		if err := rows.Scan(&a.ID, &a.CreatedAt, &a.Username, &a.IP, &a.Success, &a.Reason); err != nil {
+			return attempts, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoginLimitWait(t *testing.T) {
+	capped := loginLimit{Free: 0, Base: time.Second, MaxDelay: 5 * time.Second, Lockout: 100, LockoutDuration: time.Hour}
+
+	tests := []struct {
+		name     string
+		limit    loginLimit
+		failures int
+		want     time.Duration
+	}{
+		{"username, none", loginUsernameLimit, 0, 0},
+		{"username, last free", loginUsernameLimit, 2, 0},
+		{"username, first throttled", loginUsernameLimit, 3, time.Second},
+		{"username, doubling", loginUsernameLimit, 4, 2 * time.Second},
+		{"username, before lockout", loginUsernameLimit, 9, 64 * time.Second},
+		{"username, lockout", loginUsernameLimit, 10, 15 * time.Minute},
+		{"username, after lockout", loginUsernameLimit, 30, 15 * time.Minute},
+		{"ip, last free", loginIPLimit, 9, 0},
+		{"ip, first throttled", loginIPLimit, 10, time.Second},
+		{"ip, capped", loginIPLimit, 49, 5 * time.Minute},
+		{"ip, lockout", loginIPLimit, 50, 15 * time.Minute},
+		{"capped", capped, 2, 4 * time.Second},
+		{"capped, max", capped, 3, 5 * time.Second},
+		{"capped, overflow", capped, 70, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := tt.limit.wait(tt.failures); got != tt.want {
+			t.Errorf("%s: wait(%d) = %s, want %s", tt.name, tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	testState(t)
+
+	for i := 0; i < loginUsernameLimit.Free; i++ {
+		if wait, err := LoginThrottle("alice", "192.0.2.1"); err != nil || wait != 0 {
+			t.Fatalf("failure %d: waiting %s, %v", i, wait, err)
+		}
+		if err := LoginRecord("alice", "192.0.2.1", false, LoginInvalidPassword); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the account is throttled from every ip, the ip isn't for other accounts yet
+	if wait, _ := LoginThrottle("alice", "192.0.2.2"); wait <= 0 || wait > loginUsernameLimit.Base {
+		t.Errorf("after %d failures: waiting %s", loginUsernameLimit.Free, wait)
+	}
+	if wait, _ := LoginThrottle("bob", "192.0.2.1"); wait != 0 {
+		t.Errorf("another account: waiting %s", wait)
+	}
+
+	// throttled attempts don't count as failures
+	if err := LoginRecord("alice", "192.0.2.1", false, LoginThrottled); err != nil {
+		t.Fatal(err)
+	}
+	if wait, _ := LoginThrottle("alice", "192.0.2.1"); wait > loginUsernameLimit.Base {
+		t.Errorf("after a throttled attempt: waiting %s", wait)
+	}
+
+	// a successful login resets the failures of the account
+	if err := LoginUnlock("alice", "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, _ := LoginThrottle("alice", "192.0.2.2"); wait != 0 {
+		t.Errorf("after unlocking: waiting %s", wait)
+	}
+}
+
+// TestLoginThrottleTimezones stores attempts whose times as text order differently than the
+// times themselves
+func TestLoginThrottleTimezones(t *testing.T) {
+	s := testState(t)
+
+	now := time.Now().Truncate(time.Second)
+	plus2 := time.FixedZone("+02:00", 2*60*60)
+	attempts := []struct {
+		at      time.Time
+		success bool
+	}{
+		// the success is an hour before the failure, but reads as an hour after it
+		{now.Add(-2 * time.Minute).In(plus2).Add(-time.Hour), true},
+		{now.Add(-2 * time.Minute).UTC(), false},
+	}
+	for _, a := range attempts {
+		_, err := s.db.Exec(`
+			INSERT INTO login_attempts (created_at, created_ns, username, ip, success, reason)
+			VALUES (?, ?, "alice", "192.0.2.1", ?, "")`, a.at.Format("2006-01-02 15:04:05-07:00"), a.at.UnixNano(), a.success)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failures, last, err := s.GetLoginFailuresForUsername("alice", now.Add(-time.Hour*3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != 1 || !last.Equal(attempts[1].at) {
+		t.Errorf("got %d failures, the last at %s, want 1 at %s", failures, last, attempts[1].at)
+	}
+}
+
+// TestLoginThrottleConcurrent makes sure attempts made at the same time can't all pass the
+// throttle before the first failure is recorded
+func TestLoginThrottleConcurrent(t *testing.T) {
+	testState(t)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	passed := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer LoginLock("alice", "192.0.2.1")()
+
+			wait, err := LoginThrottle("alice", "192.0.2.1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if wait > 0 {
+				LoginRecord("alice", "192.0.2.1", false, LoginThrottled)
+				return
+			}
+
+			mu.Lock()
+			passed++
+			mu.Unlock()
+
+			// checking the password takes a while
+			time.Sleep(10 * time.Millisecond)
+			LoginRecord("alice", "192.0.2.1", false, LoginInvalidPassword)
+		}()
+	}
+	wg.Wait()
+
+	if passed != loginUsernameLimit.Free {
+		t.Errorf("%d attempts passed the throttle, want %d", passed, loginUsernameLimit.Free)
+	}
+	if n := len(loginLocks.keys); n != 0 {
+		t.Errorf("%d locks are left over", n)
+	}
+}
@@ -16,6 +16,12 @@ var logFilePath string
 var databasePath string
 var sessiondbPath string
 var templatesPath string
+var adminUsername string
+var trustProxy bool
+var oidcIssuer string
+var oidcClientID string
+var oidcRedirectURL string
+var oidcName string
 
 var (
 	globalState *State
@@ -32,12 +38,36 @@ func initFlags() {
 	flag.StringVar(&databasePath, "databasepath", "./main.db", "The path to the main database")
 	flag.StringVar(&sessiondbPath, "sessiondbpath", "./sessions.db", "The path to the session database")
 	flag.StringVar(&templatesPath, "templates", "./templates", "The path to the templates used")
+	flag.StringVar(&adminUsername, "admin", "", "Promote the given user to an admin on startup")
+	flag.BoolVar(&trustProxy, "trustproxy", false, "Use the X-Forwarded-For header for the client ip (only when running behind a reverse proxy)")
+
+	flag.StringVar(&oidcIssuer, "oidc-issuer", "", "The issuer url of the OpenID Connect provider to sign in with (the client secret is read from OIDC_CLIENT_SECRET)")
+	flag.StringVar(&oidcClientID, "oidc-client-id", "", "The client id registered at the OpenID Connect provider")
+	flag.StringVar(&oidcRedirectURL, "oidc-redirect", "", "The redirect url registered at the provider (default derived from the request, http(s)://<host>/login/oidc/callback)")
+	flag.StringVar(&oidcName, "oidc-name", "single sign-on", "The name of the provider displayed on the login page")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [migrate status | apply [version] | rollback [version]]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 }
 
 func main() {
 	initFlags()
 	flag.Parse()
 
+	// the migrate subcommand only touches the database and exits
+	if flag.Arg(0) == "migrate" {
+		migrateCommand(flag.Args()[1:])
+		return
+	}
+
+	// the sessions and share links are signed using the session key, anyone could forge them
+	// using an empty one
+	if os.Getenv("SESSION_KEY") == "" {
+		log.Fatal("The SESSION_KEY environment variable has to be set")
+	}
+
 	// log init
 	log.Println("[i] Setting up logging...")
 	logFile, err := os.OpenFile(logFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0664)
@@ -54,6 +84,17 @@ func main() {
 	}
 	globalState = s
 
+	if adminUsername != "" {
+		log.Printf("[i] Promoting %s to an admin...", adminUsername)
+		admin, err := UserGetUserFromUsername(adminUsername)
+		if err != nil {
+			log.Fatal("Error getting the user to promote: ", err)
+		}
+		if err := UserSetRole(admin.ID, RoleAdmin); err != nil {
+			log.Fatal("Error promoting the user: ", err)
+		}
+	}
+
 	// session init
 	log.Println("[i] Setting up Session Storage...")
 	store, err := NewSqliteStore(sessiondbPath, "sessions", "/", 3600, []byte(os.Getenv("SESSION_KEY")))
@@ -62,14 +103,27 @@ func main() {
 	}
 	globalState.sessions = store
 
+	// run queue init
+	log.Println("[i] Setting up the Run Queue...")
+	if err := RunRequeuePending(); err != nil {
+		log.Fatal("Error requeueing the pending runs: ", err)
+	}
+	go RunWorker()
+	go WebhookWorker()
+	go SessionWorker()
+
 	// HTTP init
 	log.Println("[i] Setting up HTTP Routes...")
 	r := mux.NewRouter()
 	r.Use(logger.Middleware)
+	r.Use(csrfMiddleware)
 
 	// unauthenticated endpoints
 	r.HandleFunc("/", indexHandler)
 	r.HandleFunc("/login", loginHandler)
+	r.HandleFunc("/login/totp", loginTOTPHandler)
+	r.HandleFunc("/login/oidc", loginOIDCHandler)
+	r.HandleFunc("/login/oidc/callback", loginOIDCCallbackHandler)
 	r.HandleFunc("/register", registerHandler)
 	// r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
 
@@ -85,6 +139,24 @@ func main() {
 	auth_needed.HandleFunc("/user", usersHandler)
 	auth_needed.HandleFunc("/user/{id}", userHandler)
 	auth_needed.HandleFunc("/user/{id}/profile", profileHandler)
+	auth_needed.HandleFunc("/user/{id}/token", tokenNewHandler)
+	auth_needed.HandleFunc("/user/{id}/token/{tokenid}/revoke", tokenRevokeHandler)
+	auth_needed.HandleFunc("/user/{id}/totp/{action}", totpHandler)
+	auth_needed.HandleFunc("/user/{id}/session/{sessionid}/revoke", sessionRevokeHandler)
+	auth_needed.HandleFunc("/user/{id}/oidc/{identityid}/unlink", oidcUnlinkHandler)
+	auth_needed.HandleFunc("/user/{id}/export", accountExportHandler)
+	auth_needed.HandleFunc("/user/{id}/delete", accountDeleteHandler)
+	auth_needed.HandleFunc("/user/{id}/webhook", webhookNewHandler)
+	auth_needed.HandleFunc("/user/{id}/webhook/{hookid}/delete", webhookDeleteHandler)
+
+	auth_needed.HandleFunc("/team", teamsHandler)
+	auth_needed.HandleFunc("/team/new", teamNewHandler)
+	auth_needed.HandleFunc("/team/{id}", teamSingleHandler)
+	auth_needed.HandleFunc("/team/{id}/member", teamMemberHandler)
+	auth_needed.HandleFunc("/team/{id}/member/{userid}/{action}", teamMemberHandler)
+	auth_needed.HandleFunc("/team/{id}/bot", teamBotHandler)
+	auth_needed.HandleFunc("/team/{id}/bot/{botid}/remove", teamBotHandler)
+	auth_needed.HandleFunc("/team/{id}/delete", teamDeleteHandler)
 
 	r.HandleFunc("/battle", battlesHandler)
 	r.HandleFunc("/battle/{id}", battleSingleHandler)
@@ -92,7 +164,34 @@ func main() {
 	auth_needed.HandleFunc("/battle/quick", battleQuickHandler)
 	auth_needed.HandleFunc("/battle/{id}/submit", battleSubmitHandler)
 	auth_needed.HandleFunc("/battle/{id}/run", battleRunHandler)
+	auth_needed.HandleFunc("/battle/{id}/series", battleSeriesHandler)
 	auth_needed.HandleFunc("/battle/{id}/delete", battleDeleteHandler)
+	auth_needed.HandleFunc("/battle/{id}/member", battleMemberHandler)
+	auth_needed.HandleFunc("/battle/{id}/member/{userid}/{action}", battleMemberHandler)
+	auth_needed.HandleFunc("/battle/{id}/disqualify", battleDisqualifyHandler)
+	auth_needed.HandleFunc("/battle/{id}/disqualify/{botid}/reinstate", battleDisqualifyHandler)
+	auth_needed.HandleFunc("/battle/{id}/share", battleShareHandler)
+	auth_needed.HandleFunc("/battle/{id}/share/{linkid}/revoke", battleShareHandler)
+	auth_needed.HandleFunc("/battle/{id}/join", battleJoinHandler)
+	auth_needed.HandleFunc("/battle/{id}/webhook", webhookNewHandler)
+	auth_needed.HandleFunc("/battle/{id}/webhook/{hookid}/delete", webhookDeleteHandler)
+
+	// endpoints only admins may use
+	admin_needed := auth_needed.PathPrefix("/admin").Subrouter()
+	admin_needed.Use(adminMiddleware)
+	admin_needed.HandleFunc("", adminHandler)
+	admin_needed.HandleFunc("/user/{id}", adminUserHandler)
+	admin_needed.HandleFunc("/bot/{id}", adminBotHandler)
+	admin_needed.HandleFunc("/battle/{id}", adminBattleHandler)
+	admin_needed.HandleFunc("/arch/{id}", adminArchHandler)
+	admin_needed.HandleFunc("/bit/{id}", adminBitHandler)
+
+	// the json api, authenticated using the session cookie or an api token. The description of the
+	// api is registered on the main router, as generating clients shouldn't require a login.
+	r.HandleFunc("/api/v1/openapi.json", apiOpenAPIHandler)
+	api := r.PathPrefix("/api/v1").Subrouter()
+	api.Use(apiMiddleware)
+	apiRoutes(api)
 
 	log.Printf("[i] HTTP Server running on %s:%d\n", host, port)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%d", host, port), r))
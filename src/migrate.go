@@ -0,0 +1,863 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migration is a single versioned change to the schema. Migrations are applied in order, each in
+// its own transaction together with recording its version in the schema_version table. down undoes
+// up, it is nil for migrations that can't be rolled back.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+	down    func(tx *sql.Tx) error
+}
+
+// migrations is the list of all migrations, append new ones at the end and never change the ones
+// that have been released, databases in the wild have already applied them
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(initialSchema)
+			return err
+		},
+	},
+	{
+		// databases created before the migrations existed lack the columns added over time, the
+		// create above doesn't touch tables that already exist
+		version: 2,
+		name:    "add the columns and defaults missing from old databases",
+		up: func(tx *sql.Tx) error {
+			for _, c := range legacyColumns {
+				if err := addColumnIfMissing(tx, c.table, c.column, c.decl); err != nil {
+					return err
+				}
+				query := fmt.Sprintf("UPDATE %s SET %s=? WHERE %s IS NULL", c.table, c.column, c.column)
+				if _, err := tx.Exec(query, c.def); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version: 3,
+		name:    "index the battle and run lookups",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				CREATE INDEX IF NOT EXISTS bot_battle_rel_battle ON bot_battle_rel(battle_id);
+				CREATE INDEX IF NOT EXISTS user_battle_rel_battle ON user_battle_rel(battle_id);
+				CREATE INDEX IF NOT EXISTS runs_battle ON runs(battle_id, created_at);
+				CREATE INDEX IF NOT EXISTS fights_run ON fights(run_id);`)
+			return err
+		},
+		down: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				DROP INDEX IF EXISTS bot_battle_rel_battle;
+				DROP INDEX IF EXISTS user_battle_rel_battle;
+				DROP INDEX IF EXISTS runs_battle;
+				DROP INDEX IF EXISTS fights_run;`)
+			return err
+		},
+	},
+	{
+		// SQLite can't add constraints to existing tables, so the tables are rebuilt. Rows pointing
+		// to things deleted before are dropped, they'd violate the new constraints.
+		version: 4,
+		name:    "foreign keys with cascading deletes",
+		up: func(tx *sql.Tx) error {
+			// webhooks of a user used the battle id 0 instead of NULL
+			if _, err := tx.Exec("UPDATE webhooks SET battle_id=NULL WHERE battle_id=0"); err != nil {
+				return err
+			}
+			// parents before their children, the tables referenced must have been rebuilt already
+			for _, t := range foreignKeyTables {
+				if err := t.removeOrphans(tx); err != nil {
+					return err
+				}
+				if err := rebuildTable(tx, t.table, t.columnNames(), t.schema(true)); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		down: func(tx *sql.Tx) error {
+			// children before their parents, dropping a parent would cascade to them otherwise
+			for i := len(foreignKeyTables) - 1; i >= 0; i-- {
+				t := foreignKeyTables[i]
+				if err := rebuildTable(tx, t.table, t.columnNames(), t.schema(false)); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec("UPDATE webhooks SET battle_id=0 WHERE battle_id IS NULL")
+			return err
+		},
+	},
+	{
+		// bots removed from a team go back to the user who added them, the bots added before don't
+		// know and go to the owner removing them
+		version: 5,
+		name:    "remember who added a bot to a team",
+		up: func(tx *sql.Tx) error {
+			return addColumnIfMissing(tx, "team_bot_rel", "added_by", "INTEGER REFERENCES users(id) ON DELETE SET NULL")
+		},
+		down: func(tx *sql.Tx) error {
+			// SQLite can't drop columns with a foreign key, back to the table of migration 4
+			t := foreignKeyTableNamed("team_bot_rel")
+			return rebuildTable(tx, t.table, t.columnNames(), t.schema(true))
+		},
+	},
+	{
+		// users joining a battle using a share link lose their membership when it gets revoked
+		version: 6,
+		name:    "remember the share link a member joined with",
+		up: func(tx *sql.Tx) error {
+			return addColumnIfMissing(tx, "user_battle_rel", "share_link_id", "INTEGER REFERENCES battle_share_links(id) ON DELETE CASCADE")
+		},
+		down: func(tx *sql.Tx) error {
+			t := foreignKeyTableNamed("user_battle_rel")
+			return rebuildTable(tx, t.table, t.columnNames(), t.schema(true))
+		},
+	},
+	{
+		// the times stored as text compare wrongly across timezone offsets, the throttling of the
+		// logins compares the time in nanoseconds instead
+		version: 7,
+		name:    "store the time of login attempts as a number",
+		up: func(tx *sql.Tx) error {
+			if err := addColumnIfMissing(tx, "login_attempts", "created_ns", "INTEGER"); err != nil {
+				return err
+			}
+
+			rows, err := tx.Query("SELECT id, created_at FROM login_attempts")
+			if err != nil {
+				return err
+			}
+			times := map[int]string{}
+			for rows.Next() {
+				var id int
+				var t string
+				if err := rows.Scan(&id, &t); err != nil {
+					rows.Close()
+					return err
+				}
+				times[id] = t
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			for id, text := range times {
+				// attempts with a time that can't be read are too old to be throttled on
+				var ns int64
+				if t, err := migrateParseTime(text); err == nil {
+					ns = t.UnixNano()
+				} else {
+					log.Printf("[!] Login attempt %d: %s", id, err)
+				}
+				if _, err := tx.Exec("UPDATE login_attempts SET created_ns=? WHERE id=?", ns, id); err != nil {
+					return err
+				}
+			}
+
+			_, err = tx.Exec(`
+				DROP INDEX IF EXISTS login_attempts_username;
+				DROP INDEX IF EXISTS login_attempts_ip;
+				CREATE INDEX login_attempts_username_ns ON login_attempts(username, created_ns);
+				CREATE INDEX login_attempts_ip_ns ON login_attempts(ip, created_ns);`)
+			return err
+		},
+		down: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+				DROP INDEX IF EXISTS login_attempts_username_ns;
+				DROP INDEX IF EXISTS login_attempts_ip_ns;
+				ALTER TABLE login_attempts DROP COLUMN created_ns;
+				CREATE INDEX login_attempts_username ON login_attempts(username, created_at);
+				CREATE INDEX login_attempts_ip ON login_attempts(ip, created_at);`)
+			return err
+		},
+	},
+}
+
+// initialSchema is the schema created by migration 1. It's frozen like every released migration,
+// schema changes are new migrations appended to the migrations.
+const initialSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER NOT NULL PRIMARY KEY,
+	created_at DATETIME NOT NULL,
+	name TEXT,
+	passwordHash TEXT,
+	role TEXT,
+	disabled BOOLEAN
+);
+CREATE TABLE IF NOT EXISTS bots (
+	id INTEGER NOT NULL PRIMARY KEY,
+	created_at DATETIME NOT NULL,
+	name TEXT,
+	source TEXT,
+	hidden BOOLEAN
+);
+CREATE TABLE IF NOT EXISTS battles (
+	id INTEGER NOT NULL PRIMARY KEY,
+	created_at DATETIME NOT NULL,
+	name TEXT,
+	public BOOLEAN,
+	raw_output TEXT,
+	max_rounds INTEGER,
+	arena_size INTEGER,
+	arena_fill TEXT,
+	arena_fill_value TEXT,
+	sp_init TEXT,
+	sp_init_value INTEGER,
+	bp_init TEXT,
+	bp_init_value INTEGER,
+	gpr_init TEXT,
+	gpr_init_value INTEGER,
+	max_bot_size INTEGER,
+	mixed_arch BOOLEAN,
+	hidden BOOLEAN,
+	visibility TEXT
+);
+CREATE TABLE IF NOT EXISTS archs (
+	id INTEGER NOT NULL PRIMARY KEY,
+	name TEXT,
+	enabled BOOLEAN,
+    UNIQUE(name)
+);
+INSERT OR IGNORE INTO archs (name) VALUES
+	("null"), ("6502"), ("6502.cs"), ("8051"), ("alpha"), ("amd29k"),
+	("any.as"), ("any.vasm"), ("arm.nz"), ("arm"), ("avr"), ("bf"), ("bpf.mr"),
+	("bpf"), ("chip8"), ("cr16"), ("cris"), ("dalvik"), ("dis"), ("ebc"),
+	("evm"), ("fslsp"), ("gb"), ("h8300"), ("i4004"), ("i8080"), ("java"),
+	("jdh8"), ("kvx"), ("lh5801"), ("lm32"), ("m680x"), ("m68k"), ("mcore"),
+	("mcs96"), ("mips"), ("msp430"), ("nios2"), ("or1k"), ("pic"), ("ppc"),
+	("propeller"), ("pyc"), ("riscv"), ("riscv.cs"), ("rsp"), ("s390"),
+	("sh"), ("sh.cs"), ("snes"), ("sparc"), ("tms320"), ("tricore"),
+	("tricore.cs"), ("v850"), ("vax"), ("wasm"), ("ws"), ("x86"), ("x86.nz"),
+	("xap"), ("xcore"), ("arm.gnu"), ("lanai"), ("loongarch"), ("m68k.gnu"),
+	("mips.gnu"), ("nds32"), ("pdp11"), ("ppc.gnu"), ("s390.gnu"),
+	("sparc.gnu"), ("xtensa"), ("z80")
+;
+
+/*
+	("x86-64"), ("Alpha"), ("ARM"), ("AVR"), ("BPF"), ("MIPS"), ("PowerPC"),
+	("SPARC"), ("RISC-V"), ("SH"), ("m68k"), ("S390"), ("XCore"), ("CR16"),
+	("HPPA"), ("ARC"), ("Blackfin"), ("Z80"), ("H8/300"), ("V810"), ("PDP11"),
+	("m680x"), ("V850"), ("CRIS"), ("XAP (CSR)"), ("PIC"), ("LM32"), ("8051"),
+	("6502"), ("i4004"), ("i8080"), ("Propeller"), ("EVM"), ("OR1K Tricore"),
+	("CHIP-8"), ("LH5801"), ("T8200"), ("GameBoy"), ("SNES"), ("SPC700"),
+	("MSP430"), ("Xtensa"), ("xcore"), ("NIOS II"), ("Java"), ("Dalvik"),
+	("Pickle"), ("WebAssembly"), ("MSIL"), ("EBC"), ("TMS320"), ("c54x"), ("c55x"),
+	("c55+"), ("c64x"), ("Hexagon"), ("Brainfuck"), ("Malbolge"),
+	("whitespace"), ("DCPU16"), ("LANAI"), ("lm32"), ("MCORE"), ("mcs96"),
+	("RSP"), ("SuperH-4"), ("VAX"), ("KVX"), ("Am29000"), ("LOONGARCH"),
+	("JDH8"), ("s390x"), ("STM8.")
+*/
+
+CREATE TABLE IF NOT EXISTS bits (
+	id INTEGER NOT NULL PRIMARY KEY,
+	name TEXT,
+	enabled BOOLEAN,
+    UNIQUE(name)
+);
+INSERT OR IGNORE INTO bits (name) VALUES
+	("8"), ("16"), ("32"), ("64")
+;
+
+CREATE TABLE IF NOT EXISTS user_bot_rel (
+	user_id INTEGER,
+	bot_id INTEGER,
+	PRIMARY KEY(user_id, bot_id)
+);
+CREATE TABLE IF NOT EXISTS arch_bot_rel (
+	arch_id INTEGER,
+	bot_id INTEGER,
+	PRIMARY KEY(arch_id, bot_id)
+);
+CREATE TABLE IF NOT EXISTS bit_bot_rel (
+	bit_id INTEGER,
+	bot_id INTEGER,
+	PRIMARY KEY(bit_id, bot_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_battle_rel (
+	user_id INTEGER,
+	battle_id INTEGER,
+	role TEXT,
+	PRIMARY KEY(user_id, battle_id)
+);
+CREATE TABLE IF NOT EXISTS owner_battle_rel (
+	user_id INTEGER,
+	battle_id INTEGER,
+	PRIMARY KEY(user_id, battle_id)
+);
+CREATE TABLE IF NOT EXISTS battle_share_links (
+	id INTEGER NOT NULL PRIMARY KEY,
+	created_at DATETIME NOT NULL,
+	battle_id INTEGER,
+	user_id INTEGER,
+	expires_at DATETIME NOT NULL
+);
+CREATE TABLE IF NOT EXISTS battle_disqualifications (
+	battle_id INTEGER,
+	bot_id INTEGER,
+	user_id INTEGER,
+	created_at DATETIME NOT NULL,
+	reason TEXT,
+	PRIMARY KEY(battle_id, bot_id)
+);
+CREATE TABLE IF NOT EXISTS bot_battle_rel (
+	bot_id INTEGER,
+	battle_id INTEGER,
+	PRIMARY KEY(bot_id, battle_id)
+);
+CREATE TABLE IF NOT EXISTS arch_battle_rel (
+	arch_id INTEGER,
+	battle_id INTEGER,
+	PRIMARY KEY(arch_id, battle_id)
+);
+CREATE TABLE IF NOT EXISTS bit_battle_rel (
+	bit_id INTEGER,
+	battle_id INTEGER,
+	PRIMARY KEY(bit_id, battle_id)
+);
+
+CREATE TABLE IF NOT EXISTS teams (
+	id INTEGER NOT NULL PRIMARY KEY,
+	created_at DATETIME NOT NULL,
+	name TEXT,
+	UNIQUE(name)
+);
+CREATE TABLE IF NOT EXISTS team_members (
+	team_id INTEGER,
+	user_id INTEGER,
+	role TEXT,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY(team_id, user_id)
+);
+CREATE TABLE IF NOT EXISTS team_bot_rel (
+	team_id INTEGER,
+	bot_id INTEGER,
+	PRIMARY KEY(team_id, bot_id)
+);
+
+CREATE TABLE IF NOT EXISTS tokens (
+	id INTEGER NOT NULL PRIMARY KEY,
+	created_at DATETIME NOT NULL,
+	user_id INTEGER,
+	name TEXT,
+	scopes TEXT,
+	token_hash TEXT,
+	last_used_at DATETIME,
+	UNIQUE(token_hash)
+);
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+	id INTEGER NOT NULL PRIMARY KEY,
+	created_at DATETIME NOT NULL,
+	username TEXT,
+	ip TEXT,
+	success BOOLEAN,
+	reason TEXT
+);
+CREATE INDEX IF NOT EXISTS login_attempts_username ON login_attempts(username, created_at);
+CREATE INDEX IF NOT EXISTS login_attempts_ip ON login_attempts(ip, created_at);
+
+CREATE TABLE IF NOT EXISTS oidc_identities (
+	id INTEGER NOT NULL PRIMARY KEY,
+	created_at DATETIME NOT NULL,
+	user_id INTEGER,
+	issuer TEXT,
+	subject TEXT,
+	email TEXT,
+	UNIQUE(issuer, subject)
+);
+
+CREATE TABLE IF NOT EXISTS totp (
+	user_id INTEGER NOT NULL PRIMARY KEY,
+	created_at DATETIME NOT NULL,
+	secret TEXT,
+	enabled BOOLEAN,
+	last_step INTEGER
+);
+CREATE TABLE IF NOT EXISTS recovery_codes (
+	id INTEGER NOT NULL PRIMARY KEY,
+	created_at DATETIME NOT NULL,
+	user_id INTEGER,
+	code_hash TEXT,
+	used_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+	id INTEGER NOT NULL PRIMARY KEY,
+	created_at DATETIME NOT NULL,
+	user_id INTEGER,
+	battle_id INTEGER,
+	url TEXT,
+	secret TEXT,
+	events TEXT
+);
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id INTEGER NOT NULL PRIMARY KEY,
+	created_at DATETIME NOT NULL,
+	webhook_id INTEGER,
+	event TEXT,
+	payload TEXT,
+	state TEXT,
+	attempts INTEGER,
+	next_attempt_at DATETIME,
+	status_code INTEGER,
+	error TEXT
+);
+
+CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER NOT NULL PRIMARY KEY,
+	created_at DATETIME NOT NULL,
+	battle_id INTEGER,
+	status TEXT,
+	fights INTEGER,
+	seed INTEGER,
+	error TEXT
+);
+CREATE TABLE IF NOT EXISTS fights (
+	id INTEGER NOT NULL PRIMARY KEY,
+	run_id INTEGER,
+	seed INTEGER,
+	first_bot_id INTEGER,
+	second_bot_id INTEGER,
+	winner_bot_id INTEGER,
+	rounds INTEGER
+);
+`
+
+// legacyColumns are the columns added to the schema before there were migrations, in the order
+// they were added (the inserts rely on the column order) along with the value for existing rows.
+// The tables of databases created at any point before the migrations have a prefix of their
+// columns listed here, the ones missing are added.
+var legacyColumns = []struct {
+	table  string
+	column string
+	decl   string
+	def    any
+}{
+	// the admin panel: user roles, disabling users and hiding bots and battles
+	{"users", "role", "TEXT", RoleUser},
+	{"users", "disabled", "BOOLEAN", false},
+	{"bots", "hidden", "BOOLEAN", false},
+
+	// the battle settings, the first three are part of the oldest schema
+	{"battles", "raw_output", "TEXT", ""},
+	{"battles", "max_rounds", "INTEGER", 100},
+	{"battles", "arena_size", "INTEGER", 4096},
+	// the arena fill patterns
+	{"battles", "arena_fill", "TEXT", "zeros"},
+	{"battles", "arena_fill_value", "TEXT", ""},
+	// the initial register state
+	{"battles", "sp_init", "TEXT", "keep"},
+	{"battles", "sp_init_value", "INTEGER", 0},
+	{"battles", "bp_init", "TEXT", "keep"},
+	{"battles", "bp_init_value", "INTEGER", 0},
+	{"battles", "gpr_init", "TEXT", "keep"},
+	{"battles", "gpr_init_value", "INTEGER", 0},
+	// the bot size limit
+	{"battles", "max_bot_size", "INTEGER", 0},
+	// mixed arch battles
+	{"battles", "mixed_arch", "BOOLEAN", false},
+	// the admin panel
+	{"battles", "hidden", "BOOLEAN", false},
+	// visibility, invitations and share links
+	{"battles", "visibility", "TEXT", BattlePublic},
+
+	// the admin panel
+	{"archs", "enabled", "BOOLEAN", true},
+	{"bits", "enabled", "BOOLEAN", true},
+
+	// the battle roles
+	{"user_battle_rel", "role", "TEXT", BattleRoleParticipant},
+}
+
+// migrateParseTime parses a time stored by the sqlite driver, which writes them in the format of
+// time.Time.String() and hands them back as RFC 3339 when it can read them itself
+func migrateParseTime(text string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, text); err == nil {
+		return t, nil
+	}
+	// without the name of the zone, which might be an offset as well
+	fields := strings.Fields(text)
+	if len(fields) >= 3 {
+		text = strings.Join(fields[:3], " ")
+	}
+	return time.Parse("2006-01-02 15:04:05.999999999 -0700", text)
+}
+
+// addColumnIfMissing adds the column to the table unless it's already there
+func addColumnIfMissing(tx *sql.Tx, table string, column string, decl string) error {
+	var count int
+	err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?", table, column).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl))
+	return err
+}
+
+// foreignKey references the id of the parent table, onDelete is the action taken when the parent
+// row is deleted (CASCADE or SET NULL)
+type foreignKey struct {
+	column   string
+	parent   string
+	onDelete string
+}
+
+// foreignKeyTable is a table with foreign keys, as added by migration 4
+type foreignKeyTable struct {
+	table       string
+	columns     []string
+	constraints []string
+	keys        []foreignKey
+}
+
+var foreignKeyTables = []foreignKeyTable{
+	{"user_bot_rel", []string{"user_id INTEGER", "bot_id INTEGER"}, []string{"PRIMARY KEY(user_id, bot_id)"},
+		[]foreignKey{{"user_id", "users", "CASCADE"}, {"bot_id", "bots", "CASCADE"}}},
+	{"arch_bot_rel", []string{"arch_id INTEGER", "bot_id INTEGER"}, []string{"PRIMARY KEY(arch_id, bot_id)"},
+		[]foreignKey{{"arch_id", "archs", "CASCADE"}, {"bot_id", "bots", "CASCADE"}}},
+	{"bit_bot_rel", []string{"bit_id INTEGER", "bot_id INTEGER"}, []string{"PRIMARY KEY(bit_id, bot_id)"},
+		[]foreignKey{{"bit_id", "bits", "CASCADE"}, {"bot_id", "bots", "CASCADE"}}},
+
+	{"user_battle_rel", []string{"user_id INTEGER", "battle_id INTEGER", "role TEXT"}, []string{"PRIMARY KEY(user_id, battle_id)"},
+		[]foreignKey{{"user_id", "users", "CASCADE"}, {"battle_id", "battles", "CASCADE"}}},
+	{"owner_battle_rel", []string{"user_id INTEGER", "battle_id INTEGER"}, []string{"PRIMARY KEY(user_id, battle_id)"},
+		[]foreignKey{{"user_id", "users", "CASCADE"}, {"battle_id", "battles", "CASCADE"}}},
+	{"bot_battle_rel", []string{"bot_id INTEGER", "battle_id INTEGER"}, []string{"PRIMARY KEY(bot_id, battle_id)"},
+		[]foreignKey{{"bot_id", "bots", "CASCADE"}, {"battle_id", "battles", "CASCADE"}}},
+	{"arch_battle_rel", []string{"arch_id INTEGER", "battle_id INTEGER"}, []string{"PRIMARY KEY(arch_id, battle_id)"},
+		[]foreignKey{{"arch_id", "archs", "CASCADE"}, {"battle_id", "battles", "CASCADE"}}},
+	{"bit_battle_rel", []string{"bit_id INTEGER", "battle_id INTEGER"}, []string{"PRIMARY KEY(bit_id, battle_id)"},
+		[]foreignKey{{"bit_id", "bits", "CASCADE"}, {"battle_id", "battles", "CASCADE"}}},
+	{"battle_share_links", []string{"id INTEGER NOT NULL PRIMARY KEY", "created_at DATETIME NOT NULL", "battle_id INTEGER", "user_id INTEGER", "expires_at DATETIME NOT NULL"}, nil,
+		[]foreignKey{{"battle_id", "battles", "CASCADE"}, {"user_id", "users", "CASCADE"}}},
+	// the disqualification stays when the referee deletes their account
+	{"battle_disqualifications", []string{"battle_id INTEGER", "bot_id INTEGER", "user_id INTEGER", "created_at DATETIME NOT NULL", "reason TEXT"}, []string{"PRIMARY KEY(battle_id, bot_id)"},
+		[]foreignKey{{"battle_id", "battles", "CASCADE"}, {"bot_id", "bots", "CASCADE"}, {"user_id", "users", "SET NULL"}}},
+
+	{"team_members", []string{"team_id INTEGER", "user_id INTEGER", "role TEXT", "created_at DATETIME NOT NULL"}, []string{"PRIMARY KEY(team_id, user_id)"},
+		[]foreignKey{{"team_id", "teams", "CASCADE"}, {"user_id", "users", "CASCADE"}}},
+	{"team_bot_rel", []string{"team_id INTEGER", "bot_id INTEGER"}, []string{"PRIMARY KEY(team_id, bot_id)"},
+		[]foreignKey{{"team_id", "teams", "CASCADE"}, {"bot_id", "bots", "CASCADE"}}},
+
+	{"tokens", []string{"id INTEGER NOT NULL PRIMARY KEY", "created_at DATETIME NOT NULL", "user_id INTEGER", "name TEXT", "scopes TEXT", "token_hash TEXT", "last_used_at DATETIME"}, []string{"UNIQUE(token_hash)"},
+		[]foreignKey{{"user_id", "users", "CASCADE"}}},
+	{"oidc_identities", []string{"id INTEGER NOT NULL PRIMARY KEY", "created_at DATETIME NOT NULL", "user_id INTEGER", "issuer TEXT", "subject TEXT", "email TEXT"}, []string{"UNIQUE(issuer, subject)"},
+		[]foreignKey{{"user_id", "users", "CASCADE"}}},
+	{"totp", []string{"user_id INTEGER NOT NULL PRIMARY KEY", "created_at DATETIME NOT NULL", "secret TEXT", "enabled BOOLEAN", "last_step INTEGER"}, nil,
+		[]foreignKey{{"user_id", "users", "CASCADE"}}},
+	{"recovery_codes", []string{"id INTEGER NOT NULL PRIMARY KEY", "created_at DATETIME NOT NULL", "user_id INTEGER", "code_hash TEXT", "used_at DATETIME"}, nil,
+		[]foreignKey{{"user_id", "users", "CASCADE"}}},
+
+	{"webhooks", []string{"id INTEGER NOT NULL PRIMARY KEY", "created_at DATETIME NOT NULL", "user_id INTEGER", "battle_id INTEGER", "url TEXT", "secret TEXT", "events TEXT"}, nil,
+		[]foreignKey{{"user_id", "users", "CASCADE"}, {"battle_id", "battles", "CASCADE"}}},
+	{"webhook_deliveries", []string{"id INTEGER NOT NULL PRIMARY KEY", "created_at DATETIME NOT NULL", "webhook_id INTEGER", "event TEXT", "payload TEXT", "state TEXT", "attempts INTEGER", "next_attempt_at DATETIME", "status_code INTEGER", "error TEXT"}, nil,
+		[]foreignKey{{"webhook_id", "webhooks", "CASCADE"}}},
+
+	// the fights keep pointing to deleted bots, the results of the others stay intact
+	{"runs", []string{"id INTEGER NOT NULL PRIMARY KEY", "created_at DATETIME NOT NULL", "battle_id INTEGER", "status TEXT", "fights INTEGER", "seed INTEGER", "error TEXT"}, nil,
+		[]foreignKey{{"battle_id", "battles", "CASCADE"}}},
+	{"fights", []string{"id INTEGER NOT NULL PRIMARY KEY", "run_id INTEGER", "seed INTEGER", "first_bot_id INTEGER", "second_bot_id INTEGER", "winner_bot_id INTEGER", "rounds INTEGER"}, nil,
+		[]foreignKey{{"run_id", "runs", "CASCADE"}}},
+}
+
+// foreignKeyTableNamed returns the table of the foreignKeyTables with the given name
+func foreignKeyTableNamed(table string) foreignKeyTable {
+	for _, t := range foreignKeyTables {
+		if t.table == table {
+			return t
+		}
+	}
+	panic(fmt.Sprintf("no foreign key table %s", table))
+}
+
+// schema returns the column definitions and constraints of the table, with or without the
+// foreign keys
+func (t foreignKeyTable) schema(withKeys bool) string {
+	defs := append([]string{}, t.columns...)
+	defs = append(defs, t.constraints...)
+	if withKeys {
+		for _, k := range t.keys {
+			defs = append(defs, fmt.Sprintf("FOREIGN KEY(%s) REFERENCES %s(id) ON DELETE %s", k.column, k.parent, k.onDelete))
+		}
+	}
+	return strings.Join(defs, ",\n\t")
+}
+
+// columnNames returns the names of the columns of the table, without their types
+func (t foreignKeyTable) columnNames() []string {
+	var names []string
+	for _, c := range t.columns {
+		names = append(names, strings.Fields(c)[0])
+	}
+	return names
+}
+
+// removeOrphans applies the action of the foreign keys to the rows whose parent doesn't exist
+// anymore
+func (t foreignKeyTable) removeOrphans(tx *sql.Tx) error {
+	for _, k := range t.keys {
+		query := fmt.Sprintf("DELETE FROM %s WHERE %s NOT IN (SELECT id FROM %s)", t.table, k.column, k.parent)
+		if k.onDelete == "SET NULL" {
+			query = fmt.Sprintf("UPDATE %s SET %s=NULL WHERE %s NOT IN (SELECT id FROM %s)", t.table, k.column, k.column, k.parent)
+		}
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildTable replaces the table with one created from the schema, keeping the rows and the
+// indexes. The given columns are copied by name, so their order in the old table doesn't matter
+// (columns added using ALTER TABLE end up last) and columns not listed are dropped.
+func rebuildTable(tx *sql.Tx, table string, columns []string, schema string) error {
+	rows, err := tx.Query("SELECT sql FROM sqlite_master WHERE type='index' AND tbl_name=? AND sql IS NOT NULL", table)
+	if err != nil {
+		return err
+	}
+	var indexes []string
+	for rows.Next() {
+		var index string
+		if err := rows.Scan(&index); err != nil {
+			rows.Close()
+			return err
+		}
+		indexes = append(indexes, index)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	statements := []string{
+		fmt.Sprintf("CREATE TABLE %s_new (\n\t%s\n)", table, schema),
+		fmt.Sprintf("INSERT INTO %s_new (%s) SELECT %s FROM %s", table, strings.Join(columns, ", "), strings.Join(columns, ", "), table),
+		fmt.Sprintf("DROP TABLE %s", table),
+		fmt.Sprintf("ALTER TABLE %s_new RENAME TO %s", table, table),
+	}
+	for _, statement := range append(statements, indexes...) {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("rebuilding %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func latestMigration() int {
+	return migrations[len(migrations)-1].version
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// DATABASE
+
+// SchemaVersion returns the version of the latest migration applied to the database, 0 if none
+func SchemaVersion(db *sql.DB) (int, error) {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER NOT NULL PRIMARY KEY,
+			name TEXT,
+			applied_at DATETIME NOT NULL
+		)`)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// SchemaApplied returns when each of the applied migrations has been applied
+func SchemaApplied(db *sql.DB) (map[int]time.Time, error) {
+	rows, err := db.Query("SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return applied, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// MigrateUp applies all migrations after the current version up to (and including) target
+func MigrateUp(db *sql.DB, target int) error {
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > latestMigration() {
+		return fmt.Errorf("the database is at version %d, newer than the latest known migration %d", current, latestMigration())
+	}
+
+	for _, m := range migrations {
+		if m.version <= current || m.version > target {
+			continue
+		}
+
+		log.Printf("[i] Applying migration %d (%s)...", m.version, m.name)
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := m.up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		_, err = tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)", m.version, m.name, time.Now())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateDown rolls back the applied migrations after target, the newest first
+func MigrateDown(db *sql.DB, target int) error {
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > latestMigration() {
+		return fmt.Errorf("the database is at version %d, newer than the latest known migration %d", current, latestMigration())
+	}
+
+	// rolling back the initial schema would drop all the data, remove the database instead
+	if target < 1 {
+		return fmt.Errorf("can't roll back below version 1, the initial schema, remove the database file instead")
+	}
+
+	// check everything can be rolled back before touching anything
+	for i := len(migrations) - 1; i >= 0; i-- {
+		if m := migrations[i]; m.version > target && m.version <= current && m.down == nil {
+			return fmt.Errorf("migration %d (%s) can't be rolled back", m.version, m.name)
+		}
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version <= target || m.version > current {
+			continue
+		}
+
+		log.Printf("[i] Rolling back migration %d (%s)...", m.version, m.name)
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := m.down(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if _, err := tx.Exec("DELETE FROM schema_version WHERE version=?", m.version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// COMMAND
+
+// migrateCommand implements the migrate subcommand:
+//
+//	migrate status              list the migrations and whether they have been applied
+//	migrate apply [version]     apply the pending migrations (up to the given version)
+//	migrate rollback [version]  roll back to the given version (default: the previous one)
+func migrateCommand(args []string) {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "usage: migrate status | apply [version] | rollback [version]")
+		os.Exit(2)
+	}
+	if len(args) < 1 || len(args) > 2 {
+		usage()
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		log.Fatal("Error opening the db: ", err)
+	}
+	defer db.Close()
+
+	current, err := SchemaVersion(db)
+	if err != nil {
+		log.Fatal("Error getting the schema version: ", err)
+	}
+
+	version := -1
+	if len(args) == 2 {
+		version, err = strconv.Atoi(args[1])
+		if err != nil || version < 0 || version > latestMigration() {
+			log.Fatalf("Invalid version %q, expected a number between 0 and %d", args[1], latestMigration())
+		}
+	}
+
+	switch args[0] {
+	case "status":
+		if len(args) != 1 {
+			usage()
+		}
+		applied, err := SchemaApplied(db)
+		if err != nil {
+			log.Fatal("Error getting the applied migrations: ", err)
+		}
+		fmt.Printf("database %s is at version %d (latest %d)\n", databasePath, current, latestMigration())
+		for _, m := range migrations {
+			state := "pending"
+			if at, ok := applied[m.version]; ok {
+				state = "applied " + at.Format(time.DateTime)
+			}
+			fmt.Printf("%4d  %-27s  %s\n", m.version, state, m.name)
+		}
+	case "apply":
+		if version == -1 {
+			version = latestMigration()
+		}
+		if err := MigrateUp(db, version); err != nil {
+			log.Fatal("Error applying the migrations: ", err)
+		}
+	case "rollback":
+		if version == -1 {
+			version = max(current-1, 0)
+		}
+		if err := MigrateDown(db, version); err != nil {
+			log.Fatal("Error rolling back the migrations: ", err)
+		}
+	default:
+		usage()
+	}
+}
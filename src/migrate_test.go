@@ -0,0 +1,382 @@
+package main
+
+import (
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// legacySchema is the schema of the databases created before there were migrations
+//
+//go:embed testdata/legacy.sql
+var legacySchema string
+
+// legacyData is a bit of everything the legacy schema can hold: alice owns bot 1 and battle 1,
+// bob owns bot 2 and battle 2 and is a participant of battle 1, bot 3 is shared by both. The
+// last row points to a user that doesn't exist anymore.
+const legacyData = `
+INSERT INTO users VALUES (1, ?1, "alice", ""), (2, ?1, "bob", "");
+INSERT INTO bots VALUES (1, ?1, "one", "nop"), (2, ?1, "two", "nop"), (3, ?1, "three", "nop");
+INSERT INTO battles VALUES (1, ?1, "first", true, "", 100, 4096), (2, ?1, "second", false, "", 100, 4096);
+INSERT INTO user_bot_rel VALUES (1, 1), (2, 2), (1, 3), (2, 3);
+INSERT INTO arch_bot_rel VALUES (1, 1), (1, 2), (1, 3);
+INSERT INTO bit_bot_rel VALUES (1, 1), (1, 2), (1, 3);
+INSERT INTO owner_battle_rel VALUES (1, 1), (2, 2);
+INSERT INTO user_battle_rel VALUES (2, 1);
+INSERT INTO bot_battle_rel VALUES (1, 1), (2, 1), (3, 1), (2, 2);
+INSERT INTO arch_battle_rel VALUES (1, 1), (1, 2);
+INSERT INTO bit_battle_rel VALUES (1, 1), (1, 2);
+INSERT INTO user_bot_rel VALUES (99, 1);
+`
+
+// migrateTestDB opens an empty database in a temporary directory
+func migrateTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "main.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// migrateTestLegacyState fills a database with the legacyData, migrates it to the latest version
+// and makes it the globalState for the duration of the test
+func migrateTestLegacyState(t *testing.T) *State {
+	t.Helper()
+	db := migrateTestDB(t)
+	if _, err := db.Exec(legacySchema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(legacyData, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateUp(db, latestMigration()); err != nil {
+		t.Fatal(err)
+	}
+
+	old := globalState
+	globalState = &State{db: db, webhookWake: make(chan struct{}, 1)}
+	t.Cleanup(func() { globalState = old })
+	return globalState
+}
+
+func migrateTestCount(t *testing.T, db *sql.DB, query string, args ...any) int {
+	t.Helper()
+	var count int
+	if err := db.QueryRow(query, args...).Scan(&count); err != nil {
+		t.Fatalf("%s: %s", query, err)
+	}
+	return count
+}
+
+type migrateTestCountCheck struct {
+	query string
+	want  int
+}
+
+func migrateTestCheckCounts(t *testing.T, db *sql.DB, checks []migrateTestCountCheck) {
+	t.Helper()
+	for _, c := range checks {
+		if got := migrateTestCount(t, db, c.query); got != c.want {
+			t.Errorf("%s: %d, want %d", c.query, got, c.want)
+		}
+	}
+}
+
+// migrateTestSchema describes the tables of the database: their columns, foreign keys and indexes
+func migrateTestSchema(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	var tables []string
+	rows, err := db.Query(`
+		SELECT name FROM sqlite_master
+		WHERE type='table' AND name NOT LIKE 'sqlite_%' AND name != 'schema_version'
+		ORDER BY name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+
+	queries := []string{
+		"SELECT name || ' ' || type || ' ' || \"notnull\" || ' ' || pk FROM pragma_table_info(?)",
+		"SELECT 'key ' || \"from\" || ' ' || \"table\" || '(' || COALESCE(\"to\", 'id') || ') ' || on_delete FROM pragma_foreign_key_list(?) ORDER BY \"from\"",
+		"SELECT 'index ' || name FROM sqlite_master WHERE type='index' AND tbl_name=? AND sql IS NOT NULL ORDER BY name",
+	}
+	var schema strings.Builder
+	for _, table := range tables {
+		fmt.Fprintf(&schema, "%s\n", table)
+		for _, query := range queries {
+			rows, err := db.Query(query, table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for rows.Next() {
+				var line string
+				if err := rows.Scan(&line); err != nil {
+					t.Fatal(err)
+				}
+				fmt.Fprintf(&schema, "\t%s\n", line)
+			}
+			rows.Close()
+		}
+	}
+	return schema.String()
+}
+
+// migrateTestLowest returns the lowest version the database can be rolled back to
+func migrateTestLowest() int {
+	lowest := latestMigration()
+	for i := len(migrations) - 1; i >= 0 && migrations[i].down != nil; i-- {
+		lowest = migrations[i].version - 1
+	}
+	return lowest
+}
+
+func TestMigrateUpDown(t *testing.T) {
+	db := migrateTestDB(t)
+
+	// the schema after each migration, applied one at a time
+	schemas := map[int]string{}
+	for _, m := range migrations {
+		if err := MigrateUp(db, m.version); err != nil {
+			t.Fatal(err)
+		}
+		schemas[m.version] = migrateTestSchema(t, db)
+	}
+
+	// rolling back one at a time gives the same schemas
+	lowest := migrateTestLowest()
+	if lowest >= latestMigration() {
+		t.Fatal("the latest migration can't be rolled back")
+	}
+	for version := latestMigration() - 1; version >= lowest; version-- {
+		if err := MigrateDown(db, version); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := SchemaVersion(db); got != version {
+			t.Fatalf("at version %d after rolling back to %d", got, version)
+		}
+		if got := migrateTestSchema(t, db); got != schemas[version] {
+			t.Errorf("schema after rolling back to %d:\n%s\nwant:\n%s", version, got, schemas[version])
+		}
+	}
+
+	if err := MigrateDown(db, lowest-1); err == nil {
+		t.Errorf("rolling back migration %d succeeded", lowest)
+	}
+	if err := MigrateDown(db, 0); err == nil || !strings.Contains(err.Error(), "below version 1") {
+		t.Errorf("rolling back the initial schema: %v", err)
+	}
+
+	// and back up in one go
+	if err := MigrateUp(db, latestMigration()); err != nil {
+		t.Fatal(err)
+	}
+	if got := migrateTestSchema(t, db); got != schemas[latestMigration()] {
+		t.Errorf("schema after migrating up again:\n%s\nwant:\n%s", got, schemas[latestMigration()])
+	}
+}
+
+func TestMigrateUpDownKeepsData(t *testing.T) {
+	s := migrateTestLegacyState(t)
+	checks := []migrateTestCountCheck{
+		{"SELECT COUNT(*) FROM users", 2},
+		{"SELECT COUNT(*) FROM bots", 3},
+		{"SELECT COUNT(*) FROM battles", 2},
+		{"SELECT COUNT(*) FROM user_bot_rel", 4},
+		{"SELECT COUNT(*) FROM bot_battle_rel", 4},
+		{"SELECT COUNT(*) FROM user_battle_rel WHERE role='participant'", 1},
+	}
+
+	if err := MigrateDown(s.db, migrateTestLowest()); err != nil {
+		t.Fatal(err)
+	}
+	migrateTestCheckCounts(t, s.db, checks)
+
+	if err := MigrateUp(s.db, latestMigration()); err != nil {
+		t.Fatal(err)
+	}
+	migrateTestCheckCounts(t, s.db, checks)
+}
+
+// TestMigrateLegacyColumns upgrades databases created at every point before the migrations, each
+// having some of the legacyColumns already, and compares them to a fresh database
+func TestMigrateLegacyColumns(t *testing.T) {
+	fresh := migrateTestDB(t)
+	if err := MigrateUp(fresh, latestMigration()); err != nil {
+		t.Fatal(err)
+	}
+	want := migrateTestSchema(t, fresh)
+
+	for n := 0; n <= len(legacyColumns); n++ {
+		db := migrateTestDB(t)
+		if _, err := db.Exec(legacySchema); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(legacyData, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range legacyColumns[:n] {
+			query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.decl)
+			if _, err := db.Exec(query); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+				t.Fatal(err)
+			}
+		}
+
+		if err := MigrateUp(db, latestMigration()); err != nil {
+			t.Fatalf("with %d legacy columns: %v", n, err)
+		}
+		if got := migrateTestSchema(t, db); got != want {
+			t.Errorf("schema with %d legacy columns:\n%s\nwant:\n%s", n, got, want)
+		}
+		migrateTestCheckCounts(t, db, []migrateTestCountCheck{
+			{"SELECT COUNT(*) FROM users WHERE role IS NULL OR disabled IS NULL", 0},
+			{"SELECT COUNT(*) FROM battles WHERE visibility IS NULL OR max_bot_size IS NULL", 0},
+			{"SELECT COUNT(*) FROM user_battle_rel WHERE role IS NULL", 0},
+		})
+	}
+}
+
+func TestMigrateLegacyOrphans(t *testing.T) {
+	s := migrateTestLegacyState(t)
+	migrateTestCheckCounts(t, s.db, []migrateTestCountCheck{
+		{"SELECT COUNT(*) FROM user_bot_rel WHERE user_id=99", 0},
+		{"SELECT COUNT(*) FROM user_bot_rel", 4},
+		{"SELECT COUNT(*) FROM user_battle_rel WHERE role='participant'", 1},
+		{"SELECT COUNT(*) FROM users WHERE role='user' AND disabled=false", 2},
+		{"SELECT COUNT(*) FROM battles WHERE visibility='public'", 2},
+	})
+}
+
+func TestMigrateLegacyDeleteUser(t *testing.T) {
+	s := migrateTestLegacyState(t)
+
+	// alice's own bot goes, the shared one stays with bob
+	if err := s.DeleteAccount(1, "alice", AccountBotsDelete, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	migrateTestCheckCounts(t, s.db, []migrateTestCountCheck{
+		{"SELECT COUNT(*) FROM users WHERE id=1", 0},
+		{"SELECT COUNT(*) FROM user_bot_rel WHERE user_id=1", 0},
+		{"SELECT COUNT(*) FROM owner_battle_rel WHERE user_id=1", 0},
+		{"SELECT COUNT(*) FROM bots WHERE id=1", 0},
+		{"SELECT COUNT(*) FROM arch_bot_rel WHERE bot_id=1", 0},
+		{"SELECT COUNT(*) FROM bot_battle_rel WHERE bot_id=1", 0},
+		{"SELECT COUNT(*) FROM user_bot_rel WHERE bot_id=3", 1},
+		{"SELECT COUNT(*) FROM battles WHERE id=1", 1},
+	})
+}
+
+func TestMigrateLegacyDeleteBot(t *testing.T) {
+	s := migrateTestLegacyState(t)
+
+	if err := BotDeleteID(2); err != nil {
+		t.Fatal(err)
+	}
+	migrateTestCheckCounts(t, s.db, []migrateTestCountCheck{
+		{"SELECT COUNT(*) FROM user_bot_rel WHERE bot_id=2", 0},
+		{"SELECT COUNT(*) FROM arch_bot_rel WHERE bot_id=2", 0},
+		{"SELECT COUNT(*) FROM bit_bot_rel WHERE bot_id=2", 0},
+		{"SELECT COUNT(*) FROM bot_battle_rel WHERE bot_id=2", 0},
+		{"SELECT COUNT(*) FROM bot_battle_rel", 2},
+		{"SELECT COUNT(*) FROM users", 2},
+	})
+}
+
+func TestMigrateLegacyDeleteBattle(t *testing.T) {
+	s := migrateTestLegacyState(t)
+
+	runid, err := s.InsertRun(Run{BattleID: 1, Status: RunFinished, Fights: 1, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InsertFight(runid, 1, 1, 2, 1, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := BattleDeleteID(1); err != nil {
+		t.Fatal(err)
+	}
+	migrateTestCheckCounts(t, s.db, []migrateTestCountCheck{
+		{"SELECT COUNT(*) FROM battles WHERE id=1", 0},
+		{"SELECT COUNT(*) FROM owner_battle_rel WHERE battle_id=1", 0},
+		{"SELECT COUNT(*) FROM user_battle_rel WHERE battle_id=1", 0},
+		{"SELECT COUNT(*) FROM bot_battle_rel WHERE battle_id=1", 0},
+		{"SELECT COUNT(*) FROM arch_battle_rel WHERE battle_id=1", 0},
+		{"SELECT COUNT(*) FROM bit_battle_rel WHERE battle_id=1", 0},
+		{"SELECT COUNT(*) FROM runs", 0},
+		{"SELECT COUNT(*) FROM fights", 0},
+		{"SELECT COUNT(*) FROM bots", 3},
+		{"SELECT COUNT(*) FROM bot_battle_rel WHERE battle_id=2", 1},
+	})
+
+	if err := BattleDeleteID(1); err == nil {
+		t.Error("deleting the battle twice succeeded")
+	}
+}
+
+func TestRebuildTableColumnOrder(t *testing.T) {
+	db := migrateTestDB(t)
+	_, err := db.Exec(`
+		CREATE TABLE things (b TEXT, a INTEGER);
+		INSERT INTO things VALUES ("second", 1);
+		CREATE INDEX things_a ON things(a);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rebuildTable(tx, "things", []string{"a", "b"}, "a INTEGER,\n\tb TEXT"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	var a int
+	var b string
+	if err := db.QueryRow("SELECT * FROM things").Scan(&a, &b); err != nil {
+		t.Fatal(err)
+	}
+	if a != 1 || b != "second" {
+		t.Errorf("got a=%d b=%q after the rebuild", a, b)
+	}
+	if n := migrateTestCount(t, db, "SELECT COUNT(*) FROM sqlite_master WHERE type='index' AND name='things_a'"); n != 1 {
+		t.Error("the index got lost")
+	}
+}
+
+func TestMigrateLoginAttemptTimes(t *testing.T) {
+	db := migrateTestDB(t)
+	if err := MigrateUp(db, 6); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 11, 8, 12, 0, 0, 0, time.FixedZone("+02:00", 2*60*60))
+	_, err := db.Exec(`
+		INSERT INTO login_attempts (created_at, username, ip, success, reason)
+		VALUES (?, "alice", "192.0.2.1", false, ?)`, at, LoginInvalidPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateUp(db, 7); err != nil {
+		t.Fatal(err)
+	}
+	if got := migrateTestCount(t, db, "SELECT created_ns FROM login_attempts"); int64(got) != at.UnixNano() {
+		t.Errorf("created_ns %d, want %d", got, at.UnixNano())
+	}
+}
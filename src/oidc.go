@@ -0,0 +1,678 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Users can sign in using an OpenID Connect provider (authorization code flow with PKCE) if
+// -oidc-issuer and -oidc-client-id are given, the client secret is read from OIDC_CLIENT_SECRET.
+// The endpoints and keys of the provider are discovered using its
+// /.well-known/openid-configuration.
+//
+// An identity (issuer and subject) is linked to a single local user. Signing in with an unknown
+// identity creates a new user without a password, while signing in when already logged in links
+// the identity to the current user. Existing users are never linked by their name or email, as
+// anyone could register a matching name at the provider.
+const (
+	oidcStateKey    = "oidc_state"
+	oidcNonceKey    = "oidc_nonce"
+	oidcVerifierKey = "oidc_verifier"
+	oidcStartedKey  = "oidc_started"
+
+	oidcTimeout  = 5 * time.Minute // time the user may spend at the provider
+	oidcLeeway   = time.Minute     // allowed clock difference to the provider
+	oidcCallback = "/login/oidc/callback"
+)
+
+// OIDCIdentity is an identity at the provider linked to a local user
+type OIDCIdentity struct {
+	ID        int
+	CreatedAt time.Time
+	UserID    int
+	Issuer    string
+	Subject   string
+	Email     string
+}
+
+// oidcProvider is the part of the discovery document we need, along with the signing keys
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	keys map[string]*rsa.PublicKey
+}
+
+// oidcClaims are the claims of the id token we use
+type oidcClaims struct {
+	Issuer            string       `json:"iss"`
+	Subject           string       `json:"sub"`
+	Audience          oidcAudience `json:"aud"`
+	AuthorizedParty   string       `json:"azp"`
+	Expiry            int64        `json:"exp"`
+	IssuedAt          int64        `json:"iat"`
+	Nonce             string       `json:"nonce"`
+	PreferredUsername string       `json:"preferred_username"`
+	Email             string       `json:"email"`
+}
+
+// oidcAudience is either a single string or a list of strings
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = oidcAudience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+var oidc struct {
+	sync.Mutex
+	provider *oidcProvider
+}
+
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// usernames created from the claims are limited to these chars
+var oidcUsernameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+//////////////////////////////////////////////////////////////////////////////
+// GENERAL PURPOSE
+
+// OIDCEnabled returns true if a provider has been configured
+func OIDCEnabled() bool {
+	return oidcIssuer != "" && oidcClientID != ""
+}
+
+func OIDCGetAllForUser(userid int) ([]OIDCIdentity, error) {
+	return globalState.GetOIDCIdentitiesForUser(userid)
+}
+
+// OIDCUnlink removes the identity from the user. Users without a password need to keep at least
+// one identity, as they couldn't log in anymore otherwise.
+func OIDCUnlink(user User, identityid int) error {
+	identities, err := OIDCGetAllForUser(user.ID)
+	if err != nil {
+		return err
+	}
+	passwordHash, err := globalState.GetUserPasswordHash(user.Name)
+	if err != nil {
+		return err
+	}
+	if len(passwordHash) == 0 && len(identities) <= 1 {
+		return fmt.Errorf("set a password before unlinking your last identity")
+	}
+	return globalState.DeleteOIDCIdentity(user.ID, identityid)
+}
+
+// oidcGetJSON fetches the url and decodes the json response into v
+func oidcGetJSON(target string, v interface{}) error {
+	resp, err := oidcHTTPClient.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", target, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// oidcDiscover returns the provider, it is fetched once and then cached
+func oidcDiscover() (*oidcProvider, error) {
+	oidc.Lock()
+	defer oidc.Unlock()
+	if oidc.provider != nil {
+		return oidc.provider, nil
+	}
+
+	var provider oidcProvider
+	err := oidcGetJSON(strings.TrimSuffix(oidcIssuer, "/")+"/.well-known/openid-configuration", &provider)
+	if err != nil {
+		return nil, err
+	}
+	if provider.Issuer != oidcIssuer {
+		return nil, fmt.Errorf("the provider claims to be %q instead of %q", provider.Issuer, oidcIssuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, fmt.Errorf("the discovery document of %s is incomplete", oidcIssuer)
+	}
+
+	oidc.provider = &provider
+	return oidc.provider, nil
+}
+
+// key returns the public key with the given id. The keys are fetched again if the id is unknown,
+// as providers rotate their keys from time to time.
+func (p *oidcProvider) key(kid string) (*rsa.PublicKey, error) {
+	oidc.Lock()
+	defer oidc.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := oidcGetJSON(p.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	p.keys = map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			continue
+		}
+		p.keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// verify checks the signature and the claims of the id token and returns its claims
+func (p *oidcProvider) verify(idToken string, nonce string) (oidcClaims, error) {
+	var claims oidcClaims
+
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, err
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return claims, err
+	}
+	// RS256 is the only algorithm every provider has to support, accepting only it also rules
+	// out "none" and HMAC tokens signed using the public key
+	if header.Alg != "RS256" {
+		return claims, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return claims, fmt.Errorf("invalid id token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, err
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, err
+	}
+
+	now := time.Now()
+	switch {
+	case claims.Issuer != p.Issuer:
+		return claims, fmt.Errorf("id token issued by %q", claims.Issuer)
+	case !claims.Audience.contains(oidcClientID):
+		return claims, fmt.Errorf("id token issued for %v", claims.Audience)
+	case claims.AuthorizedParty != "" && claims.AuthorizedParty != oidcClientID:
+		return claims, fmt.Errorf("id token issued to %q", claims.AuthorizedParty)
+	case now.After(time.Unix(claims.Expiry, 0).Add(oidcLeeway)):
+		return claims, fmt.Errorf("id token expired")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return claims, fmt.Errorf("id token has the wrong nonce")
+	case claims.Subject == "":
+		return claims, fmt.Errorf("id token without a subject")
+	}
+	return claims, nil
+}
+
+func (a oidcAudience) contains(aud string) bool {
+	for _, a := range a {
+		if a == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// exchange redeems the authorization code at the token endpoint and returns the id token
+func (p *oidcProvider) exchange(code string, redirectURL string, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest("POST", p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(oidcClientID), url.QueryEscape(os.Getenv("OIDC_CLIENT_SECRET")))
+
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return "", fmt.Errorf("token endpoint: %s: %s", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || token.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s: %s %s", resp.Status, token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return "", fmt.Errorf("token endpoint: no id token returned")
+	}
+	return token.IDToken, nil
+}
+
+// oidcRedirectURLFor returns the url the provider sends the user back to, -oidc-redirect if
+// given and derived from the request otherwise
+func oidcRedirectURLFor(r *http.Request) string {
+	if oidcRedirectURL != "" {
+		return oidcRedirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil || (trustProxy && r.Header.Get("X-Forwarded-Proto") == "https") {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, r.Host, oidcCallback)
+}
+
+// oidcRandom returns a random url safe string
+func oidcRandom() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// oidcUserFor returns the user linked to the identity of the claims, creating a new one if there
+// is none yet
+func oidcUserFor(claims oidcClaims) (User, error) {
+	identity, err := globalState.GetOIDCIdentity(claims.Issuer, claims.Subject)
+	if err == nil {
+		return UserGetUserFromID(identity.UserID)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return User{}, err
+	}
+
+	// derive a name from the claims, adding a number if it's taken already
+	base := claims.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	base = oidcUsernameInvalid.ReplaceAllString(base, "")
+	if len(base) > 48 {
+		base = base[:48]
+	}
+	if base == "" {
+		base = "user"
+	}
+
+	name := base
+	for i := 2; ; i++ {
+		count, err := UserGetUsernameCount(name)
+		if err != nil {
+			return User{}, err
+		}
+		if count == 0 {
+			break
+		}
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+
+	// without a password hash, password logins never succeed for the user
+	id, err := UserRegister(name, nil)
+	if err != nil {
+		return User{}, err
+	}
+	log.Printf("[i] Created the user %s for %s at %s", name, claims.Subject, claims.Issuer)
+
+	if err := globalState.InsertOIDCIdentity(OIDCIdentity{UserID: id, Issuer: claims.Issuer, Subject: claims.Subject, Email: claims.Email}); err != nil {
+		return User{}, err
+	}
+	return UserGetUserFromID(id)
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// DATABASE
+
+func (s *State) InsertOIDCIdentity(identity OIDCIdentity) error {
+	_, err := s.db.Exec(`
+		INSERT INTO oidc_identities (created_at, user_id, issuer, subject, email)
+		VALUES (?, ?, ?, ?, ?)`,
+		time.Now(), identity.UserID, identity.Issuer, identity.Subject, identity.Email)
+	return err
+}
+
+func (s *State) GetOIDCIdentity(issuer string, subject string) (OIDCIdentity, error) {
+	var identity OIDCIdentity
+	err := s.db.QueryRow(`
+		SELECT id, created_at, user_id, issuer, subject, email
+		FROM oidc_identities
+		WHERE issuer=? AND subject=?`, issuer, subject).Scan(&identity.ID, &identity.CreatedAt, &identity.UserID, &identity.Issuer, &identity.Subject, &identity.Email)
+	return identity, err
+}
+
+func (s *State) GetOIDCIdentitiesForUser(userid int) ([]OIDCIdentity, error) {
+	rows, err := s.db.Query(`
+		SELECT id, created_at, user_id, issuer, subject, email
+		FROM oidc_identities
+		WHERE user_id=?
+		ORDER BY id`, userid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []OIDCIdentity
+	for rows.Next() {
+		var identity OIDCIdentity
+		if err := rows.Scan(&identity.ID, &identity.CreatedAt, &identity.UserID, &identity.Issuer, &identity.Subject, &identity.Email); err != nil {
+			return identities, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// Deletes the identity, the user id is checked so that users can only unlink their own identities
+func (s *State) DeleteOIDCIdentity(userid int, identityid int) error {
+	_, err := s.db.Exec("DELETE FROM oidc_identities WHERE id=? AND user_id=?", identityid, userid)
+	return err
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// HTTP
+
+// loginOIDCHandler sends the user to the provider. It's a POST, so that other sites can't start
+// linking identities to the account of the user.
+func loginOIDCHandler(w http.ResponseWriter, r *http.Request) {
+	redir_target := "/login?res=%s"
+
+	switch r.Method {
+	case "POST":
+		if !OIDCEnabled() {
+			log_and_redir_with_msg(w, r, nil, redir_target, "Single sign-on isn't configured")
+			return
+		}
+
+		provider, err := oidcDiscover()
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not reach the identity provider")
+			return
+		}
+
+		state, err1 := oidcRandom()
+		nonce, err2 := oidcRandom()
+		verifier, err3 := oidcRandom()
+		if err := errors.Join(err1, err2, err3); err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not start the login")
+			return
+		}
+
+		session, _ := globalState.sessions.Get(r, "session")
+		session.Values[oidcStateKey] = state
+		session.Values[oidcNonceKey] = nonce
+		session.Values[oidcVerifierKey] = verifier
+		session.Values[oidcStartedKey] = time.Now().Unix()
+		if err := session.Save(r, w); err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not store the login in your session")
+			return
+		}
+
+		challenge := sha256.Sum256([]byte(verifier))
+		params := url.Values{}
+		params.Set("response_type", "code")
+		params.Set("client_id", oidcClientID)
+		params.Set("redirect_uri", oidcRedirectURLFor(r))
+		params.Set("scope", "openid profile email")
+		params.Set("state", state)
+		params.Set("nonce", nonce)
+		params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+		params.Set("code_challenge_method", "S256")
+
+		separator := "?"
+		if strings.Contains(provider.AuthorizationEndpoint, "?") {
+			separator = "&"
+		}
+		http.Redirect(w, r, provider.AuthorizationEndpoint+separator+params.Encode(), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
+
+// loginOIDCCallbackHandler is where the provider sends the user back to. The user is logged in
+// (or the identity linked to the logged in user) after the code has been exchanged for a valid id
+// token.
+func loginOIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	redir_target := "/login?res=%s"
+
+	switch r.Method {
+	case "GET":
+		session, _ := globalState.sessions.Get(r, "session")
+		state, _ := session.Values[oidcStateKey].(string)
+		nonce, _ := session.Values[oidcNonceKey].(string)
+		verifier, _ := session.Values[oidcVerifierKey].(string)
+		started, _ := session.Values[oidcStartedKey].(int64)
+
+		// every login attempt can only be completed once
+		delete(session.Values, oidcStateKey)
+		delete(session.Values, oidcNonceKey)
+		delete(session.Values, oidcVerifierKey)
+		delete(session.Values, oidcStartedKey)
+		if err := session.Save(r, w); err != nil {
+			log.Println(err)
+		}
+
+		query := r.URL.Query()
+		if query.Get("error") != "" {
+			log_and_redir_with_msg(w, r, fmt.Errorf("oidc: %s: %s", query.Get("error"), query.Get("error_description")), redir_target, "The identity provider refused the login")
+			return
+		}
+		if state == "" || subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+			log_and_redir_with_msg(w, r, nil, redir_target, "Invalid login state, please try again")
+			return
+		}
+		if time.Since(time.Unix(started, 0)) > oidcTimeout {
+			log_and_redir_with_msg(w, r, nil, redir_target, "Took too long, please try again")
+			return
+		}
+
+		provider, err := oidcDiscover()
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not reach the identity provider")
+			return
+		}
+		idToken, err := provider.exchange(query.Get("code"), oidcRedirectURLFor(r), verifier)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not redeem the login at the identity provider")
+			return
+		}
+		claims, err := provider.verify(idToken, nonce)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "The identity provider returned an invalid id token")
+			return
+		}
+
+		// logged in users link the identity to their account
+		if username, ok := session.Values["username"].(string); ok {
+			user, err := UserGetUserFromUsername(username)
+			if err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Could not get the id for your username")
+				return
+			}
+			profile_target := fmt.Sprintf("/user/%d/profile?res=%%s#oidc", user.ID)
+
+			identity, err := globalState.GetOIDCIdentity(claims.Issuer, claims.Subject)
+			if err == nil {
+				msg := "This identity is already linked to another user"
+				if identity.UserID == user.ID {
+					msg = "This identity is already linked to your account"
+				}
+				log_and_redir_with_msg(w, r, nil, profile_target, msg)
+				return
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				log_and_redir_with_msg(w, r, err, profile_target, "Could not check the identity")
+				return
+			}
+
+			err = globalState.InsertOIDCIdentity(OIDCIdentity{UserID: user.ID, Issuer: claims.Issuer, Subject: claims.Subject, Email: claims.Email})
+			if err != nil {
+				log_and_redir_with_msg(w, r, err, profile_target, "Could not link the identity")
+				return
+			}
+			http.Redirect(w, r, fmt.Sprintf(profile_target, "Linked the identity"), http.StatusSeeOther)
+			return
+		}
+
+		user, err := oidcUserFor(claims)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the user for your identity")
+			return
+		}
+
+		ip := loginClientIP(r)
+		if user.Disabled {
+			LoginRecord(user.Name, ip, false, LoginDisabled)
+			log_and_redir_with_msg(w, r, nil, redir_target, "Account disabled")
+			return
+		}
+
+		// the provider replaces the password, the second factor is still required
+		totpEnabled, err := TOTPEnabled(user.ID)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not check your two-factor authentication")
+			return
+		}
+		if totpEnabled {
+			totpStartLogin(w, r, user.Name)
+			return
+		}
+
+		session.Values["username"] = user.Name
+		if err := session.Save(r, w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := LoginRecord(user.Name, ip, true, LoginOIDC); err != nil {
+			log.Println(err)
+		}
+
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
+
+func oidcUnlinkHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Error reading the profile id"))
+		return
+	}
+
+	redir_target := fmt.Sprintf("/user/%d/profile?res=%%s#oidc", id)
+
+	identityid, err := strconv.Atoi(vars["identityid"])
+	if err != nil {
+		log_and_redir_with_msg(w, r, err, redir_target, "Invalid identity id")
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		session, _ := globalState.sessions.Get(r, "session")
+		user, err := UserGetUserFromUsername(session.Values["username"].(string))
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the id for your username")
+			return
+		}
+		if user.ID != id {
+			log_and_redir_with_msg(w, r, nil, redir_target, "You can only unlink your own identities")
+			return
+		}
+
+		if err := OIDCUnlink(user, identityid); err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not unlink the identity, set a password first if it's your last one")
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf(redir_target, "Unlinked the identity"), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// oidcTestProvider serves the signing key of a provider for the client "r2wars" and signs id
+// tokens with it
+type oidcTestProvider struct {
+	*oidcProvider
+	key *rsa.PrivateKey
+}
+
+func newOIDCTestProvider(t *testing.T) oidcTestProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "key",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	oldClientID := oidcClientID
+	oidcClientID = "r2wars"
+	t.Cleanup(func() { oidcClientID = oldClientID })
+
+	return oidcTestProvider{&oidcProvider{Issuer: "https://idp.example", JWKSURI: srv.URL}, key}
+}
+
+// sign returns an id token with the given header and claims, signed using the key of the provider
+func (p oidcTestProvider) sign(t *testing.T, header map[string]string, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCVerify(t *testing.T) {
+	p := newOIDCTestProvider(t)
+
+	header := map[string]string{"alg": "RS256", "kid": "key"}
+	claims := func(change map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   "https://idp.example",
+			"sub":   "1234",
+			"aud":   "r2wars",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": "nonce",
+		}
+		for k, v := range change {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	valid := p.sign(t, header, claims(nil))
+
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"valid", valid, ""},
+		{"audience list", p.sign(t, header, claims(map[string]interface{}{"aud": []string{"other", "r2wars"}, "azp": "r2wars"})), ""},
+		{"within the leeway", p.sign(t, header, claims(map[string]interface{}{"exp": time.Now().Add(-oidcLeeway / 2).Unix()})), ""},
+		{"malformed", "a.b", "malformed"},
+		{"none", p.sign(t, map[string]string{"alg": "none", "kid": "key"}, claims(nil)), "algorithm"},
+		{"HMAC", p.sign(t, map[string]string{"alg": "HS256", "kid": "key"}, claims(nil)), "algorithm"},
+		{"unknown key", p.sign(t, map[string]string{"alg": "RS256", "kid": "other"}, claims(nil)), "unknown key"},
+		{"tampered", strings.Replace(valid, ".", ".e30", 1), "signature"},
+		{"issuer", p.sign(t, header, claims(map[string]interface{}{"iss": "https://evil.example"})), "issued by"},
+		{"audience", p.sign(t, header, claims(map[string]interface{}{"aud": "other"})), "issued for"},
+		{"authorized party", p.sign(t, header, claims(map[string]interface{}{"azp": "other"})), "issued to"},
+		{"expired", p.sign(t, header, claims(map[string]interface{}{"exp": time.Now().Add(-2 * oidcLeeway).Unix()})), "expired"},
+		{"nonce", p.sign(t, header, claims(map[string]interface{}{"nonce": "other"})), "nonce"},
+		{"no nonce", p.sign(t, header, claims(map[string]interface{}{"nonce": nil})), "nonce"},
+		{"no subject", p.sign(t, header, claims(map[string]interface{}{"sub": nil})), "subject"},
+	}
+	for _, tt := range tests {
+		got, err := p.verify(tt.token, "nonce")
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err == "" && got.Subject != "1234":
+			t.Errorf("%s: got the subject %q", tt.name, got.Subject)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got %v, want an error containing %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestOIDCUserFor(t *testing.T) {
+	testState(t)
+	testUser(t, "alice")
+
+	tests := []struct {
+		name   string
+		claims oidcClaims
+		want   string
+	}{
+		{"new user", oidcClaims{Subject: "1", PreferredUsername: "bob"}, "bob"},
+		{"known identity", oidcClaims{Subject: "1", PreferredUsername: "robert"}, "bob"},
+		{"name taken", oidcClaims{Subject: "2", PreferredUsername: "alice"}, "alice-2"},
+		{"name taken twice", oidcClaims{Subject: "3", PreferredUsername: "alice"}, "alice-3"},
+		{"invalid chars", oidcClaims{Subject: "4", PreferredUsername: "c a/r<o>l"}, "carol"},
+		{"email", oidcClaims{Subject: "5", Email: "dave@example.org"}, "dave"},
+		{"nothing usable", oidcClaims{Subject: "6", PreferredUsername: "?!"}, "user"},
+		{"other issuer", oidcClaims{Issuer: "https://other.example", Subject: "1", PreferredUsername: "bob"}, "bob-2"},
+	}
+	for _, tt := range tests {
+		if tt.claims.Issuer == "" {
+			tt.claims.Issuer = "https://idp.example"
+		}
+		user, err := oidcUserFor(tt.claims)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if user.Name != tt.want {
+			t.Errorf("%s: logged in as %q, want %q", tt.name, user.Name, tt.want)
+		}
+	}
+
+	// the users created can't log in using a password
+	if UserCheckPassword("bob", "") {
+		t.Error("a user created for an identity logged in without a password")
+	}
+}
+
+func TestOIDCUnlink(t *testing.T) {
+	testState(t)
+
+	user, err := oidcUserFor(oidcClaims{Issuer: "https://idp.example", Subject: "1", PreferredUsername: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities, err := OIDCGetAllForUser(user.ID)
+	if err != nil || len(identities) != 1 {
+		t.Fatalf("%v, %v", identities, err)
+	}
+
+	// without a password, the last identity is the only way to log in
+	if err := OIDCUnlink(user, identities[0].ID); err == nil {
+		t.Error("unlinked the last identity of a user without a password")
+	}
+
+	if err := UserUpdatePasswordHash(user.Name, []byte("hash")); err != nil {
+		t.Fatal(err)
+	}
+	if err := OIDCUnlink(user, identities[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if identities, _ := OIDCGetAllForUser(user.ID); len(identities) != 0 {
+		t.Errorf("%d identities are left", len(identities))
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// apiOperation describes a single operation of the json api. The OpenAPI description served at
+// /api/v1/openapi.json is generated from the apiOperations below, the schemas of the request and
+// response bodies are derived from the go types using reflection.
+type apiOperation struct {
+	Method   string
+	Path     string // relative to /api/v1, using the mux path template syntax
+	Summary  string
+	Scope    string      // the scope an api token needs
+	Request  interface{} // the request body, nil if there is none
+	Status   int         // the status code on success
+	Response interface{} // the response body
+}
+
+// apiOperations must contain every route (and method) registered by apiRoutes, which
+// TestOpenAPIMatchesRoutes checks. The tokens are limited to these operations as well.
+var apiOperations = []apiOperation{
+	{"GET", "/archs", "List the enabled archs", ScopeRead, nil, http.StatusOK, []string{}},
+	{"GET", "/bits", "List the enabled bits", ScopeRead, nil, http.StatusOK, []string{}},
+	{"GET", "/users", "List the users", ScopeRead, nil, http.StatusOK, []apiUser{}},
+	{"GET", "/users/{id}", "Get a user and their bots", ScopeRead, nil, http.StatusOK, apiUserBots{}},
+	{"GET", "/me", "Get the authenticated user and their bots", ScopeRead, nil, http.StatusOK, apiUserBots{}},
+	{"GET", "/bots", "List the bots", ScopeRead, nil, http.StatusOK, []apiBot{}},
+	{"POST", "/bots", "Create a bot", ScopeBots, apiBot{}, http.StatusCreated, apiBot{}},
+	{"GET", "/bots/{id}", "Get a bot", ScopeRead, nil, http.StatusOK, apiBot{}},
+	{"PUT", "/bots/{id}", "Update a bot you own", ScopeBots, apiBot{}, http.StatusOK, apiBot{}},
+	{"GET", "/battles", "List the battles", ScopeRead, nil, http.StatusOK, []apiBattle{}},
+	{"POST", "/battles", "Create a battle", ScopeBattles, apiBattle{}, http.StatusCreated, apiBattle{}},
+	{"GET", "/battles/{id}", "Get a battle", ScopeRead, nil, http.StatusOK, apiBattle{}},
+	{"PUT", "/battles/{id}", "Update the settings of a battle you own", ScopeBattles, apiBattle{}, http.StatusOK, apiBattle{}},
+	{"POST", "/battles/{id}/bots", "Replace your bots registered in a battle", ScopeBattles, apiSubmission{}, http.StatusOK, apiBattle{}},
+	{"POST", "/battles/{id}/run", "Run a single fight and wait for the result (referees only)", ScopeRuns, nil, http.StatusOK, apiRunResult{}},
+	{"POST", "/battles/{id}/series", "Enqueue a series of fights (referees only)", ScopeRuns, apiSeries{}, http.StatusAccepted, Run{}},
+	{"GET", "/battles/{id}/output", "Get the output of the last fight", ScopeRead, nil, http.StatusOK, apiOutput{}},
+	{"GET", "/runs/{id}", "Get a run and the results of its series", ScopeRead, nil, http.StatusOK, apiRunStats{}},
+}
+
+var openapiPathParam = regexp.MustCompile(`{([^}:]+)(:[^}]*)?}`)
+
+//////////////////////////////////////////////////////////////////////////////
+// GENERAL PURPOSE
+
+// OpenAPISpec returns the OpenAPI 3 description of the json api
+func OpenAPISpec() map[string]interface{} {
+	schemas := map[string]interface{}{}
+	errorSchema := openapiSchema(reflect.TypeOf(apiError{}), schemas)
+
+	paths := map[string]interface{}{}
+	for _, op := range apiOperations {
+		path := openapiPathParam.ReplaceAllString(op.Path, "{$1}")
+
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[path] = item
+		}
+
+		var parameters []interface{}
+		for _, match := range openapiPathParam.FindAllStringSubmatch(op.Path, -1) {
+			parameters = append(parameters, map[string]interface{}{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "integer"},
+			})
+		}
+
+		responses := map[string]interface{}{
+			fmt.Sprint(op.Status): map[string]interface{}{
+				"description": http.StatusText(op.Status),
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": openapiSchema(reflect.TypeOf(op.Response), schemas),
+					},
+				},
+			},
+			"default": map[string]interface{}{
+				"description": "Error",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": errorSchema},
+				},
+			},
+		}
+
+		operation := map[string]interface{}{
+			"summary":     op.Summary,
+			"operationId": openapiOperationID(op),
+			"responses":   responses,
+			"x-scope":     op.Scope,
+		}
+		if parameters != nil {
+			operation["parameters"] = parameters
+		}
+		if op.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": openapiSchema(reflect.TypeOf(op.Request), schemas),
+					},
+				},
+			}
+		}
+
+		item[strings.ToLower(op.Method)] = operation
+	}
+
+	version := os.Getenv("VERSION")
+	if version == "" {
+		version = "dev"
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "r2wars",
+			"version": version,
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": "/api/v1"},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"token": []string{}},
+			map[string]interface{}{"session": []string{}},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"token": map[string]interface{}{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+				"session": map[string]interface{}{
+					"type":        "apiKey",
+					"in":          "cookie",
+					"name":        "session",
+					"description": "State changing requests using the session cookie have to send the CSRF token of the session in the " + csrfHeader + " header",
+				},
+			},
+		},
+	}
+}
+
+// openapiOperationID builds an id such as "getBattlesIdOutput" from the method and the path
+func openapiOperationID(op apiOperation) string {
+	id := strings.ToLower(op.Method)
+	for _, part := range strings.Split(op.Path, "/") {
+		part = strings.Trim(openapiPathParam.ReplaceAllString(part, "$1"), "{}")
+		if part == "" {
+			continue
+		}
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+// openapiSchema returns the schema of the given type. Named structs are added to the schemas map
+// and referenced, the "api" prefix of their name is dropped.
+func openapiSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := openapiSchema(t.Elem(), schemas)
+		if _, ok := schema["$ref"]; ok {
+			// siblings of $ref are ignored, so wrap it
+			schema = map[string]interface{}{"allOf": []interface{}{schema}}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": openapiSchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		name := strings.TrimPrefix(t.Name(), "api")
+		name = strings.ToUpper(name[:1]) + name[1:]
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + name}
+		if _, ok := schemas[name]; ok {
+			return ref
+		}
+		schemas[name] = nil // guards against recursive types
+
+		properties := map[string]interface{}{}
+		required := []string{}
+		openapiStructFields(t, schemas, properties, &required)
+
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			sort.Strings(required)
+			schema["required"] = required
+		}
+		schemas[name] = schema
+		return ref
+	}
+	return map[string]interface{}{}
+}
+
+// openapiStructFields adds the json fields of the struct to the properties, fields of embedded
+// structs are inlined like encoding/json does
+func openapiStructFields(t reflect.Type, schemas map[string]interface{}, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if field.Anonymous && tag == "" {
+			openapiStructFields(field.Type, schemas, properties, required)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = openapiSchema(field.Type, schemas)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// HTTP
+
+// apiOpenAPIHandler serves the OpenAPI description, it doesn't require authentication so that
+// clients can be generated from it
+func apiOpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiMethodNotAllowedHandler(w, r)
+		return
+	}
+	apiWriteJSON(w, http.StatusOK, OpenAPISpec())
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestOpenAPIMatchesRoutes makes sure every method and path registered on the api router is
+// documented and every documented operation is registered
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	api := mux.NewRouter().PathPrefix("/api/v1").Subrouter()
+	apiRoutes(api)
+
+	registered := map[string]bool{}
+	err := api.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// the method not allowed fallbacks
+			return nil
+		}
+		for _, method := range methods {
+			registered[method+" "+path] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	documented := map[string]bool{}
+	for _, op := range apiOperations {
+		key := op.Method + " /api/v1" + op.Path
+		if documented[key] {
+			t.Errorf("%s is documented twice", key)
+		}
+		documented[key] = true
+	}
+
+	var problems []string
+	for key := range registered {
+		if !documented[key] {
+			problems = append(problems, key+" is registered but not documented")
+		}
+	}
+	for key := range documented {
+		if !registered[key] {
+			problems = append(problems, key+" is documented but not registered")
+		}
+	}
+	sort.Strings(problems)
+	for _, problem := range problems {
+		t.Error(problem)
+	}
+}
+
+func TestAPIMethodNotAllowed(t *testing.T) {
+	r := mux.NewRouter()
+	apiRoutes(r.PathPrefix("/api/v1").Subrouter())
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"DELETE", "/api/v1/archs", http.StatusMethodNotAllowed},
+		{"DELETE", "/api/v1/bots/1", http.StatusMethodNotAllowed},
+		{"GET", "/api/v1/battles/1/run", http.StatusMethodNotAllowed},
+		{"GET", "/api/v1/nope", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, w.Code, tt.status)
+		}
+	}
+}
+
+func TestOpenAPIDescription(t *testing.T) {
+	w := httptest.NewRecorder()
+	apiOpenAPIHandler(w, httptest.NewRequest("GET", "/api/v1/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	var spec struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.OpenAPI == "" {
+		t.Error("no openapi version")
+	}
+
+	operations := 0
+	for _, methods := range spec.Paths {
+		operations += len(methods)
+	}
+	if operations != len(apiOperations) {
+		t.Errorf("the description has %d operations, want %d", operations, len(apiOperations))
+	}
+}
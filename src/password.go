@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// The argon2id parameters used for new password hashes. Hashes created with
+// other parameters are still accepted, but get rehashed on the next login.
+const (
+	argonTime    uint32 = 1
+	argonMemory  uint32 = 64 * 1024
+	argonThreads uint8  = 4
+	argonKeyLen  uint32 = 32
+	argonSaltLen        = 16
+)
+
+// The shortest salt and hash accepted in a stored hash, the minimums of the argon2 spec would be
+// 8 and 4 bytes. An empty hash would match any password.
+const (
+	argonMinSaltLen = 8
+	argonMinKeyLen  = 16
+)
+
+// PasswordHash hashes the given password with a fresh random salt and returns
+// it encoded as "$argon2id$v=19$m=...,t=...,p=...$<salt>$<hash>", so that the
+// salt and the parameters are stored alongside the hash itself.
+func PasswordHash(password string) ([]byte, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+
+	return []byte(encoded), nil
+}
+
+// PasswordVerify checks the password against the stored hash. The second
+// return value is true if the stored hash should be replaced, as it is either
+// a legacy hash (raw argon2 output using the global SALT) or was created with
+// parameters differing from the current ones.
+func PasswordVerify(password string, stored []byte) (bool, bool) {
+	if !strings.HasPrefix(string(stored), "$argon2id$") {
+		key := argon2.IDKey([]byte(password), []byte(os.Getenv("SALT")), 1, 64*1024, 4, 32)
+		return subtle.ConstantTimeCompare(key, stored) == 1, true
+	}
+
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, hash
+	parts := strings.Split(string(stored), "$")
+	if len(parts) != 6 {
+		return false, false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil || time < 1 || threads < 1 {
+		return false, false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) < argonMinSaltLen {
+		return false, false
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(hash) < argonMinKeyLen {
+		return false, false
+	}
+
+	key := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(hash)))
+	if subtle.ConstantTimeCompare(key, hash) != 1 {
+		return false, false
+	}
+
+	outdated := memory != argonMemory || time != argonTime || threads != argonThreads ||
+		uint32(len(hash)) != argonKeyLen || len(salt) != argonSaltLen
+	return true, outdated
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func TestPasswordHashRoundTrip(t *testing.T) {
+	hash, err := PasswordHash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(hash), "$argon2id$v=19$m=65536,t=1,p=4$") {
+		t.Errorf("unexpected encoding %q", hash)
+	}
+
+	ok, outdated := PasswordVerify("correct horse", hash)
+	if !ok || outdated {
+		t.Errorf("PasswordVerify(right password) = %v, %v, want true, false", ok, outdated)
+	}
+	if ok, _ := PasswordVerify("correct horsf", hash); ok {
+		t.Error("PasswordVerify accepted the wrong password")
+	}
+
+	// a fresh salt every time
+	other, err := PasswordHash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(hash, other) {
+		t.Error("two hashes of the same password are equal")
+	}
+}
+
+func TestPasswordVerifyOutdated(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte("pw"), salt, 2, 32*1024, 2, 32)
+	stored := fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$%s$%s", 32*1024, 2, 2,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+
+	ok, outdated := PasswordVerify("pw", []byte(stored))
+	if !ok || !outdated {
+		t.Errorf("PasswordVerify(other parameters) = %v, %v, want true, true", ok, outdated)
+	}
+}
+
+func TestPasswordVerifyLegacy(t *testing.T) {
+	t.Setenv("SALT", "pepper")
+	legacy := argon2.IDKey([]byte("pw"), []byte("pepper"), 1, 64*1024, 4, 32)
+
+	ok, outdated := PasswordVerify("pw", legacy)
+	if !ok || !outdated {
+		t.Errorf("PasswordVerify(legacy) = %v, %v, want true, true", ok, outdated)
+	}
+	if ok, _ := PasswordVerify("px", legacy); ok {
+		t.Error("PasswordVerify accepted the wrong password for a legacy hash")
+	}
+}
+
+func TestPasswordVerifyMalformed(t *testing.T) {
+	// a valid salt and hash of the password "pw", so only the part under test is wrong
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte("pw"), salt, 1, 64*1024, 4, 32)
+	b64 := base64.RawStdEncoding.EncodeToString
+
+	for _, stored := range []string{
+		"$argon2id$",
+		"$argon2id$v=18$m=65536,t=1,p=4$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=x,t=1,p=4$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=65536,t=1,p=4$!!!$aGFzaA",
+		"$argon2id$v=19$m=65536,t=1,p=4$" + b64(salt) + "$",
+		"$argon2id$v=19$m=65536,t=1,p=4$" + b64(salt) + "$" + b64(key[:8]),
+		"$argon2id$v=19$m=65536,t=1,p=4$$" + b64(argon2.IDKey([]byte("pw"), nil, 1, 64*1024, 4, 32)),
+		"$argon2id$v=19$m=65536,t=1,p=4$" + b64(salt[:4]) + "$" + b64(argon2.IDKey([]byte("pw"), salt[:4], 1, 64*1024, 4, 32)),
+		"$argon2id$v=19$m=65536,t=0,p=4$" + b64(salt) + "$" + b64(key),
+		"$argon2id$v=19$m=65536,t=1,p=0$" + b64(salt) + "$" + b64(key),
+	} {
+		if ok, _ := PasswordVerify("pw", []byte(stored)); ok {
+			t.Errorf("PasswordVerify accepted %q", stored)
+		}
+	}
+}
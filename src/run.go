@@ -0,0 +1,502 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.emile.space/r2wars-web/engine"
+	"github.com/gorilla/mux"
+)
+
+// The states a run goes through
+const (
+	RunQueued   = "queued"
+	RunRunning  = "running"
+	RunFinished = "finished"
+	RunFailed   = "failed"
+)
+
+// the upper limit of fights per pairing, as every fight spawns its own r2 instance
+const maxSeriesFights = 1000
+
+// A Run is a series of fights: every pairing of the bots in the battle fights Fights times, each
+// time with a different seed (and thus a different placement) and alternating starting order
+type Run struct {
+	ID        int       `json:"id"`
+	BattleID  int       `json:"battle_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Status    string    `json:"status"`
+	Fights    int       `json:"fights"`
+	Seed      int64     `json:"seed"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// SeriesStat is the summary of how a single bot did in a series
+type SeriesStat struct {
+	BotID   int     `json:"bot_id"`
+	BotName string  `json:"bot_name"`
+	Fights  int     `json:"fights"`
+	Wins    int     `json:"wins"`
+	Draws   int     `json:"draws"`
+	WinRate float64 `json:"win_rate"`
+
+	// the 95% wilson score interval of the win rate
+	Low  float64 `json:"ci_low"`
+	High float64 `json:"ci_high"`
+}
+
+// Interval formats the win rate and its interval for displaying it
+func (s SeriesStat) Interval() string {
+	return fmt.Sprintf("%.1f%% (95%% CI %.1f%% - %.1f%%)", s.WinRate*100, s.Low*100, s.High*100)
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// GENERAL PURPOSE
+
+func RunGetById(id int) (Run, error) {
+	return globalState.GetRunById(id)
+}
+
+func RunGetLatestForBattle(battleid int) (Run, error) {
+	return globalState.GetLatestRunForBattle(battleid)
+}
+
+// RunGetPending returns the runs that are queued or currently running
+func RunGetPending() ([]Run, error) {
+	return globalState.GetPendingRuns()
+}
+
+func RunSetStatus(id int, status string, errMsg string) error {
+	return globalState.UpdateRunStatus(id, status, errMsg)
+}
+
+func RunGetSeriesStats(runid int) ([]SeriesStat, error) {
+	stats, err := globalState.GetSeriesStats(runid)
+	if err != nil {
+		return nil, err
+	}
+	for i, stat := range stats {
+		stats[i].WinRate, stats[i].Low, stats[i].High = wilson(stat.Wins, stat.Fights)
+	}
+	return stats, nil
+}
+
+// RunEnqueue stores a new run and wakes up the worker, which executes the queued runs in the
+// order they were queued
+func RunEnqueue(battleid int, fights int, seed int64) (int, error) {
+	id, err := globalState.InsertRun(Run{BattleID: battleid, Status: RunQueued, Fights: fights, Seed: seed})
+	if err != nil {
+		return -1, err
+	}
+
+	// the worker is already going to look for queued runs if there is a wake up pending
+	select {
+	case globalState.runWake <- struct{}{}:
+	default:
+	}
+
+	if run, err := RunGetById(id); err == nil {
+		WebhookFire(EventRunQueued, run)
+	}
+
+	return id, nil
+}
+
+// RunRequeuePending puts the runs that were queued or running when the server went down back into
+// the queue, the worker picks them up once it's started
+func RunRequeuePending() error {
+	ids, err := globalState.GetPendingRunIDs()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		log.Printf("[i] Requeueing run %d", id)
+		if err := RunSetStatus(id, RunQueued, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunWorker executes the queued runs one after another, the oldest first. It looks for them when
+// woken up by RunEnqueue and once a minute, in case the database couldn't be reached before.
+func RunWorker() {
+	for {
+		id, err := globalState.GetNextQueuedRunID()
+		if err == nil {
+			RunExecute(id)
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("[!] Could not get the next queued run: %s", err)
+		}
+
+		select {
+		case <-globalState.runWake:
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+func RunExecute(id int) {
+	run, err := RunGetById(id)
+	if err != nil {
+		// it would be picked up again otherwise
+		log.Printf("[!] Could not fetch run %d: %s", id, err)
+		RunSetStatus(id, RunFailed, err.Error())
+		return
+	}
+
+	log.Printf("[i] Executing run %d for battle %d", run.ID, run.BattleID)
+	RunSetStatus(run.ID, RunRunning, "")
+	run.Status = RunRunning
+	WebhookFire(EventRunStarted, run)
+
+	if err := runSeries(run); err != nil {
+		log.Printf("[!] Run %d failed: %s", run.ID, err)
+		RunSetStatus(run.ID, RunFailed, err.Error())
+		run.Status, run.Error = RunFailed, err.Error()
+		WebhookFire(EventRunFailed, run)
+		return
+	}
+
+	RunSetStatus(run.ID, RunFinished, "")
+	run.Status = RunFinished
+	WebhookFire(EventRunFinished, run)
+}
+
+// runSeries lets every pairing of bots in the battle fight run.Fights times
+func runSeries(run Run) error {
+	battle, err := BattleGetByIdDeep(run.BattleID)
+	if err != nil {
+		return err
+	}
+
+	var bots []Bot
+	for _, b := range battle.Bots {
+		bot, err := BotGetById(b.ID)
+		if err != nil {
+			return err
+		}
+		bots = append(bots, bot)
+	}
+
+	if len(bots) < 2 {
+		return errors.New("a series needs at least two bots")
+	}
+
+	rng := rand.New(rand.NewSource(run.Seed))
+
+	for i := 0; i < len(bots); i++ {
+		for j := i + 1; j < len(bots); j++ {
+			for k := 0; k < run.Fights; k++ {
+
+				// alternate which of the bots makes the first step
+				first, second := bots[i], bots[j]
+				if k%2 == 1 {
+					first, second = second, first
+				}
+
+				// a seed of 0 would place the bots at fixed offsets
+				seed := rng.Int63() | 1
+
+				result, err := engine.FightRun(engine.Fight{
+					ArenaSize:  battle.ArenaSize,
+					MaxRounds:  battle.MaxRounds,
+					Arena:      battle.ArenaInit,
+					Registers:  battle.Registers,
+					MaxBotSize: battle.MaxBotSize,
+					Seed:       seed,
+					Fighters:   []engine.Fighter{BotFighter(first), BotFighter(second)},
+				})
+				if err != nil {
+					return err
+				}
+
+				var winner int
+				switch result.Winner {
+				case 0:
+					winner = first.ID
+				case 1:
+					winner = second.ID
+				}
+
+				err = globalState.InsertFight(run.ID, seed, first.ID, second.ID, winner, result.Rounds)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// wilson returns the win rate and the bounds of its 95% wilson score interval
+func wilson(wins int, n int) (float64, float64, float64) {
+	if n == 0 {
+		return 0, 0, 0
+	}
+
+	z := 1.96
+	fn := float64(n)
+	p := float64(wins) / fn
+
+	denom := 1 + z*z/fn
+	center := (p + z*z/(2*fn)) / denom
+	half := z * math.Sqrt(p*(1-p)/fn+z*z/(4*fn*fn)) / denom
+
+	return p, math.Max(0, center-half), math.Min(1, center+half)
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// DATABASE
+
+func (s *State) InsertRun(run Run) (int, error) {
+	res, err := s.db.Exec(`
+		INSERT INTO runs (created_at, battle_id, status, fights, seed, error)
+		VALUES (?, ?, ?, ?, ?, "")`,
+		time.Now(), run.BattleID, run.Status, run.Fights, run.Seed)
+	if err != nil {
+		log.Println(err)
+		return -1, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		log.Println(err)
+		return -1, err
+	}
+	return int(id), nil
+}
+
+func (s *State) GetRunById(id int) (Run, error) {
+	var run Run
+	err := s.db.QueryRow(`
+		SELECT id, created_at, battle_id, status, fights, seed, COALESCE(error, "")
+		FROM runs
+		WHERE id=?`, id).Scan(&run.ID, &run.CreatedAt, &run.BattleID, &run.Status, &run.Fights, &run.Seed, &run.Error)
+	if err != nil {
+		return Run{}, err
+	}
+	return run, nil
+}
+
+func (s *State) GetLatestRunForBattle(battleid int) (Run, error) {
+	var run Run
+	err := s.db.QueryRow(`
+		SELECT id, created_at, battle_id, status, fights, seed, COALESCE(error, "")
+		FROM runs
+		WHERE battle_id=?
+		ORDER BY id DESC
+		LIMIT 1`, battleid).Scan(&run.ID, &run.CreatedAt, &run.BattleID, &run.Status, &run.Fights, &run.Seed, &run.Error)
+	if err != nil {
+		return Run{}, err
+	}
+	return run, nil
+}
+
+func (s *State) GetPendingRunIDs() ([]int, error) {
+	rows, err := s.db.Query("SELECT id FROM runs WHERE status=? OR status=? ORDER BY id", RunQueued, RunRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetNextQueuedRunID returns the id of the run queued first, sql.ErrNoRows if there is none
+func (s *State) GetNextQueuedRunID() (int, error) {
+	var id int
+	err := s.db.QueryRow("SELECT id FROM runs WHERE status=? ORDER BY id LIMIT 1", RunQueued).Scan(&id)
+	return id, err
+}
+
+func (s *State) GetPendingRuns() ([]Run, error) {
+	rows, err := s.db.Query(`
+		SELECT id, created_at, battle_id, status, fights, seed, COALESCE(error, "")
+		FROM runs
+		WHERE status=? OR status=?
+		ORDER BY id`, RunQueued, RunRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []Run
+	for rows.Next() {
+		var run Run
+		if err := rows.Scan(&run.ID, &run.CreatedAt, &run.BattleID, &run.Status, &run.Fights, &run.Seed, &run.Error); err != nil {
+			return runs, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+func (s *State) UpdateRunStatus(id int, status string, errMsg string) error {
+	_, err := s.db.Exec("UPDATE runs SET status=?, error=? WHERE id=?", status, errMsg, id)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// InsertFight stores the outcome of a single fight, a winner of 0 is stored as a draw
+func (s *State) InsertFight(runid int, seed int64, firstBotID int, secondBotID int, winnerBotID int, rounds int) error {
+	winner := sql.NullInt64{Int64: int64(winnerBotID), Valid: winnerBotID != 0}
+	_, err := s.db.Exec(`
+		INSERT INTO fights (run_id, seed, first_bot_id, second_bot_id, winner_bot_id, rounds)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		runid, seed, firstBotID, secondBotID, winner, rounds)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	return nil
+}
+
+// GetSeriesStats counts the fights, wins and draws of every bot that took part in the run
+func (s *State) GetSeriesStats(runid int) ([]SeriesStat, error) {
+	rows, err := s.db.Query(`
+		SELECT
+			b.id, b.name,
+			COUNT(f.id),
+			SUM(CASE WHEN f.winner_bot_id = b.id THEN 1 ELSE 0 END),
+			SUM(CASE WHEN f.winner_bot_id IS NULL THEN 1 ELSE 0 END)
+		FROM fights f
+		JOIN bots b ON b.id = f.first_bot_id OR b.id = f.second_bot_id
+		WHERE f.run_id=?
+		GROUP BY b.id
+		ORDER BY b.name`, runid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []SeriesStat
+	for rows.Next() {
+		var stat SeriesStat
+		if err := rows.Scan(&stat.BotID, &stat.BotName, &stat.Fights, &stat.Wins, &stat.Draws); err != nil {
+			return stats, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, rows.Err()
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// HTTP
+
+// battleSeriesHandler queues a new series for the battle (POST) or returns the results of the
+// latest series as json (GET)
+func battleSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	battleid, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Invalid battle id"))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	redir_target := fmt.Sprintf("/battle/%d?res=%%s#series", battleid)
+
+	// the series of battles the user isn't allowed to see don't exist as far as they know
+	user := sessionUser(r)
+	battle, err := BattleGetByIdDeep(battleid)
+	if err != nil || !BattleCan(battle, user, BattleView) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404 - Battle not found"))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+
+		run, err := RunGetLatestForBattle(battleid)
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "no series has been run for this battle yet"})
+			return
+		} else if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "could not fetch the series"})
+			return
+		}
+
+		stats, err := RunGetSeriesStats(run.ID)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "could not fetch the series results"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(struct {
+			Run  Run          `json:"run"`
+			Bots []SeriesStat `json:"bots"`
+		}{run, stats})
+
+	case "POST":
+		r.ParseForm()
+
+		if !BattleCan(battle, user, BattleReferee) {
+			log_and_redir_with_msg(w, r, nil, redir_target, "Only the referees of the battle can run a series")
+			return
+		}
+
+		fights, err := strconv.Atoi(r.Form.Get("fights"))
+		if err != nil || fights < 1 || fights > maxSeriesFights {
+			log_and_redir_with_msg(w, r, err, redir_target, fmt.Sprintf("The amount of fights must be within 1 and %d", maxSeriesFights))
+			return
+		}
+
+		// use a random seed if none is given, the seed is stored with the run, so the series can
+		// be reproduced
+		seed := time.Now().UnixNano()
+		if r.Form.Get("seed") != "" {
+			seed, err = strconv.ParseInt(r.Form.Get("seed"), 10, 64)
+			if err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Invalid seed")
+				return
+			}
+		}
+
+		if len(battle.Bots) < 2 {
+			log_and_redir_with_msg(w, r, errors.New("not enough bots"), redir_target, "A series needs at least two bots")
+			return
+		}
+
+		_, err = RunEnqueue(battleid, fights, seed)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not queue the series")
+			return
+		}
+
+		msg := "Series queued!"
+		http.Redirect(w, r, fmt.Sprintf(redir_target, msg), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
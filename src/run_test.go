@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestWilson(t *testing.T) {
+	tests := []struct {
+		wins, n         int
+		rate, low, high float64
+	}{
+		{0, 0, 0, 0, 0},
+		{0, 10, 0, 0, 0.2775},
+		{5, 10, 0.5, 0.2366, 0.7634},
+		{10, 10, 1, 0.7225, 1},
+		{1, 1, 1, 0.2065, 1},
+		{81, 263, 0.3080, 0.2553, 0.3662},
+	}
+	for _, tt := range tests {
+		rate, low, high := wilson(tt.wins, tt.n)
+		for _, v := range []struct {
+			name      string
+			got, want float64
+		}{{"rate", rate, tt.rate}, {"low", low, tt.low}, {"high", high, tt.high}} {
+			if math.Abs(v.got-v.want) > 0.00005 {
+				t.Errorf("wilson(%d, %d) %s: %.4f, want %.4f", tt.wins, tt.n, v.name, v.got, v.want)
+			}
+		}
+	}
+}
+
+func TestRunQueueOrder(t *testing.T) {
+	s := testState(t)
+
+	if _, err := UserRegister("alice", []byte("hash")); err != nil {
+		t.Fatal(err)
+	}
+	alice, err := UserGetUserFromUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	battleid, err := BattleCreate(Battle{Name: "battle", Visibility: BattlePublic}, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// enqueueing doesn't wait for the worker, which isn't running
+	var ids []int
+	for i := 0; i < 3; i++ {
+		id, err := RunEnqueue(battleid, 1, int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	// the server went down while executing the second one
+	if err := RunSetStatus(ids[1], RunRunning, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunRequeuePending(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range ids {
+		id, err := s.GetNextQueuedRunID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != want {
+			t.Fatalf("got run %d next, want %d", id, want)
+		}
+		if err := RunSetStatus(id, RunFinished, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.GetNextQueuedRunID(); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("after the last run: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// how often expired sessions are purged from the session database
+const sessionCleanupInterval = time.Hour
+
+//////////////////////////////////////////////////////////////////////////////
+// GENERAL PURPOSE
+
+func SessionGetAllForUser(username string) ([]SessionInfo, error) {
+	return globalState.sessions.ListForUser(username)
+}
+
+// SessionRevoke logs the user out of the session with the given id
+func SessionRevoke(username string, id string) error {
+	return globalState.sessions.RevokeForUser(username, id)
+}
+
+// SessionRevokeAll logs the user out everywhere
+func SessionRevokeAll(username string) error {
+	return globalState.sessions.RevokeForUser(username, "")
+}
+
+// SessionWorker purges the expired sessions from time to time, they would pile up forever
+// otherwise
+func SessionWorker() {
+	ticker := time.NewTicker(sessionCleanupInterval)
+	for {
+		purged, err := globalState.sessions.PurgeExpired()
+		if err != nil {
+			log.Printf("[!] Could not purge the expired sessions: %s", err)
+		} else if purged > 0 {
+			log.Printf("[i] Purged %d expired sessions", purged)
+		}
+		<-ticker.C
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// HTTP
+
+// sessionRevokeHandler logs the user out of one of their sessions, or out of all of them if the
+// session id is "all"
+func sessionRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Error reading the profile id"))
+		return
+	}
+
+	redir_target := fmt.Sprintf("/user/%d/profile?res=%%s#sessions", id)
+	sessionid := vars["sessionid"]
+
+	switch r.Method {
+	case "POST":
+		session, _ := globalState.sessions.Get(r, "session")
+		user, err := UserGetUserFromUsername(session.Values["username"].(string))
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the id for your username")
+			return
+		}
+		if user.ID != id {
+			log_and_redir_with_msg(w, r, nil, redir_target, "You can only revoke your own sessions")
+			return
+		}
+
+		if sessionid == "all" {
+			if err := SessionRevokeAll(user.Name); err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Could not revoke your sessions")
+				return
+			}
+			http.Redirect(w, r, "/login?res=Logged out everywhere", http.StatusSeeOther)
+			return
+		}
+
+		if err := SessionRevoke(user.Name, sessionid); err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not revoke the session")
+			return
+		}
+
+		// revoking the current session is just logging out
+		if sessionid == session.ID {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf(redir_target, "Revoked the session"), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
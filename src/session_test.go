@@ -0,0 +1,210 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// sessionTestLogin stores a session for the user as if they logged in using the given user agent
+// and returns its cookie
+func sessionTestLogin(t *testing.T, username string, userAgent string) *http.Cookie {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", userAgent)
+	w := httptest.NewRecorder()
+
+	session, _ := globalState.sessions.Get(r, "session")
+	session.Values["username"] = username
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	return w.Result().Cookies()[0]
+}
+
+// sessionTestLoggedIn returns the user the cookie is logged in as, "" if it isn't
+func sessionTestLoggedIn(cookie *http.Cookie) string {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	session, _ := globalState.sessions.Get(r, "session")
+	username, _ := session.Values["username"].(string)
+	return username
+}
+
+func sessionTestUserAgents(t *testing.T, username string) []string {
+	t.Helper()
+	infos, err := SessionGetAllForUser(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var agents []string
+	for _, info := range infos {
+		agents = append(agents, info.UserAgent)
+	}
+	return agents
+}
+
+func TestSessionRevoke(t *testing.T) {
+	testState(t)
+
+	laptop := sessionTestLogin(t, "alice", "laptop")
+	phone := sessionTestLogin(t, "alice", "phone")
+	tablet := sessionTestLogin(t, "alice", "tablet")
+	bobs := sessionTestLogin(t, "bob", "bobs laptop")
+
+	infos, err := SessionGetAllForUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 3 {
+		t.Fatalf("alice has %d sessions, want 3", len(infos))
+	}
+	for _, info := range infos {
+		if info.Username != "alice" || info.IP == "" || !info.ExpiresOn.After(time.Now()) {
+			t.Errorf("session %+v", info)
+		}
+	}
+
+	// the phone is logged out, the other sessions stay
+	var phoneID string
+	for _, info := range infos {
+		if info.UserAgent == "phone" {
+			phoneID = info.ID
+		}
+	}
+	if err := SessionRevoke("alice", phoneID); err != nil {
+		t.Fatal(err)
+	}
+	if got := sessionTestLoggedIn(phone); got != "" {
+		t.Errorf("the revoked session is still logged in as %q", got)
+	}
+	if got := sessionTestLoggedIn(laptop); got != "alice" {
+		t.Errorf("another session is logged in as %q", got)
+	}
+	if agents := sessionTestUserAgents(t, "alice"); len(agents) != 2 {
+		t.Errorf("alice has the sessions %v after revoking one", agents)
+	}
+
+	// sessions of others can't be revoked
+	if err := SessionRevoke("bob", infos[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := sessionTestLoggedIn(tablet); got != "alice" {
+		t.Errorf("bob revoked a session of alice, it's logged in as %q", got)
+	}
+
+	if err := SessionRevokeAll("alice"); err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range []*http.Cookie{laptop, tablet} {
+		if got := sessionTestLoggedIn(cookie); got != "" {
+			t.Errorf("a session is still logged in as %q after logging out everywhere", got)
+		}
+	}
+	if agents := sessionTestUserAgents(t, "alice"); len(agents) != 0 {
+		t.Errorf("alice has the sessions %v after logging out everywhere", agents)
+	}
+	if got := sessionTestLoggedIn(bobs); got != "bob" {
+		t.Errorf("the session of bob is logged in as %q", got)
+	}
+}
+
+func TestSessionRevokeHandler(t *testing.T) {
+	testState(t)
+	testUser(t, "alice")
+	bob := testUser(t, "bob")
+
+	alices := sessionTestLogin(t, "alice", "laptop")
+	bobs := sessionTestLogin(t, "bob", "laptop")
+
+	// alice can't log bob out
+	r := httptest.NewRequest("POST", "/", nil)
+	r.AddCookie(alices)
+	r = mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(bob.ID), "sessionid": "all"})
+	w := httptest.NewRecorder()
+	sessionRevokeHandler(w, r)
+	if got := sessionTestLoggedIn(bobs); got != "bob" {
+		t.Errorf("alice logged bob out: %s", w.Header().Get("Location"))
+	}
+
+	r = httptest.NewRequest("POST", "/", nil)
+	r.AddCookie(bobs)
+	r = mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(bob.ID), "sessionid": "all"})
+	w = httptest.NewRecorder()
+	sessionRevokeHandler(w, r)
+	if got := sessionTestLoggedIn(bobs); got != "" {
+		t.Errorf("bob is still logged in after logging out everywhere: %s", w.Header().Get("Location"))
+	}
+	if got := sessionTestLoggedIn(alices); got != "alice" {
+		t.Errorf("bob logged alice out")
+	}
+}
+
+func TestSessionTouch(t *testing.T) {
+	testState(t)
+	cookie := sessionTestLogin(t, "alice", "laptop")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "phone")
+	r.AddCookie(cookie)
+	session, _ := globalState.sessions.Get(r, "session")
+
+	// seen just now, nothing is written
+	if err := globalState.sessions.Touch(r, session); err != nil {
+		t.Fatal(err)
+	}
+	if agents := sessionTestUserAgents(t, "alice"); len(agents) != 1 || agents[0] != "laptop" {
+		t.Errorf("touching a fresh session: %v", agents)
+	}
+
+	session.Values["modified_on"] = time.Now().Add(-2 * sessionTouchInterval)
+	if err := globalState.sessions.Touch(r, session); err != nil {
+		t.Fatal(err)
+	}
+	if agents := sessionTestUserAgents(t, "alice"); len(agents) != 1 || agents[0] != "phone" {
+		t.Errorf("touching a session last seen a while ago: %v", agents)
+	}
+}
+
+func TestSessionPurgeExpired(t *testing.T) {
+	s := testState(t)
+
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		sessionTestLogin(t, name, "laptop")
+	}
+
+	// all but bob's session expired
+	_, err := s.sessions.db.Exec("UPDATE sessions SET expires_on = ? WHERE username != ?", time.Now().Add(-time.Minute), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the newest one stays even though it expired, so that its id isn't handed out again
+	purged, err := s.sessions.PurgeExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 {
+		t.Errorf("purged %d sessions, want 2", purged)
+	}
+	rows, err := s.sessions.db.Query("SELECT username FROM sessions ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var left []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			t.Fatal(err)
+		}
+		left = append(left, username)
+	}
+	if len(left) != 2 || left[0] != "bob" || left[1] != "dave" {
+		t.Errorf("the sessions of %v are left, want bob and dave", left)
+	}
+}
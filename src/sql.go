@@ -19,7 +19,9 @@ func (d sqlite3Driver) Open(name string) (conn driver.Conn, err error) {
 	if err != nil {
 		return
 	}
-	_, err = conn.(sqlite3DriverConn).Exec("PRAGMA foreign_keys = ON;", nil)
+	// the run and webhook workers write concurrently to the requests, so wait for locks to be
+	// released instead of failing right away with SQLITE_BUSY
+	_, err = conn.(sqlite3DriverConn).Exec("PRAGMA foreign_keys = ON; PRAGMA busy_timeout = 5000;", nil)
 	if err != nil {
 		_ = conn.Close()
 	}
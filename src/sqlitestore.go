@@ -42,8 +42,24 @@ type sessionRow struct {
 	expiresOn  time.Time
 }
 
+// SessionInfo describes a session without its data, for listing the sessions of a user. The
+// username, user agent and ip are taken from the request the session was last saved or touched in.
+type SessionInfo struct {
+	ID         string
+	Username   string
+	UserAgent  string
+	IP         string
+	CreatedOn  time.Time
+	ModifiedOn time.Time // the last time the session has been seen
+	ExpiresOn  time.Time
+}
+
+// sessionTouchInterval limits how often the last seen time of a session is updated
+const sessionTouchInterval = time.Minute
+
 type DB interface {
 	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
 	Prepare(query string) (*sql.Stmt, error)
 	Close() error
 }
@@ -70,26 +86,42 @@ func NewSqliteStoreFromConnection(db DB, tableName string, path string, maxAge i
 		"session_data LONGBLOB, " +
 		"created_on TIMESTAMP DEFAULT 0, " +
 		"modified_on TIMESTAMP DEFAULT CURRENT_TIMESTAMP, " +
-		"expires_on TIMESTAMP DEFAULT 0);"
+		"expires_on TIMESTAMP DEFAULT 0, " +
+		"username TEXT, " +
+		"user_agent TEXT, " +
+		"ip TEXT);"
 	if _, err := db.Exec(cTableQ); err != nil {
 		return nil, err
 	}
 
+	// tables created before the sessions could be listed lack the columns describing them
+	for _, column := range []string{"username", "user_agent", "ip"} {
+		_, err := db.Exec("ALTER TABLE " + tableName + " ADD COLUMN " + column + " TEXT")
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return nil, err
+		}
+	}
+
 	insQ := "INSERT INTO " + tableName +
-		"(id, session_data, created_on, modified_on, expires_on) VALUES (NULL, ?, ?, ?, ?)"
+		"(id, session_data, created_on, modified_on, expires_on, username, user_agent, ip) " +
+		"VALUES (NULL, ?, ?, ?, ?, ?, ?, ?)"
 	stmtInsert, stmtErr := db.Prepare(insQ)
 	if stmtErr != nil {
 		return nil, stmtErr
 	}
 
-	delQ := "DELETE FROM " + tableName + " WHERE id = ?"
+	// Sessions are never deleted right away but expired and emptied instead. The ids are the
+	// rowids of the table, so deleting the newest session would hand out its id (and thus make
+	// its cookie valid) again.
+	delQ := "UPDATE " + tableName + " SET session_data = '', expires_on = ?, username = NULL " +
+		"WHERE id = ?"
 	stmtDelete, stmtErr := db.Prepare(delQ)
 	if stmtErr != nil {
 		return nil, stmtErr
 	}
 
-	updQ := "UPDATE " + tableName + " SET session_data = ?, created_on = ?, expires_on = ? " +
-		"WHERE id = ?"
+	updQ := "UPDATE " + tableName + " SET session_data = ?, created_on = ?, modified_on = ?, " +
+		"expires_on = ?, username = ?, user_agent = ?, ip = ? WHERE id = ?"
 	stmtUpdate, stmtErr := db.Prepare(updQ)
 	if stmtErr != nil {
 		return nil, stmtErr
@@ -154,10 +186,10 @@ func (m *SqliteStore) New(r *http.Request, name string) (*sessions.Session, erro
 func (m *SqliteStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
 	var err error
 	if session.ID == "" {
-		if err = m.insert(session); err != nil {
+		if err = m.insert(r, session); err != nil {
 			return err
 		}
-	} else if err = m.save(session); err != nil {
+	} else if err = m.save(r, session); err != nil {
 		return err
 	}
 	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, m.Codecs...)
@@ -168,7 +200,15 @@ func (m *SqliteStore) Save(r *http.Request, w http.ResponseWriter, session *sess
 	return nil
 }
 
-func (m *SqliteStore) insert(session *sessions.Session) error {
+// sessionDescription returns the username of the session and the user agent and ip of the request
+func sessionDescription(r *http.Request, session *sessions.Session) (username interface{}, userAgent string, ip string) {
+	if name, ok := session.Values["username"].(string); ok {
+		username = name
+	}
+	return username, r.UserAgent(), loginClientIP(r)
+}
+
+func (m *SqliteStore) insert(r *http.Request, session *sessions.Session) error {
 	var createdOn time.Time
 	var modifiedOn time.Time
 	var expiresOn time.Time
@@ -193,7 +233,8 @@ func (m *SqliteStore) insert(session *sessions.Session) error {
 	if encErr != nil {
 		return encErr
 	}
-	res, insErr := m.stmtInsert.Exec(encoded, createdOn, modifiedOn, expiresOn)
+	username, userAgent, ip := sessionDescription(r, session)
+	res, insErr := m.stmtInsert.Exec(encoded, createdOn, modifiedOn, expiresOn, username, userAgent, ip)
 	if insErr != nil {
 		return insErr
 	}
@@ -216,16 +257,16 @@ func (m *SqliteStore) Delete(r *http.Request, w http.ResponseWriter, session *se
 		delete(session.Values, k)
 	}
 
-	_, delErr := m.stmtDelete.Exec(session.ID)
+	_, delErr := m.stmtDelete.Exec(time.Now(), session.ID)
 	if delErr != nil {
 		return delErr
 	}
 	return nil
 }
 
-func (m *SqliteStore) save(session *sessions.Session) error {
+func (m *SqliteStore) save(r *http.Request, session *sessions.Session) error {
 	if session.IsNew == true {
-		return m.insert(session)
+		return m.insert(r, session)
 	}
 	var createdOn time.Time
 	var expiresOn time.Time
@@ -254,7 +295,8 @@ func (m *SqliteStore) save(session *sessions.Session) error {
 	if encErr != nil {
 		return encErr
 	}
-	_, updErr := m.stmtUpdate.Exec(encoded, createdOn, expiresOn, session.ID)
+	username, userAgent, ip := sessionDescription(r, session)
+	_, updErr := m.stmtUpdate.Exec(encoded, createdOn, time.Now(), expiresOn, username, userAgent, ip, session.ID)
 	if updErr != nil {
 		return updErr
 	}
@@ -282,3 +324,73 @@ func (m *SqliteStore) load(session *sessions.Session) error {
 	return nil
 
 }
+
+// Touch updates the last seen time, user agent and ip of a stored session without saving its
+// values. It is meant to be called on every request, but only writes once per
+// sessionTouchInterval.
+func (m *SqliteStore) Touch(r *http.Request, session *sessions.Session) error {
+	if session.IsNew || session.ID == "" {
+		return nil
+	}
+	if modifiedOn, ok := session.Values["modified_on"].(time.Time); ok && time.Since(modifiedOn) < sessionTouchInterval {
+		return nil
+	}
+
+	_, userAgent, ip := sessionDescription(r, session)
+	now := time.Now()
+	_, err := m.db.Exec("UPDATE "+m.table+" SET modified_on = ?, user_agent = ?, ip = ? WHERE id = ?",
+		now, userAgent, ip, session.ID)
+	if err != nil {
+		return err
+	}
+	session.Values["modified_on"] = now
+	return nil
+}
+
+// ListForUser returns the sessions of the user that haven't expired yet, the most recently seen
+// first
+func (m *SqliteStore) ListForUser(username string) ([]SessionInfo, error) {
+	rows, err := m.db.Query("SELECT id, username, COALESCE(user_agent, ''), COALESCE(ip, ''), "+
+		"created_on, modified_on, expires_on FROM "+m.table+
+		" WHERE username = ? AND expires_on > ? ORDER BY modified_on DESC", username, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var infos []SessionInfo
+	for rows.Next() {
+		var info SessionInfo
+		err := rows.Scan(&info.ID, &info.Username, &info.UserAgent, &info.IP, &info.CreatedOn, &info.ModifiedOn, &info.ExpiresOn)
+		if err != nil {
+			return infos, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, rows.Err()
+}
+
+// RevokeForUser expires the session with the given id if it belongs to the user, or all sessions
+// of the user if the id is empty
+func (m *SqliteStore) RevokeForUser(username string, id string) error {
+	query := "UPDATE " + m.table + " SET session_data = '', expires_on = ?, username = NULL " +
+		"WHERE username = ?"
+	args := []interface{}{time.Now(), username}
+	if id != "" {
+		query += " AND id = ?"
+		args = append(args, id)
+	}
+	_, err := m.db.Exec(query, args...)
+	return err
+}
+
+// PurgeExpired deletes the expired sessions and returns how many were deleted. The newest session
+// is always kept, so that its id isn't handed out again (see delQ).
+func (m *SqliteStore) PurgeExpired() (int64, error) {
+	res, err := m.db.Exec("DELETE FROM "+m.table+" WHERE expires_on < ? AND id < (SELECT MAX(id) FROM "+m.table+")",
+		time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,831 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Team is a group of users sharing bots. All members can edit the bots of the team and enter them
+// into battles, the owners additionally manage the members and remove bots from the team.
+type Team struct {
+	ID        int
+	CreatedAt time.Time
+	Name      string
+}
+
+type TeamMember struct {
+	UserID   int
+	Name     string
+	Role     string
+	JoinedAt time.Time
+}
+
+// The roles of the members of a team
+const (
+	TeamRoleOwner  = "owner"
+	TeamRoleMember = "member"
+)
+
+// TeamStanding is the summary of how the bots of a team did in the latest series of a battle.
+// Fights between two bots of the same team don't count for the team.
+type TeamStanding struct {
+	TeamID     int
+	TeamName   string
+	BattleID   int
+	BattleName string
+	Bots       int // the amount of bots the team entered into the battle
+	Fights     int
+	Wins       int
+	Draws      int
+	WinRate    float64
+	Low        float64
+	High       float64
+}
+
+// Interval formats the win rate and its interval for displaying it
+func (s TeamStanding) Interval() string {
+	return fmt.Sprintf("%.1f%% (95%% CI %.1f%% - %.1f%%)", s.WinRate*100, s.Low*100, s.High*100)
+}
+
+var errTeamLastOwner = errors.New("a team needs at least one owner")
+var errTeamAlreadyMember = errors.New("the user is already a member of the team")
+
+//////////////////////////////////////////////////////////////////////////////
+// GENERAL PURPOSE
+
+// TeamCreate creates a new team with the given user as its owner
+func TeamCreate(name string, owner User) (int, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return -1, fmt.Errorf("please provide a name for the team")
+	}
+	return globalState.InsertTeam(name, owner.ID)
+}
+
+func TeamGetById(id int) (Team, error) {
+	teams, err := globalState.GetTeams("id=?", id)
+	if err != nil {
+		return Team{}, err
+	}
+	if len(teams) == 0 {
+		return Team{}, fmt.Errorf("no team with the id %d", id)
+	}
+	return teams[0], nil
+}
+
+func TeamGetAll() ([]Team, error) {
+	return globalState.GetTeams("1")
+}
+
+func TeamGetAllForUser(userid int) ([]Team, error) {
+	return globalState.GetTeams("id IN (SELECT team_id FROM team_members WHERE user_id=?)", userid)
+}
+
+func TeamGetAllForBot(botid int) ([]Team, error) {
+	return globalState.GetTeams("id IN (SELECT team_id FROM team_bot_rel WHERE bot_id=?)", botid)
+}
+
+func TeamGetMembers(teamid int) ([]TeamMember, error) {
+	return globalState.GetTeamMembers(teamid)
+}
+
+// TeamGetRole returns the role of the user in the team, or "" if they aren't a member
+func TeamGetRole(teamid int, userid int) (string, error) {
+	return globalState.GetTeamRole(teamid, userid)
+}
+
+func TeamGetBots(teamid int) ([]Bot, error) {
+	return globalState.GetTeamBots("tb.team_id=?", teamid)
+}
+
+// TeamGetBotsForUser returns the bots of all teams the user is a member of
+func TeamGetBotsForUser(userid int) ([]Bot, error) {
+	return globalState.GetTeamBots("tb.team_id IN (SELECT team_id FROM team_members WHERE user_id=?)", userid)
+}
+
+// TeamIsBotMember returns true if the user is a member of one of the teams owning the bot
+func TeamIsBotMember(botid int, userid int) (bool, error) {
+	return globalState.GetTeamBotMember(botid, userid)
+}
+
+// TeamAddMember adds the user to the team as a member, adding someone who already is one fails with
+// errTeamAlreadyMember instead of touching their role
+func TeamAddMember(teamid int, userid int) error {
+	role, err := TeamGetRole(teamid, userid)
+	if err != nil {
+		return err
+	}
+	if role != "" {
+		return errTeamAlreadyMember
+	}
+	return globalState.InsertTeamMember(teamid, userid, TeamRoleMember)
+}
+
+// TeamSetRole changes the role of a member of the team, the last owner can't be demoted
+func TeamSetRole(teamid int, userid int, role string) error {
+	if role != TeamRoleOwner && role != TeamRoleMember {
+		return fmt.Errorf("invalid role %q", role)
+	}
+	if role == TeamRoleMember {
+		if err := teamCheckOwnerLeft(teamid, userid); err != nil {
+			return err
+		}
+	}
+	return globalState.UpdateTeamMemberRole(teamid, userid, role)
+}
+
+func TeamRemoveMember(teamid int, userid int) error {
+	if err := teamCheckOwnerLeft(teamid, userid); err != nil {
+		return err
+	}
+	return globalState.DeleteTeamMember(teamid, userid)
+}
+
+// teamCheckOwnerLeft returns errTeamLastOwner if the user is the only owner of the team, so they
+// can't leave or be demoted
+func teamCheckOwnerLeft(teamid int, userid int) error {
+	members, err := TeamGetMembers(teamid)
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		if m.Role == TeamRoleOwner && m.UserID != userid {
+			return nil
+		}
+	}
+	return errTeamLastOwner
+}
+
+// TeamLinkBot adds the bot to the team, remembering who added it so that it can be given back
+func TeamLinkBot(teamid int, botid int, user User) error {
+	return globalState.LinkTeamBot(teamid, botid, user.ID)
+}
+
+// TeamUnlinkBot removes the bot from the team, only the owners of the team may do so. The bot goes
+// back to the user who added it to the team, or to the owner removing it if that user is gone.
+func TeamUnlinkBot(teamid int, botid int, owner User) error {
+	role, err := TeamGetRole(teamid, owner.ID)
+	if err != nil {
+		return err
+	}
+	if role != TeamRoleOwner {
+		return fmt.Errorf("only the owners of the team can remove its bots")
+	}
+	return globalState.UnlinkTeamBot(teamid, botid, owner.ID)
+}
+
+// TeamDelete deletes the team, its bots are handed over to the user deleting it
+func TeamDelete(teamid int, user User) error {
+	return globalState.DeleteTeam(teamid, user.ID)
+}
+
+// TeamGetStandings returns how the teams that entered bots into the battle did in its latest
+// series, best first
+func TeamGetStandings(battleid int) ([]TeamStanding, error) {
+	runid := 0
+	if run, err := RunGetLatestForBattle(battleid); err == nil {
+		runid = run.ID
+	}
+
+	standings, err := globalState.GetTeamStandings(battleid, runid)
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range standings {
+		standings[i].WinRate, standings[i].Low, standings[i].High = wilson(s.Wins, s.Fights)
+	}
+	sort.SliceStable(standings, func(i, j int) bool {
+		return standings[i].WinRate > standings[j].WinRate
+	})
+	return standings, nil
+}
+
+// TeamGetResults returns the standing of the team in every battle it entered bots into that the
+// viewer is allowed to see
+func TeamGetResults(teamid int, viewer User) ([]TeamStanding, error) {
+	battleIDs, err := globalState.GetTeamBattleIDs(teamid)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []TeamStanding
+	for _, battleid := range battleIDs {
+		battle, err := BattleGetByIdDeep(battleid)
+		if err != nil {
+			return nil, err
+		}
+		if !BattleCan(battle, viewer, BattleView) {
+			continue
+		}
+
+		standings, err := TeamGetStandings(battleid)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range standings {
+			if s.TeamID == teamid {
+				results = append(results, s)
+			}
+		}
+	}
+	return results, nil
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// DATABASE
+
+func (s *State) InsertTeam(name string, ownerid int) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO teams (created_at, name) VALUES (?, ?)", time.Now(), name)
+	if err != nil {
+		return -1, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return -1, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO team_members (team_id, user_id, role, created_at) VALUES (?, ?, ?, ?)`,
+		id, ownerid, TeamRoleOwner, time.Now())
+	if err != nil {
+		return -1, err
+	}
+
+	return int(id), tx.Commit()
+}
+
+// GetTeams returns the teams matching the where clause
+func (s *State) GetTeams(where string, args ...interface{}) ([]Team, error) {
+	rows, err := s.db.Query(`
+		SELECT id, created_at, name
+		FROM teams
+		WHERE `+where+`
+		ORDER BY name`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var teams []Team
+	for rows.Next() {
+		var team Team
+		if err := rows.Scan(&team.ID, &team.CreatedAt, &team.Name); err != nil {
+			return teams, err
+		}
+		teams = append(teams, team)
+	}
+	return teams, rows.Err()
+}
+
+func (s *State) GetTeamMembers(teamid int) ([]TeamMember, error) {
+	rows, err := s.db.Query(`
+		SELECT u.id, u.name, tm.role, tm.created_at
+		FROM team_members tm
+		JOIN users u ON u.id = tm.user_id
+		WHERE tm.team_id=?
+		ORDER BY tm.role DESC, u.name`, teamid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []TeamMember
+	for rows.Next() {
+		var m TeamMember
+		if err := rows.Scan(&m.UserID, &m.Name, &m.Role, &m.JoinedAt); err != nil {
+			return members, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (s *State) GetTeamRole(teamid int, userid int) (string, error) {
+	var role string
+	err := s.db.QueryRow("SELECT role FROM team_members WHERE team_id=? AND user_id=?", teamid, userid).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return role, err
+}
+
+// GetTeamBots returns the bots owned by the teams matching the where clause
+func (s *State) GetTeamBots(where string, args ...interface{}) ([]Bot, error) {
+	rows, err := s.db.Query(`
+		SELECT DISTINCT b.id, b.name, b.source
+		FROM bots b
+		JOIN team_bot_rel tb ON tb.bot_id = b.id
+		WHERE `+where+`
+		ORDER BY b.name`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bots []Bot
+	for rows.Next() {
+		var bot Bot
+		if err := rows.Scan(&bot.ID, &bot.Name, &bot.Source); err != nil {
+			return bots, err
+		}
+		bots = append(bots, bot)
+	}
+	return bots, rows.Err()
+}
+
+func (s *State) GetTeamBotMember(botid int, userid int) (bool, error) {
+	var count int
+	err := s.db.QueryRow(`
+		SELECT COUNT(*)
+		FROM team_bot_rel tb
+		JOIN team_members tm ON tm.team_id = tb.team_id
+		WHERE tb.bot_id=? AND tm.user_id=?`, botid, userid).Scan(&count)
+	return count > 0, err
+}
+
+func (s *State) InsertTeamMember(teamid int, userid int, role string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO team_members (team_id, user_id, role, created_at) VALUES (?, ?, ?, ?)`,
+		teamid, userid, role, time.Now())
+	return err
+}
+
+func (s *State) UpdateTeamMemberRole(teamid int, userid int, role string) error {
+	_, err := s.db.Exec("UPDATE team_members SET role=? WHERE team_id=? AND user_id=?", role, teamid, userid)
+	return err
+}
+
+func (s *State) DeleteTeamMember(teamid int, userid int) error {
+	_, err := s.db.Exec("DELETE FROM team_members WHERE team_id=? AND user_id=?", teamid, userid)
+	return err
+}
+
+func (s *State) LinkTeamBot(teamid int, botid int, userid int) error {
+	_, err := s.db.Exec("INSERT OR IGNORE INTO team_bot_rel (team_id, bot_id, added_by) VALUES (?, ?, ?)", teamid, botid, userid)
+	return err
+}
+
+// UnlinkTeamBot removes the bot from the team and makes the user who added it (or ownerid, if they
+// have been deleted) an owner of the bot
+func (s *State) UnlinkTeamBot(teamid int, botid int, ownerid int) error {
+	_, err := s.db.Exec(`
+		INSERT OR IGNORE INTO user_bot_rel (user_id, bot_id)
+			SELECT COALESCE(added_by, ?1), bot_id FROM team_bot_rel WHERE team_id=?3 AND bot_id=?2;
+		DELETE FROM team_bot_rel WHERE team_id=?3 AND bot_id=?2;
+		`, ownerid, botid, teamid)
+	return err
+}
+
+func (s *State) DeleteTeam(teamid int, userid int) error {
+	_, err := s.db.Exec(`
+		INSERT OR IGNORE INTO user_bot_rel (user_id, bot_id)
+			SELECT ?1, bot_id FROM team_bot_rel WHERE team_id=?2;
+		DELETE FROM team_bot_rel WHERE team_id=?2;
+		DELETE FROM team_members WHERE team_id=?2;
+		DELETE FROM teams WHERE id=?2;
+		`, userid, teamid)
+	return err
+}
+
+// GetTeamBattleIDs returns the ids of the battles the team has bots in
+func (s *State) GetTeamBattleIDs(teamid int) ([]int, error) {
+	rows, err := s.db.Query(`
+		SELECT DISTINCT bb.battle_id
+		FROM bot_battle_rel bb
+		JOIN team_bot_rel tb ON tb.bot_id = bb.bot_id
+		WHERE tb.team_id=?
+		ORDER BY bb.battle_id`, teamid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetTeamStandings sums up the fights of the run per team that entered bots into the battle. A
+// fight counts for a team if exactly one of the two bots belongs to it.
+func (s *State) GetTeamStandings(battleid int, runid int) ([]TeamStanding, error) {
+	rows, err := s.db.Query(`
+		SELECT
+			t.id, t.name, (SELECT name FROM battles WHERE id = ?),
+			(SELECT COUNT(*) FROM team_bot_rel tb JOIN bot_battle_rel bb ON bb.bot_id = tb.bot_id
+			 WHERE tb.team_id = t.id AND bb.battle_id = ?),
+			COUNT(f.id),
+			COALESCE(SUM(CASE WHEN f.winner_bot_id IN (SELECT bot_id FROM team_bot_rel WHERE team_id = t.id) THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN f.id IS NOT NULL AND f.winner_bot_id IS NULL THEN 1 ELSE 0 END), 0)
+		FROM teams t
+		LEFT JOIN fights f ON f.run_id = ?
+			AND (f.first_bot_id IN (SELECT bot_id FROM team_bot_rel WHERE team_id = t.id))
+			 != (f.second_bot_id IN (SELECT bot_id FROM team_bot_rel WHERE team_id = t.id))
+		WHERE t.id IN (SELECT tb.team_id FROM team_bot_rel tb JOIN bot_battle_rel bb ON bb.bot_id = tb.bot_id
+		               WHERE bb.battle_id = ?)
+		GROUP BY t.id
+		ORDER BY t.name`, battleid, battleid, runid, battleid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var standings []TeamStanding
+	for rows.Next() {
+		st := TeamStanding{BattleID: battleid}
+		if err := rows.Scan(&st.TeamID, &st.TeamName, &st.BattleName, &st.Bots, &st.Fights, &st.Wins, &st.Draws); err != nil {
+			return standings, err
+		}
+		standings = append(standings, st)
+	}
+	return standings, rows.Err()
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// HTTP
+
+// teamRequest returns the user making the request, the team from the url and the role of the user
+// in that team
+func teamRequest(r *http.Request) (User, Team, string, error) {
+	session, _ := globalState.sessions.Get(r, "session")
+	user, err := UserGetUserFromUsername(session.Values["username"].(string))
+	if err != nil {
+		return User{}, Team{}, "", fmt.Errorf("Could not get the id for your username")
+	}
+
+	teamid, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return user, Team{}, "", fmt.Errorf("Invalid team id")
+	}
+	team, err := TeamGetById(teamid)
+	if err != nil {
+		return user, Team{}, "", fmt.Errorf("Could not get the team")
+	}
+
+	role, err := TeamGetRole(team.ID, user.ID)
+	if err != nil {
+		return user, team, "", fmt.Errorf("Could not get your role in the team")
+	}
+	return user, team, role, nil
+}
+
+// teamsHandler lists all teams
+func teamsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		// define data
+		data := map[string]interface{}{}
+		data["version"] = os.Getenv("VERSION")
+		data["csrfToken"] = csrfToken(r)
+		data["pagelink1"] = Link{Name: "team", Target: "/team"}
+		data["pagelink1options"] = []Link{
+			{Name: "user", Target: "/user"},
+			{Name: "bot", Target: "/bot"},
+			{Name: "battle", Target: "/battle"},
+		}
+
+		// display errors passed via query parameters
+		queryres := r.URL.Query().Get("res")
+		if queryres != "" {
+			data["res"] = queryres
+		}
+
+		session, _ := globalState.sessions.Get(r, "session")
+		user, err := UserGetUserFromUsername(session.Values["username"].(string))
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		data["user"] = user
+
+		teams, err := TeamGetAll()
+		if err != nil {
+			data["err"] = "Could not fetch the teams"
+		}
+		data["teams"] = teams
+
+		myTeams, err := TeamGetAllForUser(user.ID)
+		if err != nil {
+			data["err"] = "Could not fetch your teams"
+		}
+		data["myTeams"] = myTeams
+
+		// get the template
+		t, err := template.ParseGlob(fmt.Sprintf("%s/*.html", templatesPath))
+		if err != nil {
+			log.Printf("Error reading the template Path: %s/*.html", templatesPath)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("500 - Error reading template file"))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// exec!
+		t.ExecuteTemplate(w, "teams", data)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
+
+// teamNewHandler creates a team owned by the user creating it
+func teamNewHandler(w http.ResponseWriter, r *http.Request) {
+	redir_target := "/team?res=%s"
+
+	switch r.Method {
+	case "POST":
+		session, _ := globalState.sessions.Get(r, "session")
+		user, err := UserGetUserFromUsername(session.Values["username"].(string))
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the id for your username")
+			return
+		}
+
+		r.ParseForm()
+		id, err := TeamCreate(r.Form.Get("name"), user)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not create the team, maybe the name is already taken")
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("/team/%d", id), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
+
+// teamSingleHandler displays the members, bots and results of a team
+func teamSingleHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		// define data
+		data := map[string]interface{}{}
+		data["version"] = os.Getenv("VERSION")
+		data["csrfToken"] = csrfToken(r)
+		data["pagelink1"] = Link{Name: "team", Target: "/team"}
+		data["pagelink1options"] = []Link{
+			{Name: "user", Target: "/user"},
+			{Name: "bot", Target: "/bot"},
+			{Name: "battle", Target: "/battle"},
+		}
+
+		// display errors passed via query parameters
+		queryres := r.URL.Query().Get("res")
+		if queryres != "" {
+			data["res"] = queryres
+		}
+
+		user, team, role, err := teamRequest(r)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, "/team?res=%s", err.Error())
+			return
+		}
+		data["user"] = user
+		data["team"] = team
+		data["role"] = role
+
+		// define the breadcrumbs
+		data["pagelink2"] = Link{team.Name, fmt.Sprintf("/%d", team.ID)}
+		teams, err := TeamGetAll()
+		var opts []Link
+		for _, t := range teams {
+			if t.ID != team.ID {
+				opts = append(opts, Link{Name: t.Name, Target: fmt.Sprintf("/%d", t.ID)})
+			}
+		}
+		data["pagelink2options"] = opts
+
+		members, err := TeamGetMembers(team.ID)
+		if err != nil {
+			data["err"] = "Could not fetch the members"
+		}
+		data["members"] = members
+
+		bots, err := TeamGetBots(team.ID)
+		if err != nil {
+			data["err"] = "Could not fetch the bots"
+		}
+		data["bots"] = bots
+
+		results, err := TeamGetResults(team.ID, user)
+		if err != nil {
+			data["err"] = "Could not fetch the results"
+		}
+		data["results"] = results
+
+		// the bots of the user that could be added to the team
+		if role != "" {
+			myBots, err := UserGetBotsUsingUserID(user.ID)
+			if err != nil {
+				data["err"] = "Could not fetch your bots"
+			}
+			data["myBots"] = myBots
+		}
+
+		// get the template
+		t, err := template.ParseGlob(fmt.Sprintf("%s/*.html", templatesPath))
+		if err != nil {
+			log.Printf("Error reading the template Path: %s/*.html", templatesPath)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("500 - Error reading template file"))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// exec!
+		t.ExecuteTemplate(w, "team", data)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
+
+// teamMemberHandler adds a member to the team (/team/{id}/member) or promotes, demotes or removes
+// one (/team/{id}/member/{userid}/{action}). Members may remove themselves, everything else is up
+// to the owners of the team.
+func teamMemberHandler(w http.ResponseWriter, r *http.Request) {
+	redir_target := fmt.Sprintf("/team/%s?res=%%s#members", mux.Vars(r)["id"])
+
+	switch r.Method {
+	case "POST":
+		user, team, role, err := teamRequest(r)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, err.Error())
+			return
+		}
+
+		r.ParseForm()
+		action := mux.Vars(r)["action"]
+
+		var member User
+		if action == "" {
+			member, err = UserGetUserFromUsername(strings.TrimSpace(r.Form.Get("username")))
+			if err != nil || member.Name == "" {
+				log_and_redir_with_msg(w, r, err, redir_target, "There is no user with that name")
+				return
+			}
+			action = "add"
+		} else {
+			memberid, err := strconv.Atoi(mux.Vars(r)["userid"])
+			if err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Invalid user id")
+				return
+			}
+			member.ID = memberid
+
+			memberRole, err := TeamGetRole(team.ID, member.ID)
+			if err != nil || memberRole == "" {
+				log_and_redir_with_msg(w, r, err, redir_target, "That user isn't a member of the team")
+				return
+			}
+		}
+
+		leaving := action == "remove" && member.ID == user.ID
+		if role != TeamRoleOwner && !leaving {
+			log_and_redir_with_msg(w, r, nil, redir_target, "Only the owners of the team can manage its members")
+			return
+		}
+
+		var msg string
+		switch action {
+		case "add":
+			err = TeamAddMember(team.ID, member.ID)
+			msg = fmt.Sprintf("Added %s to the team", member.Name)
+		case "promote":
+			err = TeamSetRole(team.ID, member.ID, TeamRoleOwner)
+			msg = "Promoted the member to owner"
+		case "demote":
+			err = TeamSetRole(team.ID, member.ID, TeamRoleMember)
+			msg = "Demoted the owner to member"
+		case "remove":
+			err = TeamRemoveMember(team.ID, member.ID)
+			msg = "Removed the member from the team"
+		default:
+			err = fmt.Errorf("invalid action %q", action)
+		}
+		if err != nil {
+			msg := "Could not update the members"
+			if errors.Is(err, errTeamLastOwner) {
+				msg = "A team needs at least one owner, promote someone else first"
+			}
+			if errors.Is(err, errTeamAlreadyMember) {
+				msg = fmt.Sprintf("%s is already a member of the team", member.Name)
+			}
+			log_and_redir_with_msg(w, r, err, redir_target, msg)
+			return
+		}
+
+		if leaving {
+			http.Redirect(w, r, "/team?res=You left the team", http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf(redir_target, msg), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
+
+// teamBotHandler adds one of the bots of a member to the team (/team/{id}/bot) or removes a bot
+// from the team (/team/{id}/bot/{botid}/remove)
+func teamBotHandler(w http.ResponseWriter, r *http.Request) {
+	redir_target := fmt.Sprintf("/team/%s?res=%%s#bots", mux.Vars(r)["id"])
+
+	switch r.Method {
+	case "POST":
+		user, team, role, err := teamRequest(r)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, err.Error())
+			return
+		}
+		if role == "" {
+			log_and_redir_with_msg(w, r, nil, redir_target, "Only the members of the team can manage its bots")
+			return
+		}
+
+		r.ParseForm()
+		rawid := mux.Vars(r)["botid"]
+		if rawid == "" {
+			rawid = r.Form.Get("bot")
+		}
+		botid, err := strconv.Atoi(rawid)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Invalid bot id")
+			return
+		}
+
+		if mux.Vars(r)["botid"] != "" {
+			if role != TeamRoleOwner {
+				log_and_redir_with_msg(w, r, nil, redir_target, "Only the owners of the team can remove its bots")
+				return
+			}
+			if err := TeamUnlinkBot(team.ID, botid, user); err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Could not remove the bot from the team")
+				return
+			}
+			http.Redirect(w, r, fmt.Sprintf(redir_target, "Removed the bot from the team, it went back to the member who added it"), http.StatusSeeOther)
+			return
+		}
+
+		// only bots the user owns can be handed to the team
+		bot, err := BotGetById(botid)
+		if err != nil || !bot.HasOwner(user.ID) {
+			log_and_redir_with_msg(w, r, err, redir_target, "You can only add your own bots to the team")
+			return
+		}
+		if err := TeamLinkBot(team.ID, botid, user); err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not add the bot to the team")
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf(redir_target, "Added the bot to the team"), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
+
+// teamDeleteHandler deletes a team, the bots of the team go to the owner deleting it
+func teamDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	redir_target := fmt.Sprintf("/team/%s?res=%%s", mux.Vars(r)["id"])
+
+	switch r.Method {
+	case "POST":
+		user, team, role, err := teamRequest(r)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, err.Error())
+			return
+		}
+		if role != TeamRoleOwner {
+			log_and_redir_with_msg(w, r, nil, redir_target, "Only the owners of the team can delete it")
+			return
+		}
+
+		if err := TeamDelete(team.ID, user); err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not delete the team")
+			return
+		}
+
+		http.Redirect(w, r, "/team?res=Deleted the team, its bots now belong to you", http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// teamTestSetup creates a team owned by alice with bob as a member
+func teamTestSetup(t *testing.T) (*State, User, User, int) {
+	s := testState(t)
+
+	var users []User
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := UserRegister(name, []byte("hash")); err != nil {
+			t.Fatal(err)
+		}
+		user, err := UserGetUserFromUsername(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+
+	teamid, err := TeamCreate("team", users[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := TeamAddMember(teamid, users[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	return s, users[0], users[1], teamid
+}
+
+func TestTeamMembers(t *testing.T) {
+	_, alice, bob, teamid := teamTestSetup(t)
+
+	// adding an existing member doesn't touch their role
+	for _, user := range []User{alice, bob} {
+		if err := TeamAddMember(teamid, user.ID); !errors.Is(err, errTeamAlreadyMember) {
+			t.Errorf("adding %s again: %v", user.Name, err)
+		}
+	}
+	if role, _ := TeamGetRole(teamid, alice.ID); role != TeamRoleOwner {
+		t.Errorf("alice is a %s after being added again", role)
+	}
+
+	// the last owner can't be demoted or leave
+	if err := TeamSetRole(teamid, alice.ID, TeamRoleMember); !errors.Is(err, errTeamLastOwner) {
+		t.Errorf("demoting the last owner: %v", err)
+	}
+	if err := TeamRemoveMember(teamid, alice.ID); !errors.Is(err, errTeamLastOwner) {
+		t.Errorf("removing the last owner: %v", err)
+	}
+
+	// once there is another one, they can
+	if err := TeamSetRole(teamid, bob.ID, TeamRoleOwner); err != nil {
+		t.Fatal(err)
+	}
+	if err := TeamSetRole(teamid, alice.ID, TeamRoleMember); err != nil {
+		t.Errorf("demoting one of two owners: %v", err)
+	}
+}
+
+func TestTeamUnlinkBot(t *testing.T) {
+	s, alice, bob, teamid := teamTestSetup(t)
+
+	// a bot bob created for the team, it has no other owner
+	botid, err := BotCreate("bot", "nop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := TeamLinkBot(teamid, botid, bob); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := TeamUnlinkBot(teamid, botid, bob); err == nil {
+		t.Error("a member removed a bot from the team")
+	}
+	if err := TeamUnlinkBot(teamid, botid, alice); err != nil {
+		t.Fatal(err)
+	}
+
+	bot, err := BotGetById(botid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bot.HasOwner(bob.ID) || bot.HasOwner(alice.ID) {
+		t.Errorf("the bot went to %+v instead of back to bob", bot.Users)
+	}
+	if n := migrateTestCount(t, s.db, "SELECT COUNT(*) FROM team_bot_rel WHERE bot_id=?", botid); n != 0 {
+		t.Error("the bot is still in the team")
+	}
+}
+
+func TestTeamUnlinkBotAdderDeleted(t *testing.T) {
+	s, alice, bob, teamid := teamTestSetup(t)
+
+	botid, err := BotCreate("bot", "nop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := TeamLinkBot(teamid, botid, bob); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteAccount(bob.ID, bob.Name, AccountBotsDelete, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := TeamUnlinkBot(teamid, botid, alice); err != nil {
+		t.Fatal(err)
+	}
+	bot, err := BotGetById(botid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bot.HasOwner(alice.ID) {
+		t.Errorf("the bot of the deleted member went to %+v instead of the team owner", bot.Users)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Token is a personal API token. Only the sha256 of the token itself is stored, the plaintext is
+// shown to the user once after creating it.
+type Token struct {
+	ID         int
+	UserID     int
+	Name       string
+	Scopes     []string
+	CreatedAt  time.Time
+	LastUsedAt time.Time // zero if the token has never been used
+}
+
+// The scopes a token can be restricted to
+const (
+	ScopeRead    = "read"    // all GET requests
+	ScopeBots    = "bots"    // creating and updating bots
+	ScopeBattles = "battles" // creating and configuring battles, submitting bots to them
+	ScopeRuns    = "runs"    // triggering runs
+)
+
+var tokenScopes = []string{ScopeRead, ScopeBots, ScopeBattles, ScopeRuns}
+
+const tokenPrefix = "r2w_"
+
+type tokenContextKeyType struct{}
+
+// tokenContextKey is used to store the Token a request has been authenticated with
+var tokenContextKey = tokenContextKeyType{}
+
+// HasScope returns true if the token may be used for the given scope
+func (t Token) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// GENERAL PURPOSE
+
+// TokenCreate creates a new token for the user and returns its plaintext value
+func TokenCreate(userid int, name string, scopes []string) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	plaintext := tokenPrefix + hex.EncodeToString(secret)
+
+	_, err := globalState.InsertToken(Token{UserID: userid, Name: name, Scopes: scopes}, tokenHash(plaintext))
+	if err != nil {
+		return "", err
+	}
+	return plaintext, nil
+}
+
+func TokenGetAllForUser(userid int) ([]Token, error) {
+	return globalState.GetTokensForUser(userid)
+}
+
+func TokenRevoke(userid int, tokenid int) error {
+	return globalState.DeleteToken(userid, tokenid)
+}
+
+// TokenAuthenticate returns the user and token belonging to the plaintext token given
+func TokenAuthenticate(plaintext string) (User, Token, error) {
+	token, err := globalState.GetTokenByHash(tokenHash(plaintext))
+	if err != nil {
+		return User{}, Token{}, err
+	}
+
+	user, err := UserGetUserFromID(token.UserID)
+	if err != nil {
+		return User{}, Token{}, err
+	}
+
+	if err := globalState.UpdateTokenLastUsed(token.ID); err != nil {
+		log.Println(err)
+	}
+	return user, token, nil
+}
+
+// RequestToken returns the token the request was authenticated with, if any
+func RequestToken(r *http.Request) (Token, bool) {
+	token, ok := r.Context().Value(tokenContextKey).(Token)
+	return token, ok
+}
+
+// tokenHash hashes the token for storing it. The tokens are random enough that a plain sha256
+// is sufficient, no need for argon2 here.
+func tokenHash(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenScopeForRequest returns the scope a token needs in order to be used for the request. Tokens
+// are limited to the operations of the json api listed in apiOperations, an empty string means
+// that tokens can't be used for the request at all (e.g. the account settings or the data export).
+func tokenScopeForRequest(r *http.Request) string {
+	path, ok := strings.CutPrefix(r.URL.Path, "/api/v1/")
+	if !ok {
+		return ""
+	}
+
+	method := r.Method
+	if method == "HEAD" {
+		method = "GET"
+	}
+
+	for _, op := range apiOperations {
+		if op.Method == method && tokenPathMatches(op.Path, path) {
+			return op.Scope
+		}
+	}
+	return ""
+}
+
+// tokenPathMatches returns true if the path matches the path template of an api operation, every
+// variable in the template has to match exactly one non empty segment of the path
+func tokenPathMatches(template string, path string) bool {
+	want := strings.Split(strings.TrimPrefix(template, "/"), "/")
+	got := strings.Split(path, "/")
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if strings.HasPrefix(want[i], "{") {
+			if got[i] == "" {
+				return false
+			}
+		} else if want[i] != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenAuthenticateRequest authenticates the request using the bearer token in the Authorization
+// header. On success, the token and the user owning it are stored in the request context, the
+// session isn't touched. On failure, the http status code to respond with and a message are
+// returned.
+func tokenAuthenticateRequest(r *http.Request) (*http.Request, int, string) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return r, http.StatusUnauthorized, "Expected a bearer token"
+	}
+
+	user, token, err := TokenAuthenticate(strings.TrimPrefix(header, "Bearer "))
+	if err != nil {
+		log.Println(err)
+		return r, http.StatusUnauthorized, "Invalid token"
+	}
+
+	scope := tokenScopeForRequest(r)
+	if scope == "" || !token.HasScope(scope) {
+		return r, http.StatusForbidden, "The token isn't allowed to do this"
+	}
+
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	ctx = context.WithValue(ctx, apiUserContextKey, user)
+	return r.WithContext(ctx), 0, ""
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// DATABASE
+
+func (s *State) InsertToken(token Token, hash string) (int, error) {
+	res, err := s.db.Exec(`
+		INSERT INTO tokens (created_at, user_id, name, scopes, token_hash)
+		VALUES (?, ?, ?, ?, ?)`,
+		time.Now(), token.UserID, token.Name, strings.Join(token.Scopes, ","), hash)
+	if err != nil {
+		return -1, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return -1, err
+	}
+	return int(id), nil
+}
+
+func (s *State) GetTokensForUser(userid int) ([]Token, error) {
+	rows, err := s.db.Query(`
+		SELECT id, user_id, name, scopes, created_at, last_used_at
+		FROM tokens
+		WHERE user_id=?
+		ORDER BY id`, userid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []Token
+	for rows.Next() {
+		var token Token
+		var scopes string
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&token.ID, &token.UserID, &token.Name, &scopes, &token.CreatedAt, &lastUsed); err != nil {
+			return tokens, err
+		}
+		token.Scopes = strings.Split(scopes, ",")
+		token.LastUsedAt = lastUsed.Time
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *State) GetTokenByHash(hash string) (Token, error) {
+	var token Token
+	var scopes string
+	var lastUsed sql.NullTime
+	err := s.db.QueryRow(`
+		SELECT id, user_id, name, scopes, created_at, last_used_at
+		FROM tokens
+		WHERE token_hash=?`, hash).Scan(&token.ID, &token.UserID, &token.Name, &scopes, &token.CreatedAt, &lastUsed)
+	if err != nil {
+		return Token{}, err
+	}
+	token.Scopes = strings.Split(scopes, ",")
+	token.LastUsedAt = lastUsed.Time
+	return token, nil
+}
+
+func (s *State) UpdateTokenLastUsed(tokenid int) error {
+	_, err := s.db.Exec("UPDATE tokens SET last_used_at=? WHERE id=?", time.Now(), tokenid)
+	return err
+}
+
+// Deletes the token, the user id is checked so that users can only revoke their own tokens
+func (s *State) DeleteToken(userid int, tokenid int) error {
+	_, err := s.db.Exec("DELETE FROM tokens WHERE id=? AND user_id=?", tokenid, userid)
+	return err
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// HTTP
+
+// tokenNewHandler creates a new token for the user. The plaintext token is passed to the profile
+// page using the session, as it shouldn't end up in any url.
+func tokenNewHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Error reading the profile id"))
+		return
+	}
+
+	redir_target := fmt.Sprintf("/user/%d/profile?res=%%s#tokens", id)
+
+	switch r.Method {
+	case "POST":
+		session, _ := globalState.sessions.Get(r, "session")
+		user, err := UserGetUserFromUsername(session.Values["username"].(string))
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the id for your username")
+			return
+		}
+		if user.ID != id {
+			log_and_redir_with_msg(w, r, nil, redir_target, "You can only create tokens for yourself")
+			return
+		}
+
+		r.ParseForm()
+		name := r.Form.Get("name")
+		if name == "" || len(name) >= 64 {
+			log_and_redir_with_msg(w, r, nil, redir_target, "Please give the token a name with less than 64 chars")
+			return
+		}
+
+		var scopes []string
+		for _, scope := range tokenScopes {
+			if r.Form.Get("scope-"+scope) == "on" {
+				scopes = append(scopes, scope)
+			}
+		}
+		if len(scopes) == 0 {
+			log_and_redir_with_msg(w, r, nil, redir_target, "Please select at least one scope")
+			return
+		}
+
+		plaintext, err := TokenCreate(user.ID, name, scopes)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not create the token")
+			return
+		}
+
+		session.AddFlash(plaintext, "token")
+		if err := session.Save(r, w); err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not store the token in your session")
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf(redir_target, "Created the token"), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
+
+func tokenRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Error reading the profile id"))
+		return
+	}
+
+	redir_target := fmt.Sprintf("/user/%d/profile?res=%%s#tokens", id)
+
+	tokenid, err := strconv.Atoi(vars["tokenid"])
+	if err != nil {
+		log_and_redir_with_msg(w, r, err, redir_target, "Invalid token id")
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		session, _ := globalState.sessions.Get(r, "session")
+		user, err := UserGetUserFromUsername(session.Values["username"].(string))
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the id for your username")
+			return
+		}
+		if user.ID != id {
+			log_and_redir_with_msg(w, r, nil, redir_target, "You can only revoke your own tokens")
+			return
+		}
+
+		if err := TokenRevoke(user.ID, tokenid); err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not revoke the token")
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf(redir_target, "Revoked the token"), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
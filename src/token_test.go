@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenScopeForRequest(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		scope  string
+	}{
+		{"GET", "/api/v1/bots", ScopeRead},
+		{"HEAD", "/api/v1/bots", ScopeRead},
+		{"GET", "/api/v1/bots/3", ScopeRead},
+		{"POST", "/api/v1/bots", ScopeBots},
+		{"PUT", "/api/v1/bots/3", ScopeBots},
+		{"POST", "/api/v1/battles", ScopeBattles},
+		{"PUT", "/api/v1/battles/3", ScopeBattles},
+		{"POST", "/api/v1/battles/3/bots", ScopeBattles},
+		{"POST", "/api/v1/battles/3/run", ScopeRuns},
+		{"POST", "/api/v1/battles/3/series", ScopeRuns},
+		{"GET", "/api/v1/battles/3/output", ScopeRead},
+		{"GET", "/api/v1/runs/3", ScopeRead},
+
+		// not part of the api
+		{"GET", "/user/3/export", ""},
+		{"GET", "/user/3/profile", ""},
+		{"POST", "/user/3/profile", ""},
+		{"POST", "/user/3/delete", ""},
+		{"GET", "/bot/3", ""},
+		{"POST", "/bot/new", ""},
+		{"GET", "/admin", ""},
+
+		// unknown operations of the api
+		{"DELETE", "/api/v1/bots/3", ""},
+		{"GET", "/api/v1/battles/3/run", ""},
+		{"GET", "/api/v1/bots/", ""},
+		{"GET", "/api/v1/bots/3/export", ""},
+		{"GET", "/api/v1", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := tokenScopeForRequest(r); got != tt.scope {
+			t.Errorf("%s %s: scope %q, want %q", tt.method, tt.path, got, tt.scope)
+		}
+	}
+}
+
+func TestTokenHasScope(t *testing.T) {
+	token := Token{Scopes: []string{ScopeRead, ScopeRuns}}
+	for scope, want := range map[string]bool{ScopeRead: true, ScopeRuns: true, ScopeBots: false, "": false} {
+		if got := token.HasScope(scope); got != want {
+			t.Errorf("HasScope(%q) = %v, want %v", scope, got, want)
+		}
+	}
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Users can enable TOTP (RFC 6238) as a second factor. The secret is first stored disabled and
+// only enabled once the user proved that their authenticator app generates matching codes. When
+// enabling it, the user gets recovery codes that can be used once each instead of a TOTP code.
+// Only the sha256 of the recovery codes is stored, they are shown to the user once.
+//
+// While logging in, the session only gets the username after the second step succeeded. Until
+// then, the username is stored as totpPendingKey.
+const (
+	totpIssuer  = "r2wars"
+	totpPeriod  = 30 // seconds
+	totpDigits  = 6
+	totpSkew    = 1 // steps accepted before and after the current one, for clocks being off
+	totpSecret  = 20
+	totpPending = 5 * time.Minute // time between entering the password and the code
+
+	totpRecoveryCodes = 10
+
+	totpPendingKey   = "totp_username"
+	totpPendingAtKey = "totp_started"
+)
+
+// TOTP is the second factor of a user
+type TOTP struct {
+	UserID    int
+	CreatedAt time.Time
+	Secret    string // base32 encoded
+	Enabled   bool
+	LastStep  int64 // the last step a code was accepted for, so that codes can't be replayed
+}
+
+// The reason stored for the login attempts with an invalid code
+const LoginInvalidTOTP = "invalid totp code"
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//////////////////////////////////////////////////////////////////////////////
+// GENERAL PURPOSE
+
+// URI returns the otpauth:// provisioning uri understood by authenticator apps, usually scanned
+// as a QR code
+func (t TOTP) URI(username string) string {
+	label := url.PathEscape(fmt.Sprintf("%s:%s", totpIssuer, username))
+	params := url.Values{}
+	params.Set("secret", t.Secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(totpDigits))
+	params.Set("period", strconv.Itoa(totpPeriod))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
+
+// totpCode computes the code for the given step (RFC 4226 section 5.3)
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// totpMatch returns the step the code is valid for, or -1 if it doesn't match any step around now
+func totpMatch(secret string, code string, now time.Time) int64 {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			log.Println(err)
+			return -1
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return -1
+}
+
+// totpNormalize strips the spaces and dashes people tend to type along with codes
+func totpNormalize(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, " ", "")
+	return strings.ReplaceAll(code, "-", "")
+}
+
+// recoveryCodeHash hashes the normalized recovery code, they are random enough for a plain sha256
+func recoveryCodeHash(code string) string {
+	sum := sha256.Sum256([]byte(totpNormalize(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// TOTPGet returns the second factor of the user, if they started enrolling one
+func TOTPGet(userid int) (TOTP, bool, error) {
+	totp, err := globalState.GetTOTP(userid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TOTP{}, false, nil
+	}
+	if err != nil {
+		return TOTP{}, false, err
+	}
+	return totp, true, nil
+}
+
+// TOTPEnabled returns true if the user has to enter a code when logging in
+func TOTPEnabled(userid int) (bool, error) {
+	totp, ok, err := TOTPGet(userid)
+	return ok && totp.Enabled, err
+}
+
+// TOTPEnroll creates a new, not yet enabled secret for the user
+func TOTPEnroll(userid int) error {
+	enabled, err := TOTPEnabled(userid)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		return fmt.Errorf("two-factor authentication is already enabled")
+	}
+
+	secret := make([]byte, totpSecret)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	return globalState.InsertTOTP(userid, totpEncoding.EncodeToString(secret))
+}
+
+// TOTPConfirm enables the enrolled secret if the code matches it and returns fresh recovery codes
+func TOTPConfirm(userid int, code string) ([]string, error) {
+	totp, ok, err := TOTPGet(userid)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || totp.Enabled {
+		return nil, fmt.Errorf("there is no two-factor authentication to confirm")
+	}
+
+	step := totpMatch(totp.Secret, totpNormalize(code), time.Now())
+	if step < 0 {
+		return nil, fmt.Errorf("invalid code")
+	}
+	if err := globalState.UpdateTOTPEnabled(userid, step); err != nil {
+		return nil, err
+	}
+	return TOTPNewRecoveryCodes(userid)
+}
+
+// TOTPVerify checks the code, either a TOTP code or one of the unused recovery codes. Every code
+// is only accepted once.
+func TOTPVerify(userid int, code string) (bool, error) {
+	totp, ok, err := TOTPGet(userid)
+	if err != nil || !ok || !totp.Enabled {
+		return false, err
+	}
+
+	code = totpNormalize(code)
+	if len(code) == totpDigits {
+		step := totpMatch(totp.Secret, code, time.Now())
+		if step < 0 {
+			return false, nil
+		}
+		return globalState.UpdateTOTPLastStep(userid, step)
+	}
+	return globalState.UseRecoveryCode(userid, recoveryCodeHash(code))
+}
+
+// TOTPDisable removes the second factor and the recovery codes of the user
+func TOTPDisable(userid int) error {
+	return globalState.DeleteTOTP(userid)
+}
+
+// TOTPNewRecoveryCodes replaces the recovery codes of the user and returns the plaintext codes
+func TOTPNewRecoveryCodes(userid int) ([]string, error) {
+	var codes []string
+	var hashes []string
+	for i := 0; i < totpRecoveryCodes; i++ {
+		secret := make([]byte, 5)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(secret)
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, recoveryCodeHash(code))
+	}
+
+	if err := globalState.ReplaceRecoveryCodes(userid, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// TOTPRecoveryCodesLeft returns the amount of unused recovery codes
+func TOTPRecoveryCodesLeft(userid int) (int, error) {
+	return globalState.GetRecoveryCodesLeft(userid)
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// DATABASE
+
+func (s *State) GetTOTP(userid int) (TOTP, error) {
+	var totp TOTP
+	err := s.db.QueryRow(`
+		SELECT user_id, created_at, secret, enabled, last_step
+		FROM totp
+		WHERE user_id=?`, userid).Scan(&totp.UserID, &totp.CreatedAt, &totp.Secret, &totp.Enabled, &totp.LastStep)
+	return totp, err
+}
+
+// Inserts a disabled secret, replacing a previous one the user didn't confirm
+func (s *State) InsertTOTP(userid int, secret string) error {
+	_, err := s.db.Exec(`
+		INSERT OR REPLACE INTO totp (user_id, created_at, secret, enabled, last_step)
+		VALUES (?, ?, ?, false, 0)`,
+		userid, time.Now(), secret)
+	return err
+}
+
+func (s *State) UpdateTOTPEnabled(userid int, step int64) error {
+	_, err := s.db.Exec("UPDATE totp SET enabled=true, last_step=? WHERE user_id=?", step, userid)
+	return err
+}
+
+// Stores the step a code was accepted for, returns false if a code for the step (or a later one)
+// has already been used
+func (s *State) UpdateTOTPLastStep(userid int, step int64) (bool, error) {
+	res, err := s.db.Exec("UPDATE totp SET last_step=? WHERE user_id=? AND last_step<?", step, userid, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *State) DeleteTOTP(userid int) error {
+	if _, err := s.db.Exec("DELETE FROM recovery_codes WHERE user_id=?", userid); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("DELETE FROM totp WHERE user_id=?", userid)
+	return err
+}
+
+func (s *State) ReplaceRecoveryCodes(userid int, hashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id=?", userid); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		_, err := tx.Exec(`
+			INSERT INTO recovery_codes (created_at, user_id, code_hash)
+			VALUES (?, ?, ?)`,
+			time.Now(), userid, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Marks the recovery code as used, returns false if there is no such unused code
+func (s *State) UseRecoveryCode(userid int, hash string) (bool, error) {
+	res, err := s.db.Exec(`
+		UPDATE recovery_codes
+		SET used_at=?
+		WHERE user_id=? AND code_hash=? AND used_at IS NULL`,
+		time.Now(), userid, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *State) GetRecoveryCodesLeft(userid int) (int, error) {
+	var count int
+	err := s.db.QueryRow(`
+		SELECT COUNT(*)
+		FROM recovery_codes
+		WHERE user_id=? AND used_at IS NULL`, userid).Scan(&count)
+	return count, err
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// HTTP
+
+// totpStartLogin is called by the loginHandler after the password has been checked. The username
+// is only stored as pending, the loginTOTPHandler sets the session username once the code matches.
+func totpStartLogin(w http.ResponseWriter, r *http.Request, username string) {
+	session, _ := globalState.sessions.Get(r, "session")
+	delete(session.Values, "username")
+	session.Values[totpPendingKey] = username
+	session.Values[totpPendingAtKey] = time.Now().Unix()
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/login/totp", http.StatusSeeOther)
+}
+
+// totpPendingUsername returns the user that entered their password but not their code yet
+func totpPendingUsername(r *http.Request) string {
+	session, _ := globalState.sessions.Get(r, "session")
+	username, _ := session.Values[totpPendingKey].(string)
+	started, _ := session.Values[totpPendingAtKey].(int64)
+	if username == "" || time.Since(time.Unix(started, 0)) > totpPending {
+		return ""
+	}
+	return username
+}
+
+// loginTOTPHandler is the second step of logging in for users with two-factor authentication
+func loginTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if totpPendingUsername(r) == "" {
+			http.Redirect(w, r, "/login?res=Please log in again", http.StatusSeeOther)
+			return
+		}
+
+		// define data
+		data := map[string]interface{}{}
+		data["version"] = os.Getenv("VERSION")
+		data["csrfToken"] = csrfToken(r)
+		data["pagelink1"] = Link{"login", "/login"}
+		data["pagelink1options"] = []Link{
+			{Name: "register", Target: "/register"},
+		}
+
+		// display errors passed via query parameters
+		queryres := r.URL.Query().Get("res")
+		if queryres != "" {
+			data["res"] = queryres
+		}
+
+		// get the template
+		t, err := template.ParseGlob(fmt.Sprintf("%s/*.html", templatesPath))
+		if err != nil {
+			log.Printf("Error reading the template Path: %s/*.html", templatesPath)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("500 - Error reading template file"))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// exec!
+		t.ExecuteTemplate(w, "loginTotp", data)
+
+	case "POST":
+		redir_target := "/login/totp?res=%s"
+
+		username := totpPendingUsername(r)
+		if username == "" {
+			log_and_redir_with_msg(w, r, nil, "/login?res=%s", "Took too long, please log in again")
+			return
+		}
+
+		r.ParseForm()
+		code := r.Form.Get("code")
+		ip := loginClientIP(r)
+		defer LoginLock(username, ip)()
+
+		// the codes are short, so guessing them is throttled just like guessing passwords
+		wait, err := LoginThrottle(username, ip)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not check the previous logins")
+			return
+		}
+		if wait > 0 {
+			LoginRecord(username, ip, false, LoginThrottled)
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())+1))
+			log_and_redir_with_msg(w, r, nil, redir_target, loginWaitMessage(wait))
+			return
+		}
+
+		user, err := UserGetUserFromUsername(username)
+		if err != nil || user.Disabled {
+			LoginRecord(username, ip, false, LoginDisabled)
+			log_and_redir_with_msg(w, r, err, "/login?res=%s", "Account disabled")
+			return
+		}
+
+		valid, err := TOTPVerify(user.ID, code)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not check the code")
+			return
+		}
+		if !valid {
+			if err := LoginRecord(username, ip, false, LoginInvalidTOTP); err != nil {
+				log.Println(err)
+			}
+			log_and_redir_with_msg(w, r, nil, redir_target, "Invalid code")
+			return
+		}
+
+		session, _ := globalState.sessions.Get(r, "session")
+		delete(session.Values, totpPendingKey)
+		delete(session.Values, totpPendingAtKey)
+		session.Values["username"] = username
+		if err := session.Save(r, w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if err := LoginRecord(username, ip, true, LoginOK); err != nil {
+			log.Println(err)
+		}
+
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
+
+// totpHandler manages the second factor of the user on their profile page. The action is taken
+// from the url: enroll, confirm, recovery (new recovery codes) or disable. New recovery codes are
+// passed to the profile page using a flash message, so they are only displayed once.
+func totpHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Error reading the profile id"))
+		return
+	}
+
+	redir_target := fmt.Sprintf("/user/%d/profile?res=%%s#totp", id)
+
+	switch r.Method {
+	case "POST":
+		session, _ := globalState.sessions.Get(r, "session")
+		user, err := UserGetUserFromUsername(session.Values["username"].(string))
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the id for your username")
+			return
+		}
+		if user.ID != id {
+			log_and_redir_with_msg(w, r, nil, redir_target, "You can only change your own two-factor authentication")
+			return
+		}
+
+		r.ParseForm()
+		code := r.Form.Get("code")
+
+		var codes []string
+		var msg string
+		switch vars["action"] {
+		case "enroll":
+			if err := TOTPEnroll(user.ID); err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Could not start enrolling two-factor authentication")
+				return
+			}
+			msg = "Add the secret to your authenticator app and enter a code to confirm it"
+
+		case "confirm":
+			codes, err = TOTPConfirm(user.ID, code)
+			if err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Could not enable two-factor authentication, check the code and your clock")
+				return
+			}
+			msg = "Enabled two-factor authentication"
+
+		case "recovery", "disable":
+			// both require a current code, so that a session left open can't be used to take over
+			// the second factor
+			valid, err := TOTPVerify(user.ID, code)
+			if err != nil || !valid {
+				log_and_redir_with_msg(w, r, err, redir_target, "Invalid code")
+				return
+			}
+
+			if vars["action"] == "recovery" {
+				codes, err = TOTPNewRecoveryCodes(user.ID)
+				msg = "Created new recovery codes, the old ones can't be used anymore"
+			} else {
+				err = TOTPDisable(user.ID)
+				msg = "Disabled two-factor authentication"
+			}
+			if err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Could not update the two-factor authentication")
+				return
+			}
+
+		default:
+			log_and_redir_with_msg(w, r, nil, redir_target, "Invalid action")
+			return
+		}
+
+		if codes != nil {
+			session.AddFlash(strings.Join(codes, " "), "recovery")
+			if err := session.Save(r, w); err != nil {
+				log_and_redir_with_msg(w, r, err, redir_target, "Could not store the recovery codes in your session")
+				return
+			}
+		}
+
+		http.Redirect(w, r, fmt.Sprintf(redir_target, msg), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
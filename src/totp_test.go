@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// the secret of the sha1 test vectors of RFC 6238 appendix B, "12345678901234567890"
+var totpTestSecret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCode(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		code, err := totpCode(totpTestSecret, tt.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("code at %d = %s, want %s", tt.unix, code, tt.code)
+		}
+	}
+}
+
+func TestTOTPMatchWindow(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+
+	tests := []struct {
+		offset int64 // in steps, relative to now
+		ok     bool
+	}{
+		{0, true},
+		{-1, true},
+		{1, true},
+		{-2, false},
+		{2, false},
+		{-10, false},
+	}
+	for _, tt := range tests {
+		code, err := totpCode(totpTestSecret, current+tt.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		step := totpMatch(totpTestSecret, code, now)
+		if tt.ok && step != current+tt.offset {
+			t.Errorf("code of step %+d matched step %d, want %d", tt.offset, step, current+tt.offset)
+		}
+		if !tt.ok && step != -1 {
+			t.Errorf("code of step %+d matched step %d, want no match", tt.offset, step)
+		}
+	}
+
+	// the boundaries of the window move with the time
+	code, _ := totpCode(totpTestSecret, current+1)
+	if step := totpMatch(totpTestSecret, code, now.Add(-totpPeriod*time.Second)); step != -1 {
+		t.Errorf("code two steps ahead matched step %d", step)
+	}
+}
+
+func TestTOTPNormalize(t *testing.T) {
+	for in, want := range map[string]string{
+		" 123 456 ":   "123456",
+		"123-456":     "123456",
+		"ABCD-EFGH\n": "abcdefgh",
+	} {
+		if got := totpNormalize(in); got != want {
+			t.Errorf("totpNormalize(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestTOTPVerifyReplay(t *testing.T) {
+	testState(t)
+
+	userid, err := UserRegister("alice", []byte("hash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := TOTPEnroll(userid); err != nil {
+		t.Fatal(err)
+	}
+	totp, _, err := TOTPGet(userid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := time.Now().Unix() / totpPeriod
+	previous, _ := totpCode(totp.Secret, current-1)
+	recovery, err := TOTPConfirm(userid, previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the code used for confirming (and older ones) can't be used again
+	if ok, _ := TOTPVerify(userid, previous); ok {
+		t.Error("the confirmation code was accepted again")
+	}
+
+	code, _ := totpCode(totp.Secret, current)
+	if ok, err := TOTPVerify(userid, code); !ok || err != nil {
+		t.Errorf("TOTPVerify(current code) = %v, %v", ok, err)
+	}
+	if ok, _ := TOTPVerify(userid, code); ok {
+		t.Error("the current code was accepted twice")
+	}
+
+	// recovery codes work once, also when typed with spaces
+	if ok, err := TOTPVerify(userid, " "+recovery[0]+" "); !ok || err != nil {
+		t.Errorf("TOTPVerify(recovery code) = %v, %v", ok, err)
+	}
+	if ok, _ := TOTPVerify(userid, recovery[0]); ok {
+		t.Error("a recovery code was accepted twice")
+	}
+}
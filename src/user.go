@@ -7,16 +7,32 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
-	"golang.org/x/crypto/argon2"
 )
 
 type User struct {
 	ID           int
 	Name         string
 	PasswordHash []byte
+
+	// Admins may manage all users, bots, battles, archs and bits
+	Role string
+
+	// Disabled users can't log in anymore
+	Disabled bool
+}
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// IsAdmin returns true if the user has the admin role
+func (u User) IsAdmin() bool {
+	return u.Role == RoleAdmin
 }
 
 //////////////////////////////////////////////////////////////////////////////
@@ -31,11 +47,28 @@ func UserRegister(username string, passwordHash []byte) (int, error) {
 	}
 }
 
-// UserCheckPasswordHash returns a boolean that is true if the users password
-// is correct and false if the users password is false and thus doesn't match
-// the one stored in the database
-func UserCheckPasswordHash(username string, passwordHash []byte) bool {
-	return globalState.CheckUserHash(username, passwordHash)
+// UserCheckPassword returns a boolean that is true if the users password is
+// correct and false if the users password is false and thus doesn't match the
+// one stored in the database. Legacy or outdated hashes are replaced by a
+// freshly salted hash after a successful check.
+func UserCheckPassword(username string, password string) bool {
+	stored, err := globalState.GetUserPasswordHash(username)
+	if err != nil {
+		return false
+	}
+
+	valid, rehash := PasswordVerify(password, stored)
+	if valid && rehash {
+		passwordHash, err := PasswordHash(password)
+		if err != nil {
+			log.Println(err)
+			return valid
+		}
+		if err := UserUpdatePasswordHash(username, passwordHash); err != nil {
+			log.Println(err)
+		}
+	}
+	return valid
 }
 
 // UserUpdatePasswordHash does exactly that
@@ -75,11 +108,19 @@ func UserGetUsernameCount(username string) (int, error) {
 	return globalState.GetUsernameCount(username)
 }
 
+func UserSetRole(id int, role string) error {
+	return globalState.UpdateUserRole(id, role)
+}
+
+func UserSetDisabled(id int, disabled bool) error {
+	return globalState.UpdateUserDisabled(id, disabled)
+}
+
 //////////////////////////////////////////////////////////////////////////////
 // DATABASE
 
 func (s *State) InsertUser(user User) (int, error) {
-	res, err := s.db.Exec("INSERT INTO users VALUES(NULL,?,?,?);", time.Now(), user.Name, user.PasswordHash)
+	res, err := s.db.Exec("INSERT INTO users (created_at, name, passwordHash, role, disabled) VALUES(?,?,?,?,?);", time.Now(), user.Name, string(user.PasswordHash), RoleUser, false)
 	if err != nil {
 		return 0, err
 	}
@@ -91,20 +132,18 @@ func (s *State) InsertUser(user User) (int, error) {
 	return int(id), nil
 }
 
-// returns true if the password matches
-func (s *State) CheckUserHash(username string, passwordHash []byte) bool {
-	var created time.Time
-	err := s.db.QueryRow("SELECT created_at FROM users WHERE name=? AND passwordHash=?", username, passwordHash).Scan(&created)
-	switch {
-	case err != nil:
-		return false
-	default:
-		return true
+// returns the stored (encoded) password hash of the user
+func (s *State) GetUserPasswordHash(username string) ([]byte, error) {
+	var passwordHash []byte
+	err := s.db.QueryRow("SELECT passwordHash FROM users WHERE name=?", username).Scan(&passwordHash)
+	if err != nil {
+		return nil, err
 	}
+	return passwordHash, nil
 }
 
 func (s *State) UpdateUserPasswordHash(username string, passwordHash []byte) error {
-	_, err := s.db.Exec("UPDATE users SET passwordHash=? WHERE name=?", passwordHash, username)
+	_, err := s.db.Exec("UPDATE users SET passwordHash=? WHERE name=?", string(passwordHash), username)
 	if err != nil {
 		return err
 	} else {
@@ -124,7 +163,7 @@ func (s *State) UpdateUserUsername(id int, new_username string) error {
 // Links the given bot to the given user in the user_bot_rel table
 func (s *State) LinkUserBot(username string, botid int) error {
 	_, err := s.db.Exec(`
-		INSERT INTO user_bot_rel
+		INSERT INTO user_bot_rel (user_id, bot_id)
 		VALUES ((SELECT id FROM users WHERE name=?), ?)`, username, botid)
 	if err != nil {
 		return err
@@ -133,26 +172,46 @@ func (s *State) LinkUserBot(username string, botid int) error {
 	}
 }
 
+func (s *State) UpdateUserRole(id int, role string) error {
+	_, err := s.db.Exec("UPDATE users SET role=? WHERE id=?", role, id)
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
+func (s *State) UpdateUserDisabled(id int, disabled bool) error {
+	_, err := s.db.Exec("UPDATE users SET disabled=? WHERE id=?", disabled, id)
+	if err != nil {
+		return err
+	} else {
+		return nil
+	}
+}
+
 // Links the given bot to the given user in the user_bot_rel table
 func (s *State) GetUserFromId(id int) (User, error) {
-	var user_id int
-	var username string
-	err := s.db.QueryRow("SELECT id, name FROM users WHERE id=?", id).Scan(&user_id, &username)
+	var user User
+	err := s.db.QueryRow(`
+		SELECT id, name, role, disabled
+		FROM users WHERE id=?`, id).Scan(&user.ID, &user.Name, &user.Role, &user.Disabled)
 	if err != nil {
 		return User{}, err
 	} else {
-		return User{user_id, username, nil}, nil
+		return user, nil
 	}
 }
 
 func (s *State) GetUserFromUsername(username string) (User, error) {
-	var id int
-	var name string
-	err := s.db.QueryRow("SELECT id, name FROM users WHERE name=?", username).Scan(&id, &name)
+	var user User
+	err := s.db.QueryRow(`
+		SELECT id, name, role, disabled
+		FROM users WHERE name=?`, username).Scan(&user.ID, &user.Name, &user.Role, &user.Disabled)
 	if err != nil {
 		return User{}, err
 	} else {
-		return User{id, name, nil}, nil
+		return user, nil
 	}
 }
 
@@ -211,7 +270,7 @@ func (s *State) GetUserBotsId(id int) ([]Bot, error) {
 
 // Returns the bots belonging to the given user
 func (s *State) GetAllUsers() ([]User, error) {
-	rows, err := s.db.Query("SELECT id, name FROM users")
+	rows, err := s.db.Query(`SELECT id, name, role, disabled FROM users`)
 	defer rows.Close()
 	if err != nil {
 		return nil, err
@@ -220,7 +279,7 @@ func (s *State) GetAllUsers() ([]User, error) {
 	var users []User
 	for rows.Next() {
 		var user User
-		if err := rows.Scan(&user.ID, &user.Name); err != nil {
+		if err := rows.Scan(&user.ID, &user.Name, &user.Role, &user.Disabled); err != nil {
 			return users, err
 		}
 		users = append(users, user)
@@ -263,6 +322,7 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		// define data
 		data := map[string]interface{}{}
 		data["version"] = os.Getenv("VERSION")
+		data["csrfToken"] = csrfToken(r)
 		data["pagelink1"] = Link{"login", "/login"}
 		data["pagelink1options"] = []Link{
 			{Name: "register", Target: "/register"},
@@ -270,6 +330,9 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		data["pagelinkauth"] = []Link{
 			{Name: "register/", Target: "/register"},
 		}
+		if OIDCEnabled() {
+			data["oidcName"] = oidcName
+		}
 
 		// session foo
 		session, _ := globalState.sessions.Get(r, "session")
@@ -315,28 +378,70 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		username := r.Form.Get("username")
 		password := r.Form.Get("password")
 
-		// if we've got a password, hash it and compare it with the stored one
+		// if we've got a password, compare it with the stored hash
 		if password != "" {
-			passwordHash := argon2.IDKey([]byte(password), []byte(os.Getenv("SALT")), 1, 64*1024, 4, 32)
+			ip := loginClientIP(r)
+			defer LoginLock(username, ip)()
+
+			// repeated failures have to wait before trying again, the password isn't even
+			// checked while they do
+			wait, err := LoginThrottle(username, ip)
+			if err != nil {
+				log_and_redir_with_msg(w, r, err, "/login?res=%s", "Could not check the previous logins")
+				return
+			}
+			if wait > 0 {
+				LoginRecord(username, ip, false, LoginThrottled)
+				w.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())+1))
+				log_and_redir_with_msg(w, r, nil, "/login?res=%s", loginWaitMessage(wait))
+				return
+			}
 
 			// check if it's valid
-			valid := UserCheckPasswordHash(username, passwordHash)
+			valid := UserCheckPassword(username, password)
 			if valid {
 
+				// disabled users aren't allowed to log in
+				user, err := UserGetUserFromUsername(username)
+				if err != nil || user.Disabled {
+					LoginRecord(username, ip, false, LoginDisabled)
+					http.Redirect(w, r, "/login?err=Account+disabled", http.StatusSeeOther)
+					return
+				}
+
+				// users with two-factor authentication have to enter a code first, the
+				// session only gets the username after that
+				totpEnabled, err := TOTPEnabled(user.ID)
+				if err != nil {
+					log_and_redir_with_msg(w, r, err, "/login?res=%s", "Could not check your two-factor authentication")
+					return
+				}
+				if totpEnabled {
+					totpStartLogin(w, r, username)
+					return
+				}
+
 				// if it's valid, we set a session for the user
 				session, _ := globalState.sessions.Get(r, "session")
 				session.Values["username"] = username
-				err := session.Save(r, w)
+				err = session.Save(r, w)
 				if err != nil {
 					http.Error(w, err.Error(), http.StatusInternalServerError)
 					return
 				}
 
+				if err := LoginRecord(username, ip, true, LoginOK); err != nil {
+					log.Println(err)
+				}
+
 				http.Redirect(w, r, "/", http.StatusSeeOther)
 				return
 
 			} else {
 				// invalid password
+				if err := LoginRecord(username, ip, false, LoginInvalidPassword); err != nil {
+					log.Println(err)
+				}
 				http.Redirect(w, r, "/login?err=Invalid+Password", http.StatusSeeOther)
 				return
 			}
@@ -356,6 +461,7 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		// define data
 		data := map[string]interface{}{}
 		data["version"] = os.Getenv("VERSION")
+		data["csrfToken"] = csrfToken(r)
 
 		// get the session
 		session, _ := globalState.sessions.Get(r, "session")
@@ -419,9 +525,14 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 
 		// if we've got a password, hash it and store it and create a User
 		if password1 != "" {
-			passwordHash := argon2.IDKey([]byte(password1), []byte(os.Getenv("SALT")), 1, 64*1024, 4, 32)
+			passwordHash, err := PasswordHash(password1)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("500 - We had problems hashing your password"))
+				return
+			}
 
-			_, err := UserRegister(username, passwordHash)
+			_, err = UserRegister(username, passwordHash)
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				w.Write([]byte("500 - We had problems inserting you into the DB"))
@@ -439,9 +550,9 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
+		// delete the session instead of only the cookie, so that it isn't listed anymore
 		session, _ := globalState.sessions.Get(r, "session")
-		session.Options.MaxAge = -1
-		err := session.Save(r, w)
+		err := globalState.sessions.Delete(r, w, session)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
@@ -463,10 +574,12 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 		// define data
 		data := map[string]interface{}{}
 		data["version"] = os.Getenv("VERSION")
+		data["csrfToken"] = csrfToken(r)
 		data["pagelink1"] = Link{"user", "/user"}
 		data["pagelink1options"] = []Link{
 			{Name: "bot", Target: "/bot"},
 			{Name: "battle", Target: "/battle"},
+			{Name: "team", Target: "/team"},
 		}
 
 		// session foo
@@ -531,10 +644,12 @@ func usersHandler(w http.ResponseWriter, r *http.Request) {
 		// define data
 		data := map[string]interface{}{}
 		data["version"] = os.Getenv("VERSION")
+		data["csrfToken"] = csrfToken(r)
 		data["pagelink1"] = Link{Name: "user", Target: "/user"}
 		data["pagelink1options"] = []Link{
 			{Name: "bot", Target: "/bot"},
 			{Name: "battle", Target: "/battle"},
+			{Name: "team", Target: "/team"},
 		}
 
 		// sessions
@@ -586,6 +701,7 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
 		// define data
 		data := map[string]interface{}{}
 		data["version"] = os.Getenv("VERSION")
+		data["csrfToken"] = csrfToken(r)
 		data["pagelink1"] = Link{"user", "/user"}
 		data["pagelink1options"] = []Link{
 			{Name: "bot", Target: "/bot"},
@@ -618,6 +734,76 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
 		data["user"] = editing_user
 		data["target_user"] = target_user
 
+		// display errors passed via query parameters
+		queryres := r.URL.Query().Get("res")
+		if queryres != "" {
+			data["res"] = queryres
+		}
+
+		// the api tokens of the user, a freshly created token is passed using a flash message
+		// and thus only displayed once
+		tokens, err := TokenGetAllForUser(editing_user.ID)
+		if err != nil {
+			data["err"] = "Couldn't get your tokens"
+		}
+		data["tokens"] = tokens
+		data["tokenScopes"] = tokenScopes
+		if flashes := session.Flashes("token"); len(flashes) > 0 {
+			data["newToken"] = flashes[0]
+			session.Save(r, w)
+		}
+
+		webhooks, err := WebhookGetAllForUser(editing_user.ID)
+		if err != nil {
+			data["err"] = "Couldn't get your webhooks"
+		}
+		data["webhooks"] = webhooks
+		data["webhookEvents"] = webhookEvents
+		data["webhookBase"] = fmt.Sprintf("/user/%d/webhook", editing_user.ID)
+
+		if OIDCEnabled() {
+			identities, err := OIDCGetAllForUser(editing_user.ID)
+			if err != nil {
+				data["err"] = "Couldn't get your linked identities"
+			}
+			data["oidcName"] = oidcName
+			data["oidcIdentities"] = identities
+		}
+
+		sessions, err := SessionGetAllForUser(editing_user.Name)
+		if err != nil {
+			data["err"] = "Couldn't get your sessions"
+		}
+		data["sessions"] = sessions
+		data["currentSession"] = session.ID
+
+		// the second factor, new recovery codes are passed using a flash message just like tokens
+		totp, totpStarted, err := TOTPGet(editing_user.ID)
+		if err != nil {
+			data["err"] = "Couldn't get your two-factor authentication"
+		}
+		if totpStarted {
+			data["totp"] = totp
+			data["totpURI"] = template.URL(totp.URI(editing_user.Name))
+		}
+		if totp.Enabled {
+			left, err := TOTPRecoveryCodesLeft(editing_user.ID)
+			if err != nil {
+				data["err"] = "Couldn't get your recovery codes"
+			}
+			data["recoveryCodesLeft"] = left
+		}
+		if flashes := session.Flashes("recovery"); len(flashes) > 0 {
+			data["newRecoveryCodes"] = strings.Fields(flashes[0].(string))
+			session.Save(r, w)
+		}
+
+		deliveries, err := WebhookGetDeliveriesForUser(editing_user.ID)
+		if err != nil {
+			data["err"] = "Couldn't get the deliveries of your webhooks"
+		}
+		data["webhookDeliveries"] = deliveries
+
 		data["pagelink2"] = Link{target_user.Name, fmt.Sprintf("/%d", id)}
 		allUserNames, err := UserGetAll()
 		var opts []Link
@@ -676,9 +862,14 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
 		// first update the password, as they might have also changed their
 		// username
 		if password1 != "" {
-			passwordHash := argon2.IDKey([]byte(password1), []byte(os.Getenv("SALT")), 1, 64*1024, 4, 32)
+			passwordHash, err := PasswordHash(password1)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("500 - We had problems hashing your new pw"))
+				return
+			}
 
-			err := UserUpdatePasswordHash(orig_username, passwordHash)
+			err = UserUpdatePasswordHash(orig_username, passwordHash)
 			if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				w.Write([]byte("500 - We had problems inserting your new pw into the DB"))
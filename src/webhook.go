@@ -0,0 +1,690 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Webhook is a subscription to the lifecycle events of runs. Webhooks of a battle (BattleID != 0)
+// are managed by the owners of the battle, webhooks of a user (BattleID == 0, NULL in the database)
+// fire for all battles the user owns or has bots in.
+type Webhook struct {
+	ID        int
+	CreatedAt time.Time
+	UserID    int
+	BattleID  int
+	URL       string
+	Secret    string // used to sign the payloads, see webhookSign
+	Events    []string
+}
+
+// WebhookDelivery is a single event sent (or to be sent) to a webhook
+type WebhookDelivery struct {
+	ID            int
+	CreatedAt     time.Time
+	WebhookID     int
+	URL           string
+	Event         string
+	State         string
+	Attempts      int
+	NextAttemptAt time.Time
+	StatusCode    int
+	Error         string
+}
+
+// The events webhooks can subscribe to
+const (
+	EventRunQueued   = "run.queued"
+	EventRunStarted  = "run.started"
+	EventRunFinished = "run.finished"
+	EventRunFailed   = "run.failed"
+)
+
+var webhookEvents = []string{EventRunQueued, EventRunStarted, EventRunFinished, EventRunFailed}
+
+// The states of a delivery
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed" // gave up after webhookMaxAttempts
+)
+
+// A failed delivery is retried after 30s, 1m, 2m, 4m, ... until webhookMaxAttempts is reached.
+// Up to webhookWorkers deliveries are attempted at the same time, so a slow endpoint only delays
+// its own deliveries.
+const (
+	webhookMaxAttempts = 6
+	webhookBackoff     = 30 * time.Second
+	webhookTimeout     = 10 * time.Second
+	webhookWorkers     = 8
+)
+
+// the amount of deliveries displayed in the delivery logs
+const webhookLogSize = 50
+
+// webhookPayload is the json body posted to the webhooks. Single fights (started using "run
+// once") aren't stored as runs, their run has the id 0.
+type webhookPayload struct {
+	Event     string       `json:"event"`
+	CreatedAt time.Time    `json:"created_at"`
+	Battle    apiBattle    `json:"battle"`
+	Run       Run          `json:"run"`
+	Results   []SeriesStat `json:"results,omitempty"` // only for finished runs
+}
+
+// webhookClient delivers the webhooks. The urls are chosen by the users, so it refuses to connect
+// to anything but public addresses (see webhookDialControl) and doesn't use a proxy, which would
+// connect to the address on our behalf.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: webhookDialControl,
+		}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+		MaxIdleConns:        webhookWorkers,
+	},
+}
+
+// webhookBlockedNets are the special purpose networks not covered by the net.IP methods used in
+// webhookAllowedIP
+var webhookBlockedNets = []*net.IPNet{
+	webhookMustParseCIDR("0.0.0.0/8"),     // "this network"
+	webhookMustParseCIDR("100.64.0.0/10"), // carrier grade nat
+	webhookMustParseCIDR("192.0.0.0/24"),  // ietf protocol assignments
+	webhookMustParseCIDR("198.18.0.0/15"), // benchmarking
+	webhookMustParseCIDR("240.0.0.0/4"),   // reserved
+	webhookMustParseCIDR("64:ff9b::/96"),  // nat64, embeds ipv4 addresses
+}
+
+// HasEvent returns true if the webhook is subscribed to the event
+func (wh Webhook) HasEvent(event string) bool {
+	for _, e := range wh.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// GENERAL PURPOSE
+
+// WebhookCreate creates a new webhook with a random secret
+func WebhookCreate(userid int, battleid int, rawurl string, events []string) (int, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return -1, fmt.Errorf("%q is not a valid http(s) url", rawurl)
+	}
+
+	// the resolved addresses are checked again on every delivery, as they may change in between
+	if err := webhookCheckHost(u.Hostname()); err != nil {
+		return -1, err
+	}
+	if len(events) == 0 {
+		return -1, fmt.Errorf("please select at least one event")
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return -1, err
+	}
+
+	return globalState.InsertWebhook(Webhook{
+		UserID:   userid,
+		BattleID: battleid,
+		URL:      rawurl,
+		Secret:   hex.EncodeToString(secret),
+		Events:   events,
+	})
+}
+
+func WebhookGetAllForBattle(battleid int) ([]Webhook, error) {
+	return globalState.GetWebhooks("battle_id=?", battleid)
+}
+
+// WebhookGetAllForUser returns the webhooks of the user that aren't bound to a battle
+func WebhookGetAllForUser(userid int) ([]Webhook, error) {
+	return globalState.GetWebhooks("battle_id IS NULL AND user_id=?", userid)
+}
+
+func WebhookGetById(id int) (Webhook, error) {
+	webhooks, err := globalState.GetWebhooks("id=?", id)
+	if err != nil {
+		return Webhook{}, err
+	}
+	if len(webhooks) == 0 {
+		return Webhook{}, fmt.Errorf("no webhook with the id %d", id)
+	}
+	return webhooks[0], nil
+}
+
+func WebhookDeleteID(id int) error {
+	return globalState.DeleteWebhook(id)
+}
+
+func WebhookGetDeliveriesForBattle(battleid int) ([]WebhookDelivery, error) {
+	return globalState.GetWebhookDeliveries("w.battle_id=?", battleid)
+}
+
+func WebhookGetDeliveriesForUser(userid int) ([]WebhookDelivery, error) {
+	return globalState.GetWebhookDeliveries("w.battle_id IS NULL AND w.user_id=?", userid)
+}
+
+// WebhookFire queues the delivery of the event to all webhooks subscribed to it. Errors are only
+// logged, as webhooks must never break the runs themselves.
+func WebhookFire(event string, run Run) {
+	var results []SeriesStat
+	if event == EventRunFinished {
+		var err error
+		results, err = RunGetSeriesStats(run.ID)
+		if err != nil {
+			log.Printf("[!] Could not get the results of run %d for the webhooks: %s", run.ID, err)
+		}
+	}
+	webhookFire(event, run, results)
+}
+
+// webhookFire queues the deliveries of the event along with the given results and wakes up the
+// WebhookWorker, the deliveries themselves never block the caller
+func webhookFire(event string, run Run, results []SeriesStat) {
+	webhooks, err := globalState.GetWebhooksForBattle(run.BattleID)
+	if err != nil {
+		log.Printf("[!] Could not get the webhooks for battle %d: %s", run.BattleID, err)
+		return
+	}
+
+	var subscribed []Webhook
+	for _, wh := range webhooks {
+		if wh.HasEvent(event) {
+			subscribed = append(subscribed, wh)
+		}
+	}
+	if len(subscribed) == 0 {
+		return
+	}
+
+	battle, err := BattleGetByIdDeep(run.BattleID)
+	if err != nil {
+		log.Printf("[!] Could not get battle %d for the webhooks: %s", run.BattleID, err)
+		return
+	}
+
+	payload := webhookPayload{
+		Event:     event,
+		CreatedAt: time.Now().UTC(),
+		Battle:    apiBattleFromBattle(battle),
+		Run:       run,
+		Results:   results,
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("[!] Could not encode the webhook payload: %s", err)
+		return
+	}
+
+	for _, wh := range subscribed {
+		if err := globalState.InsertWebhookDelivery(wh.ID, event, string(body)); err != nil {
+			log.Printf("[!] Could not queue the delivery to webhook %d: %s", wh.ID, err)
+		}
+	}
+
+	// wake up the worker without blocking if it's busy anyway
+	select {
+	case globalState.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// WebhookWorker delivers the pending deliveries whenever new ones are queued and periodically in
+// order to retry the failed ones. Every delivery is attempted in its own goroutine, at most
+// webhookWorkers at a time.
+func WebhookWorker() {
+	ticker := time.NewTicker(webhookBackoff / 2)
+	slots := make(chan struct{}, webhookWorkers)
+	done := make(chan int)
+	inflight := map[int]bool{}
+
+	for {
+		deliveries, err := globalState.GetDueWebhookDeliveries(time.Now())
+		if err != nil {
+			log.Printf("[!] Could not get the due webhook deliveries: %s", err)
+		}
+		for _, id := range deliveries {
+			// still being attempted since the last time
+			if inflight[id] {
+				continue
+			}
+			inflight[id] = true
+
+			go func(id int) {
+				slots <- struct{}{}
+				webhookDeliver(id)
+				<-slots
+				done <- id
+			}(id)
+		}
+
+		for waiting := true; waiting; {
+			select {
+			case id := <-done:
+				delete(inflight, id)
+			case <-globalState.webhookWake:
+				waiting = false
+			case <-ticker.C:
+				waiting = false
+			}
+		}
+	}
+}
+
+// webhookAllowedIP returns true if webhooks may be delivered to the address: loopback, link-local,
+// private and other special purpose addresses are refused, so webhooks can't be used to reach the
+// services next to (or on) the server
+func webhookAllowedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsPrivate() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range webhookBlockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// webhookDialControl is called by the dialer of the webhookClient after resolving the host, right
+// before connecting. Checking the address there (and not only the url when creating the webhook)
+// catches hosts resolving to internal addresses, including redirects and dns rebinding.
+func webhookDialControl(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !webhookAllowedIP(ip) {
+		return fmt.Errorf("refusing to deliver webhooks to the non-public address %s", host)
+	}
+	return nil
+}
+
+// webhookCheckHost rejects webhook urls pointing to a non-public address, either directly or by
+// resolving to one
+func webhookCheckHost(host string) error {
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return fmt.Errorf("webhooks can't be delivered to %s", host)
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		addrs, err := net.LookupIP(host)
+		if err != nil {
+			return fmt.Errorf("could not resolve %s", host)
+		}
+		ips = addrs
+	}
+	for _, ip := range ips {
+		if !webhookAllowedIP(ip) {
+			return fmt.Errorf("webhooks can't be delivered to the non-public address %s", ip)
+		}
+	}
+	return nil
+}
+
+func webhookMustParseCIDR(cidr string) *net.IPNet {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// webhookSign returns the value of the X-R2wars-Signature header: the hex encoded HMAC-SHA256 of
+// the body using the secret of the webhook
+func webhookSign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDeliver makes a single attempt to deliver the delivery and reschedules it on failure
+func webhookDeliver(id int) {
+	delivery, wh, payload, err := globalState.GetWebhookDelivery(id)
+	if err != nil {
+		log.Printf("[!] Could not get webhook delivery %d: %s", id, err)
+		return
+	}
+
+	statusCode, err := webhookPost(wh, delivery, []byte(payload))
+
+	attempts := delivery.Attempts + 1
+	state := DeliveryDelivered
+	errMsg := ""
+	next := time.Time{}
+
+	if err != nil {
+		errMsg = err.Error()
+		if attempts >= webhookMaxAttempts {
+			state = DeliveryFailed
+		} else {
+			state = DeliveryPending
+			next = time.Now().Add(webhookBackoff << (attempts - 1))
+		}
+		log.Printf("[!] Delivering %s to webhook %d failed (attempt %d): %s", delivery.Event, wh.ID, attempts, err)
+	}
+
+	if err := globalState.UpdateWebhookDelivery(id, state, attempts, next, statusCode, errMsg); err != nil {
+		log.Printf("[!] Could not update webhook delivery %d: %s", id, err)
+	}
+}
+
+func webhookPost(wh Webhook, delivery WebhookDelivery, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "r2wars-webhook")
+	req.Header.Set("X-R2wars-Event", delivery.Event)
+	req.Header.Set("X-R2wars-Delivery", strconv.Itoa(delivery.ID))
+	req.Header.Set("X-R2wars-Signature", webhookSign(wh.Secret, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("got status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookEventsFromForm returns the events checked in the form
+func webhookEventsFromForm(r *http.Request) []string {
+	var events []string
+	for _, event := range webhookEvents {
+		if r.Form.Get("event-"+event) == "on" {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// DATABASE
+
+func (s *State) InsertWebhook(wh Webhook) (int, error) {
+	res, err := s.db.Exec(`
+		INSERT INTO webhooks (created_at, user_id, battle_id, url, secret, events)
+		VALUES (?, ?, NULLIF(?, 0), ?, ?, ?)`,
+		time.Now(), wh.UserID, wh.BattleID, wh.URL, wh.Secret, strings.Join(wh.Events, ","))
+	if err != nil {
+		return -1, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return -1, err
+	}
+	return int(id), nil
+}
+
+// GetWebhooks returns the webhooks matching the where clause
+func (s *State) GetWebhooks(where string, args ...interface{}) ([]Webhook, error) {
+	rows, err := s.db.Query(`
+		SELECT id, created_at, user_id, COALESCE(battle_id, 0), url, secret, events
+		FROM webhooks
+		WHERE `+where+`
+		ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []Webhook
+	for rows.Next() {
+		var wh Webhook
+		var events string
+		if err := rows.Scan(&wh.ID, &wh.CreatedAt, &wh.UserID, &wh.BattleID, &wh.URL, &wh.Secret, &events); err != nil {
+			return webhooks, err
+		}
+		wh.Events = strings.Split(events, ",")
+		webhooks = append(webhooks, wh)
+	}
+	return webhooks, rows.Err()
+}
+
+// GetWebhooksForBattle returns the webhooks of the battle and the webhooks of all users owning
+// the battle or owning a bot registered in it
+func (s *State) GetWebhooksForBattle(battleid int) ([]Webhook, error) {
+	return s.GetWebhooks(`
+		battle_id=? OR (battle_id IS NULL AND user_id IN (
+			SELECT user_id FROM owner_battle_rel WHERE battle_id=?
+			UNION
+			SELECT ubr.user_id
+			FROM user_bot_rel ubr
+			JOIN bot_battle_rel bbr ON bbr.bot_id=ubr.bot_id
+			WHERE bbr.battle_id=?
+		))`, battleid, battleid, battleid)
+}
+
+func (s *State) DeleteWebhook(id int) error {
+	// the deliveries are deleted along with it (ON DELETE CASCADE)
+	_, err := s.db.Exec("DELETE FROM webhooks WHERE id=?", id)
+	return err
+}
+
+func (s *State) InsertWebhookDelivery(webhookid int, event string, payload string) error {
+	now := time.Now()
+	_, err := s.db.Exec(`
+		INSERT INTO webhook_deliveries (created_at, webhook_id, event, payload, state, attempts, next_attempt_at, status_code, error)
+		VALUES (?, ?, ?, ?, ?, 0, ?, 0, "")`,
+		now, webhookid, event, payload, DeliveryPending, now)
+	return err
+}
+
+// GetDueWebhookDeliveries returns the ids of the pending deliveries that should be attempted now
+func (s *State) GetDueWebhookDeliveries(now time.Time) ([]int, error) {
+	rows, err := s.db.Query(`
+		SELECT id
+		FROM webhook_deliveries
+		WHERE state=? AND next_attempt_at<=?
+		ORDER BY id`, DeliveryPending, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetWebhookDelivery returns the delivery, its webhook and the payload to deliver
+func (s *State) GetWebhookDelivery(id int) (WebhookDelivery, Webhook, string, error) {
+	var d WebhookDelivery
+	var wh Webhook
+	var payload string
+	err := s.db.QueryRow(`
+		SELECT d.id, d.event, d.payload, d.attempts, w.id, w.url, w.secret
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id=d.webhook_id
+		WHERE d.id=?`, id).Scan(&d.ID, &d.Event, &payload, &d.Attempts, &wh.ID, &wh.URL, &wh.Secret)
+	return d, wh, payload, err
+}
+
+func (s *State) UpdateWebhookDelivery(id int, state string, attempts int, next time.Time, statusCode int, errMsg string) error {
+	_, err := s.db.Exec(`
+		UPDATE webhook_deliveries
+		SET state=?, attempts=?, next_attempt_at=?, status_code=?, error=?
+		WHERE id=?`, state, attempts, next, statusCode, errMsg, id)
+	return err
+}
+
+// GetWebhookDeliveries returns the latest deliveries of the webhooks matching the where clause,
+// the webhooks table is aliased as w
+func (s *State) GetWebhookDeliveries(where string, args ...interface{}) ([]WebhookDelivery, error) {
+	rows, err := s.db.Query(`
+		SELECT d.id, d.created_at, d.webhook_id, w.url, d.event, d.state, d.attempts, d.next_attempt_at, d.status_code, d.error
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id=d.webhook_id
+		WHERE `+where+`
+		ORDER BY d.id DESC
+		LIMIT `+strconv.Itoa(webhookLogSize), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.CreatedAt, &d.WebhookID, &d.URL, &d.Event, &d.State, &d.Attempts, &d.NextAttemptAt, &d.StatusCode, &d.Error); err != nil {
+			return deliveries, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// HTTP
+
+// webhookRequest parses the ids of the webhook endpoints below and makes sure the requesting user
+// may manage the webhooks of the target (a battle or a user)
+func webhookRequest(r *http.Request, battle bool) (User, int, error) {
+	session, _ := globalState.sessions.Get(r, "session")
+	user, err := UserGetUserFromUsername(session.Values["username"].(string))
+	if err != nil {
+		return User{}, 0, fmt.Errorf("Could not get the id for your username")
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return User{}, 0, fmt.Errorf("Invalid id")
+	}
+
+	if battle {
+		b, err := BattleGetByIdDeep(id)
+		if err != nil {
+			return User{}, 0, fmt.Errorf("Could not get the battle")
+		}
+		if !BattleCan(b, user, BattleEdit) {
+			return User{}, 0, fmt.Errorf("Only the owners of the battle can manage its webhooks")
+		}
+	} else if user.ID != id {
+		return User{}, 0, fmt.Errorf("You can only manage your own webhooks")
+	}
+
+	return user, id, nil
+}
+
+// webhookNewHandler creates a webhook for a battle (/battle/{id}/webhook) or a user
+// (/user/{id}/webhook)
+func webhookNewHandler(w http.ResponseWriter, r *http.Request) {
+	battle := strings.HasPrefix(r.URL.Path, "/battle/")
+
+	redir_target := fmt.Sprintf("/user/%s/profile?res=%%s#webhooks", mux.Vars(r)["id"])
+	if battle {
+		redir_target = fmt.Sprintf("/battle/%s?res=%%s#webhooks", mux.Vars(r)["id"])
+	}
+
+	switch r.Method {
+	case "POST":
+		user, id, err := webhookRequest(r, battle)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, err.Error())
+			return
+		}
+
+		battleid := 0
+		if battle {
+			battleid = id
+		}
+
+		r.ParseForm()
+		if _, err := WebhookCreate(user.ID, battleid, strings.TrimSpace(r.Form.Get("url")), webhookEventsFromForm(r)); err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, err.Error())
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf(redir_target, "Created the webhook"), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
+
+// webhookDeleteHandler deletes a webhook of a battle (/battle/{id}/webhook/{hookid}/delete) or a
+// user (/user/{id}/webhook/{hookid}/delete)
+func webhookDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	battle := strings.HasPrefix(r.URL.Path, "/battle/")
+
+	redir_target := fmt.Sprintf("/user/%s/profile?res=%%s#webhooks", mux.Vars(r)["id"])
+	if battle {
+		redir_target = fmt.Sprintf("/battle/%s?res=%%s#webhooks", mux.Vars(r)["id"])
+	}
+
+	switch r.Method {
+	case "POST":
+		_, id, err := webhookRequest(r, battle)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, err.Error())
+			return
+		}
+
+		hookid, err := strconv.Atoi(mux.Vars(r)["hookid"])
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Invalid webhook id")
+			return
+		}
+
+		wh, err := WebhookGetById(hookid)
+		if err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not get the webhook")
+			return
+		}
+
+		// the webhook has to belong to the battle or the user in the url
+		if (battle && wh.BattleID != id) || (!battle && (wh.BattleID != 0 || wh.UserID != id)) {
+			log_and_redir_with_msg(w, r, nil, redir_target, "Could not get the webhook")
+			return
+		}
+
+		if err := WebhookDeleteID(hookid); err != nil {
+			log_and_redir_with_msg(w, r, err, redir_target, "Could not delete the webhook")
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf(redir_target, "Deleted the webhook"), http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookAllowedIP(t *testing.T) {
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"1.1.1.1", true},
+		{"93.184.216.34", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"::1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"::", false},
+		{"10.0.0.1", false},
+		{"172.16.5.4", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+	}
+	for _, tt := range tests {
+		if got := webhookAllowedIP(net.ParseIP(tt.ip)); got != tt.allowed {
+			t.Errorf("webhookAllowedIP(%s) = %v, want %v", tt.ip, got, tt.allowed)
+		}
+	}
+}
+
+func TestWebhookCreateRejectsInternalHosts(t *testing.T) {
+	for _, rawurl := range []string{
+		"http://localhost/hook",
+		"http://foo.localhost:8080/hook",
+		"http://127.0.0.1:8080/hook",
+		"http://[::1]/hook",
+		"https://10.1.2.3/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"ftp://example.com/hook",
+		"http:///hook",
+	} {
+		if _, err := WebhookCreate(1, 0, rawurl, webhookEvents); err == nil {
+			t.Errorf("WebhookCreate(%q) succeeded", rawurl)
+		}
+	}
+}
+
+func TestWebhookClientRefusesLoopback(t *testing.T) {
+	reached := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer srv.Close()
+
+	_, err := webhookPost(Webhook{URL: srv.URL, Secret: "secret"}, WebhookDelivery{Event: EventRunFinished}, []byte("{}"))
+	if err == nil || !strings.Contains(err.Error(), "non-public address") {
+		t.Errorf("delivery to %s: got error %v", srv.URL, err)
+	}
+	if reached {
+		t.Error("the webhook reached the loopback server")
+	}
+}